@@ -4,7 +4,10 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math"
+	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/sburnett/bismark-passive-server-go/passive"
@@ -13,53 +16,204 @@ import (
 	"github.com/sburnett/transformer/store"
 )
 
+const (
+	defaultLevelDbRoot  = "/data/users/sburnett/passive-leveldb-new"
+	defaultTarballsPath = "/data/users/sburnett/passive-organized"
+	postgresDsnUsage    = "Connect to Postgres using this data source name. If empty, use the PG* environment variables."
+	fullReloadUsage     = "Replace every row of the Postgres tables instead of upserting the rows that changed since the last run."
+	batchSizeUsage      = "Load Postgres tables using COPY in batches of this many rows. If 0, use one INSERT per row."
+	sqliteOutputUsage   = "If set, write results to tables in this SQLite database, replacing their previous contents, instead of Postgres."
+)
+
+// The git revision of this build. Set it using
+// go install -ldflags "-X main.gitBuild $(git describe --always --dirty)".
+var gitBuild = "unknown"
+
+var metricsAddress = flag.String("metrics_address", "", "If set, serve Prometheus metrics at /metrics on this address while the command runs.")
+var metricsOutput = flag.String("metrics_output", "", "If set, write Prometheus metrics to this file when the command finishes, e.g., for node_exporter's textfile collector.")
+
+var configPath = flag.String("config", "", "Read default flag values from this JSON configuration file. Flags given on the command line override it.")
+
+// The names of every command, for checking configuration files.
+var commandNames []string
+
+var config *passive.Config
+
+// The --passive_leveldb_root of the current command, where we record its run.
+var runsDbRoot string
+
+// Our lock on runsDbRoot, which we hold until we exit.
+var runsDbRootLock *passive.LevelDbRootLock
+
+// Commands that lock their --passive_leveldb_root themselves, only while they
+// use it, instead of for as long as they run.
+var selfLockingCommands = map[string]bool{
+	"serve-upload": true,
+}
+
+// Commands that only read the leveldbs, apart from scratch stores, so we
+// don't record their runs.
+var unrecordedCommands = map[string]bool{
+	"dump":    true,
+	"export":  true,
+	"history": true,
+	"inspect": true,
+}
+
+func loadConfig() *passive.Config {
+	if config != nil {
+		return config
+	}
+	config = new(passive.Config)
+	if *configPath == "" {
+		return config
+	}
+	configHandle, err := os.Open(*configPath)
+	if err != nil {
+		log.Fatalf("Error opening configuration: %v", err)
+	}
+	defer configHandle.Close()
+	if config, err = passive.ParseConfig(configHandle); err != nil {
+		log.Fatalf("Error reading configuration %s: %v", *configPath, err)
+	}
+	return config
+}
+
+// Parse the current command's flags, using the configuration file for
+// defaults.
+func parseFlags(flagset *flag.FlagSet) {
+	config := loadConfig()
+	if err := config.ApplyToFlags(flag.Arg(0), flagset); err != nil {
+		log.Fatalf("Error in configuration %s: %v", *configPath, err)
+	}
+	if config.Workers > 0 {
+		workersSet := false
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "workers" {
+				workersSet = true
+			}
+		})
+		if !workersSet {
+			if err := flag.Set("workers", fmt.Sprint(config.Workers)); err != nil {
+				log.Fatalf("Error setting --workers: %v", err)
+			}
+		}
+	}
+	flagset.Parse(flag.Args()[1:])
+	if dbRoot := flagset.Lookup("passive_leveldb_root"); dbRoot != nil {
+		runsDbRoot = dbRoot.Value.String()
+		if !selfLockingCommands[flag.Arg(0)] {
+			lock, err := passive.LockLevelDbRoot(runsDbRoot)
+			if err != nil {
+				log.Fatalf("Error locking %s: %v", runsDbRoot, err)
+			}
+			runsDbRootLock = lock
+		}
+	}
+}
+
+// Write the metrics to a temporary file and rename it, so readers never see a
+// partially written file.
+func writeMetricsFile(path string) {
+	temporaryPath := path + ".tmp"
+	handle, err := os.Create(temporaryPath)
+	if err != nil {
+		log.Fatalf("Error creating metrics output: %v", err)
+	}
+	if err := passive.WriteMetrics(handle); err != nil {
+		log.Fatalf("Error writing metrics: %v", err)
+	}
+	if err := handle.Close(); err != nil {
+		log.Fatalf("Error writing metrics: %v", err)
+	}
+	if err := os.Rename(temporaryPath, path); err != nil {
+		log.Fatalf("Error writing metrics: %v", err)
+	}
+}
+
+// Load a pipeline's results into Postgres, or into SQLite if sqliteOutput
+// isn't empty. We replace the SQLite tables on every run, so we also return
+// whether the pipeline must send every row.
+func resultsStore(postgresStore store.Writer, fullReload bool, sqliteOutput, storeName string) (store.Writer, bool) {
+	if sqliteOutput == "" {
+		return postgresStore, fullReload
+	}
+	return passive.NewSqliteStore(sqliteOutput, passive.LookupStoreSchema(storeName)), true
+}
+
+// Export the results of pipelines that don't load Postgres to SQLite if
+// sqliteOutput isn't empty.
+func withSqliteExport(pipeline transformer.Pipeline, levelDbManager store.Manager, sqliteOutput, pipelineName string) transformer.Pipeline {
+	if sqliteOutput == "" {
+		return pipeline
+	}
+	return append(pipeline, passive.SqliteExportPipeline(levelDbManager, sqliteOutput, passive.SqliteExportStores[pipelineName]...)...)
+}
+
 func pipelineAvailability() transformer.Pipeline {
 	flagset := flag.NewFlagSet("availability", flag.ExitOnError)
-	dbRoot := flagset.String("passive_leveldb_root", "/data/users/sburnett/passive-leveldb-new", "Write leveldbs in this directory.")
+	dbRoot := flagset.String("passive_leveldb_root", defaultLevelDbRoot, "Write leveldbs in this directory.")
 	jsonOutput := flagset.String("json_output", "/dev/null", "Write availability in JSON format to this file.")
-	flagset.Parse(flag.Args()[1:])
+	sqliteOutput := flagset.String("sqlite_output", "", sqliteOutputUsage)
+	parseFlags(flagset)
 	jsonHandle, err := os.Create(*jsonOutput)
 	if err != nil {
 		log.Fatalf("Error opening JSON output: %v", err)
 	}
-	return passive.AvailabilityPipeline(store.NewLevelDbManager(*dbRoot), jsonHandle, time.Now().Unix())
+	levelDbManager := store.NewLevelDbManager(*dbRoot)
+	return withSqliteExport(passive.AvailabilityPipeline(levelDbManager, jsonHandle, time.Now().Unix()), levelDbManager, *sqliteOutput, "AvailabilityPipeline")
 }
 
 func pipelineBytesPerDevice() transformer.Pipeline {
 	flagset := flag.NewFlagSet("bytesperdevice", flag.ExitOnError)
-	dbRoot := flagset.String("passive_leveldb_root", "/data/users/sburnett/passive-leveldb-new", "Write leveldbs in this directory.")
-	flagset.Parse(flag.Args()[1:])
-	return passive.BytesPerDevicePipeline(store.NewLevelDbManager(*dbRoot), passive.NewBytesPerDevicePostgresStore())
+	dbRoot := flagset.String("passive_leveldb_root", defaultLevelDbRoot, "Write leveldbs in this directory.")
+	postgresDsn := flagset.String("postgres_dsn", "", postgresDsnUsage)
+	fullReload := flagset.Bool("postgres_full_reload", false, fullReloadUsage)
+	batchSize := flagset.Int("postgres_batch_size", passive.DefaultPostgresBatchSize, batchSizeUsage)
+	sqliteOutput := flagset.String("sqlite_output", "", sqliteOutputUsage)
+	parseFlags(flagset)
+	resultsWriter, reload := resultsStore(passive.NewBytesPerDevicePostgresStore(*postgresDsn, passive.PostgresOptions{FullReload: *fullReload, BatchSize: *batchSize}), *fullReload, *sqliteOutput, "bytesperdevice")
+	return passive.BytesPerDevicePipeline(store.NewLevelDbManager(*dbRoot), resultsWriter, reload)
 }
 
 func pipelineBytesPerDomain() transformer.Pipeline {
 	flagset := flag.NewFlagSet("bytesperdomain", flag.ExitOnError)
-	dbRoot := flagset.String("passive_leveldb_root", "/data/users/sburnett/passive-leveldb-new", "Write leveldbs in this directory.")
-	flagset.Parse(flag.Args()[1:])
-	return passive.BytesPerDomainPipeline(store.NewLevelDbManager(*dbRoot), passive.NewBytesPerDomainPostgresStore())
+	dbRoot := flagset.String("passive_leveldb_root", defaultLevelDbRoot, "Write leveldbs in this directory.")
+	postgresDsn := flagset.String("postgres_dsn", "", postgresDsnUsage)
+	fullReload := flagset.Bool("postgres_full_reload", false, fullReloadUsage)
+	batchSize := flagset.Int("postgres_batch_size", passive.DefaultPostgresBatchSize, batchSizeUsage)
+	sqliteOutput := flagset.String("sqlite_output", "", sqliteOutputUsage)
+	parseFlags(flagset)
+	resultsWriter, reload := resultsStore(passive.NewBytesPerDomainPostgresStore(*postgresDsn, passive.PostgresOptions{FullReload: *fullReload, BatchSize: *batchSize}), *fullReload, *sqliteOutput, "bytesperdomain-bytes-per-domain")
+	return passive.BytesPerDomainPipeline(store.NewLevelDbManager(*dbRoot), resultsWriter, reload)
 }
 
 func pipelineBytesPerMinute() transformer.Pipeline {
 	flagset := flag.NewFlagSet("bytesperminute", flag.ExitOnError)
-	dbRoot := flagset.String("passive_leveldb_root", "/data/users/sburnett/passive-leveldb-new", "Write leveldbs in this directory.")
-	flagset.Parse(flag.Args()[1:])
-	return passive.BytesPerMinutePipeline(store.NewLevelDbManager(*dbRoot), passive.NewBytesPerHourPostgresStore())
+	dbRoot := flagset.String("passive_leveldb_root", defaultLevelDbRoot, "Write leveldbs in this directory.")
+	postgresDsn := flagset.String("postgres_dsn", "", postgresDsnUsage)
+	fullReload := flagset.Bool("postgres_full_reload", false, fullReloadUsage)
+	batchSize := flagset.Int("postgres_batch_size", passive.DefaultPostgresBatchSize, batchSizeUsage)
+	sqliteOutput := flagset.String("sqlite_output", "", sqliteOutputUsage)
+	parseFlags(flagset)
+	resultsWriter, reload := resultsStore(passive.NewBytesPerHourPostgresStore(*postgresDsn, passive.PostgresOptions{FullReload: *fullReload, BatchSize: *batchSize}), *fullReload, *sqliteOutput, "bytesperhour")
+	return passive.BytesPerMinutePipeline(store.NewLevelDbManager(*dbRoot), resultsWriter, reload)
 }
 
 func pipelineFilterNode() transformer.Pipeline {
 	flagset := flag.NewFlagSet("filter", flag.ExitOnError)
-	dbRoot := flagset.String("passive_leveldb_root", "/data/users/sburnett/passive-leveldb-new", "Write leveldbs in this directory.")
+	dbRoot := flagset.String("passive_leveldb_root", defaultLevelDbRoot, "Write leveldbs in this directory.")
 	nodeId := flagset.String("node_id", "OWC43DC7B0AE78", "Retain only data from this router.")
-	flagset.Parse(flag.Args()[1:])
+	parseFlags(flagset)
 	return passive.FilterNodesPipeline(*nodeId, store.NewLevelDbManager(*dbRoot))
 }
 
 func pipelineFilterDates() transformer.Pipeline {
 	flagset := flag.NewFlagSet("filter", flag.ExitOnError)
-	dbRoot := flagset.String("passive_leveldb_root", "/data/users/sburnett/passive-leveldb-new", "Write leveldbs in this directory.")
+	dbRoot := flagset.String("passive_leveldb_root", defaultLevelDbRoot, "Write leveldbs in this directory.")
 	sessionStartDate := flagset.String("session_start_date", "20120301", "Retain only session starting after this date, in YYYYMMDD format.")
 	sessionEndDate := flagset.String("session_end_date", "20120401", "Retain only session starting before this date, in YYYYMMDD format.")
-	flagset.Parse(flag.Args()[1:])
+	parseFlags(flagset)
 	timeFormatString := "20060102"
 	sessionStartTime, err := time.Parse(timeFormatString, *sessionStartDate)
 	if err != nil {
@@ -73,31 +227,323 @@ func pipelineFilterDates() transformer.Pipeline {
 	return passive.FilterSessionsPipeline(sessionStartTime.Unix(), sessionEndTime.Unix(), store.NewLevelDbManager(*dbRoot), outputName)
 }
 
+func pipelineConfig() transformer.Pipeline {
+	flagset := flag.NewFlagSet("config", flag.ExitOnError)
+	parseFlags(flagset)
+	if flagset.Arg(0) != "check" {
+		log.Fatalf("Usage: config check")
+	}
+	if err := passive.CheckConfig(loadConfig(), commandNames, os.Stdout); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	os.Exit(0)
+	return nil
+}
+
+func pipelineDb() transformer.Pipeline {
+	flagset := flag.NewFlagSet("db", flag.ExitOnError)
+	postgresDsn := flagset.String("postgres_dsn", "", postgresDsnUsage)
+	parseFlags(flagset)
+	if flagset.Arg(0) != "migrate" {
+		log.Fatalf("Usage: db migrate")
+	}
+	if err := passive.MigratePostgres(*postgresDsn, os.Stdout); err != nil {
+		log.Fatalf("Error migrating Postgres: %v", err)
+	}
+	os.Exit(0)
+	return nil
+}
+
+func pipelineDump() transformer.Pipeline {
+	flagset := flag.NewFlagSet("dump", flag.ExitOnError)
+	dbRoot := flagset.String("passive_leveldb_root", defaultLevelDbRoot, "Read leveldbs from this directory.")
+	storeName := flagset.String("store", "", fmt.Sprintf("Dump this store. One of: %s", strings.Join(passive.StoreSchemaNames(), ", ")))
+	nodeId := flagset.String("node_id", "", "Only dump records for this node.")
+	startDate := flagset.String("start_date", "", "Only dump records whose first key timestamp is on or after this date, in YYYYMMDD format.")
+	endDate := flagset.String("end_date", "", "Only dump records whose first key timestamp is before this date, in YYYYMMDD format.")
+	format := flagset.String("format", "tsv", "Print records in this format: tsv or json.")
+	listStores := flagset.Bool("list_stores", false, "Print the schema of every store and exit.")
+	parseFlags(flagset)
+	if *listStores {
+		if err := passive.PrintStoreSchemas(os.Stdout); err != nil {
+			log.Fatalf("Error listing stores: %v", err)
+		}
+		os.Exit(0)
+	}
+	schema := passive.LookupStoreSchema(*storeName)
+	if schema == nil {
+		log.Fatalf("Unknown store %q", *storeName)
+	}
+	if *nodeId != "" && !schema.HasNodePrefix() {
+		log.Fatalf("Can't filter %s by node because its keys don't begin with the node ID", *storeName)
+	}
+	parseDate := func(date string) int64 {
+		if date == "" {
+			return 0
+		}
+		parsed, err := time.Parse("20060102", date)
+		if err != nil {
+			log.Fatalf("Error parsing date %s: %v", date, err)
+		}
+		return parsed.Unix()
+	}
+	startTime, endTime := parseDate(*startDate), parseDate(*endDate)
+	if (startTime != 0 || endTime != 0) && schema.TimeColumn() < 0 {
+		log.Fatalf("Can't filter %s by time because its keys don't contain a timestamp", *storeName)
+	}
+	return passive.DumpStorePipeline(store.NewLevelDbManager(*dbRoot), schema, *nodeId, startTime, endTime, *format, os.Stdout)
+}
+
+func pipelineExpire() transformer.Pipeline {
+	flagset := flag.NewFlagSet("expire", flag.ExitOnError)
+	dbRoot := flagset.String("passive_leveldb_root", defaultLevelDbRoot, "Expire records from leveldbs in this directory.")
+	retentionPolicyPath := flagset.String("retention_policy", "/data/users/sburnett/passive-retention-policy", "Read the maximum age of each store's records from this file, one \"store age\" pair per line.")
+	parseFlags(flagset)
+	retentionPolicyHandle, err := os.Open(*retentionPolicyPath)
+	if err != nil {
+		log.Fatalf("Error opening retention policy: %v", err)
+	}
+	retentionPolicy, err := passive.ParseRetentionPolicy(retentionPolicyHandle)
+	retentionPolicyHandle.Close()
+	if err != nil {
+		log.Fatalf("Error reading retention policy: %v", err)
+	}
+	return passive.ExpireRecordsPipeline(store.NewLevelDbManager(*dbRoot), retentionPolicy, time.Now().Unix(), os.Stdout)
+}
+
+func pipelineExport() transformer.Pipeline {
+	flagset := flag.NewFlagSet("export", flag.ExitOnError)
+	dbRoot := flagset.String("passive_leveldb_root", defaultLevelDbRoot, "Read leveldbs from this directory.")
+	storeNames := flagset.String("stores", strings.Join(passive.DefaultExportStores, ","), "Comma separated list of the stores to export. They can be any stores that aren't intermediate.")
+	exportPath := flagset.String("export_path", ".", "Write one file per store, or per store and day, in this directory.")
+	format := flagset.String("format", "csv", "Write records in this format: csv or jsonl.")
+	compress := flagset.Bool("gzip", false, "Compress the files using gzip.")
+	rotateDaily := flagset.Bool("rotate_daily", false, "Write a file per day of the records' timestamps, for stores whose keys contain a timestamp.")
+	parseFlags(flagset)
+	if *format != "csv" && *format != "jsonl" {
+		log.Fatalf("Unknown export format %q", *format)
+	}
+	names := strings.Split(*storeNames, ",")
+	for _, name := range names {
+		schema := passive.LookupStoreSchema(name)
+		if schema == nil {
+			log.Fatalf("Unknown store %q", name)
+		}
+		if schema.Intermediate {
+			log.Fatalf("Can't export %s because it's an intermediate store", name)
+		}
+	}
+	options := passive.ExportOptions{
+		Format:      *format,
+		Directory:   *exportPath,
+		Gzip:        *compress,
+		RotateDaily: *rotateDaily,
+	}
+	return passive.ExportPipeline(store.NewLevelDbManager(*dbRoot), options, names...)
+}
+
+func pipelineFailedTraces() transformer.Pipeline {
+	flagset := flag.NewFlagSet("failedtraces", flag.ExitOnError)
+	dbRoot := flagset.String("passive_leveldb_root", defaultLevelDbRoot, "Write leveldbs in this directory.")
+	action := flagset.String("action", "list", "What to do with traces that failed to parse: list, summarize, report (count failures by bismark-passive build and error code), or retry.")
+	parseFlags(flagset)
+	switch *action {
+	case "list":
+		return passive.ListFailedTracesPipeline(store.NewLevelDbManager(*dbRoot), os.Stdout)
+	case "summarize":
+		return passive.SummarizeFailedTracesPipeline(store.NewLevelDbManager(*dbRoot), os.Stdout)
+	case "report":
+		return passive.ReportFailedTracesPipeline(store.NewLevelDbManager(*dbRoot), os.Stdout)
+	case "retry":
+		return passive.RetryFailedTracesPipeline(store.NewLevelDbManager(*dbRoot))
+	}
+	log.Fatalf("Invalid action %q", *action)
+	return nil
+}
+
+func pipelineGc() transformer.Pipeline {
+	flagset := flag.NewFlagSet("gc", flag.ExitOnError)
+	dbRoot := flagset.String("passive_leveldb_root", defaultLevelDbRoot, "Garbage collect leveldbs in this directory.")
+	rebuildPipelines := flagset.String("rebuild_pipelines", "", "Comma separated list of pipelines (e.g., BytesPerDevicePipeline) whose intermediate and bookkeeping stores we should delete, so they reprocess every trace on their next run.")
+	compact := flagset.Bool("compact", false, "Compact every store we don't delete.")
+	dryRun := flagset.Bool("dry_run", true, "Only report what we would delete or compact.")
+	parseFlags(flagset)
+	var rebuild []string
+	if *rebuildPipelines != "" {
+		rebuild = strings.Split(*rebuildPipelines, ",")
+	}
+	return passive.GarbageCollectPipeline(*dbRoot, rebuild, *compact, *dryRun, os.Stdout)
+}
+
+func pipelineHistory() transformer.Pipeline {
+	flagset := flag.NewFlagSet("history", flag.ExitOnError)
+	dbRoot := flagset.String("passive_leveldb_root", defaultLevelDbRoot, "Read leveldbs from this directory.")
+	pipelineName := flagset.String("pipeline", "", "Only list runs of this pipeline, named by its command (e.g., index) or, for pipelines started by the run command, its function (e.g., IndexTarballsPipeline).")
+	showRanges := flagset.Bool("show_ranges", false, "Also list the trace key ranges each run consumed.")
+	parseFlags(flagset)
+	return passive.HistoryPipeline(store.NewLevelDbManager(*dbRoot), *pipelineName, *showRanges, os.Stdout)
+}
+
 func pipelineIndex() transformer.Pipeline {
 	flagset := flag.NewFlagSet("index", flag.ExitOnError)
-	tarballsPath := flagset.String("tarballs_path", "/data/users/sburnett/passive-organized", "Read tarballs from this directory.")
-	dbRoot := flagset.String("passive_leveldb_root", "/data/users/sburnett/passive-leveldb-new", "Write leveldbs in this directory.")
-	flagset.Parse(flag.Args()[1:])
-	return passive.IndexTarballsPipeline(*tarballsPath, store.NewLevelDbManager(*dbRoot))
+	tarballsPath := flagset.String("tarballs_path", defaultTarballsPath, "Read tarballs from this directory.")
+	tarballsPattern := flagset.String("tarballs_pattern", "*/*/*.tar.gz", "Comma separated glob patterns, relative to --tarballs_path, matching the archives to index. Archives can be .tar.gz, .tgz, .tar.xz, .tar.bz2, .tar, .zip, or bare .gz traces.")
+	dbRoot := flagset.String("passive_leveldb_root", defaultLevelDbRoot, "Write leveldbs in this directory.")
+	lenient := flagset.Bool("lenient", false, "Salvage valid sections from damaged traces instead of rejecting them.")
+	parseFlags(flagset)
+	return passive.IndexTarballsPipeline(*tarballsPath, strings.Split(*tarballsPattern, ","), *lenient, store.NewLevelDbManager(*dbRoot), os.Stdout)
+}
+
+func pipelineInspect() transformer.Pipeline {
+	flagset := flag.NewFlagSet("inspect", flag.ExitOnError)
+	dbRoot := flagset.String("passive_leveldb_root", defaultLevelDbRoot, "Read leveldbs from this directory.")
+	nodeId := flagset.String("node_id", "", "Inspect traces from this node.")
+	firstSessionId := flagset.Int64("first_session_id", 0, "Inspect sessions starting at this process start time, in microseconds.")
+	lastSessionId := flagset.Int64("last_session_id", math.MaxInt64, "Inspect sessions starting up to and including this process start time, in microseconds.")
+	firstSequenceNumber := flagset.Int("first_sequence_number", 0, "Inspect traces starting at this sequence number.")
+	lastSequenceNumber := flagset.Int("last_sequence_number", math.MaxInt32, "Inspect traces up to and including this sequence number.")
+	format := flagset.String("format", "trace", "Print traces in this format: json, text (protocol buffer text format), or trace (bismark-passive text format). The text and trace formats begin each trace with a \"# node_id session_id sequence_number\" line.")
+	parseFlags(flagset)
+	if *nodeId == "" {
+		log.Fatalf("--node_id is required")
+	}
+	return passive.InspectTracesPipeline(store.NewLevelDbManager(*dbRoot), *nodeId, *firstSessionId, *lastSessionId, int32(*firstSequenceNumber), int32(*lastSequenceNumber), *format, os.Stdout)
 }
 
 func pipelineLookupsPerDevice() transformer.Pipeline {
 	flagset := flag.NewFlagSet("lookupsperdevice", flag.ExitOnError)
-	dbRoot := flagset.String("passive_leveldb_root", "/data/users/sburnett/passive-leveldb-new", "Write leveldbs in this directory.")
-	flagset.Parse(flag.Args()[1:])
-	return passive.LookupsPerDevicePipeline(store.NewLevelDbManager(*dbRoot))
+	dbRoot := flagset.String("passive_leveldb_root", defaultLevelDbRoot, "Write leveldbs in this directory.")
+	sqliteOutput := flagset.String("sqlite_output", "", sqliteOutputUsage)
+	parseFlags(flagset)
+	levelDbManager := store.NewLevelDbManager(*dbRoot)
+	return withSqliteExport(passive.LookupsPerDevicePipeline(levelDbManager), levelDbManager, *sqliteOutput, "LookupsPerDevicePipeline")
+}
+
+func pipelinePurgeNode() transformer.Pipeline {
+	flagset := flag.NewFlagSet("purge-node", flag.ExitOnError)
+	dbRoot := flagset.String("passive_leveldb_root", defaultLevelDbRoot, "Purge the node from leveldbs in this directory.")
+	tarballsPath := flagset.String("tarballs_path", defaultTarballsPath, "Delete the node's tarballs from the subdirectory of this directory named after the node.")
+	nodeId := flagset.String("node_id", "", "Purge every record about this node.")
+	postgres := flagset.Bool("postgres", false, "Also purge the node from the Postgres tables.")
+	postgresDsn := flagset.String("postgres_dsn", "", postgresDsnUsage)
+	auditLog := flagset.String("audit_log", "/dev/stdout", "Append the records we remove to this file.")
+	parseFlags(flagset)
+	if *nodeId == "" {
+		log.Fatalf("--node_id is required")
+	}
+	auditHandle, err := os.OpenFile(*auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Fatalf("Error opening audit log: %v", err)
+	}
+	var postgresStore store.Writer
+	if *postgres {
+		postgresStore = passive.NewPurgeNodePostgresStore(*postgresDsn, auditHandle)
+	}
+	return passive.PurgeNodePipeline(store.NewLevelDbManager(*dbRoot), *nodeId, *tarballsPath, postgresStore, auditHandle)
+}
+
+func pipelineRun() transformer.Pipeline {
+	flagset := flag.NewFlagSet("run", flag.ExitOnError)
+	dbRoot := flagset.String("passive_leveldb_root", defaultLevelDbRoot, "Write leveldbs in this directory.")
+	tarballsPath := flagset.String("tarballs_path", defaultTarballsPath, "Read tarballs from this directory.")
+	tarballsPattern := flagset.String("tarballs_pattern", "*/*/*.tar.gz", "Comma separated glob patterns, relative to --tarballs_path, matching the archives to index.")
+	lenient := flagset.Bool("lenient", false, "Salvage valid sections from damaged traces instead of rejecting them.")
+	availabilityJsonOutput := flagset.String("availability_json_output", "/dev/null", "Write availability in JSON format to this file.")
+	statisticsJsonOutput := flagset.String("statistics_json_output", "/dev/null", "Write statistics in JSON format to this file.")
+	postgresDsn := flagset.String("postgres_dsn", "", postgresDsnUsage)
+	fullReload := flagset.Bool("postgres_full_reload", false, fullReloadUsage)
+	batchSize := flagset.Int("postgres_batch_size", passive.DefaultPostgresBatchSize, batchSizeUsage)
+	sqliteOutput := flagset.String("sqlite_output", "", sqliteOutputUsage)
+	pipelines := flagset.String("pipelines", strings.Join(passive.SchedulablePipelineNames(), ","), "Comma separated list of pipelines to run.")
+	force := flagset.Bool("force", false, "Run pipelines even if their inputs haven't changed since they last ran.")
+	parallelism := flagset.Int("parallelism", 1, "Run up to this many pipelines at once, as long as they don't use any stores in common.")
+	parseFlags(flagset)
+
+	levelDbManager := store.NewLevelDbManager(*dbRoot)
+	postgresOptions := passive.PostgresOptions{FullReload: *fullReload, BatchSize: *batchSize}
+	openJsonOutput := func(path string) *os.File {
+		handle, err := os.Create(path)
+		if err != nil {
+			log.Fatalf("Error opening JSON output: %v", err)
+		}
+		return handle
+	}
+	allThunks := map[string]transformer.PipelineThunk{
+		"IndexTarballsPipeline": func() transformer.Pipeline {
+			return passive.IndexTarballsPipeline(*tarballsPath, strings.Split(*tarballsPattern, ","), *lenient, levelDbManager, os.Stdout)
+		},
+		"AvailabilityPipeline": func() transformer.Pipeline {
+			return withSqliteExport(passive.AvailabilityPipeline(levelDbManager, openJsonOutput(*availabilityJsonOutput), time.Now().Unix()), levelDbManager, *sqliteOutput, "AvailabilityPipeline")
+		},
+		"BytesPerMinutePipeline": func() transformer.Pipeline {
+			resultsWriter, reload := resultsStore(passive.NewBytesPerHourPostgresStore(*postgresDsn, postgresOptions), *fullReload, *sqliteOutput, "bytesperhour")
+			return passive.BytesPerMinutePipeline(levelDbManager, resultsWriter, reload)
+		},
+		"BytesPerDevicePipeline": func() transformer.Pipeline {
+			resultsWriter, reload := resultsStore(passive.NewBytesPerDevicePostgresStore(*postgresDsn, postgresOptions), *fullReload, *sqliteOutput, "bytesperdevice")
+			return passive.BytesPerDevicePipeline(levelDbManager, resultsWriter, reload)
+		},
+		"BytesPerDomainPipeline": func() transformer.Pipeline {
+			resultsWriter, reload := resultsStore(passive.NewBytesPerDomainPostgresStore(*postgresDsn, postgresOptions), *fullReload, *sqliteOutput, "bytesperdomain-bytes-per-domain")
+			return passive.BytesPerDomainPipeline(levelDbManager, resultsWriter, reload)
+		},
+		"LookupsPerDevicePipeline": func() transformer.Pipeline {
+			return withSqliteExport(passive.LookupsPerDevicePipeline(levelDbManager), levelDbManager, *sqliteOutput, "LookupsPerDevicePipeline")
+		},
+		"AggregateStatisticsPipeline": func() transformer.Pipeline {
+			return withSqliteExport(passive.AggregateStatisticsPipeline(levelDbManager, openJsonOutput(*statisticsJsonOutput)), levelDbManager, *sqliteOutput, "AggregateStatisticsPipeline")
+		},
+	}
+	thunks := make(map[string]transformer.PipelineThunk)
+	for _, name := range strings.Split(*pipelines, ",") {
+		thunk, found := allThunks[name]
+		if !found {
+			log.Fatalf("Unknown pipeline %q", name)
+		}
+		name := name
+		thunks[name] = func() transformer.Pipeline {
+			return passive.RecordRunPipeline(levelDbManager, name, gitBuild, passive.InstrumentPipeline(name, thunk()))
+		}
+	}
+	if err := passive.RunPipelines(levelDbManager, thunks, *force, *parallelism, os.Stdout); err != nil {
+		log.Fatalf("Error running pipelines: %v", err)
+	}
+	return transformer.Pipeline{}
+}
+
+func pipelineServeUpload() transformer.Pipeline {
+	flagset := flag.NewFlagSet("serve-upload", flag.ExitOnError)
+	listenAddress := flagset.String("listen_address", ":8080", "Accept uploads on this address.")
+	tarballsPath := flagset.String("tarballs_path", defaultTarballsPath, "Write uploaded tarballs into this directory.")
+	nodeKeysPath := flagset.String("node_keys", "/data/users/sburnett/passive-node-keys", "Read node IDs and their upload keys from this file, one \"node_id key\" pair per line.")
+	maxUploadBytes := flagset.Int64("max_upload_bytes", 64<<20, "Reject uploads larger than this many bytes.")
+	dbRoot := flagset.String("passive_leveldb_root", defaultLevelDbRoot, "Write leveldbs in this directory.")
+	lenient := flagset.Bool("lenient", false, "Salvage valid sections from damaged traces instead of rejecting them.")
+	parseFlags(flagset)
+	nodeKeysHandle, err := os.Open(*nodeKeysPath)
+	if err != nil {
+		log.Fatalf("Error opening node keys: %v", err)
+	}
+	nodeKeys, err := passive.ParseNodeKeys(nodeKeysHandle)
+	nodeKeysHandle.Close()
+	if err != nil {
+		log.Fatalf("Error reading node keys: %v", err)
+	}
+	return passive.UploadPipeline(*listenAddress, *tarballsPath, nodeKeys, *maxUploadBytes, *lenient, *dbRoot, store.NewLevelDbManager(*dbRoot), os.Stdout)
 }
 
 func pipelineStatistics() transformer.Pipeline {
 	flagset := flag.NewFlagSet("statistics", flag.ExitOnError)
-	dbRoot := flagset.String("passive_leveldb_root", "/data/users/sburnett/passive-leveldb-new", "Write leveldbs in this directory.")
+	dbRoot := flagset.String("passive_leveldb_root", defaultLevelDbRoot, "Write leveldbs in this directory.")
 	jsonOutput := flagset.String("json_output", "/dev/null", "Write statistics in JSON format to this file.")
-	flagset.Parse(flag.Args()[2:])
+	sqliteOutput := flagset.String("sqlite_output", "", sqliteOutputUsage)
+	parseFlags(flagset)
 	jsonHandle, err := os.Create(*jsonOutput)
 	if err != nil {
 		log.Fatalf("Error opening JSON output: %v", err)
 	}
-	return passive.AggregateStatisticsPipeline(store.NewLevelDbManager(*dbRoot), jsonHandle)
+	levelDbManager := store.NewLevelDbManager(*dbRoot)
+	return withSqliteExport(passive.AggregateStatisticsPipeline(levelDbManager, jsonHandle), levelDbManager, *sqliteOutput, "AggregateStatisticsPipeline")
 }
 
 func main() {
@@ -106,15 +552,56 @@ func main() {
 		"bytesperdevice":   pipelineBytesPerDevice,
 		"bytesperdomain":   pipelineBytesPerDomain,
 		"bytesperminute":   pipelineBytesPerMinute,
+		"config":           pipelineConfig,
+		"db":               pipelineDb,
+		"dump":             pipelineDump,
+		"expire":           pipelineExpire,
+		"export":           pipelineExport,
+		"failedtraces":     pipelineFailedTraces,
 		"filternode":       pipelineFilterNode,
 		"filterdates":      pipelineFilterDates,
+		"gc":               pipelineGc,
+		"history":          pipelineHistory,
 		"index":            pipelineIndex,
+		"inspect":          pipelineInspect,
 		"lookupsperdevice": pipelineLookupsPerDevice,
+		"purge-node":       pipelinePurgeNode,
+		"run":              pipelineRun,
+		"serve-upload":     pipelineServeUpload,
 		"statistics":       pipelineStatistics,
 	}
+	for name := range pipelineFuncs {
+		commandNames = append(commandNames, name)
+	}
+
+	// Parse the global flags and serve metrics before we choose the command,
+	// because some commands, like run, do all their work while
+	// ParsePipelineChoice constructs their pipelines.
+	flag.Parse()
+	if *metricsAddress != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", passive.MetricsHandler{})
+		go func() {
+			log.Fatal(http.ListenAndServe(*metricsAddress, metricsMux))
+		}()
+	}
+
 	name, pipeline := transformer.ParsePipelineChoice(pipelineFuncs)
 
 	go cube.Run(fmt.Sprintf("bismark_passive_pipeline_%s", name))
 
+	// The run command records and instruments each pipeline it runs, and
+	// returns an empty pipeline itself.
+	if len(pipeline) > 0 {
+		pipeline = passive.InstrumentPipeline(name, pipeline)
+	}
+	if runsDbRoot != "" && len(pipeline) > 0 && !unrecordedCommands[name] {
+		pipeline = passive.RecordRunPipeline(store.NewLevelDbManager(runsDbRoot), name, gitBuild, pipeline)
+	}
+
 	transformer.RunPipeline(pipeline)
+
+	if *metricsOutput != "" {
+		writeMetricsFile(*metricsOutput)
+	}
 }
@@ -0,0 +1,171 @@
+package passive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The archive formats we know how to index, in the order we try to match
+// their suffixes. The go standard library doesn't support xz, so we
+// decompress xz archives using the xz command.
+var archiveFormats = []string{"tar.gz", "tgz", "tar.xz", "tar.bz2", "tar", "zip", "gz"}
+
+// Figure out an archive's format from its name, returning "" for unknown
+// formats.
+func archiveFormat(archivePath string) string {
+	for _, format := range archiveFormats {
+		if strings.HasSuffix(archivePath, "."+format) {
+			return format
+		}
+	}
+	return ""
+}
+
+// Iterates through the files in an archive. Next returns io.EOF after the
+// last file.
+type archiveReader interface {
+	Next() (name string, contents io.Reader, err error)
+	Close() error
+}
+
+// Open an archive of the given format for reading. The archive reads from
+// handle, which must stay open until we're done with the archive.
+func openArchive(format string, handle *os.File, size int64) (archiveReader, error) {
+	switch format {
+	case "tar.gz", "tgz":
+		gzipHandle, err := gzip.NewReader(handle)
+		if err != nil {
+			return nil, err
+		}
+		return &tarArchiveReader{reader: tar.NewReader(gzipHandle), closer: gzipHandle}, nil
+	case "tar.xz":
+		command := exec.Command("xz", "--decompress", "--stdout")
+		command.Stdin = handle
+		stdout, err := command.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := command.Start(); err != nil {
+			return nil, err
+		}
+		return &tarArchiveReader{reader: tar.NewReader(stdout), closer: &commandCloser{command: command, stdout: stdout}}, nil
+	case "tar.bz2":
+		return &tarArchiveReader{reader: tar.NewReader(bzip2.NewReader(handle))}, nil
+	case "tar":
+		return &tarArchiveReader{reader: tar.NewReader(handle)}, nil
+	case "zip":
+		zipReader, err := zip.NewReader(handle, size)
+		if err != nil {
+			return nil, err
+		}
+		return &zipArchiveReader{files: zipReader.File}, nil
+	case "gz":
+		// A bare gzipped trace, rather than an archive of traces.
+		gzipHandle, err := gzip.NewReader(handle)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(filepath.Base(handle.Name()), ".gz")
+		return &singleFileArchiveReader{name: name, reader: gzipHandle}, nil
+	}
+	return nil, fmt.Errorf("Unsupported archive format %q", format)
+}
+
+type tarArchiveReader struct {
+	reader *tar.Reader
+	closer io.Closer
+}
+
+func (archive *tarArchiveReader) Next() (string, io.Reader, error) {
+	for {
+		header, err := archive.reader.Next()
+		if err != nil {
+			return "", nil, err
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+		return header.Name, archive.reader, nil
+	}
+}
+
+func (archive *tarArchiveReader) Close() error {
+	if archive.closer == nil {
+		return nil
+	}
+	return archive.closer.Close()
+}
+
+// Closes the pipe from a decompression command and waits for the command to
+// exit.
+type commandCloser struct {
+	command *exec.Cmd
+	stdout  io.ReadCloser
+}
+
+func (closer *commandCloser) Close() error {
+	// Drain the pipe so the command can exit even if we stopped reading
+	// early.
+	io.Copy(ioutil.Discard, closer.stdout)
+	return closer.command.Wait()
+}
+
+type zipArchiveReader struct {
+	files   []*zip.File
+	current io.ReadCloser
+}
+
+func (archive *zipArchiveReader) Next() (string, io.Reader, error) {
+	if archive.current != nil {
+		archive.current.Close()
+		archive.current = nil
+	}
+	for len(archive.files) > 0 {
+		file := archive.files[0]
+		archive.files = archive.files[1:]
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		contents, err := file.Open()
+		if err != nil {
+			return "", nil, err
+		}
+		archive.current = contents
+		return file.Name, contents, nil
+	}
+	return "", nil, io.EOF
+}
+
+func (archive *zipArchiveReader) Close() error {
+	if archive.current != nil {
+		return archive.current.Close()
+	}
+	return nil
+}
+
+type singleFileArchiveReader struct {
+	name   string
+	reader io.ReadCloser
+	done   bool
+}
+
+func (archive *singleFileArchiveReader) Next() (string, io.Reader, error) {
+	if archive.done {
+		return "", nil, io.EOF
+	}
+	archive.done = true
+	return archive.name, archive.reader, nil
+}
+
+func (archive *singleFileArchiveReader) Close() error {
+	return archive.reader.Close()
+}
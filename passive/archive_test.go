@@ -0,0 +1,239 @@
+package passive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sburnett/lexicographic-tuples"
+	"github.com/sburnett/transformer/store"
+)
+
+func TestArchiveFormat(t *testing.T) {
+	formats := map[string]string{
+		"a/b/NODE_1.tar.gz":  "tar.gz",
+		"a/b/NODE_1.tgz":     "tgz",
+		"a/b/NODE_1.tar.xz":  "tar.xz",
+		"a/b/NODE_1.tar.bz2": "tar.bz2",
+		"a/b/NODE_1.tar":     "tar",
+		"a/b/NODE_1.zip":     "zip",
+		"a/b/NODE-1-0.gz":    "gz",
+		"a/b/NODE_1.rar":     "",
+	}
+	for path, expected := range formats {
+		if format := archiveFormat(path); format != expected {
+			t.Errorf("Expected format %q for %s. Got %q", expected, path, format)
+		}
+	}
+}
+
+func makeTestTar(t *testing.T, members map[string]string) []byte {
+	buffer := new(bytes.Buffer)
+	writer := tar.NewWriter(buffer)
+	for _, name := range []string{"1", "2"} {
+		if err := writer.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(members[name]))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write([]byte(members[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func gzipBytes(t *testing.T, contents []byte) []byte {
+	buffer := new(bytes.Buffer)
+	writer := gzip.NewWriter(buffer)
+	if _, err := writer.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func compressWithCommand(t *testing.T, command string, contents []byte) []byte {
+	if _, err := exec.LookPath(command); err != nil {
+		t.Skipf("%s isn't installed", command)
+	}
+	cmd := exec.Command(command, "--compress", "--stdout")
+	cmd.Stdin = bytes.NewReader(contents)
+	compressed, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return compressed
+}
+
+func checkArchiveContents(t *testing.T, archivePath string, expected map[string]string) {
+	handle, err := os.Open(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+	fileinfo, err := handle.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := openArchive(archiveFormat(archivePath), handle, fileinfo.Size())
+	if err != nil {
+		t.Fatalf("Failed to open %s: %s", archivePath, err)
+	}
+	defer archive.Close()
+	actual := make(map[string]string)
+	for {
+		name, contents, err := archive.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Failed to read %s: %s", archivePath, err)
+		}
+		data, err := ioutil.ReadAll(contents)
+		if err != nil {
+			t.Fatalf("Failed to read %s from %s: %s", name, archivePath, err)
+		}
+		actual[name] = string(data)
+	}
+	if len(actual) != len(expected) {
+		t.Fatalf("Expected %d files in %s. Got %d", len(expected), archivePath, len(actual))
+	}
+	for name, contents := range expected {
+		if actual[name] != contents {
+			t.Fatalf("Expected %q in %s:%s. Got %q", contents, archivePath, name, actual[name])
+		}
+	}
+}
+
+func writeTestArchive(t *testing.T, directory, name string, contents []byte) string {
+	archivePath := filepath.Join(directory, name)
+	if err := ioutil.WriteFile(archivePath, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return archivePath
+}
+
+func TestOpenArchive(t *testing.T) {
+	directory, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	members := map[string]string{"1": "first trace", "2": "second trace"}
+	tarContents := makeTestTar(t, members)
+	checkArchiveContents(t, writeTestArchive(t, directory, "NODE_1.tar", tarContents), members)
+	checkArchiveContents(t, writeTestArchive(t, directory, "NODE_1.tar.gz", gzipBytes(t, tarContents)), members)
+	checkArchiveContents(t, writeTestArchive(t, directory, "NODE_1.tgz", gzipBytes(t, tarContents)), members)
+	checkArchiveContents(t, writeTestArchive(t, directory, "NODE-1-0.gz", gzipBytes(t, []byte("bare trace"))), map[string]string{"NODE-1-0": "bare trace"})
+
+	zipBuffer := new(bytes.Buffer)
+	zipWriter := zip.NewWriter(zipBuffer)
+	for name, contents := range members {
+		writer, err := zipWriter.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := zipWriter.Create("directory/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := zipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkArchiveContents(t, writeTestArchive(t, directory, "NODE_1.zip", zipBuffer.Bytes()), members)
+
+	checkArchiveContents(t, writeTestArchive(t, directory, "NODE_1.tar.bz2", compressWithCommand(t, "bzip2", tarContents)), members)
+	checkArchiveContents(t, writeTestArchive(t, directory, "NODE_1.tar.xz", compressWithCommand(t, "xz", tarContents)), members)
+}
+
+// xz reports that this archive is corrupt only when it exits, after we've read
+// every tar member, so we don't record that we indexed it.
+func TestIndexTarball_CorruptXz(t *testing.T) {
+	directory, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	compressed := compressWithCommand(t, "xz", makeTestTar(t, map[string]string{"1": "first trace", "2": "second trace"}))
+	archivePath := writeTestArchive(t, directory, "NODE_1.tar.xz", append(compressed, []byte("garbage")...))
+
+	tracesChan := make(chan *store.Record, 10)
+	failedChan := make(chan *store.Record, 10)
+	tarnamesTracesChan := make(chan *store.Record, 10)
+	failedBefore := tarsFailed.Value()
+	if indexTarball(archivePath, "hash", parseTrace, tracesChan, failedChan, tarnamesTracesChan) {
+		t.Errorf("Indexing a corrupt archive should fail")
+	}
+	if failed := tarsFailed.Value() - failedBefore; failed != 1 {
+		t.Errorf("TarsFailed should increase by 1, not %d", failed)
+	}
+}
+
+// We record archives we fail to index, and don't try them again until their
+// size or modification time changes.
+func TestIndexTarballs_RecordsFailures(t *testing.T) {
+	directory, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	archivePath := writeTestArchive(t, directory, "NODE_1.tar.gz", []byte("garbage"))
+
+	runIndexTarballs := func(records ...*store.Record) []*store.Record {
+		var outputChans []chan *store.Record
+		for i := 0; i < 6; i++ {
+			outputChans = append(outputChans, make(chan *store.Record, 10))
+		}
+		indexTarballs(parseTrace, records, outputChans...)
+		tarnamesFailedChan := outputChans[5]
+		close(tarnamesFailedChan)
+		var failedRecords []*store.Record
+		for record := range tarnamesFailedChan {
+			failedRecords = append(failedRecords, record)
+		}
+		return failedRecords
+	}
+	current := &store.Record{
+		Key:   lex.EncodeOrDie(archivePath),
+		Value: lex.EncodeOrDie(int64(7), time.Unix(100, 0).UnixNano()),
+	}
+
+	failedBefore := tarsFailed.Value()
+	failedRecords := runIndexTarballs(current)
+	if len(failedRecords) != 1 || !bytes.Equal(failedRecords[0].Value, current.Value) {
+		t.Fatalf("Expected to record the failed archive's size and modification time. Got %v", failedRecords)
+	}
+	failed := failedRecords[0]
+	failed.DatabaseIndex = 2
+
+	if failedRecords := runIndexTarballs(current, failed); len(failedRecords) != 0 {
+		t.Errorf("Shouldn't try an unchanged archive again. Got %v", failedRecords)
+	}
+	if failures := tarsFailed.Value() - failedBefore; failures != 1 {
+		t.Errorf("TarsFailed should increase by 1, not %d", failures)
+	}
+
+	touched := &store.Record{
+		Key:   current.Key,
+		Value: lex.EncodeOrDie(int64(7), time.Unix(200, 0).UnixNano()),
+	}
+	if failedRecords := runIndexTarballs(touched, failed); len(failedRecords) != 1 {
+		t.Errorf("Expected to try the archive again after it changed. Got %v", failedRecords)
+	}
+}
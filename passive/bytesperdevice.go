@@ -1,12 +1,10 @@
 package passive
 
 import (
-	"database/sql"
 	"fmt"
 	"time"
 
 	"code.google.com/p/goprotobuf/proto"
-	_ "github.com/bmizerany/pq"
 	"github.com/sburnett/lexicographic-tuples"
 	"github.com/sburnett/transformer"
 	"github.com/sburnett/transformer/store"
@@ -17,7 +15,12 @@ type FlowTimestamp struct {
 	timestamp int64
 }
 
-func BytesPerDevicePipeline(levelDbManager store.Manager, bytesPerDevicePostgresStore store.Writer) transformer.Pipeline {
+// Compute the number of bytes each device sent per hour, and send the hours
+// that changed in this run, because we processed new traces from their
+// sessions, to bytesPerDevicePostgresStore. If fullReload is true, we send
+// every hour instead; see PostgresOptions.FullReload and
+// NewBytesPerDevicePostgresStore.
+func BytesPerDevicePipeline(levelDbManager store.Manager, bytesPerDevicePostgresStore store.Writer, fullReload bool) transformer.Pipeline {
 	tracesStore := levelDbManager.Seeker("traces")
 	availabilityIntervalsStore := levelDbManager.Seeker("consistent-ranges")
 	sessionsStore := levelDbManager.ReadingDeleter("bytesperdevice-session")
@@ -28,7 +31,8 @@ func BytesPerDevicePipeline(levelDbManager store.Manager, bytesPerDevicePostgres
 	flowIdToMacsStore := levelDbManager.SeekingWriter("bytesperdevice-flow-id-to-macs")
 	bytesPerDeviceUnreducedStore := levelDbManager.SeekingWriter("bytesperdevice-unreduced")
 	bytesPerDeviceSessionStore := levelDbManager.ReadingWriter("bytesperdevice-reduced-sessions")
-	bytesPerDeviceStore := levelDbManager.ReadingWriter("bytesperdevice")
+	bytesPerDeviceStore := levelDbManager.SeekingWriter("bytesperdevice")
+	changedRowsStore := levelDbManager.ReadingDeleter("bytesperdevice-changed-rows")
 	traceKeyRangesStore := levelDbManager.ReadingDeleter("bytesperdevice-trace-key-ranges")
 	consolidatedTraceKeyRangesStore := levelDbManager.ReadingDeleter("bytesperdevice-consolidated-trace-key-ranges")
 	newTracesStore := store.NewRangeExcludingReader(store.NewRangeIncludingReader(tracesStore, availabilityIntervalsStore), traceKeyRangesStore)
@@ -62,7 +66,7 @@ func BytesPerDevicePipeline(levelDbManager store.Manager, bytesPerDevicePostgres
 			Name:        "ReduceBytesPerDeviceSession",
 			Reader:      store.NewPrefixIncludingReader(bytesPerDeviceUnreducedStore, sessionsStore),
 			Transformer: transformer.TransformFunc(reduceBytesPerDeviceSession),
-			Writer:      bytesPerDeviceSessionStore,
+			Writer:      store.NewMuxingWriter(bytesPerDeviceSessionStore, store.NewTruncatingWriter(changedRowsStore)),
 		},
 		transformer.PipelineStage{
 			Name:        "ReduceBytesPerDevice",
@@ -72,7 +76,7 @@ func BytesPerDevicePipeline(levelDbManager store.Manager, bytesPerDevicePostgres
 		},
 		transformer.PipelineStage{
 			Name:   "BytesPerDevicePostgres",
-			Reader: bytesPerDeviceStore,
+			Reader: postgresRowsReader(bytesPerDeviceStore, changedRowsStore, fullReload),
 			Writer: bytesPerDevicePostgresStore,
 		},
 	}, TraceKeyRangesPipeline(newTracesStore, traceKeyRangesStore, consolidatedTraceKeyRangesStore)...)
@@ -253,6 +257,11 @@ func reduceBytesPerDeviceSession(inputChan, outputChan chan *store.Record) {
 			Key:   lex.EncodeOrDie(session.NodeId, macAddress, timestamp, session.AnonymizationContext, session.SessionId),
 			Value: lex.EncodeOrDie(totalSize),
 		}
+		// ReduceBytesPerDevice will change this hour's total.
+		outputChan <- &store.Record{
+			Key:           lex.EncodeOrDie(session.NodeId, macAddress, timestamp),
+			DatabaseIndex: 1,
+		}
 	}
 }
 
@@ -276,45 +285,21 @@ func reduceBytesPerDevice(inputChan, outputChan chan *store.Record) {
 }
 
 type BytesPerDevicePostgresStore struct {
-	conn        *sql.DB
-	transaction *sql.Tx
-	statement   *sql.Stmt
+	dataSourceName string
+	table          postgresTable
 }
 
-func NewBytesPerDevicePostgresStore() *BytesPerDevicePostgresStore {
-	return &BytesPerDevicePostgresStore{}
+// Connect to Postgres using dataSourceName, or using the PG* environment
+// variables if it's empty, and load the table as options describes.
+func NewBytesPerDevicePostgresStore(dataSourceName string, options PostgresOptions) *BytesPerDevicePostgresStore {
+	return &BytesPerDevicePostgresStore{
+		dataSourceName: dataSourceName,
+		table:          newPostgresTable("bytes_per_device_per_hour", []string{"node_id", "mac_address", "timestamp"}, []string{"bytes"}, options),
+	}
 }
 
 func (store *BytesPerDevicePostgresStore) BeginWriting() error {
-	conn, err := sql.Open("postgres", "")
-	if err != nil {
-		return err
-	}
-	transaction, err := conn.Begin()
-	if err != nil {
-		conn.Close()
-		return err
-	}
-	if _, err := transaction.Exec("SET search_path TO bismark_passive"); err != nil {
-		transaction.Rollback()
-		conn.Close()
-		return err
-	}
-	if _, err := transaction.Exec("DELETE FROM bytes_per_device_per_hour"); err != nil {
-		transaction.Rollback()
-		conn.Close()
-		return err
-	}
-	statement, err := transaction.Prepare("INSERT INTO bytes_per_device_per_hour (node_id, mac_address, timestamp, bytes) VALUES ($1, $2, $3, $4)")
-	if err != nil {
-		transaction.Rollback()
-		conn.Close()
-		return err
-	}
-	store.conn = conn
-	store.transaction = transaction
-	store.statement = statement
-	return nil
+	return store.table.begin(store.dataSourceName)
 }
 
 func (store *BytesPerDevicePostgresStore) WriteRecord(record *store.Record) error {
@@ -324,21 +309,9 @@ func (store *BytesPerDevicePostgresStore) WriteRecord(record *store.Record) erro
 	lex.DecodeOrDie(record.Key, &nodeId, &macAddress, &timestamp)
 	lex.DecodeOrDie(record.Value, &size)
 
-	if _, err := store.statement.Exec(nodeId, macAddress, time.Unix(timestamp, 0), size); err != nil {
-		return err
-	}
-	return nil
+	return store.table.write(string(nodeId), string(macAddress), time.Unix(timestamp, 0), size)
 }
 
 func (store *BytesPerDevicePostgresStore) EndWriting() error {
-	if err := store.statement.Close(); err != nil {
-		return err
-	}
-	if err := store.transaction.Commit(); err != nil {
-		return err
-	}
-	if err := store.conn.Close(); err != nil {
-		return err
-	}
-	return nil
+	return store.table.end()
 }
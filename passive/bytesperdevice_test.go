@@ -33,7 +33,7 @@ func runBytesPerDevicePipeline(consistentRanges []*store.Record, allTraces ...ma
 		}
 		tracesStore.EndWriting()
 
-		transformer.RunPipeline(BytesPerDevicePipeline(levelDbManager, &bytesPerDevicePostgresStore))
+		transformer.RunPipeline(BytesPerDevicePipeline(levelDbManager, &bytesPerDevicePostgresStore, false))
 	}
 
 	bytesPerDeviceStore := levelDbManager.Reader("bytesperdevice")
@@ -1,7 +1,6 @@
 package passive
 
 import (
-	"database/sql"
 	"fmt"
 	"log"
 	"math"
@@ -9,13 +8,17 @@ import (
 	"time"
 
 	"code.google.com/p/goprotobuf/proto"
-	_ "github.com/bmizerany/pq"
 	"github.com/sburnett/lexicographic-tuples"
 	"github.com/sburnett/transformer"
 	"github.com/sburnett/transformer/store"
 )
 
-func BytesPerDomainPipeline(levelDbManager store.Manager, bytesPerDomainPostgresStore store.Writer) transformer.Pipeline {
+// Compute the number of bytes each node exchanged with each whitelisted
+// domain per hour, and send the hours that changed in this run, because we
+// processed new traces from their sessions, to bytesPerDomainPostgresStore. If
+// fullReload is true, we send every hour instead; see
+// PostgresOptions.FullReload and NewBytesPerDomainPostgresStore.
+func BytesPerDomainPipeline(levelDbManager store.Manager, bytesPerDomainPostgresStore store.Writer, fullReload bool) transformer.Pipeline {
 	tracesStore := levelDbManager.Seeker("traces")
 	availabilityIntervalsStore := levelDbManager.Seeker("consistent-ranges")
 	traceKeyRangesStore := levelDbManager.ReadingDeleter("bytesperdomain-trace-key-ranges")
@@ -36,7 +39,8 @@ func BytesPerDomainPipeline(levelDbManager store.Manager, bytesPerDomainPostgres
 	flowDomainsGroupedTableStore := levelDbManager.SeekingWriter("bytesperdomain-flow-domains-grouped-table")
 	bytesPerDomainShardedStore := levelDbManager.ReadingWriter("bytesperdomain-bytes-per-domain-sharded")
 	bytesPerDomainPerDeviceStore := levelDbManager.ReadingWriter("bytesperdomain-bytes-per-domain-per-device")
-	bytesPerDomainStore := levelDbManager.ReadingWriter("bytesperdomain-bytes-per-domain")
+	bytesPerDomainStore := levelDbManager.SeekingWriter("bytesperdomain-bytes-per-domain")
+	changedRowsStore := levelDbManager.ReadingDeleter("bytesperdomain-changed-rows")
 	sessionsStore := levelDbManager.ReadingDeleter("bytesperdomain-sessions")
 	excludeOldSessions := func(stor store.Seeker) store.Seeker {
 		return store.NewPrefixIncludingReader(stor, sessionsStore)
@@ -102,7 +106,7 @@ func BytesPerDomainPipeline(levelDbManager store.Manager, bytesPerDomainPostgres
 			Name:        "JoinDomainsWithSizes",
 			Reader:      excludeOldSessions(store.NewDemuxingSeeker(flowDomainsGroupedTableStore, bytesPerTimestampShardedStore)),
 			Transformer: transformer.TransformFunc(joinDomainsWithSizes),
-			Writer:      bytesPerDomainShardedStore,
+			Writer:      store.NewMuxingWriter(bytesPerDomainShardedStore, store.NewTruncatingWriter(changedRowsStore)),
 		},
 		transformer.PipelineStage{
 			Name:        "FlattenIntoBytesPerDevice",
@@ -118,15 +122,16 @@ func BytesPerDomainPipeline(levelDbManager store.Manager, bytesPerDomainPostgres
 		},
 		transformer.PipelineStage{
 			Name:   "BytesPerDomainPostgresStore",
-			Reader: bytesPerDomainStore,
+			Reader: postgresRowsReader(bytesPerDomainStore, changedRowsStore, fullReload),
 			Writer: bytesPerDomainPostgresStore,
 		},
 	}, TraceKeyRangesPipeline(newTracesStore, traceKeyRangesStore, consolidatedTraceKeyRangesStore)...)
 }
 
 func mapTraceToAddressIdTable(traceKey *TraceKey, trace *Trace, outputChan chan *store.Record) {
-	if trace.AddressTableFirstId == nil || trace.AddressTableSize == nil {
-		panic("AddressTableFirstId and AddressTableSize must be present in all traces")
+	// Traces salvaged leniently may have lost the address table's header.
+	if trace.AddressTableFirstId == nil || trace.AddressTableSize == nil || *trace.AddressTableSize == 0 {
+		return
 	}
 	baseAddress := *trace.AddressTableFirstId
 	maxAddress := *trace.AddressTableSize
@@ -591,6 +596,11 @@ func joinDomainsWithSizes(inputChan, outputChan chan *store.Record) {
 							Key:   lex.EncodeOrDie(session.NodeId, domain, timestamp, macAddresses[idx], session.AnonymizationContext, session.SessionId, flowId, sequenceNumber),
 							Value: record.Value,
 						}
+						// FlattenIntoBytesPerTimestamp will change this hour's total.
+						outputChan <- &store.Record{
+							Key:           lex.EncodeOrDie(session.NodeId, domain, timestamp),
+							DatabaseIndex: 1,
+						}
 					}
 				}
 			}
@@ -642,45 +652,21 @@ func flattenIntoBytesPerTimestamp(inputChan, outputChan chan *store.Record) {
 }
 
 type BytesPerDomainPostgresStore struct {
-	conn        *sql.DB
-	transaction *sql.Tx
-	statement   *sql.Stmt
+	dataSourceName string
+	table          postgresTable
 }
 
-func NewBytesPerDomainPostgresStore() *BytesPerDomainPostgresStore {
-	return &BytesPerDomainPostgresStore{}
+// Connect to Postgres using dataSourceName, or using the PG* environment
+// variables if it's empty, and load the table as options describes.
+func NewBytesPerDomainPostgresStore(dataSourceName string, options PostgresOptions) *BytesPerDomainPostgresStore {
+	return &BytesPerDomainPostgresStore{
+		dataSourceName: dataSourceName,
+		table:          newPostgresTable("bytes_per_domain_per_hour", []string{"node_id", "domain", "timestamp"}, []string{"bytes"}, options),
+	}
 }
 
 func (store *BytesPerDomainPostgresStore) BeginWriting() error {
-	conn, err := sql.Open("postgres", "")
-	if err != nil {
-		return err
-	}
-	transaction, err := conn.Begin()
-	if err != nil {
-		conn.Close()
-		return err
-	}
-	if _, err := transaction.Exec("SET search_path TO bismark_passive"); err != nil {
-		transaction.Rollback()
-		conn.Close()
-		return err
-	}
-	if _, err := transaction.Exec("DELETE FROM bytes_per_domain_per_hour"); err != nil {
-		transaction.Rollback()
-		conn.Close()
-		return err
-	}
-	statement, err := transaction.Prepare("INSERT INTO bytes_per_domain_per_hour (node_id, domain, timestamp, bytes) VALUES ($1, $2, $3, $4)")
-	if err != nil {
-		transaction.Rollback()
-		conn.Close()
-		return err
-	}
-	store.conn = conn
-	store.transaction = transaction
-	store.statement = statement
-	return nil
+	return store.table.begin(store.dataSourceName)
 }
 
 func (store *BytesPerDomainPostgresStore) WriteRecord(record *store.Record) error {
@@ -690,21 +676,9 @@ func (store *BytesPerDomainPostgresStore) WriteRecord(record *store.Record) erro
 	lex.DecodeOrDie(record.Key, &nodeId, &domain, &timestamp)
 	lex.DecodeOrDie(record.Value, &size)
 
-	if _, err := store.statement.Exec(nodeId, domain, time.Unix(timestamp, 0), size); err != nil {
-		return err
-	}
-	return nil
+	return store.table.write(string(nodeId), string(domain), time.Unix(timestamp, 0), size)
 }
 
 func (store *BytesPerDomainPostgresStore) EndWriting() error {
-	if err := store.statement.Close(); err != nil {
-		return err
-	}
-	if err := store.transaction.Commit(); err != nil {
-		return err
-	}
-	if err := store.conn.Close(); err != nil {
-		return err
-	}
-	return nil
+	return store.table.end()
 }
@@ -33,7 +33,7 @@ func runBytesPerDomainPipeline(consistentRanges []*store.Record, allTraces ...ma
 		}
 		tracesStore.EndWriting()
 
-		transformer.RunPipeline(BytesPerDomainPipeline(levelDbManager, &bytesPerDomainPostgresStore))
+		transformer.RunPipeline(BytesPerDomainPipeline(levelDbManager, &bytesPerDomainPostgresStore, false))
 	}
 
 	fmt.Printf("BytesPerDomain:\n")
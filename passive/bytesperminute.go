@@ -2,22 +2,25 @@ package passive
 
 import (
 	"bytes"
-	"database/sql"
 	"log"
 	"time"
 
 	"code.google.com/p/goprotobuf/proto"
-	_ "github.com/bmizerany/pq"
 	"github.com/sburnett/lexicographic-tuples"
 	"github.com/sburnett/transformer"
 	"github.com/sburnett/transformer/store"
 )
 
-func BytesPerMinutePipeline(levelDbManager store.Manager, bytesPerHourPostgresStore store.Writer) transformer.Pipeline {
+// Compute the number of bytes each node sent per minute and per hour, and send
+// the hours that changed in this run to bytesPerHourPostgresStore. If
+// fullReload is true, we send every hour instead; see
+// PostgresOptions.FullReload and NewBytesPerHourPostgresStore.
+func BytesPerMinutePipeline(levelDbManager store.Manager, bytesPerHourPostgresStore store.Writer, fullReload bool) transformer.Pipeline {
 	tracesStore := levelDbManager.Seeker("traces")
 	mappedStore := levelDbManager.ReadingWriter("bytesperminute-mapped")
 	bytesPerMinuteStore := levelDbManager.ReadingWriter("bytesperminute")
-	bytesPerHourStore := levelDbManager.ReadingWriter("bytesperhour")
+	bytesPerHourStore := levelDbManager.SeekingWriter("bytesperhour")
+	changedHoursStore := levelDbManager.ReadingDeleter("bytesperminute-changed-hours")
 	traceKeyRangesStore := levelDbManager.ReadingDeleter("bytesperminute-trace-key-ranges")
 	consolidatedTraceKeyRangesStore := levelDbManager.ReadingDeleter("bytesperminute-consolidated-trace-key-ranges")
 	return append([]transformer.PipelineStage{
@@ -25,7 +28,7 @@ func BytesPerMinutePipeline(levelDbManager store.Manager, bytesPerHourPostgresSt
 			Name:        "BytesPerMinuteMapper",
 			Reader:      store.NewRangeExcludingReader(tracesStore, traceKeyRangesStore),
 			Transformer: transformer.MakeDoTransformer(bytesPerMinuteMapper(transformer.NewNonce())),
-			Writer:      mappedStore,
+			Writer:      store.NewMuxingWriter(mappedStore, store.NewTruncatingWriter(changedHoursStore)),
 		},
 		transformer.PipelineStage{
 			Name:        "BytesPerMinuteReducer",
@@ -41,7 +44,7 @@ func BytesPerMinutePipeline(levelDbManager store.Manager, bytesPerHourPostgresSt
 		},
 		transformer.PipelineStage{
 			Name:   "BytesPerHourPostgres",
-			Reader: bytesPerHourStore,
+			Reader: postgresRowsReader(bytesPerHourStore, changedHoursStore, fullReload),
 			Writer: bytesPerHourPostgresStore,
 		},
 	}, TraceKeyRangesPipeline(store.NewRangeExcludingReader(tracesStore, traceKeyRangesStore), traceKeyRangesStore, consolidatedTraceKeyRangesStore)...)
@@ -59,10 +62,15 @@ func (nonce bytesPerMinuteMapper) Do(inputRecord *store.Record, outputChan chan
 	}
 
 	buckets := make(map[int64]int64)
+	hours := make(map[int64]bool)
 	for _, packetSeriesEntry := range trace.PacketSeries {
+		if packetSeriesEntry.TimestampMicroseconds == nil || packetSeriesEntry.Size == nil {
+			continue
+		}
 		timestamp := time.Unix(0, *packetSeriesEntry.TimestampMicroseconds*1000)
 		minuteTimestamp := time.Date(timestamp.Year(), timestamp.Month(), timestamp.Day(), timestamp.Hour(), timestamp.Minute(), 0, 0, timestamp.Location())
 		buckets[minuteTimestamp.Unix()] += int64(*packetSeriesEntry.Size)
+		hours[getHour(minuteTimestamp.Unix())] = true
 	}
 
 	for timestamp, size := range buckets {
@@ -71,6 +79,13 @@ func (nonce bytesPerMinuteMapper) Do(inputRecord *store.Record, outputChan chan
 			Value: lex.EncodeOrDie(size),
 		}
 	}
+	// The hours whose totals this trace changes.
+	for hour := range hours {
+		outputChan <- &store.Record{
+			Key:           lex.EncodeOrDie(traceKey.NodeId, hour),
+			DatabaseIndex: 1,
+		}
+	}
 }
 
 func bytesPerMinuteReducer(inputChan, outputChan chan *store.Record) {
@@ -133,45 +148,21 @@ func bytesPerHourReducer(inputChan, outputChan chan *store.Record) {
 }
 
 type BytesPerHourPostgresStore struct {
-	conn        *sql.DB
-	transaction *sql.Tx
-	statement   *sql.Stmt
+	dataSourceName string
+	table          postgresTable
 }
 
-func NewBytesPerHourPostgresStore() *BytesPerHourPostgresStore {
-	return &BytesPerHourPostgresStore{}
+// Connect to Postgres using dataSourceName, or using the PG* environment
+// variables if it's empty, and load the table as options describes.
+func NewBytesPerHourPostgresStore(dataSourceName string, options PostgresOptions) *BytesPerHourPostgresStore {
+	return &BytesPerHourPostgresStore{
+		dataSourceName: dataSourceName,
+		table:          newPostgresTable("bytes_per_hour", []string{"node_id", "timestamp"}, []string{"bytes"}, options),
+	}
 }
 
 func (store *BytesPerHourPostgresStore) BeginWriting() error {
-	conn, err := sql.Open("postgres", "")
-	if err != nil {
-		return err
-	}
-	transaction, err := conn.Begin()
-	if err != nil {
-		conn.Close()
-		return err
-	}
-	if _, err := transaction.Exec("SET search_path TO bismark_passive"); err != nil {
-		transaction.Rollback()
-		conn.Close()
-		return err
-	}
-	if _, err := transaction.Exec("DELETE FROM bytes_per_hour"); err != nil {
-		transaction.Rollback()
-		conn.Close()
-		return err
-	}
-	statement, err := transaction.Prepare("INSERT INTO bytes_per_hour (node_id, timestamp, bytes) VALUES ($1, $2, $3)")
-	if err != nil {
-		transaction.Rollback()
-		conn.Close()
-		return err
-	}
-	store.conn = conn
-	store.transaction = transaction
-	store.statement = statement
-	return nil
+	return store.table.begin(store.dataSourceName)
 }
 
 func (store *BytesPerHourPostgresStore) WriteRecord(record *store.Record) error {
@@ -181,21 +172,9 @@ func (store *BytesPerHourPostgresStore) WriteRecord(record *store.Record) error
 	lex.DecodeOrDie(record.Key, &nodeId, &timestamp)
 	lex.DecodeOrDie(record.Value, &size)
 
-	if _, err := store.statement.Exec(nodeId, time.Unix(timestamp, 0), size); err != nil {
-		return err
-	}
-	return nil
+	return store.table.write(string(nodeId), time.Unix(timestamp, 0), size)
 }
 
 func (store *BytesPerHourPostgresStore) EndWriting() error {
-	if err := store.statement.Close(); err != nil {
-		return err
-	}
-	if err := store.transaction.Commit(); err != nil {
-		return err
-	}
-	if err := store.conn.Close(); err != nil {
-		return err
-	}
-	return nil
+	return store.table.end()
 }
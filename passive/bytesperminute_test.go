@@ -34,7 +34,7 @@ func runBytesPerMinutePipeline(allTraces ...map[string]Trace) {
 		}
 		tracesStore.EndWriting()
 
-		transformer.RunPipeline(BytesPerMinutePipeline(levelDbManager, &bytesPerHourPostgresStore))
+		transformer.RunPipeline(BytesPerMinutePipeline(levelDbManager, &bytesPerHourPostgresStore, false))
 	}
 
 	bytesPerMinuteStore := levelDbManager.Reader("bytesperminute")
@@ -156,3 +156,78 @@ func ExampleBytesPerMinute_multipleRuns() {
 	// node0,0: 320
 	// node0,60: 80
 }
+
+func ExampleBytesPerMinute_changedHours() {
+	levelDbManager := store.NewSliceManager()
+	runAndPrintPostgres := func(traces map[string]Trace) {
+		tracesStore := levelDbManager.Writer("traces")
+		tracesStore.BeginWriting()
+		for encodedKey, trace := range traces {
+			encodedTrace, err := proto.Marshal(&trace)
+			if err != nil {
+				panic(fmt.Errorf("Error encoding protocol buffer: %v", err))
+			}
+			tracesStore.WriteRecord(&store.Record{Key: []byte(encodedKey), Value: encodedTrace})
+		}
+		tracesStore.EndWriting()
+
+		bytesPerHourPostgresStore := store.SliceStore{}
+		transformer.RunPipeline(BytesPerMinutePipeline(levelDbManager, &bytesPerHourPostgresStore, false))
+		bytesPerHourPostgresStore.BeginReading()
+		for {
+			record, err := bytesPerHourPostgresStore.ReadRecord()
+			if err != nil {
+				panic(err)
+			}
+			if record == nil {
+				break
+			}
+			var nodeId string
+			var timestamp, count int64
+			lex.DecodeOrDie(record.Key, &nodeId, &timestamp)
+			lex.DecodeOrDie(record.Value, &count)
+			fmt.Printf("%s,%d: %d\n", nodeId, timestamp, count)
+		}
+		bytesPerHourPostgresStore.EndReading()
+		fmt.Println("--")
+	}
+
+	hour := int64(time.Hour / time.Microsecond)
+	trace1 := Trace{
+		PacketSeries: []*PacketSeriesEntry{
+			makePacketSeriesEntry(10, 20),
+			makePacketSeriesEntry(hour+10, 30),
+		},
+	}
+	trace2 := Trace{
+		PacketSeries: []*PacketSeriesEntry{
+			makePacketSeriesEntry(hour+20, 40),
+		},
+	}
+	runAndPrintPostgres(map[string]Trace{
+		string(lex.EncodeOrDie("node0", "anon0", int64(0), int32(0))): trace1,
+	})
+	runAndPrintPostgres(map[string]Trace{
+		string(lex.EncodeOrDie("node0", "anon0", int64(0), int32(1))): trace2,
+	})
+	runAndPrintPostgres(map[string]Trace{})
+
+	// Output:
+	// node0,0: 20
+	// node0,3600: 30
+	// --
+	// node0,3600: 70
+	// --
+	// --
+}
+
+// We skip the placeholders of damaged packets in salvaged traces.
+func ExampleBytesPerMinute_salvagedTrace() {
+	records := map[string]Trace{
+		string(lex.EncodeOrDie("NODEID", "signature", int64(1346479358582428), int32(7))): makeSalvagedTrace(),
+	}
+	runBytesPerMinutePipeline(records)
+
+	// Output:
+	// NODEID,1346479320: 74
+}
@@ -0,0 +1,210 @@
+package passive
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Settings for the pipeline commands, read from a JSON file like
+//
+//	{
+//	    "passive_leveldb_root": "/data/passive-leveldb",
+//	    "tarballs_path": "/data/passive-organized",
+//	    "postgres_dsn": "host=localhost port=5432 dbname=bismark user=bismark password=secret",
+//	    "workers": 8,
+//	    "pipelines": {
+//	        "availability": {"json_output": "/var/www/bismark-passive/status.json"},
+//	        "index": {"lenient": true}
+//	    }
+//	}
+//
+// Each setting is the default value of the flag with the same name, so flags
+// given on the command line override the file.
+type Config struct {
+	// The default for every command's --passive_leveldb_root.
+	LevelDbRoot string `json:"passive_leveldb_root"`
+	// The default for every command's --tarballs_path.
+	TarballsPath string `json:"tarballs_path"`
+	// The default for every command's --postgres_dsn. An empty data source
+	// name means we use the PG* environment variables.
+	PostgresDsn string `json:"postgres_dsn"`
+	// The default for the global --workers flag, if nonzero.
+	Workers int `json:"workers"`
+	// Defaults for individual commands' flags, keyed by command name and then
+	// by flag name.
+	Pipelines map[string]map[string]interface{} `json:"pipelines"`
+}
+
+// The settings a configuration file can contain, from Config's JSON tags.
+func configSettings() map[string]bool {
+	settings := make(map[string]bool)
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		settings[configType.Field(i).Tag.Get("json")] = true
+	}
+	return settings
+}
+
+func ParseConfig(reader io.Reader) (*Config, error) {
+	contents, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	// Reject settings we don't know, which are probably typos.
+	var settings map[string]json.RawMessage
+	if err := json.Unmarshal(contents, &settings); err != nil {
+		return nil, err
+	}
+	known := configSettings()
+	for name := range settings {
+		if !known[name] {
+			return nil, fmt.Errorf("Unknown setting %q", name)
+		}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.UseNumber()
+	config := new(Config)
+	if err := decoder.Decode(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Set the defaults of a command's flags from the configuration. It's an error
+// to configure a flag that the command doesn't have, unless it's one of the
+// settings shared by all commands.
+func (config *Config) ApplyToFlags(command string, flagset *flag.FlagSet) error {
+	shared := map[string]string{
+		"passive_leveldb_root": config.LevelDbRoot,
+		"tarballs_path":        config.TarballsPath,
+		"postgres_dsn":         config.PostgresDsn,
+	}
+	for name, value := range shared {
+		if value == "" || flagset.Lookup(name) == nil {
+			continue
+		}
+		if err := flagset.Set(name, value); err != nil {
+			return fmt.Errorf("Invalid %s: %v", name, err)
+		}
+	}
+	for name, value := range config.Pipelines[command] {
+		if flagset.Lookup(name) == nil {
+			return fmt.Errorf("%s doesn't have a --%s flag", command, name)
+		}
+		if err := flagset.Set(name, fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("Invalid %s %s: %v", command, name, err)
+		}
+	}
+	return nil
+}
+
+func checkDirectory(path string) error {
+	fileinfo, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fileinfo.IsDir() {
+		return fmt.Errorf("%s isn't a directory", path)
+	}
+	return nil
+}
+
+func checkPostgres(dataSourceName string) error {
+	conn, err := sql.Open(postgresDriverName, dataSourceName)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Ping()
+}
+
+// Check a per-command setting whose name tells us what kind of path it is.
+func checkPipelineSetting(name string, value interface{}) error {
+	path := fmt.Sprint(value)
+	switch {
+	case name == "node_keys":
+		handle, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer handle.Close()
+		_, err = ParseNodeKeys(handle)
+		return err
+	case name == "retention_policy":
+		handle, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer handle.Close()
+		_, err = ParseRetentionPolicy(handle)
+		return err
+	case strings.HasSuffix(name, "_output") || strings.HasSuffix(name, "_log"):
+		return checkDirectory(filepath.Dir(path))
+	case strings.HasSuffix(name, "_path") || strings.HasSuffix(name, "_root"):
+		return checkDirectory(path)
+	}
+	return nil
+}
+
+// Check that the configured directories and files exist, that we can connect
+// to Postgres, and that every per-command section names one of commands.
+// We write one line per check to writer and return an error if any failed.
+func CheckConfig(config *Config, commands []string, writer io.Writer) error {
+	failures := 0
+	report := func(setting string, err error) {
+		if err != nil {
+			failures++
+			fmt.Fprintf(writer, "FAIL\t%s\t%v\n", setting, err)
+		} else {
+			fmt.Fprintf(writer, "OK\t%s\n", setting)
+		}
+	}
+	if config.LevelDbRoot != "" {
+		report("passive_leveldb_root", checkDirectory(config.LevelDbRoot))
+	}
+	if config.TarballsPath != "" {
+		report("tarballs_path", checkDirectory(config.TarballsPath))
+	}
+	report("postgres_dsn", checkPostgres(config.PostgresDsn))
+	if config.Workers < 0 {
+		report("workers", fmt.Errorf("Must not be negative"))
+	}
+
+	knownCommands := make(map[string]bool)
+	for _, command := range commands {
+		knownCommands[command] = true
+	}
+	var configuredCommands []string
+	for command := range config.Pipelines {
+		configuredCommands = append(configuredCommands, command)
+	}
+	sort.Strings(configuredCommands)
+	for _, command := range configuredCommands {
+		if !knownCommands[command] {
+			report(fmt.Sprintf("pipelines.%s", command), fmt.Errorf("Unknown command"))
+			continue
+		}
+		var names []string
+		for name := range config.Pipelines[command] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			report(fmt.Sprintf("pipelines.%s.%s", command, name), checkPipelineSetting(name, config.Pipelines[command][name]))
+		}
+	}
+	if failures > 0 {
+		return fmt.Errorf("%d checks failed", failures)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package passive
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig(strings.NewReader(`{"passive_leveldb_root": "/leveldb", "workers": 8, "pipelines": {"serve-upload": {"max_upload_bytes": 67108864, "lenient": true}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flagset := flag.NewFlagSet("serve-upload", flag.ContinueOnError)
+	dbRoot := flagset.String("passive_leveldb_root", "/default", "")
+	tarballsPath := flagset.String("tarballs_path", "/default", "")
+	maxUploadBytes := flagset.Int64("max_upload_bytes", 1, "")
+	lenient := flagset.Bool("lenient", false, "")
+	if err := config.ApplyToFlags("serve-upload", flagset); err != nil {
+		t.Fatal(err)
+	}
+	if err := flagset.Parse([]string{"--lenient=false"}); err != nil {
+		t.Fatal(err)
+	}
+	if *dbRoot != "/leveldb" || *tarballsPath != "/default" || *maxUploadBytes != 67108864 || *lenient || config.Workers != 8 {
+		t.Fatalf("Unexpected flags: %s %s %d %v", *dbRoot, *tarballsPath, *maxUploadBytes, *lenient)
+	}
+
+	if err := config.ApplyToFlags("serve-upload", flag.NewFlagSet("serve-upload", flag.ContinueOnError)); err == nil {
+		t.Fatal("Expected an error configuring a flag that doesn't exist")
+	}
+	if _, err := ParseConfig(strings.NewReader(`{"leveldb_root": "/leveldb"}`)); err == nil {
+		t.Fatal("Expected an error parsing an unknown setting")
+	}
+}
+
+func TestCheckPipelineSetting(t *testing.T) {
+	directory, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	nodeKeysPath := filepath.Join(directory, "node-keys")
+	if err := ioutil.WriteFile(nodeKeysPath, []byte("NODE key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	valid := map[string]interface{}{
+		"json_output":   filepath.Join(directory, "status.json"),
+		"audit_log":     filepath.Join(directory, "audit.log"),
+		"tarballs_path": directory,
+		"node_keys":     nodeKeysPath,
+		"lenient":       true,
+	}
+	for name, value := range valid {
+		if err := checkPipelineSetting(name, value); err != nil {
+			t.Errorf("Unexpected error checking %s: %v", name, err)
+		}
+	}
+	invalid := map[string]interface{}{
+		"json_output":      filepath.Join(directory, "missing", "status.json"),
+		"tarballs_path":    nodeKeysPath,
+		"node_keys":        filepath.Join(directory, "missing"),
+		"retention_policy": nodeKeysPath,
+	}
+	for name, value := range invalid {
+		if err := checkPipelineSetting(name, value); err == nil {
+			t.Errorf("Expected an error checking %s", name)
+		}
+	}
+
+	config := &Config{
+		LevelDbRoot: filepath.Join(directory, "missing"),
+		Pipelines:   map[string]map[string]interface{}{"unknown": {}},
+	}
+	writer := bytes.NewBuffer([]byte{})
+	if err := CheckConfig(config, []string{"index"}, writer); err == nil {
+		t.Fatalf("Expected checks to fail:\n%s", writer.Bytes())
+	}
+}
@@ -0,0 +1,201 @@
+package passive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/sburnett/transformer"
+	"github.com/sburnett/transformer/store"
+)
+
+type dumpFilter struct {
+	Schema    *StoreSchema
+	StartTime int64
+	EndTime   int64
+}
+
+// Print every record in a store, decoded according to its schema. If nodeId
+// isn't empty, we only print that node's records, which requires that the
+// store's keys begin with the node ID. If startTime or endTime is nonzero, we
+// only print records whose key's first timestamp is in [startTime, endTime),
+// which are in seconds since the epoch. format is either "tsv" (tab separated
+// values, with a header) or "json" (one JSON object per line).
+func DumpStorePipeline(levelDbManager store.Manager, schema *StoreSchema, nodeId string, startTime, endTime int64, format string, writer io.Writer) transformer.Pipeline {
+	var reader store.Reader
+	if nodeId != "" {
+		reader = FilterNodes(levelDbManager.Seeker(schema.Name), nodeId)
+	} else {
+		reader = levelDbManager.Reader(schema.Name)
+	}
+	return []transformer.PipelineStage{
+		transformer.PipelineStage{
+			Name:   "DumpStore",
+			Reader: reader,
+			Transformer: dumpFilter{
+				Schema:    schema,
+				StartTime: startTime,
+				EndTime:   endTime,
+			},
+			Writer: &dumpTextStore{writer: writer, schema: schema, format: format},
+		},
+	}
+}
+
+func (filter dumpFilter) Do(inputChan, outputChan chan *store.Record) {
+	for record := range inputChan {
+		if !filter.includes(record) {
+			continue
+		}
+		outputChan <- record
+	}
+}
+
+func (filter dumpFilter) includes(record *store.Record) bool {
+	if filter.StartTime == 0 && filter.EndTime == 0 {
+		return true
+	}
+	seconds, err := filter.Schema.KeyTime(record.Key)
+	if err != nil {
+		return false
+	}
+	if filter.StartTime != 0 && seconds < filter.StartTime {
+		return false
+	}
+	if filter.EndTime != 0 && seconds >= filter.EndTime {
+		return false
+	}
+	return true
+}
+
+func formatColumns(columns []Column) string {
+	formatted := make([]string, len(columns))
+	for idx, column := range columns {
+		formatted[idx] = fmt.Sprintf("%s:%s", column.Name, column.Type)
+	}
+	return strings.Join(formatted, ",")
+}
+
+// Print each store's name, owning pipeline, whether it's intermediate or
+// final, and its key and value columns, separated by tabs.
+func PrintStoreSchemas(writer io.Writer) error {
+	for _, schema := range StoreSchemas() {
+		kind := "final"
+		if schema.Intermediate {
+			kind = "intermediate"
+		}
+		if _, err := fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", schema.Name, schema.Pipeline, kind, formatColumns(schema.Key), formatColumns(schema.Value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type dumpTextStore struct {
+	writer io.Writer
+	schema *StoreSchema
+	format string
+}
+
+func (store *dumpTextStore) BeginWriting() error {
+	switch store.format {
+	case "tsv":
+		var names []string
+		for _, column := range store.schema.Columns() {
+			names = append(names, column.Name)
+		}
+		if _, err := fmt.Fprintf(store.writer, "%s\n", strings.Join(names, "\t")); err != nil {
+			return err
+		}
+		return nil
+	case "json":
+		return nil
+	}
+	return fmt.Errorf("Unknown dump format %q", store.format)
+}
+
+func (store *dumpTextStore) WriteRecord(record *store.Record) error {
+	values, err := store.schema.DecodeRecord(record)
+	if err != nil {
+		return fmt.Errorf("Error decoding %s record %q: %v", store.schema.Name, record.Key, err)
+	}
+	var line string
+	switch store.format {
+	case "tsv":
+		line, err = formatTsvLine(values)
+	case "json":
+		line, err = formatJsonLine(store.schema.Columns(), values)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(store.writer, "%s\n", line); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (store *dumpTextStore) EndWriting() error {
+	return nil
+}
+
+var tsvEscaper = strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r")
+
+func formatTsvValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return tsvEscaper.Replace(v)
+	case []string:
+		escaped := make([]string, len(v))
+		for idx, s := range v {
+			escaped[idx] = tsvEscaper.Replace(s)
+		}
+		return strings.Join(escaped, ",")
+	case []int32:
+		formatted := make([]string, len(v))
+		for idx, i := range v {
+			formatted[idx] = fmt.Sprint(i)
+		}
+		return strings.Join(formatted, ",")
+	case []int64:
+		formatted := make([]string, len(v))
+		for idx, i := range v {
+			formatted[idx] = fmt.Sprint(i)
+		}
+		return strings.Join(formatted, ",")
+	case proto.Message:
+		return tsvEscaper.Replace(proto.CompactTextString(v))
+	}
+	return fmt.Sprint(value)
+}
+
+func formatTsvLine(values []interface{}) (string, error) {
+	formatted := make([]string, len(values))
+	for idx, value := range values {
+		formatted[idx] = formatTsvValue(value)
+	}
+	return strings.Join(formatted, "\t"), nil
+}
+
+// Format a record as a JSON object, keeping its columns in order.
+func formatJsonLine(columns []Column, values []interface{}) (string, error) {
+	fields := make([]string, len(columns))
+	for idx, column := range columns {
+		name, err := json.Marshal(column.Name)
+		if err != nil {
+			return "", err
+		}
+		value := values[idx]
+		if column.Type == JsonColumn {
+			value = json.RawMessage(value.(string))
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		fields[idx] = fmt.Sprintf("%s:%s", name, encoded)
+	}
+	return fmt.Sprintf("{%s}", strings.Join(fields, ",")), nil
+}
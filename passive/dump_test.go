@@ -0,0 +1,60 @@
+package passive
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/sburnett/lexicographic-tuples"
+	"github.com/sburnett/transformer"
+	"github.com/sburnett/transformer/store"
+)
+
+func ExampleDumpStorePipeline() {
+	levelDbManager := store.NewSliceManager()
+	bytesPerHourStore := levelDbManager.Writer("bytesperhour")
+	bytesPerHourStore.BeginWriting()
+	bytesPerHourStore.WriteRecord(&store.Record{Key: lex.EncodeOrDie("NODE1", int64(3600)), Value: lex.EncodeOrDie(int64(10))})
+	bytesPerHourStore.WriteRecord(&store.Record{Key: lex.EncodeOrDie("NODE1", int64(7200)), Value: lex.EncodeOrDie(int64(20))})
+	bytesPerHourStore.WriteRecord(&store.Record{Key: lex.EncodeOrDie("NODE2", int64(3600)), Value: lex.EncodeOrDie(int64(30))})
+	bytesPerHourStore.EndWriting()
+
+	schema := LookupStoreSchema("bytesperhour")
+	writer := bytes.NewBuffer([]byte{})
+	transformer.RunPipeline(DumpStorePipeline(levelDbManager, schema, "", 0, 0, "tsv", writer))
+	transformer.RunPipeline(DumpStorePipeline(levelDbManager, schema, "NODE1", 7000, 0, "json", writer))
+	fmt.Printf("%s", writer.Bytes())
+
+	// Output:
+	// node_id	timestamp	size
+	// NODE1	3600	10
+	// NODE1	7200	20
+	// NODE2	3600	30
+	// {"node_id":"NODE1","timestamp":7200,"size":20}
+}
+
+func TestFormatTsvLine(t *testing.T) {
+	values := []interface{}{"a\tb\nc", true, int32(1), int64(2), []int32{3, 4}, []int64{5}, []string{"x", "y"}, &AggregateStatistics{Traces: proto.Int64(1)}}
+	expected := "a\\tb\\nc\ttrue\t1\t2\t3,4\t5\tx,y\ttraces:1 "
+	line, err := formatTsvLine(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != expected {
+		t.Fatalf("Expected %q. Got %q", expected, line)
+	}
+}
+
+func TestFormatJsonLine(t *testing.T) {
+	columns := []Column{{"node_id", StringColumn}, {"flow_ids", Int32SliceColumn}, {"points", JsonColumn}}
+	values := []interface{}{"NODE", []int32{1, 2}, "[[1],[2]]"}
+	expected := `{"node_id":"NODE","flow_ids":[1,2],"points":[[1],[2]]}`
+	line, err := formatJsonLine(columns, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != expected {
+		t.Fatalf("Expected %q. Got %q", expected, line)
+	}
+}
@@ -0,0 +1,163 @@
+package passive
+
+import (
+	"bytes"
+	"expvar"
+
+	"github.com/sburnett/lexicographic-tuples"
+	"github.com/sburnett/transformer"
+	"github.com/sburnett/transformer/store"
+)
+
+var tracesDuplicated, tracesConflicting *expvar.Int
+
+func init() {
+	tracesDuplicated = expvar.NewInt("TracesDuplicated")
+	tracesConflicting = expvar.NewInt("TracesConflicting")
+}
+
+// Move newly indexed traces from traces-new into traces, checking for traces
+// that have the same key as a trace we already have. Different tarballs
+// sometimes contain the same trace, in which case the copies are usually
+// identical. We keep the first copy of every trace in traces and record which
+// tarball it came from in traces-sources. We count identical and conflicting
+// copies in traces-duplicates, which we summarize per node in
+// traces-duplicates-per-node, and keep conflicting copies in
+// traces-conflicting so we can inspect them later.
+//
+// A new copy of a trace from the same tarball member as the copy we kept isn't
+// a duplicate; it means we indexed the tarball again, so the new copy replaces
+// the old one. Traces indexed before we recorded traces-sources have no
+// source, so every new copy of them is a duplicate.
+//
+// traces-new is keyed by trace key, tarball path and tarball member name. We
+// only clear it after we've moved every trace into traces, so if indexing is
+// interrupted we'll pick up the remaining traces next time.
+func DuplicateTracesPipeline(levelDbManager store.Manager) transformer.Pipeline {
+	tracesStore := levelDbManager.SeekingWriter("traces")
+	tracesSourcesStore := levelDbManager.SeekingWriter("traces-sources")
+	tracesNewStore := levelDbManager.ReadingDeleter("traces-new")
+	tracesNewKeysStore := levelDbManager.ReadingDeleter("traces-new-keys")
+	tracesConflictingStore := levelDbManager.Writer("traces-conflicting")
+	tracesDuplicatesStore := levelDbManager.ReadingWriter("traces-duplicates")
+	tracesDuplicatesPerNodeStore := levelDbManager.Deleter("traces-duplicates-per-node")
+	return []transformer.PipelineStage{
+		transformer.PipelineStage{
+			Name:        "ScanNewTraceKeys",
+			Reader:      tracesNewStore,
+			Transformer: transformer.MakeMapFunc(newTraceKey),
+			Writer:      store.NewTruncatingWriter(tracesNewKeysStore),
+		},
+		transformer.PipelineStage{
+			Name: "DetectDuplicateTraces",
+			Reader: store.NewDemuxingReader(
+				store.NewPrefixIncludingReader(tracesStore, tracesNewKeysStore),
+				store.NewPrefixIncludingReader(tracesSourcesStore, tracesNewKeysStore),
+				tracesNewStore),
+			Transformer: transformer.TransformFunc(detectDuplicateTraces),
+			Writer:      store.NewMuxingWriter(tracesStore, tracesSourcesStore, tracesConflictingStore, tracesDuplicatesStore),
+		},
+		transformer.PipelineStage{
+			Name:        "CountDuplicateTraces",
+			Reader:      tracesDuplicatesStore,
+			Transformer: transformer.TransformFunc(countDuplicateTraces),
+			Writer:      store.NewTruncatingWriter(tracesDuplicatesPerNodeStore),
+		},
+		transformer.PipelineStage{
+			Name:   "ClearNewTraces",
+			Reader: &store.SliceStore{},
+			Writer: store.NewTruncatingWriter(tracesNewStore),
+		},
+	}
+}
+
+func newTraceKey(record *store.Record) *store.Record {
+	var traceKey TraceKey
+	lex.DecodeOrDie(record.Key, &traceKey)
+	return &store.Record{
+		Key: lex.EncodeOrDie(&traceKey),
+	}
+}
+
+func detectDuplicateTraces(inputChan, outputChan chan *store.Record) {
+	var traceKey TraceKey
+	grouper := transformer.GroupRecords(inputChan, &traceKey)
+	for grouper.NextGroup() {
+		encodedTraceKey := lex.EncodeOrDie(&traceKey)
+		var keptTrace []byte
+		var keptTarPath, keptMemberName string
+		var keptSourceKnown bool
+		var newRecords []*store.Record
+		for grouper.NextRecord() {
+			record := grouper.Read()
+			switch record.DatabaseIndex {
+			case 0:
+				keptTrace = record.Value
+			case 1:
+				lex.DecodeOrDie(record.Value, &keptTarPath, &keptMemberName)
+				keptSourceKnown = true
+			case 2:
+				newRecords = append(newRecords, record)
+			}
+		}
+
+		for _, record := range newRecords {
+			var newTraceKey TraceKey
+			var tarPath, memberName string
+			lex.DecodeOrDie(record.Key, &newTraceKey, &tarPath, &memberName)
+			sameSource := keptSourceKnown && tarPath == keptTarPath && memberName == keptMemberName
+			if keptTrace == nil || sameSource {
+				keptTrace = record.Value
+				keptTarPath, keptMemberName, keptSourceKnown = tarPath, memberName, true
+				outputChan <- &store.Record{
+					Key:           encodedTraceKey,
+					Value:         record.Value,
+					DatabaseIndex: 0,
+				}
+				outputChan <- &store.Record{
+					Key:           encodedTraceKey,
+					Value:         lex.EncodeOrDie(tarPath, memberName),
+					DatabaseIndex: 1,
+				}
+			} else if bytes.Equal(keptTrace, record.Value) {
+				tracesDuplicated.Add(1)
+				outputChan <- &store.Record{
+					Key:           record.Key,
+					Value:         lex.EncodeOrDie(int64(1), int64(0)),
+					DatabaseIndex: 3,
+				}
+			} else {
+				tracesConflicting.Add(1)
+				outputChan <- &store.Record{
+					Key:           record.Key,
+					Value:         record.Value,
+					DatabaseIndex: 2,
+				}
+				outputChan <- &store.Record{
+					Key:           record.Key,
+					Value:         lex.EncodeOrDie(int64(0), int64(1)),
+					DatabaseIndex: 3,
+				}
+			}
+		}
+	}
+}
+
+func countDuplicateTraces(inputChan, outputChan chan *store.Record) {
+	var nodeId []byte
+	grouper := transformer.GroupRecords(inputChan, &nodeId)
+	for grouper.NextGroup() {
+		var identicalCount, conflictingCount int64
+		for grouper.NextRecord() {
+			record := grouper.Read()
+			var identical, conflicting int64
+			lex.DecodeOrDie(record.Value, &identical, &conflicting)
+			identicalCount += identical
+			conflictingCount += conflicting
+		}
+		outputChan <- &store.Record{
+			Key:   lex.EncodeOrDie(nodeId),
+			Value: lex.EncodeOrDie(identicalCount, conflictingCount),
+		}
+	}
+}
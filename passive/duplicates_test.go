@@ -0,0 +1,77 @@
+package passive
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sburnett/lexicographic-tuples"
+	"github.com/sburnett/transformer"
+	"github.com/sburnett/transformer/store"
+)
+
+func readAllRecords(reader store.Reader) []*store.Record {
+	var records []*store.Record
+	reader.BeginReading()
+	for {
+		record, err := reader.ReadRecord()
+		if err != nil {
+			panic(err)
+		}
+		if record == nil {
+			break
+		}
+		records = append(records, record)
+	}
+	reader.EndReading()
+	return records
+}
+
+func ExampleDuplicateTracesPipeline() {
+	tarballsPath, err := ioutil.TempDir("", "duplicates")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tarballsPath)
+
+	original := makeValidTraceContents("NODE", 0)
+	conflicting := bytes.Replace(original, []byte("NODE 10 0 20\n"), []byte("NODE 10 0 21\n"), 1)
+	writeTestTarball(filepath.Join(tarballsPath, "NODE", "2013-01-01", "NODE_1.tar.gz"), time.Unix(100, 0), original)
+	writeTestTarball(filepath.Join(tarballsPath, "NODE", "2013-01-01", "NODE_2.tar.gz"), time.Unix(100, 0), original)
+	writeTestTarball(filepath.Join(tarballsPath, "NODE", "2013-01-01", "NODE_3.tar.gz"), time.Unix(100, 0), conflicting, makeValidTraceContents("NODE", 1))
+
+	levelDbManager := store.NewSliceManager()
+	transformer.RunPipeline(IndexTarballsPipeline(tarballsPath, []string{"*/*/*.tar.gz"}, false, levelDbManager, ioutil.Discard))
+
+	for _, record := range readAllRecords(levelDbManager.Reader("traces-sources")) {
+		var traceKey TraceKey
+		var tarPath, memberName string
+		lex.DecodeOrDie(record.Key, &traceKey)
+		lex.DecodeOrDie(record.Value, &tarPath, &memberName)
+		fmt.Printf("traces: %s %d %d from %s:%s\n", traceKey.NodeId, traceKey.SessionId, traceKey.SequenceNumber, filepath.Base(tarPath), memberName)
+	}
+	for _, record := range readAllRecords(levelDbManager.Reader("traces-conflicting")) {
+		var traceKey TraceKey
+		var tarPath, memberName string
+		lex.DecodeOrDie(record.Key, &traceKey, &tarPath, &memberName)
+		fmt.Printf("conflicting: %s %d %d from %s:%s\n", traceKey.NodeId, traceKey.SessionId, traceKey.SequenceNumber, filepath.Base(tarPath), memberName)
+	}
+	for _, record := range readAllRecords(levelDbManager.Reader("traces-duplicates-per-node")) {
+		var nodeId string
+		var identical, conflicting int64
+		lex.DecodeOrDie(record.Key, &nodeId)
+		lex.DecodeOrDie(record.Value, &identical, &conflicting)
+		fmt.Printf("duplicates: %s %d identical %d conflicting\n", nodeId, identical, conflicting)
+	}
+	fmt.Printf("traces-new: %d records\n", len(readAllRecords(levelDbManager.Reader("traces-new"))))
+
+	// Output:
+	// traces: NODE 10 0 from NODE_1.tar.gz:0
+	// traces: NODE 10 1 from NODE_3.tar.gz:1
+	// conflicting: NODE 10 0 from NODE_3.tar.gz:0
+	// duplicates: NODE 1 identical 1 conflicting
+	// traces-new: 0 records
+}
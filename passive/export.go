@@ -0,0 +1,306 @@
+package passive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sburnett/lexicographic-tuples"
+	"github.com/sburnett/transformer"
+	"github.com/sburnett/transformer/store"
+)
+
+// The final stores of the aggregate pipelines, which the export command
+// exports unless told otherwise.
+var DefaultExportStores = []string{
+	"bytesperminute",
+	"bytesperhour",
+	"bytesperdevice",
+	"bytesperdomain-bytes-per-domain",
+	"bytesperdomain-bytes-per-domain-per-device",
+	"lookupsperdevice-lookups-per-device",
+	"lookupsperdevice-lookups-per-device-per-hour",
+	"statistics-node-aggregates",
+}
+
+// How ExportStore writes its files.
+type ExportOptions struct {
+	// "csv" or "jsonl".
+	Format string
+	// Write files in this directory, which must exist.
+	Directory string
+	// Compress each file using gzip and add .gz to its name.
+	Gzip bool
+	// Write records to one file per UTC day of their key's timestamp, named
+	// like store-20120301.csv, instead of one file named like store.csv.
+	// Stores whose keys don't contain a timestamp always go to one file.
+	RotateDaily bool
+}
+
+// Writes every record of a store to CSV or JSON lines files, replacing the
+// files' previous contents. CSV files begin with a header naming the columns
+// that flattenValues returns. JSON lines files contain one object per record,
+// like the dump command's json format.
+type ExportStore struct {
+	schema  *StoreSchema
+	options ExportOptions
+
+	// The file we're writing, and the day its records are from if we're
+	// rotating files.
+	file    *exportFile
+	fileDay string
+	// The days whose files we've created during this run. If we return to a
+	// day, we append to its file instead of replacing it.
+	createdDays map[string]bool
+	// Whether each record's key begins with its day; see sortByDay.
+	sortedByDay bool
+}
+
+// Export the store described by schema.
+func NewExportStore(schema *StoreSchema, options ExportOptions) *ExportStore {
+	return &ExportStore{schema: schema, options: options}
+}
+
+// A pipeline that exports each of the stores using ExportStore. Keys usually
+// begin with the node ID, so when we rotate files daily we first sort a copy
+// of the store by day, and write each day's file in one go.
+func ExportPipeline(levelDbManager store.Manager, options ExportOptions, storeNames ...string) transformer.Pipeline {
+	sortedStore := levelDbManager.ReadingDeleter("export-sorted-by-day")
+	var stages []transformer.PipelineStage
+	sorted := false
+	for _, name := range storeNames {
+		schema := LookupStoreSchema(name)
+		if schema == nil {
+			panic(fmt.Errorf("Unknown store %q", name))
+		}
+		exportStore := NewExportStore(schema, options)
+		if !exportStore.rotates() {
+			stages = append(stages, transformer.PipelineStage{
+				Name:   fmt.Sprintf("Export:%s", name),
+				Reader: levelDbManager.Reader(name),
+				Writer: exportStore,
+			})
+			continue
+		}
+		exportStore.sortedByDay = true
+		stages = append(stages,
+			transformer.PipelineStage{
+				Name:        fmt.Sprintf("SortByDay:%s", name),
+				Reader:      levelDbManager.Reader(name),
+				Transformer: transformer.MakeMapFunc(exportStore.sortByDay),
+				Writer:      store.NewTruncatingWriter(sortedStore),
+			},
+			transformer.PipelineStage{
+				Name:   fmt.Sprintf("Export:%s", name),
+				Reader: sortedStore,
+				Writer: exportStore,
+			})
+		sorted = true
+	}
+	if sorted {
+		stages = append(stages, clearStoreStage(sortedStore))
+	}
+	return stages
+}
+
+// Prefix a record's key with its day, so the records sort by day. We leave
+// records whose day we can't decode at the beginning, and report them when
+// we write them.
+func (store *ExportStore) sortByDay(record *store.Record) *store.Record {
+	day, err := store.recordDay(record)
+	if err != nil {
+		day = ""
+	}
+	record.Key = lex.Concatenate(lex.EncodeOrDie(day), record.Key)
+	return record
+}
+
+// The name of the file for records from day, which is empty unless we're
+// rotating files.
+func (store *ExportStore) filename(day string) string {
+	name := store.schema.Name
+	if day != "" {
+		name = fmt.Sprintf("%s-%s", name, day)
+	}
+	name = fmt.Sprintf("%s.%s", name, store.options.Format)
+	if store.options.Gzip {
+		name += ".gz"
+	}
+	return filepath.Join(store.options.Directory, name)
+}
+
+func (store *ExportStore) rotates() bool {
+	return store.options.RotateDaily && store.schema.TimeColumn() >= 0
+}
+
+// The day of a record's file, in YYYYMMDD format.
+func (store *ExportStore) recordDay(record *store.Record) (string, error) {
+	if !store.rotates() {
+		return "", nil
+	}
+	seconds, err := store.schema.KeyTime(record.Key)
+	if err != nil {
+		return "", err
+	}
+	return time.Unix(seconds, 0).UTC().Format("20060102"), nil
+}
+
+func (store *ExportStore) BeginWriting() error {
+	switch store.options.Format {
+	case "csv", "jsonl":
+	default:
+		return fmt.Errorf("Unknown export format %q", store.options.Format)
+	}
+	store.file = nil
+	store.fileDay = ""
+	store.createdDays = make(map[string]bool)
+	if !store.rotates() {
+		return store.openFile("")
+	}
+	return nil
+}
+
+// Close the current file and open the one for day, writing a header if we're
+// creating it.
+func (store *ExportStore) openFile(day string) error {
+	if store.file != nil {
+		if err := store.file.Close(); err != nil {
+			return err
+		}
+		store.file = nil
+	}
+	create := !store.createdDays[day]
+	file, err := openExportFile(store.filename(day), create, store.options.Gzip)
+	if err != nil {
+		return err
+	}
+	store.file = file
+	store.fileDay = day
+	store.createdDays[day] = true
+	if create && store.options.Format == "csv" {
+		if err := store.file.csv.Write(flattenedColumnNames(store.schema.Columns())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *ExportStore) WriteRecord(record *store.Record) error {
+	if store.sortedByDay {
+		var day string
+		key, err := lex.Decode(record.Key, &day)
+		if err != nil {
+			return fmt.Errorf("Error decoding %s record %q: %v", store.schema.Name, record.Key, err)
+		}
+		record.Key = key
+	}
+	day, err := store.recordDay(record)
+	if err != nil {
+		return fmt.Errorf("Error decoding %s record %q: %v", store.schema.Name, record.Key, err)
+	}
+	if store.file == nil || day != store.fileDay {
+		if err := store.openFile(day); err != nil {
+			return err
+		}
+	}
+	values, err := store.schema.DecodeRecord(record)
+	if err != nil {
+		return fmt.Errorf("Error decoding %s record %q: %v", store.schema.Name, record.Key, err)
+	}
+	switch store.options.Format {
+	case "csv":
+		fields, err := formatCsvFields(store.schema.Columns(), values)
+		if err != nil {
+			return err
+		}
+		return store.file.csv.Write(fields)
+	case "jsonl":
+		line, err := formatJsonLine(store.schema.Columns(), values)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(store.file.writer, "%s\n", line)
+		return err
+	}
+	return nil
+}
+
+func (store *ExportStore) EndWriting() error {
+	if store.file == nil {
+		return nil
+	}
+	err := store.file.Close()
+	store.file = nil
+	return err
+}
+
+// The fields of a CSV row, which are the values that flattenValues returns.
+func formatCsvFields(columns []Column, values []interface{}) ([]string, error) {
+	flattened, err := flattenValues(columns, values)
+	if err != nil {
+		return nil, err
+	}
+	fields := make([]string, len(flattened))
+	for idx, value := range flattened {
+		fields[idx] = fmt.Sprint(value)
+	}
+	return fields, nil
+}
+
+// One of ExportStore's open files. Appending to a gzip file adds another gzip
+// member, which gzip and Go's compress/gzip read as if it were one stream.
+type exportFile struct {
+	file       *os.File
+	compressor *gzip.Writer
+	buffer     *bufio.Writer
+	// Write JSON lines to writer, and CSV rows to csv, which wraps it.
+	writer io.Writer
+	csv    *csv.Writer
+}
+
+func openExportFile(path string, create, compress bool) (*exportFile, error) {
+	flags := os.O_WRONLY | os.O_CREATE
+	if create {
+		flags |= os.O_TRUNC
+	} else {
+		flags |= os.O_APPEND
+	}
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	exported := &exportFile{file: file}
+	var writer io.Writer = file
+	if compress {
+		exported.compressor = gzip.NewWriter(file)
+		writer = exported.compressor
+	}
+	exported.buffer = bufio.NewWriter(writer)
+	exported.writer = exported.buffer
+	exported.csv = csv.NewWriter(exported.buffer)
+	return exported, nil
+}
+
+func (exported *exportFile) Close() error {
+	exported.csv.Flush()
+	if err := exported.csv.Error(); err != nil {
+		exported.file.Close()
+		return err
+	}
+	if err := exported.buffer.Flush(); err != nil {
+		exported.file.Close()
+		return err
+	}
+	if exported.compressor != nil {
+		if err := exported.compressor.Close(); err != nil {
+			exported.file.Close()
+			return err
+		}
+	}
+	return exported.file.Close()
+}
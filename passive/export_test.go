@@ -0,0 +1,126 @@
+package passive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/sburnett/lexicographic-tuples"
+	"github.com/sburnett/transformer/store"
+)
+
+func TestExportStore_Filename(t *testing.T) {
+	options := ExportOptions{Format: "csv", Directory: "exports", Gzip: true, RotateDaily: true}
+	exportStore := NewExportStore(LookupStoreSchema("lookupsperdevice-lookups-per-device-per-hour"), options)
+	if !exportStore.rotates() {
+		t.Errorf("%s should rotate daily", exportStore.schema.Name)
+	}
+	if expected, actual := filepath.Join("exports", "lookupsperdevice-lookups-per-device-per-hour-20120301.csv.gz"), exportStore.filename("20120301"); actual != expected {
+		t.Errorf("Filename should be %q, not %q", expected, actual)
+	}
+
+	options.Format, options.Gzip = "jsonl", false
+	exportStore = NewExportStore(LookupStoreSchema("lookupsperdevice-lookups-per-device"), options)
+	if exportStore.rotates() {
+		t.Errorf("%s keys don't contain a timestamp, so it shouldn't rotate", exportStore.schema.Name)
+	}
+	if expected, actual := filepath.Join("exports", "lookupsperdevice-lookups-per-device.jsonl"), exportStore.filename(""); actual != expected {
+		t.Errorf("Filename should be %q, not %q", expected, actual)
+	}
+}
+
+func TestFormatCsvFields(t *testing.T) {
+	schema := LookupStoreSchema("statistics-node-aggregates")
+	statistics := &AggregateStatistics{
+		Traces: proto.Int64(3),
+		Bytes:  proto.Int64(1000),
+	}
+	fields, err := formatCsvFields(schema.Columns(), []interface{}{"node0", statistics})
+	if err != nil {
+		t.Fatalf("Error formatting fields: %v", err)
+	}
+	expected := []string{"node0", "3", "0", "0", "0", "0", "0", "0", "1000"}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("Fields should be %v, not %v", expected, fields)
+	}
+}
+
+// Returning to a day appends to its file without repeating the header.
+func TestExportStore_ReopenDay(t *testing.T) {
+	directory, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	options := ExportOptions{Format: "csv", Directory: directory, Gzip: true, RotateDaily: true}
+	exportStore := NewExportStore(LookupStoreSchema("bytesperhour"), options)
+	if err := exportStore.BeginWriting(); err != nil {
+		t.Fatal(err)
+	}
+	for _, day := range []string{"20120301", "20120302", "20120301"} {
+		if err := exportStore.openFile(day); err != nil {
+			t.Fatal(err)
+		}
+		if err := exportStore.file.csv.Write([]string{"node0", day, "1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := exportStore.EndWriting(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(exportStore.filename("20120301"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "node_id,timestamp,size\nnode0,20120301,1\nnode0,20120301,1\n"; string(contents) != expected {
+		t.Errorf("File should contain %q, not %q", expected, contents)
+	}
+}
+
+// A later day sorts after an earlier one, whatever the node.
+func TestExportStore_SortByDay(t *testing.T) {
+	options := ExportOptions{Format: "csv", Directory: "exports", RotateDaily: true}
+	exportStore := NewExportStore(LookupStoreSchema("bytesperhour"), options)
+	firstKey := lex.EncodeOrDie("node0", int64(1330646400))
+	secondKey := lex.EncodeOrDie("node1", int64(1330560000))
+	first := exportStore.sortByDay(&store.Record{Key: firstKey})
+	second := exportStore.sortByDay(&store.Record{Key: secondKey})
+	if bytes.Compare(second.Key, first.Key) >= 0 {
+		t.Errorf("Records from 20120301 should sort before records from 20120302")
+	}
+	var day string
+	key, err := lex.Decode(first.Key, &day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if day != "20120302" || !bytes.Equal(key, firstKey) {
+		t.Errorf("Expected day 20120302 and key %q. Got %s and %q", firstKey, day, key)
+	}
+}
+
+func TestDefaultExportStores_Final(t *testing.T) {
+	for _, name := range DefaultExportStores {
+		schema := LookupStoreSchema(name)
+		if schema == nil {
+			t.Errorf("Unknown store %s", name)
+		} else if schema.Intermediate {
+			t.Errorf("%s is an intermediate store", name)
+		}
+	}
+}
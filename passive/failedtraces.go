@@ -0,0 +1,283 @@
+package passive
+
+import (
+	"fmt"
+	"io"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/sburnett/lexicographic-tuples"
+	"github.com/sburnett/transformer"
+	"github.com/sburnett/transformer/store"
+)
+
+// A trace that failed to parse during indexing. We keep the raw contents so we
+// can retry parsing after fixing the parser.
+type failedTrace struct {
+	TarPath    string
+	MemberName string
+	Contents   []byte
+	Section    int32
+	LineNumber int32
+	// The kind of error, without any details specific to this trace, which is
+	// useful for grouping similar errors together.
+	Message string
+	Error   string
+}
+
+func newFailedTrace(tarPath, memberName string, contents []byte, parseError *TraceParseError) *failedTrace {
+	message := parseError.Suberror.Error()
+	if e, ok := parseError.Suberror.(*sectionError); ok {
+		message = e.Message
+	}
+	return &failedTrace{
+		TarPath:    tarPath,
+		MemberName: memberName,
+		Contents:   contents,
+		Section:    int32(parseError.Section),
+		LineNumber: int32(parseError.LineNumber),
+		Message:    message,
+		Error:      parseError.Suberror.Error(),
+	}
+}
+
+func encodeFailedTrace(failed *failedTrace) *store.Record {
+	return &store.Record{
+		Key:   lex.EncodeOrDie(failed.TarPath, failed.MemberName),
+		Value: lex.EncodeOrDie(failed.Contents, failed.Section, failed.LineNumber, failed.Message, failed.Error),
+	}
+}
+
+func decodeFailedTrace(record *store.Record) *failedTrace {
+	failed := new(failedTrace)
+	lex.DecodeOrDie(record.Key, &failed.TarPath, &failed.MemberName)
+	lex.DecodeOrDie(record.Value, &failed.Contents, &failed.Section, &failed.LineNumber, &failed.Message, &failed.Error)
+	return failed
+}
+
+func ListFailedTracesPipeline(levelDbManager store.Manager, writer io.Writer) transformer.Pipeline {
+	tracesFailedStore := levelDbManager.Reader("traces-failed")
+	return []transformer.PipelineStage{
+		transformer.PipelineStage{
+			Name:   "ListFailedTraces",
+			Reader: tracesFailedStore,
+			Writer: &failedTracesTextStore{writer: writer},
+		},
+	}
+}
+
+func SummarizeFailedTracesPipeline(levelDbManager store.Manager, writer io.Writer) transformer.Pipeline {
+	tracesFailedStore := levelDbManager.Reader("traces-failed")
+	groupedStore := levelDbManager.ReadingDeleter("traces-failed-by-error")
+	return []transformer.PipelineStage{
+		transformer.PipelineStage{
+			Name:        "GroupFailedTracesByError",
+			Reader:      tracesFailedStore,
+			Transformer: transformer.MakeMapFunc(groupFailedTracesByError),
+			Writer:      store.NewTruncatingWriter(groupedStore),
+		},
+		transformer.PipelineStage{
+			Name:        "CountFailedTracesByError",
+			Reader:      groupedStore,
+			Transformer: transformer.TransformFunc(countFailedTracesByError),
+			Writer:      &failedTracesSummaryStore{writer: writer},
+		},
+	}
+}
+
+// Count failed traces by the build and file format version of
+// bismark-passive that wrote them, the section that failed to parse, and the
+// kind of failure. We parse each trace again to find out how it fails, so
+// traces that the current parser accepts aren't included.
+func ReportFailedTracesPipeline(levelDbManager store.Manager, writer io.Writer) transformer.Pipeline {
+	tracesFailedStore := levelDbManager.Reader("traces-failed")
+	groupedStore := levelDbManager.ReadingDeleter("traces-failed-by-build")
+	return []transformer.PipelineStage{
+		transformer.PipelineStage{
+			Name:        "GroupFailedTracesByBuild",
+			Reader:      tracesFailedStore,
+			Transformer: transformer.MakeDoFunc(groupFailedTracesByBuild),
+			Writer:      store.NewTruncatingWriter(groupedStore),
+		},
+		transformer.PipelineStage{
+			Name:        "CountFailedTracesByBuild",
+			Reader:      groupedStore,
+			Transformer: transformer.TransformFunc(countFailedTracesByBuild),
+			Writer:      &failedTracesReportStore{writer: writer},
+		},
+	}
+}
+
+// Try parsing every failed trace again. Traces that parse are added to the
+// traces store via DuplicateTracesPipeline and removed from traces-failed.
+func RetryFailedTracesPipeline(levelDbManager store.Manager) transformer.Pipeline {
+	tracesNewStore := levelDbManager.Writer("traces-new")
+	tracesFailedStore := levelDbManager.ReadingDeleter("traces-failed")
+	stillFailedStore := levelDbManager.ReadingDeleter("traces-still-failed")
+	return append([]transformer.PipelineStage{
+		transformer.PipelineStage{
+			Name:        "RetryFailedTraces",
+			Reader:      tracesFailedStore,
+			Transformer: transformer.MakeMultipleOutputsDoFunc(retryFailedTrace, 2),
+			Writer:      store.NewMuxingWriter(tracesNewStore, store.NewTruncatingWriter(stillFailedStore)),
+		},
+		transformer.PipelineStage{
+			Name:   "CopyStillFailedTraces",
+			Reader: stillFailedStore,
+			Writer: store.NewTruncatingWriter(tracesFailedStore),
+		},
+	}, DuplicateTracesPipeline(levelDbManager)...)
+}
+
+func groupFailedTracesByError(record *store.Record) *store.Record {
+	failed := decodeFailedTrace(record)
+	return &store.Record{
+		Key: lex.EncodeOrDie(failed.Section, failed.Message, failed.TarPath, failed.MemberName),
+	}
+}
+
+func groupFailedTracesByBuild(record *store.Record, outputChan chan *store.Record) {
+	failed := decodeFailedTrace(record)
+	_, err := parseTrace(failed.Contents)
+	parseError, ok := err.(*TraceParseError)
+	if !ok {
+		return
+	}
+	reparsed := newFailedTrace(failed.TarPath, failed.MemberName, failed.Contents, parseError)
+	outputChan <- &store.Record{
+		Key: lex.EncodeOrDie(parseError.BuildId, parseError.FileFormatVersion, reparsed.Section, parseError.Code.String(), reparsed.Message, failed.TarPath, failed.MemberName),
+	}
+}
+
+func countFailedTracesByBuild(inputChan, outputChan chan *store.Record) {
+	var buildId, code, message string
+	var fileFormatVersion, section int32
+	grouper := transformer.GroupRecords(inputChan, &buildId, &fileFormatVersion, &section, &code, &message)
+	for grouper.NextGroup() {
+		var count int64
+		for grouper.NextRecord() {
+			grouper.Read()
+			count++
+		}
+		outputChan <- &store.Record{
+			Key:   lex.EncodeOrDie(buildId, fileFormatVersion, section, code, message),
+			Value: lex.EncodeOrDie(count),
+		}
+	}
+}
+
+func countFailedTracesByError(inputChan, outputChan chan *store.Record) {
+	var section int32
+	var message string
+	grouper := transformer.GroupRecords(inputChan, &section, &message)
+	for grouper.NextGroup() {
+		var count int64
+		for grouper.NextRecord() {
+			grouper.Read()
+			count++
+		}
+		outputChan <- &store.Record{
+			Key:   lex.EncodeOrDie(section, message),
+			Value: lex.EncodeOrDie(count),
+		}
+	}
+}
+
+func retryFailedTrace(record *store.Record, outputChans ...chan *store.Record) {
+	tracesChan := outputChans[0]
+	stillFailedChan := outputChans[1]
+
+	failed := decodeFailedTrace(record)
+	trace, err := parseTrace(failed.Contents)
+	if err != nil {
+		if parseError, ok := err.(*TraceParseError); ok {
+			stillFailedChan <- encodeFailedTrace(newFailedTrace(failed.TarPath, failed.MemberName, failed.Contents, parseError))
+		} else {
+			stillFailedChan <- record
+		}
+		return
+	}
+	value, err := proto.Marshal(trace)
+	if err != nil {
+		panic(fmt.Errorf("Error encoding protocol buffer: %v", err))
+	}
+	tracesChan <- &store.Record{
+		Key:   append(traceKey(trace), lex.EncodeOrDie(failed.TarPath, failed.MemberName)...),
+		Value: value,
+	}
+}
+
+type failedTracesTextStore struct {
+	writer io.Writer
+}
+
+func (store *failedTracesTextStore) BeginWriting() error {
+	return nil
+}
+
+func (store *failedTracesTextStore) WriteRecord(record *store.Record) error {
+	failed := decodeFailedTrace(record)
+	if _, err := fmt.Fprintf(store.writer, "%s\t%s\t%s\t%d\t%s\n", failed.TarPath, failed.MemberName, Section(failed.Section), failed.LineNumber+1, failed.Error); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (store *failedTracesTextStore) EndWriting() error {
+	return nil
+}
+
+type failedTracesSummaryStore struct {
+	writer io.Writer
+}
+
+func (store *failedTracesSummaryStore) BeginWriting() error {
+	return nil
+}
+
+func (store *failedTracesSummaryStore) WriteRecord(record *store.Record) error {
+	var section int32
+	var message string
+	var count int64
+	lex.DecodeOrDie(record.Key, &section, &message)
+	lex.DecodeOrDie(record.Value, &count)
+	if _, err := fmt.Fprintf(store.writer, "%s\t%s\t%d\n", Section(section), message, count); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (store *failedTracesSummaryStore) EndWriting() error {
+	return nil
+}
+
+type failedTracesReportStore struct {
+	writer io.Writer
+}
+
+func (store *failedTracesReportStore) BeginWriting() error {
+	return nil
+}
+
+func (store *failedTracesReportStore) WriteRecord(record *store.Record) error {
+	var buildId, code, message string
+	var fileFormatVersion, section int32
+	var count int64
+	lex.DecodeOrDie(record.Key, &buildId, &fileFormatVersion, &section, &code, &message)
+	lex.DecodeOrDie(record.Value, &count)
+	// We couldn't parse the build or version of some traces.
+	version := fmt.Sprint(fileFormatVersion)
+	if fileFormatVersion < 0 {
+		version = "-"
+	}
+	if buildId == "" {
+		buildId = "-"
+	}
+	if _, err := fmt.Fprintf(store.writer, "%s\t%s\t%s\t%s\t%s\t%d\n", buildId, version, Section(section), code, message, count); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (store *failedTracesReportStore) EndWriting() error {
+	return nil
+}
@@ -0,0 +1,134 @@
+package passive
+
+import (
+	"bytes"
+	"fmt"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/sburnett/lexicographic-tuples"
+	"github.com/sburnett/transformer"
+	"github.com/sburnett/transformer/store"
+)
+
+func makeFailedTraceRecord(tarPath, memberName string, contents []byte) *store.Record {
+	_, err := parseTrace(contents)
+	if err == nil {
+		// Pretend an older parser rejected this trace.
+		err = newTraceParseError(SectionIntro, 0, newSectionError(ErrorMissingField, "rejected by old parser", 0))
+	}
+	return encodeFailedTrace(newFailedTrace(tarPath, memberName, contents, err.(*TraceParseError)))
+}
+
+func makeValidTraceContents(nodeId string, sequenceNumber int32) []byte {
+	trace := Trace{
+		NodeId:                       proto.String(nodeId),
+		ProcessStartTimeMicroseconds: proto.Int64(10),
+		SequenceNumber:               proto.Int32(sequenceNumber),
+		TraceCreationTimestamp:       proto.Int64(20),
+	}
+	contents, err := FormatTrace(&trace, 5)
+	if err != nil {
+		panic(err)
+	}
+	return contents
+}
+
+func makeInvalidTraceContents(old, new string) []byte {
+	return bytes.Replace(makeValidTraceContents("NODE", 3), []byte(old), []byte(new), 1)
+}
+
+func writeFailedTraces(levelDbManager store.Manager, records ...*store.Record) {
+	tracesFailedStore := levelDbManager.Writer("traces-failed")
+	tracesFailedStore.BeginWriting()
+	for _, record := range records {
+		tracesFailedStore.WriteRecord(record)
+	}
+	tracesFailedStore.EndWriting()
+}
+
+func ExampleListFailedTracesPipeline() {
+	levelDbManager := store.NewSliceManager()
+	writeFailedTraces(levelDbManager,
+		makeFailedTraceRecord("a.tar.gz", "1.gz", makeInvalidTraceContents("5\n", "InvalidVersion\n")),
+		makeFailedTraceRecord("a.tar.gz", "2.gz", makeInvalidTraceContents("NODE 10 3 20\n", "NODE 10 3\n")))
+
+	writer := bytes.NewBuffer([]byte{})
+	transformer.RunPipeline(ListFailedTracesPipeline(levelDbManager, writer))
+	fmt.Printf("%s", writer.Bytes())
+
+	// Output:
+	// a.tar.gz	1.gz	intro	1	has invalid file format version ("InvalidVersion"): strconv.ParseInt: parsing "InvalidVersion": invalid syntax
+	// a.tar.gz	2.gz	intro	3	missing trace creation timestamp
+}
+
+func ExampleSummarizeFailedTracesPipeline() {
+	levelDbManager := store.NewSliceManager()
+	writeFailedTraces(levelDbManager,
+		makeFailedTraceRecord("a.tar.gz", "1.gz", makeInvalidTraceContents("5\n", "InvalidVersion\n")),
+		makeFailedTraceRecord("a.tar.gz", "2.gz", makeInvalidTraceContents("NODE 10 3 20\n", "NODE 10 3\n")),
+		makeFailedTraceRecord("b.tar.gz", "1.gz", makeInvalidTraceContents("5\n", "BadVersion\n")),
+		makeFailedTraceRecord("b.tar.gz", "2.gz", makeInvalidTraceContents("UNANONYMIZED\n\n0 0\n", "UNANONYMIZED\n\n0 x\n")))
+
+	writer := bytes.NewBuffer([]byte{})
+	transformer.RunPipeline(SummarizeFailedTracesPipeline(levelDbManager, writer))
+	fmt.Printf("%s", writer.Bytes())
+
+	// Output:
+	// intro	has invalid file format version	2
+	// intro	missing trace creation timestamp	1
+	// packet series	invalid dropped packet count	1
+}
+
+func ExampleReportFailedTracesPipeline() {
+	levelDbManager := store.NewSliceManager()
+	writeFailedTraces(levelDbManager,
+		makeFailedTraceRecord("a.tar.gz", "1.gz", makeInvalidTraceContents("5\n", "InvalidVersion\n")),
+		makeFailedTraceRecord("a.tar.gz", "2.gz", makeInvalidTraceContents("NODE 10 3 20\n", "NODE 10 3\n")),
+		makeFailedTraceRecord("a.tar.gz", "3.gz", makeValidTraceContents("NODE", 0)),
+		makeFailedTraceRecord("b.tar.gz", "1.gz", makeInvalidTraceContents("5\n", "BadVersion\n")),
+		makeFailedTraceRecord("b.tar.gz", "2.gz", makeInvalidTraceContents("UNANONYMIZED\n\n0 0\n", "UNANONYMIZED\n\n0 x\n")),
+		makeFailedTraceRecord("b.tar.gz", "3.gz", bytes.Replace(makeInvalidTraceContents("NODE 10 3 20\n", "NODE 10 3\n"), []byte("UNKNOWN"), []byte("OLDBUILD"), 1)))
+
+	writer := bytes.NewBuffer([]byte{})
+	transformer.RunPipeline(ReportFailedTracesPipeline(levelDbManager, writer))
+	fmt.Printf("%s", writer.Bytes())
+
+	// Output:
+	// -	-	intro	invalid-field	has invalid file format version	2
+	// OLDBUILD	5	intro	missing-field	missing trace creation timestamp	1
+	// UNKNOWN	5	intro	missing-field	missing trace creation timestamp	1
+	// UNKNOWN	5	packet series	invalid-field	invalid dropped packet count	1
+}
+
+func ExampleRetryFailedTracesPipeline() {
+	levelDbManager := store.NewSliceManager()
+	writeFailedTraces(levelDbManager,
+		makeFailedTraceRecord("a.tar.gz", "1.gz", makeInvalidTraceContents("5\n", "InvalidVersion\n")),
+		makeFailedTraceRecord("a.tar.gz", "2.gz", makeValidTraceContents("NODE", 3)))
+
+	transformer.RunPipeline(RetryFailedTracesPipeline(levelDbManager))
+
+	tracesStore := levelDbManager.Reader("traces")
+	tracesStore.BeginReading()
+	for {
+		record, err := tracesStore.ReadRecord()
+		if err != nil {
+			panic(err)
+		}
+		if record == nil {
+			break
+		}
+		var traceKey TraceKey
+		lex.DecodeOrDie(record.Key, &traceKey)
+		fmt.Printf("traces: %s %d %d\n", traceKey.NodeId, traceKey.SessionId, traceKey.SequenceNumber)
+	}
+	tracesStore.EndReading()
+
+	writer := bytes.NewBuffer([]byte{})
+	transformer.RunPipeline(ListFailedTracesPipeline(levelDbManager, writer))
+	fmt.Printf("%s", writer.Bytes())
+
+	// Output:
+	// traces: NODE 10 3
+	// a.tar.gz	1.gz	intro	1	has invalid file format version ("InvalidVersion"): strconv.ParseInt: parsing "InvalidVersion": invalid syntax
+}
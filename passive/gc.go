@@ -0,0 +1,247 @@
+package passive
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/jmhodges/levigo"
+	"github.com/sburnett/lexicographic-tuples"
+	"github.com/sburnett/transformer"
+	"github.com/sburnett/transformer/store"
+)
+
+type garbageCollectStores struct {
+	RebuildPipelines map[string]bool
+	Compact          bool
+}
+
+// Report the disk usage of every store in dbRoot and delete the stores we
+// don't need to keep between runs: intermediate stores that their pipelines
+// rewrite on every run, and every intermediate and bookkeeping store of the
+// pipelines in rebuildPipelines, whose next runs will then reprocess all
+// their inputs. If compact is true, we compact the LevelDB of every store we
+// keep. If dryRun is true, we only report what we would do.
+//
+// Don't run this concurrently with any other pipeline that uses dbRoot.
+func GarbageCollectPipeline(dbRoot string, rebuildPipelines []string, compact, dryRun bool, writer io.Writer) transformer.Pipeline {
+	rebuild := make(map[string]bool)
+	for _, pipeline := range rebuildPipelines {
+		rebuild[pipeline] = true
+	}
+	return []transformer.PipelineStage{
+		transformer.PipelineStage{
+			Name:   "GarbageCollectStores",
+			Reader: &storeDirectoryReader{dbRoot: dbRoot},
+			Transformer: garbageCollectStores{
+				RebuildPipelines: rebuild,
+				Compact:          compact,
+			},
+			Writer: &garbageCollectingStore{
+				dbRoot:           dbRoot,
+				rebuildPipelines: rebuild,
+				dryRun:           dryRun,
+				writer:           writer,
+			},
+		},
+	}
+}
+
+// The pipelines that we can rebuild from scratch, because they record which
+// of their inputs they've processed.
+func rebuildablePipelines() map[string]bool {
+	pipelines := make(map[string]bool)
+	for _, schema := range StoreSchemas() {
+		if schema.Bookkeeping {
+			pipelines[schema.Pipeline] = true
+		}
+	}
+	return pipelines
+}
+
+// The pipelines that record which traces they've processed, and so never
+// process a trace again unless we rebuild them.
+func traceRangesPipelines() []string {
+	pipelines := make(map[string]bool)
+	for _, schema := range StoreSchemas() {
+		if schema.Bookkeeping && schema.isTraceKeyRanges() {
+			pipelines[schema.Pipeline] = true
+		}
+	}
+	var names []string
+	for pipeline := range pipelines {
+		names = append(names, pipeline)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Decide whether to keep, compact or delete a store, and explain why.
+func (parameters garbageCollectStores) action(schema *StoreSchema) (string, string) {
+	keep := "keep"
+	if parameters.Compact {
+		keep = "compact"
+	}
+	switch {
+	case schema == nil:
+		return "keep", "unknown store"
+	case schema.Intermediate && !schema.Incremental:
+		return "delete", "rewritten on every run"
+	case parameters.RebuildPipelines[schema.Pipeline] && (schema.Intermediate || schema.Bookkeeping):
+		return "delete", fmt.Sprintf("rebuilding %s", schema.Pipeline)
+	case schema.Intermediate:
+		return keep, "needed by incremental runs"
+	case schema.Bookkeeping:
+		return keep, "records processed inputs"
+	}
+	return keep, "pipeline output"
+}
+
+func (parameters garbageCollectStores) Do(inputChan, outputChan chan *store.Record) {
+	for record := range inputChan {
+		var name string
+		var size int64
+		lex.DecodeOrDie(record.Key, &name)
+		lex.DecodeOrDie(record.Value, &size)
+		action, reason := parameters.action(LookupStoreSchema(name))
+		outputChan <- &store.Record{
+			Key:   record.Key,
+			Value: lex.EncodeOrDie(size, action, reason),
+		}
+	}
+}
+
+// The total size of the files under path.
+func directorySize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// Reads the name and disk usage of every store in dbRoot, which is a directory
+// containing one LevelDB per store.
+type storeDirectoryReader struct {
+	dbRoot string
+	names  []string
+}
+
+func (reader *storeDirectoryReader) BeginReading() error {
+	entries, err := ioutil.ReadDir(reader.dbRoot)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			reader.names = append(reader.names, entry.Name())
+		}
+	}
+	return nil
+}
+
+func (reader *storeDirectoryReader) ReadRecord() (*store.Record, error) {
+	if len(reader.names) == 0 {
+		return nil, nil
+	}
+	name := reader.names[0]
+	reader.names = reader.names[1:]
+	size, err := directorySize(filepath.Join(reader.dbRoot, name))
+	if err != nil {
+		return nil, err
+	}
+	return &store.Record{
+		Key:   lex.EncodeOrDie(name),
+		Value: lex.EncodeOrDie(size),
+	}, nil
+}
+
+func (reader *storeDirectoryReader) EndReading() error {
+	return nil
+}
+
+// Deletes or compacts stores and reports what it did.
+type garbageCollectingStore struct {
+	dbRoot           string
+	rebuildPipelines map[string]bool
+	dryRun           bool
+	writer           io.Writer
+
+	totalBytes, freedBytes int64
+}
+
+func (store *garbageCollectingStore) BeginWriting() error {
+	rebuildable := rebuildablePipelines()
+	for pipeline := range store.rebuildPipelines {
+		if !rebuildable[pipeline] {
+			return fmt.Errorf("Can't rebuild %q because it doesn't record which inputs it has processed", pipeline)
+		}
+	}
+	return nil
+}
+
+func compactLevelDb(path string) error {
+	options := levigo.NewOptions()
+	defer options.Close()
+	db, err := levigo.Open(path, options)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	db.CompactRange(levigo.Range{})
+	return nil
+}
+
+func (store *garbageCollectingStore) WriteRecord(record *store.Record) error {
+	var name, action, reason string
+	var size int64
+	lex.DecodeOrDie(record.Key, &name)
+	lex.DecodeOrDie(record.Value, &size, &action, &reason)
+	store.totalBytes += size
+
+	path := filepath.Join(store.dbRoot, name)
+	switch action {
+	case "delete":
+		if !store.dryRun {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+		store.freedBytes += size
+	case "compact":
+		if !store.dryRun {
+			if err := compactLevelDb(path); err != nil {
+				return fmt.Errorf("Error compacting %s: %v", name, err)
+			}
+			compactedSize, err := directorySize(path)
+			if err != nil {
+				return err
+			}
+			store.freedBytes += size - compactedSize
+		}
+	}
+	if _, err := fmt.Fprintf(store.writer, "%s\t%s\t%d\t%s\n", name, action, size, reason); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (store *garbageCollectingStore) EndWriting() error {
+	freed := "Freed"
+	if store.dryRun {
+		freed = "Would free"
+	}
+	if _, err := fmt.Fprintf(store.writer, "%s %d of %d bytes\n", freed, store.freedBytes, store.totalBytes); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package passive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTraceRangesPipelines(t *testing.T) {
+	expected := []string{"AggregateStatisticsPipeline", "AvailabilityPipeline", "BytesPerDevicePipeline", "BytesPerDomainPipeline", "BytesPerMinutePipeline"}
+	if pipelines := traceRangesPipelines(); !reflect.DeepEqual(pipelines, expected) {
+		t.Errorf("Pipelines should be %v, not %v", expected, pipelines)
+	}
+}
+
+func TestGarbageCollectStores_Action(t *testing.T) {
+	parameters := garbageCollectStores{
+		RebuildPipelines: map[string]bool{"BytesPerDevicePipeline": true},
+	}
+	expectedActions := map[string]string{
+		"not-a-store":                     "keep",
+		"tarnames":                        "delete",
+		"tarnames-indexed":                "keep",
+		"traces":                          "keep",
+		"traces-new":                      "keep",
+		"bytesperdevice-session":          "delete",
+		"bytesperdevice-packets":          "delete",
+		"bytesperdevice-trace-key-ranges": "delete",
+		"bytesperdevice-consolidated-trace-key-ranges": "delete",
+		"bytesperdevice":                               "keep",
+		"bytesperdomain-flow-ips-table":                "keep",
+		"bytesperdomain-trace-key-ranges":              "keep",
+		"bytesperdomain-consolidated-trace-key-ranges": "delete",
+	}
+	for name, expected := range expectedActions {
+		if action, reason := parameters.action(LookupStoreSchema(name)); action != expected {
+			t.Errorf("Expected to %s %s. Got %s (%s)", expected, name, action, reason)
+		}
+	}
+
+	parameters.Compact = true
+	if action, _ := parameters.action(LookupStoreSchema("traces")); action != "compact" {
+		t.Errorf("Expected to compact traces. Got %s", action)
+	}
+	if action, _ := parameters.action(LookupStoreSchema("not-a-store")); action != "keep" {
+		t.Errorf("Expected to keep an unknown store. Got %s", action)
+	}
+}
+
+func TestGarbageCollectingStore_RebuildablePipelines(t *testing.T) {
+	for _, pipeline := range []string{"IndexTarballsPipeline", "AvailabilityPipeline", "BytesPerDevicePipeline", "AggregateStatisticsPipeline"} {
+		writer := garbageCollectingStore{rebuildPipelines: map[string]bool{pipeline: true}}
+		if err := writer.BeginWriting(); err != nil {
+			t.Errorf("Expected to rebuild %s: %v", pipeline, err)
+		}
+	}
+	for _, pipeline := range []string{"DuplicateTracesPipeline", "LookupsPerDevicePipeline", "NotAPipeline"} {
+		writer := garbageCollectingStore{rebuildPipelines: map[string]bool{pipeline: true}}
+		if err := writer.BeginWriting(); err == nil {
+			t.Errorf("Expected an error rebuilding %s", pipeline)
+		}
+	}
+}
+
+func TestDirectorySize(t *testing.T) {
+	dbRoot, err := ioutil.TempDir("", "gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbRoot)
+	if err := os.MkdirAll(filepath.Join(dbRoot, "store", "subdirectory"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dbRoot, "store", "a"), make([]byte, 10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dbRoot, "store", "subdirectory", "b"), make([]byte, 5), 0644); err != nil {
+		t.Fatal(err)
+	}
+	size, err := directorySize(filepath.Join(dbRoot, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 15 {
+		t.Fatalf("Expected 15 bytes. Got %d", size)
+	}
+}
@@ -0,0 +1,427 @@
+// Package generator synthesizes bismark-passive traces and tarballs for tests
+// and benchmarks. Everything is derived from a seed, so the same Config always
+// generates exactly the same traces.
+package generator
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/sburnett/bismark-passive-server-go/passive"
+)
+
+// Routers write one trace every 30 seconds.
+const traceIntervalSeconds = 30
+
+var popularDomains = []string{
+	"google.com",
+	"www.google.com",
+	"facebook.com",
+	"www.facebook.com",
+	"youtube.com",
+	"yahoo.com",
+	"amazon.com",
+	"wikipedia.org",
+	"m.facebook.com",
+	"mail.google.com",
+}
+
+var whitelist = []string{
+	"google.com",
+	"facebook.com",
+	"youtube.com",
+	"yahoo.com",
+	"amazon.com",
+	"wikipedia.org",
+	"ebay.com",
+	"twitter.com",
+}
+
+type Config struct {
+	Seed int64
+
+	Nodes            int
+	DevicesPerNode   int
+	SessionsPerNode  int
+	TracesPerSession int
+	PacketsPerTrace  int
+	FlowsPerTrace    int
+
+	// Tarballs contain at most this many traces. A new tarball is always
+	// started when the date changes.
+	TracesPerTarball int
+
+	// The probability that any trace after the first in a session is missing,
+	// which leaves a gap in the sequence numbers.
+	SequenceGapProbability float64
+	// The probability that a DNS lookup is for a domain we haven't generated
+	// before, as opposed to a popular domain.
+	DnsChurnProbability float64
+	// The probability that a DNS lookup returns a CNAME record in addition to
+	// an A record.
+	CnameProbability float64
+	// Each node's clock is offset from the true time by a random amount of up
+	// to this much in either direction.
+	MaxClockSkew time.Duration
+
+	// The true time when the first session on each node starts.
+	StartTime         time.Time
+	FileFormatVersion int32
+}
+
+// A small configuration that exercises every feature of the generator.
+func DefaultConfig() Config {
+	return Config{
+		Seed:                   1,
+		Nodes:                  2,
+		DevicesPerNode:         3,
+		SessionsPerNode:        2,
+		TracesPerSession:       10,
+		PacketsPerTrace:        20,
+		FlowsPerTrace:          2,
+		TracesPerTarball:       4,
+		SequenceGapProbability: 0.1,
+		DnsChurnProbability:    0.2,
+		CnameProbability:       0.3,
+		MaxClockSkew:           time.Minute,
+		StartTime:              time.Date(2012, time.September, 1, 0, 0, 0, 0, time.UTC),
+		FileFormatVersion:      passive.MaxFileFormatVersion,
+	}
+}
+
+type Generator struct {
+	config Config
+	random *rand.Rand
+}
+
+func New(config Config) *Generator {
+	return &Generator{
+		config: config,
+	}
+}
+
+type device struct {
+	macAddress string
+	ipAddress  string
+	addressId  int32
+}
+
+type flow struct {
+	flowId       int32
+	device       *device
+	remoteIp     string
+	newThisTrace bool
+}
+
+type session struct {
+	nodeId                 string
+	anonymizationSignature string
+	processStartTime       int64
+	devices                []*device
+	flows                  []*flow
+	usedFlowIds            map[int32]bool
+	pcapReceived           uint32
+	pcapDropped            uint32
+}
+
+func (generator *Generator) hexString(length int) string {
+	const digits = "0123456789abcdef"
+	buffer := make([]byte, length)
+	for idx := range buffer {
+		buffer[idx] = digits[generator.random.Intn(len(digits))]
+	}
+	return string(buffer)
+}
+
+func (generator *Generator) newFlow(currentSession *session) *flow {
+	if len(currentSession.usedFlowIds) >= 65536/2 {
+		// Expire every flow once the flow table is half full, so we never
+		// spin looking for an unused flow id.
+		currentSession.flows = nil
+		currentSession.usedFlowIds = make(map[int32]bool)
+	}
+	flowId := int32(generator.random.Intn(65536))
+	for currentSession.usedFlowIds[flowId] {
+		flowId = int32(generator.random.Intn(65536))
+	}
+	currentSession.usedFlowIds[flowId] = true
+	newFlow := &flow{
+		flowId:       flowId,
+		device:       currentSession.devices[generator.random.Intn(len(currentSession.devices))],
+		remoteIp:     generator.hexString(16),
+		newThisTrace: true,
+	}
+	currentSession.flows = append(currentSession.flows, newFlow)
+	return newFlow
+}
+
+func (generator *Generator) lookupDomain() string {
+	if generator.random.Float64() < generator.config.DnsChurnProbability {
+		return fmt.Sprintf("%s.example.com", generator.hexString(8))
+	}
+	return popularDomains[generator.random.Intn(len(popularDomains))]
+}
+
+func (generator *Generator) makeTrace(currentSession *session, sequenceNumber int32, creationTimestamp int64) *passive.Trace {
+	config := generator.config
+	trace := &passive.Trace{
+		FileFormatVersion:            proto.Int32(config.FileFormatVersion),
+		BuildId:                      proto.String("UNKNOWN"),
+		NodeId:                       proto.String(currentSession.nodeId),
+		ProcessStartTimeMicroseconds: proto.Int64(currentSession.processStartTime),
+		SequenceNumber:               proto.Int32(sequenceNumber),
+		TraceCreationTimestamp:       proto.Int64(creationTimestamp),
+		AnonymizationSignature:       proto.String(currentSession.anonymizationSignature),
+		PacketSeriesDropped:          proto.Uint32(0),
+		FlowTableBaseline:            proto.Int64(creationTimestamp - traceIntervalSeconds),
+		FlowTableSize:                proto.Uint32(65536),
+		FlowTableExpired:             proto.Int32(0),
+		FlowTableDropped:             proto.Int32(0),
+		ARecordsDropped:              proto.Int32(0),
+		CnameRecordsDropped:          proto.Int32(0),
+		AddressTableFirstId:          proto.Int32(0),
+		AddressTableSize:             proto.Int32(256),
+		Whitelist:                    []string{},
+		PacketSeries:                 []*passive.PacketSeriesEntry{},
+		FlowTableEntry:               []*passive.FlowTableEntry{},
+		ARecord:                      []*passive.DnsARecord{},
+		CnameRecord:                  []*passive.DnsCnameRecord{},
+		AddressTableEntry:            []*passive.AddressTableEntry{},
+		DroppedPacketsEntry:          []*passive.DroppedPacketsEntry{},
+	}
+
+	if sequenceNumber == 0 {
+		trace.Whitelist = append(trace.Whitelist, whitelist...)
+		for _, currentDevice := range currentSession.devices {
+			trace.AddressTableEntry = append(trace.AddressTableEntry, &passive.AddressTableEntry{
+				MacAddress: proto.String(currentDevice.macAddress),
+				IpAddress:  proto.String(currentDevice.ipAddress),
+			})
+		}
+	} else {
+		trace.AddressTableFirstId = proto.Int32(int32(len(currentSession.devices)))
+	}
+
+	for _, existingFlow := range currentSession.flows {
+		existingFlow.newThisTrace = false
+	}
+	for idx := 0; idx < config.FlowsPerTrace && len(currentSession.devices) > 0; idx++ {
+		newFlow := generator.newFlow(currentSession)
+		trace.FlowTableEntry = append(trace.FlowTableEntry, &passive.FlowTableEntry{
+			FlowId:                  proto.Int32(newFlow.flowId),
+			SourceIpAnonymized:      proto.Bool(true),
+			SourceIp:                proto.String(newFlow.device.ipAddress),
+			DestinationIpAnonymized: proto.Bool(true),
+			DestinationIp:           proto.String(newFlow.remoteIp),
+			TransportProtocol:       proto.Int32(6),
+			SourcePort:              proto.Int32(int32(1024 + generator.random.Intn(64511))),
+			DestinationPort:         proto.Int32(80),
+		})
+	}
+
+	if len(currentSession.flows) > 0 {
+		timestamp := (creationTimestamp - traceIntervalSeconds) * 1000000
+		maxOffset := traceIntervalSeconds*1000000/(config.PacketsPerTrace+1) + 1
+		for idx := 0; idx < config.PacketsPerTrace; idx++ {
+			timestamp += int64(generator.random.Intn(maxOffset))
+			packetFlow := currentSession.flows[generator.random.Intn(len(currentSession.flows))]
+			trace.PacketSeries = append(trace.PacketSeries, &passive.PacketSeriesEntry{
+				TimestampMicroseconds: proto.Int64(timestamp),
+				Size:                  proto.Int32(int32(40 + generator.random.Intn(1461))),
+				FlowId:                proto.Int32(packetFlow.flowId),
+			})
+		}
+	}
+
+	// Every new flow is preceded by a DNS response for its remote address.
+	if len(trace.PacketSeries) > 0 {
+		for _, newFlow := range currentSession.flows {
+			if !newFlow.newThisTrace {
+				continue
+			}
+			packetId := int32(generator.random.Intn(len(trace.PacketSeries)))
+			ttl := int32(60 + generator.random.Intn(3540))
+			domain := generator.lookupDomain()
+			if generator.random.Float64() < config.CnameProbability {
+				cname := fmt.Sprintf("%s.cdn.example.net", generator.hexString(6))
+				trace.CnameRecord = append(trace.CnameRecord, &passive.DnsCnameRecord{
+					PacketId:         proto.Int32(packetId),
+					AddressId:        proto.Int32(newFlow.device.addressId),
+					DomainAnonymized: proto.Bool(false),
+					Domain:           proto.String(domain),
+					CnameAnonymized:  proto.Bool(false),
+					Cname:            proto.String(cname),
+					Ttl:              proto.Int32(ttl),
+				})
+				domain = cname
+			}
+			trace.ARecord = append(trace.ARecord, &passive.DnsARecord{
+				PacketId:   proto.Int32(packetId),
+				AddressId:  proto.Int32(newFlow.device.addressId),
+				Anonymized: proto.Bool(false),
+				Domain:     proto.String(domain),
+				IpAddress:  proto.String(newFlow.remoteIp),
+				Ttl:        proto.Int32(ttl),
+			})
+		}
+	}
+
+	currentSession.pcapReceived += uint32(len(trace.PacketSeries))
+	if generator.random.Intn(10) == 0 {
+		currentSession.pcapDropped++
+		trace.DroppedPacketsEntry = append(trace.DroppedPacketsEntry, &passive.DroppedPacketsEntry{
+			Size:  proto.Uint32(uint32(40 + generator.random.Intn(1461))),
+			Count: proto.Uint32(1),
+		})
+	}
+	trace.PcapReceived = proto.Uint32(currentSession.pcapReceived)
+	trace.PcapDropped = proto.Uint32(currentSession.pcapDropped)
+	trace.InterfaceDropped = proto.Uint32(0)
+	return trace
+}
+
+// Generate every trace described by the generator's Config, ordered by node,
+// session and sequence number. Each call starts again from the seed, so
+// repeated calls return identical traces.
+func (generator *Generator) Traces() []*passive.Trace {
+	config := generator.config
+	generator.random = rand.New(rand.NewSource(config.Seed))
+
+	sessionDuration := int64(config.TracesPerSession * traceIntervalSeconds)
+	traces := []*passive.Trace{}
+	for nodeIndex := 0; nodeIndex < config.Nodes; nodeIndex++ {
+		nodeId := fmt.Sprintf("OW%s", generator.hexString(12))
+		anonymizationSignature := generator.hexString(40)
+		var clockSkew int64
+		if config.MaxClockSkew > 0 {
+			maxSkewMicroseconds := config.MaxClockSkew.Nanoseconds() / 1000
+			clockSkew = generator.random.Int63n(2*maxSkewMicroseconds+1) - maxSkewMicroseconds
+		}
+		devices := make([]*device, config.DevicesPerNode)
+		for idx := range devices {
+			devices[idx] = &device{
+				macAddress: generator.hexString(12),
+				ipAddress:  generator.hexString(16),
+				addressId:  int32(idx),
+			}
+		}
+
+		sessionStart := config.StartTime.Unix()
+		for sessionIndex := 0; sessionIndex < config.SessionsPerNode; sessionIndex++ {
+			currentSession := &session{
+				nodeId:                 nodeId,
+				anonymizationSignature: anonymizationSignature,
+				processStartTime:       sessionStart*1000000 + clockSkew,
+				devices:                devices,
+				usedFlowIds:            make(map[int32]bool),
+			}
+			for sequenceNumber := 0; sequenceNumber < config.TracesPerSession; sequenceNumber++ {
+				creationTimestamp := sessionStart + int64((sequenceNumber+1)*traceIntervalSeconds) + clockSkew/1000000
+				trace := generator.makeTrace(currentSession, int32(sequenceNumber), creationTimestamp)
+				if sequenceNumber > 0 && generator.random.Float64() < config.SequenceGapProbability {
+					continue
+				}
+				traces = append(traces, trace)
+			}
+			// Leave a few minutes between sessions, as if the router rebooted.
+			sessionStart += sessionDuration + int64(60+generator.random.Intn(600))
+		}
+	}
+	return traces
+}
+
+func tarballName(nodeId string, trace *passive.Trace) string {
+	return fmt.Sprintf("%s_%d.tar.gz", nodeId, *trace.TraceCreationTimestamp)
+}
+
+func traceName(trace *passive.Trace) string {
+	return fmt.Sprintf("%s-%d-%d.gz", *trace.NodeId, *trace.ProcessStartTimeMicroseconds, *trace.SequenceNumber)
+}
+
+func writeTarball(tarballPath string, traces []*passive.Trace, fileFormatVersion int32) error {
+	if err := os.MkdirAll(filepath.Dir(tarballPath), 0755); err != nil {
+		return err
+	}
+	handle, err := os.Create(tarballPath)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	zipWriter := gzip.NewWriter(handle)
+	tarWriter := tar.NewWriter(zipWriter)
+	for _, trace := range traces {
+		contents, err := passive.FormatTrace(trace, fileFormatVersion)
+		if err != nil {
+			return err
+		}
+		var compressed bytes.Buffer
+		traceWriter := gzip.NewWriter(&compressed)
+		if _, err := traceWriter.Write(contents); err != nil {
+			return err
+		}
+		if err := traceWriter.Close(); err != nil {
+			return err
+		}
+		header := &tar.Header{
+			Name:     traceName(trace),
+			Mode:     0644,
+			Size:     int64(compressed.Len()),
+			ModTime:  time.Unix(*trace.TraceCreationTimestamp, 0),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tarWriter.Write(compressed.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	return zipWriter.Close()
+}
+
+// Write the generated traces into tarballs under root, laid out as
+// root/<node id>/<date>/<node id>_<timestamp>.tar.gz so
+// IndexTarballsPipeline can index them. Returns the paths of the tarballs
+// in the order they were written.
+func (generator *Generator) WriteTarballs(root string) ([]string, error) {
+	traces := generator.Traces()
+	tarballPaths := []string{}
+	var pending []*passive.Trace
+	var pendingPath string
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		if err := writeTarball(pendingPath, pending, generator.config.FileFormatVersion); err != nil {
+			return err
+		}
+		tarballPaths = append(tarballPaths, pendingPath)
+		pending = nil
+		return nil
+	}
+	for _, trace := range traces {
+		date := time.Unix(*trace.TraceCreationTimestamp, 0).UTC().Format("2006-01-02")
+		directory := filepath.Join(root, *trace.NodeId, date)
+		if len(pending) >= generator.config.TracesPerTarball || filepath.Dir(pendingPath) != directory {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			pendingPath = filepath.Join(directory, tarballName(*trace.NodeId, trace))
+		}
+		pending = append(pending, trace)
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return tarballPaths, nil
+}
@@ -0,0 +1,144 @@
+package generator
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/sburnett/bismark-passive-server-go/passive"
+)
+
+func TestTraces_Deterministic(t *testing.T) {
+	first := New(DefaultConfig()).Traces()
+	second := New(DefaultConfig()).Traces()
+	if len(first) != len(second) {
+		t.Fatalf("Generated %d traces and then %d traces", len(first), len(second))
+	}
+	for idx := range first {
+		if !proto.Equal(first[idx], second[idx]) {
+			t.Fatalf("Trace %d differs:\nFirst:  %s\nSecond: %s", idx, first[idx], second[idx])
+		}
+	}
+
+	generator := New(DefaultConfig())
+	again := generator.Traces()
+	if !proto.Equal(generator.Traces()[0], again[0]) {
+		t.Fatalf("Calling Traces twice on the same generator should return identical traces")
+	}
+}
+
+func TestTraces_Seed(t *testing.T) {
+	config := DefaultConfig()
+	first := New(config).Traces()
+	config.Seed++
+	second := New(config).Traces()
+	if proto.Equal(first[0], second[0]) {
+		t.Fatalf("Different seeds should generate different traces")
+	}
+}
+
+func TestTraces_SequenceGaps(t *testing.T) {
+	config := DefaultConfig()
+	config.SequenceGapProbability = 0
+	traces := New(config).Traces()
+	expected := config.Nodes * config.SessionsPerNode * config.TracesPerSession
+	if len(traces) != expected {
+		t.Fatalf("Expected %d traces without gaps. Got %d", expected, len(traces))
+	}
+
+	config.SequenceGapProbability = 0.5
+	traces = New(config).Traces()
+	if len(traces) >= expected {
+		t.Fatalf("Expected fewer than %d traces with gaps. Got %d", expected, len(traces))
+	}
+	for _, trace := range traces {
+		if trace.GetSequenceNumber() == 0 {
+			continue
+		}
+		if len(trace.Whitelist) > 0 {
+			t.Fatalf("Only the first trace in a session should have a whitelist")
+		}
+	}
+}
+
+func TestTraces_Consistent(t *testing.T) {
+	for _, trace := range New(DefaultConfig()).Traces() {
+		for _, record := range trace.ARecord {
+			if record.GetPacketId() < 0 || int(record.GetPacketId()) >= len(trace.PacketSeries) {
+				t.Fatalf("A record refers to missing packet %d", record.GetPacketId())
+			}
+		}
+		for _, record := range trace.CnameRecord {
+			if record.GetPacketId() < 0 || int(record.GetPacketId()) >= len(trace.PacketSeries) {
+				t.Fatalf("CNAME record refers to missing packet %d", record.GetPacketId())
+			}
+		}
+		for idx := 1; idx < len(trace.PacketSeries); idx++ {
+			if trace.PacketSeries[idx].GetTimestampMicroseconds() < trace.PacketSeries[idx-1].GetTimestampMicroseconds() {
+				t.Fatalf("Packet timestamps must not decrease")
+			}
+		}
+		if _, err := passive.FormatTrace(trace, passive.MaxFileFormatVersion); err != nil {
+			t.Fatalf("Generated trace failed to format: %s", err)
+		}
+	}
+}
+
+func TestWriteTarballs(t *testing.T) {
+	root, err := ioutil.TempDir("", "generator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	generator := New(DefaultConfig())
+	tarballPaths, err := generator.WriteTarballs(root)
+	if err != nil {
+		t.Fatalf("Failed to write tarballs: %s", err)
+	}
+	globbedPaths, err := filepath.Glob(filepath.Join(root, "*", "*", "*.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(globbedPaths) != len(tarballPaths) {
+		t.Fatalf("Wrote %d tarballs but found %d", len(tarballPaths), len(globbedPaths))
+	}
+
+	traceCount := 0
+	for _, tarballPath := range tarballPaths {
+		handle, err := os.Open(tarballPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unzippedHandle, err := gzip.NewReader(handle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(unzippedHandle)
+		for {
+			_, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			traceHandle, err := gzip.NewReader(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ioutil.ReadAll(traceHandle); err != nil {
+				t.Fatal(err)
+			}
+			traceCount++
+		}
+		handle.Close()
+	}
+	if expected := len(generator.Traces()); traceCount != expected {
+		t.Fatalf("Expected %d traces in tarballs. Found %d", expected, traceCount)
+	}
+}
@@ -0,0 +1,391 @@
+package passive
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sburnett/lexicographic-tuples"
+	"github.com/sburnett/transformer"
+	"github.com/sburnett/transformer/store"
+)
+
+// The number of records one stage of a recorded run read and wrote.
+type stageCounts struct {
+	Name           string
+	RecordsRead    int64
+	RecordsWritten int64
+	Error          error
+}
+
+// RunPipelines runs pipelines in parallel, and they all record their runs in
+// the same stores, so we take turns writing them. We also hold the lock while
+// the scheduler writes run-completions.
+var runsMutex sync.Mutex
+
+// Holds runsMutex from BeginWriting until EndWriting.
+type runsWriter struct {
+	store.Writer
+}
+
+func (writer runsWriter) BeginWriting() error {
+	runsMutex.Lock()
+	if err := writer.Writer.BeginWriting(); err != nil {
+		runsMutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (writer runsWriter) EndWriting() error {
+	defer runsMutex.Unlock()
+	return writer.Writer.EndWriting()
+}
+
+// Collects what happened during one run of a pipeline, so we can write it to
+// the runs stores.
+type runRecorder struct {
+	pipeline string
+	build    string
+	clock    func() time.Time
+	// Writes to runs, runs-stages and runs-trace-key-ranges.
+	writer store.Writer
+
+	// In microseconds since the epoch.
+	startTime int64
+	stages    []*stageCounts
+	// The trace key ranges the run's CalculateTraceKeyRanges stages wrote, keyed
+	// by the first trace key of each range.
+	consumedRanges []*store.Record
+	// A stage's reader and writer can fail at the same time.
+	failMutex sync.Mutex
+}
+
+// Record the run of a pipeline in the runs stores: when it started and
+// finished, which build of the server ran it, how many records each stage
+// read and wrote, and the first error it encountered. We also record the trace
+// key ranges that the pipeline consumed, for pipelines that track the traces
+// they've processed using TraceKeyRangesPipeline. name identifies the pipeline
+// in HistoryPipeline's output.
+//
+// We record the run when it starts and again when it finishes or a stage
+// fails, so runs that crash appear as incomplete.
+func RecordRunPipeline(levelDbManager store.Manager, name, build string, pipeline transformer.Pipeline) transformer.Pipeline {
+	return recordRunPipeline(levelDbManager, name, build, pipeline, time.Now)
+}
+
+func recordRunPipeline(levelDbManager store.Manager, name, build string, pipeline transformer.Pipeline, clock func() time.Time) transformer.Pipeline {
+	recorder := &runRecorder{
+		pipeline: name,
+		build:    build,
+		clock:    clock,
+		writer: runsWriter{store.NewMuxingWriter(
+			levelDbManager.Writer("runs"),
+			levelDbManager.Writer("runs-stages"),
+			levelDbManager.Writer("runs-trace-key-ranges"))},
+	}
+	stages := []transformer.PipelineStage{
+		transformer.PipelineStage{
+			Name:   "BeginRun",
+			Reader: &runRecordsReader{recorder: recorder, begin: true},
+			Writer: recorder.writer,
+		},
+	}
+	for _, stage := range pipeline {
+		counts := &stageCounts{Name: stage.Name}
+		recorder.stages = append(recorder.stages, counts)
+		if stage.Reader != nil {
+			stage.Reader = &countingReader{Reader: stage.Reader, recorder: recorder, counts: counts}
+		}
+		if stage.Writer != nil {
+			stage.Writer = &countingWriter{
+				Writer:         stage.Writer,
+				recorder:       recorder,
+				counts:         counts,
+				consumesRanges: stage.Name == "CalculateTraceKeyRanges",
+			}
+		}
+		stages = append(stages, stage)
+	}
+	return append(stages, transformer.PipelineStage{
+		Name:   "EndRun",
+		Reader: &runRecordsReader{recorder: recorder},
+		Writer: recorder.writer,
+	})
+}
+
+func (recorder *runRecorder) runKey() []byte {
+	return lex.EncodeOrDie(recorder.startTime, recorder.pipeline)
+}
+
+// The records describing the run so far. If the run hasn't finished, it
+// doesn't have an end time.
+func (recorder *runRecorder) records(finished bool) []*store.Record {
+	var endTime int64
+	if finished {
+		endTime = recorder.clock().UnixNano() / int64(time.Microsecond)
+	}
+	var runError string
+	for _, counts := range recorder.stages {
+		if counts.Error != nil {
+			runError = fmt.Sprintf("%s: %v", counts.Name, counts.Error)
+			break
+		}
+	}
+	records := []*store.Record{
+		&store.Record{
+			Key:           recorder.runKey(),
+			Value:         lex.EncodeOrDie(endTime, recorder.build, runError),
+			DatabaseIndex: 0,
+		},
+	}
+	if !finished {
+		return records
+	}
+	for idx, counts := range recorder.stages {
+		var stageError string
+		if counts.Error != nil {
+			stageError = counts.Error.Error()
+		}
+		records = append(records, &store.Record{
+			Key:           lex.Concatenate(recorder.runKey(), lex.EncodeOrDie(int32(idx))),
+			Value:         lex.EncodeOrDie(counts.Name, counts.RecordsRead, counts.RecordsWritten, stageError),
+			DatabaseIndex: 1,
+		})
+	}
+	for _, consumedRange := range recorder.consumedRanges {
+		records = append(records, &store.Record{
+			Key:           lex.Concatenate(recorder.runKey(), consumedRange.Key),
+			Value:         consumedRange.Value,
+			DatabaseIndex: 2,
+		})
+	}
+	return records
+}
+
+// Record that a stage failed. The pipeline won't run any more stages,
+// including EndRun, so we record the run immediately.
+func (recorder *runRecorder) fail(counts *stageCounts, err error) error {
+	recorder.failMutex.Lock()
+	defer recorder.failMutex.Unlock()
+	if counts.Error != nil {
+		return err
+	}
+	counts.Error = err
+	if beginErr := recorder.writer.BeginWriting(); beginErr != nil {
+		return err
+	}
+	for _, record := range recorder.records(true) {
+		if writeErr := recorder.writer.WriteRecord(record); writeErr != nil {
+			break
+		}
+	}
+	recorder.writer.EndWriting()
+	return err
+}
+
+// Reads the records describing a run, either when it begins or when it ends.
+type runRecordsReader struct {
+	recorder *runRecorder
+	begin    bool
+	records  []*store.Record
+}
+
+func (reader *runRecordsReader) BeginReading() error {
+	if reader.begin {
+		reader.recorder.startTime = reader.recorder.clock().UnixNano() / int64(time.Microsecond)
+	}
+	reader.records = reader.recorder.records(!reader.begin)
+	return nil
+}
+
+func (reader *runRecordsReader) ReadRecord() (*store.Record, error) {
+	if len(reader.records) == 0 {
+		return nil, nil
+	}
+	record := reader.records[0]
+	reader.records = reader.records[1:]
+	return record, nil
+}
+
+func (reader *runRecordsReader) EndReading() error {
+	return nil
+}
+
+// Counts the records a stage reads and records errors.
+type countingReader struct {
+	store.Reader
+	recorder *runRecorder
+	counts   *stageCounts
+}
+
+func (reader *countingReader) BeginReading() error {
+	if err := reader.Reader.BeginReading(); err != nil {
+		return reader.recorder.fail(reader.counts, err)
+	}
+	return nil
+}
+
+func (reader *countingReader) ReadRecord() (*store.Record, error) {
+	record, err := reader.Reader.ReadRecord()
+	if err != nil {
+		return nil, reader.recorder.fail(reader.counts, err)
+	}
+	if record != nil {
+		reader.counts.RecordsRead++
+	}
+	return record, nil
+}
+
+func (reader *countingReader) EndReading() error {
+	if err := reader.Reader.EndReading(); err != nil {
+		return reader.recorder.fail(reader.counts, err)
+	}
+	return nil
+}
+
+// Counts the records a stage writes and records errors. If the stage
+// calculates which trace key ranges the pipeline is about to process, we also
+// remember those ranges.
+type countingWriter struct {
+	store.Writer
+	recorder       *runRecorder
+	counts         *stageCounts
+	consumesRanges bool
+}
+
+func (writer *countingWriter) BeginWriting() error {
+	if err := writer.Writer.BeginWriting(); err != nil {
+		return writer.recorder.fail(writer.counts, err)
+	}
+	return nil
+}
+
+func (writer *countingWriter) WriteRecord(record *store.Record) error {
+	if err := writer.Writer.WriteRecord(record); err != nil {
+		return writer.recorder.fail(writer.counts, err)
+	}
+	writer.counts.RecordsWritten++
+	if writer.consumesRanges {
+		writer.recorder.consumedRanges = append(writer.recorder.consumedRanges, &store.Record{
+			Key:   record.Key,
+			Value: record.Value,
+		})
+	}
+	return nil
+}
+
+func (writer *countingWriter) EndWriting() error {
+	if err := writer.Writer.EndWriting(); err != nil {
+		return writer.recorder.fail(writer.counts, err)
+	}
+	return nil
+}
+
+// Print the runs recorded by RecordRunPipeline in the order they started. If
+// pipelineName isn't empty, we only print runs of that pipeline. If
+// showRanges is true, we also print the trace key ranges each run consumed.
+func HistoryPipeline(levelDbManager store.Manager, pipelineName string, showRanges bool, writer io.Writer) transformer.Pipeline {
+	readers := []store.Reader{
+		levelDbManager.Reader("runs"),
+		levelDbManager.Reader("runs-stages"),
+	}
+	if showRanges {
+		readers = append(readers, levelDbManager.Reader("runs-trace-key-ranges"))
+	}
+	return []transformer.PipelineStage{
+		transformer.PipelineStage{
+			Name:        "FormatRunHistory",
+			Reader:      store.NewDemuxingReader(readers...),
+			Transformer: formatRunHistory{PipelineName: pipelineName},
+			Writer:      &runHistoryTextStore{writer: writer},
+		},
+	}
+}
+
+type formatRunHistory struct {
+	PipelineName string
+}
+
+func formatMicroseconds(timestamp int64) string {
+	return time.Unix(0, timestamp*int64(time.Microsecond)).UTC().Format(time.RFC3339)
+}
+
+// Format each run as a block of tab separated lines. The first line describes
+// the run, and the following lines describe its stages and the trace key
+// ranges it consumed.
+func (parameters formatRunHistory) Do(inputChan, outputChan chan *store.Record) {
+	var startTime int64
+	var pipeline string
+	grouper := transformer.GroupRecords(inputChan, &startTime, &pipeline)
+	for grouper.NextGroup() {
+		// Stage and range keys can interleave, so we sort lines by kind.
+		var runLines, stageLines, rangeLines []string
+		for grouper.NextRecord() {
+			record := grouper.Read()
+			if parameters.PipelineName != "" && pipeline != parameters.PipelineName {
+				continue
+			}
+			switch record.DatabaseIndex {
+			case 0:
+				var endTime int64
+				var build, runError string
+				lex.DecodeOrDie(record.Value, &endTime, &build, &runError)
+				end, status := "-", "incomplete"
+				if endTime > 0 {
+					end = formatMicroseconds(endTime)
+					status = fmt.Sprintf("ok in %s", time.Duration(endTime-startTime)*time.Microsecond)
+				}
+				if runError != "" {
+					status = fmt.Sprintf("failed: %s", runError)
+				}
+				runLines = append(runLines, fmt.Sprintf("run\t%s\t%s\t%s\t%s\t%s", pipeline, formatMicroseconds(startTime), end, build, status))
+			case 1:
+				var stage int32
+				var name, stageError string
+				var recordsRead, recordsWritten int64
+				lex.DecodeOrDie(record.Key, &stage)
+				lex.DecodeOrDie(record.Value, &name, &recordsRead, &recordsWritten, &stageError)
+				line := fmt.Sprintf("stage\t%d\t%s\t%d\t%d", stage, name, recordsRead, recordsWritten)
+				if stageError != "" {
+					line += "\t" + stageError
+				}
+				stageLines = append(stageLines, line)
+			case 2:
+				var firstKey, lastKey TraceKey
+				lex.DecodeOrDie(record.Key, &firstKey)
+				lex.DecodeOrDie(record.Value, &lastKey)
+				rangeLines = append(rangeLines, fmt.Sprintf("consumed\t%s\t%s\t%d\t%d\t%d", firstKey.NodeId, firstKey.AnonymizationContext, firstKey.SessionId, firstKey.SequenceNumber, lastKey.SequenceNumber))
+			}
+		}
+		if len(runLines) == 0 {
+			continue
+		}
+		lines := append(append(runLines, stageLines...), rangeLines...)
+		outputChan <- &store.Record{
+			Key:   lex.EncodeOrDie(startTime, pipeline),
+			Value: []byte(strings.Join(lines, "\n") + "\n"),
+		}
+	}
+}
+
+type runHistoryTextStore struct {
+	writer io.Writer
+}
+
+func (store *runHistoryTextStore) BeginWriting() error {
+	return nil
+}
+
+func (store *runHistoryTextStore) WriteRecord(record *store.Record) error {
+	if _, err := store.writer.Write(record.Value); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (store *runHistoryTextStore) EndWriting() error {
+	return nil
+}
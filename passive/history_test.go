@@ -0,0 +1,50 @@
+package passive
+
+import (
+	"os"
+	"time"
+
+	"github.com/sburnett/transformer"
+	"github.com/sburnett/transformer/store"
+)
+
+func ExampleHistoryPipeline() {
+	levelDbManager := store.NewSliceManager()
+	currentTime := time.Unix(1000, 0)
+	clock := func() time.Time {
+		now := currentTime
+		currentTime = currentTime.Add(time.Second)
+		return now
+	}
+	tracesStore := levelDbManager.Seeker("traces")
+	traceKeyRangesStore := levelDbManager.ReadingDeleter("ranges")
+	consolidatedTraceKeyRangesStore := levelDbManager.ReadingDeleter("ranges-consolidated")
+	runPipeline := func() {
+		pipeline := TraceKeyRangesPipeline(store.NewRangeExcludingReader(tracesStore, traceKeyRangesStore), traceKeyRangesStore, consolidatedTraceKeyRangesStore)
+		transformer.RunPipeline(recordRunPipeline(levelDbManager, "ranges", "build", pipeline, clock))
+	}
+
+	writeTraces(levelDbManager,
+		makeValidTraceContents("NODE", 0),
+		makeValidTraceContents("NODE", 1),
+		makeValidTraceContents("NODE2", 0))
+	runPipeline()
+	writeTraces(levelDbManager, makeValidTraceContents("NODE", 2))
+	runPipeline()
+
+	transformer.RunPipeline(HistoryPipeline(levelDbManager, "", true, os.Stdout))
+	transformer.RunPipeline(HistoryPipeline(levelDbManager, "other", false, os.Stdout))
+
+	// Output:
+	// run	ranges	1970-01-01T00:16:40Z	1970-01-01T00:16:41Z	build	ok in 1s
+	// stage	0	CalculateTraceKeyRanges	3	2
+	// stage	1	ConsolidateTraceKeyRanges	2	2
+	// stage	2	CopyTraceKeyRanges	2	2
+	// consumed	NODE		10	0	1
+	// consumed	NODE2		10	0	0
+	// run	ranges	1970-01-01T00:16:42Z	1970-01-01T00:16:43Z	build	ok in 1s
+	// stage	0	CalculateTraceKeyRanges	1	1
+	// stage	1	ConsolidateTraceKeyRanges	3	2
+	// stage	2	CopyTraceKeyRanges	2	2
+	// consumed	NODE		10	2	2
+}
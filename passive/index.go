@@ -1,8 +1,9 @@
 package passive
 
 import (
-	"archive/tar"
 	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
 	"expvar"
 	"fmt"
 	"io"
@@ -10,6 +11,8 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"code.google.com/p/goprotobuf/proto"
 	"github.com/sburnett/lexicographic-tuples"
@@ -18,36 +21,221 @@ import (
 )
 
 var currentTar *expvar.String
-var tarBytesRead, tarsFailed, tarsIndexed, tarsSkipped, tracesFailed, tracesIndexed *expvar.Int
+var archiveBytesRead, archivesIndexed, traceParseErrors *expvar.Map
+var tarBytesRead, tarsFailed, tarsIndexed, tarsReindexed, tarsSkipped, tracesFailed, tracesIndexed, tracesSalvaged *expvar.Int
 
 func init() {
 	currentTar = expvar.NewString("CurrentTar")
+	archiveBytesRead = expvar.NewMap("ArchiveBytesRead")
+	archivesIndexed = expvar.NewMap("ArchivesIndexed")
+	traceParseErrors = expvar.NewMap("TraceParseErrors")
 	tarBytesRead = expvar.NewInt("TarBytesRead")
 	tarsFailed = expvar.NewInt("TarsFailed")
 	tarsIndexed = expvar.NewInt("TarsIndexed")
+	tarsReindexed = expvar.NewInt("TarsReindexed")
 	tarsSkipped = expvar.NewInt("TarsSkipped")
 	tracesFailed = expvar.NewInt("TracesFailed")
 	tracesIndexed = expvar.NewInt("TracesIndexed")
+	tracesSalvaged = expvar.NewInt("TracesSalvaged")
 }
 
-func IndexTarballsPipeline(tarballsPath string, levelDbManager store.Manager) transformer.Pipeline {
-	tarballsPattern := filepath.Join(tarballsPath, "*", "*", "*.tar.gz")
-	tarnamesStore := levelDbManager.ReadingWriter("tarnames")
+// Index traces from every tarball in tarballsPath that we haven't indexed yet
+// or that changed since we indexed it, and write a report of the tarballs we
+// indexed again to reportWriter. When lenient is true, we salvage what we can
+// from damaged traces instead of rejecting them; see parseTraceLeniently.
+//
+// tarballsPatterns are glob patterns relative to tarballsPath. Despite the
+// name, they can match any archive format listed in archiveFormats, as well
+// as bare gzipped traces.
+//
+// We remember the size, modification time and SHA-1 hash of every tarball we
+// index, and which traces came from it. If a tarball's size or modification
+// time changes then we hash it again and index it again if its contents
+// changed. Traces keep their keys when we index them again, so the new copies
+// replace the old ones in traces, and we remove the traces that the new copy
+// of the tarball no longer contains. We don't know which traces came from
+// tarballs we indexed before we recorded tarnames-traces, so we never remove
+// those.
+//
+// If we fail to index a tarball, e.g., because it's corrupt, we record its
+// size and modification time in tarnames-failed and don't try it again until
+// they change, e.g., because the router uploaded it again.
+//
+// Pipelines that record which traces they've processed wouldn't process the
+// new copies, and would keep what they derived from the old ones. So whenever
+// we index a tarball again, we empty those pipelines' intermediate and
+// bookkeeping stores, like GarbageCollectPipeline does when it rebuilds them,
+// and they process every trace again on their next run.
+//
+// Newly indexed traces go through DuplicateTracesPipeline before they reach
+// the traces store.
+func IndexTarballsPipeline(tarballsPath string, tarballsPatterns []string, lenient bool, levelDbManager store.Manager, reportWriter io.Writer) transformer.Pipeline {
+	var globReaders []store.Reader
+	for _, tarballsPattern := range tarballsPatterns {
+		globReaders = append(globReaders, store.NewGlobReader(filepath.Join(tarballsPath, tarballsPattern)))
+	}
+	tarnamesStore := levelDbManager.ReadingDeleter("tarnames")
 	tarnamesIndexedStore := levelDbManager.ReadingWriter("tarnames-indexed")
-	tracesStore := levelDbManager.Writer("traces")
-	return []transformer.PipelineStage{
+	tarnamesReindexedStore := levelDbManager.ReadingDeleter("tarnames-reindexed")
+	tarnamesTracesStore := levelDbManager.SeekingWriter("tarnames-traces")
+	tarnamesFailedStore := levelDbManager.ReadingWriter("tarnames-failed")
+	tracesNewStore := levelDbManager.Writer("traces-new")
+	tracesFailedStore := levelDbManager.Writer("traces-failed")
+	tracesSourcesStore := levelDbManager.Seeker("traces-sources")
+	tracesStaleCandidatesStore := levelDbManager.ReadingDeleter("traces-stale-candidates")
+	tracesStaleStore := levelDbManager.ReadingDeleter("traces-stale")
+	tracesStaleKeptStore := levelDbManager.ReadingDeleter("traces-stale-kept")
+	indexTarballs := IndexTarballs
+	if lenient {
+		indexTarballs = IndexTarballsLeniently
+	}
+	stages := []transformer.PipelineStage{
 		transformer.PipelineStage{
-			Name:   "ScanTraceTarballs",
-			Reader: store.NewGlobReader(tarballsPattern),
-			Writer: tarnamesStore,
+			Name:        "ScanTraceTarballs",
+			Reader:      store.NewDemuxingReader(globReaders...),
+			Transformer: transformer.MakeDoFunc(statTarball),
+			Writer:      store.NewTruncatingWriter(tarnamesStore),
 		},
 		transformer.PipelineStage{
 			Name:        "IndexTraces",
-			Transformer: transformer.MakeMultipleOutputsGroupDoFunc(IndexTarballs, 2),
-			Reader:      store.NewDemuxingReader(tarnamesStore, tarnamesIndexedStore),
-			Writer:      store.NewMuxingWriter(tracesStore, tarnamesIndexedStore),
+			Transformer: transformer.MakeMultipleOutputsGroupDoFunc(indexTarballs, 6),
+			Reader:      store.NewDemuxingReader(tarnamesStore, tarnamesIndexedStore, tarnamesFailedStore),
+			Writer:      store.NewMuxingWriter(tracesNewStore, tarnamesIndexedStore, tracesFailedStore, store.NewTruncatingWriter(tarnamesReindexedStore), tarnamesTracesStore, tarnamesFailedStore),
+		},
+		transformer.PipelineStage{
+			Name:        "FindStaleTraceCandidates",
+			Reader:      store.NewDemuxingReader(tarnamesReindexedStore, store.NewPrefixIncludingReader(tarnamesTracesStore, tarnamesReindexedStore)),
+			Transformer: transformer.TransformFunc(findStaleTraceCandidates),
+			Writer:      store.NewTruncatingWriter(tracesStaleCandidatesStore),
+		},
+		transformer.PipelineStage{
+			Name:        "FindStaleTraces",
+			Reader:      store.NewDemuxingReader(store.NewPrefixIncludingReader(tracesSourcesStore, tracesStaleCandidatesStore), tracesStaleCandidatesStore),
+			Transformer: transformer.TransformFunc(findStaleTraces),
+			Writer:      store.NewTruncatingWriter(tracesStaleStore),
 		},
 	}
+	// Remove stale traces before we look for duplicates, so a copy of a stale
+	// trace from another tarball takes its place.
+	for _, name := range []string{"traces", "traces-sources"} {
+		removedStore := &removedRecordsStore{writer: reportWriter, schema: LookupStoreSchema(name), action: "removed", logKeys: true}
+		stages = append(stages, removeStaleTracesPipeline(levelDbManager.ReadingDeleter(name), tracesStaleKeptStore, tracesStaleStore, removedStore)...)
+	}
+	stages = append(stages, DuplicateTracesPipeline(levelDbManager)...)
+	stages = append(stages, resetTraceRangesPipelinesStages(levelDbManager, tarnamesReindexedStore)...)
+	return append(stages, transformer.PipelineStage{
+		Name:   "ReportReindexedTarballs",
+		Reader: tarnamesReindexedStore,
+		Writer: &reindexedTarballsTextStore{writer: reportWriter},
+	})
+}
+
+// For each tarball we indexed again, find the traces that came from the
+// previous copy of the tarball but not the new one, which tarnames-traces
+// records with the previous copy's hash.
+func findStaleTraceCandidates(inputChan, outputChan chan *store.Record) {
+	var tarPath string
+	grouper := transformer.GroupRecords(inputChan, &tarPath)
+	for grouper.NextGroup() {
+		var current tarballInfo
+		var traceRecords []*store.Record
+		for grouper.NextRecord() {
+			record := grouper.Read()
+			switch record.DatabaseIndex {
+			case 0:
+				var previous tarballInfo
+				lex.DecodeOrDie(record.Value, &previous.Size, &previous.ModificationTime, &previous.Hash, &current.Size, &current.ModificationTime, &current.Hash)
+			case 1:
+				traceRecords = append(traceRecords, record)
+			}
+		}
+		if current.Hash == "" {
+			continue
+		}
+		for _, record := range traceRecords {
+			var hash string
+			lex.DecodeOrDie(record.Value, &hash)
+			if hash == current.Hash {
+				continue
+			}
+			var recordTarPath string
+			var traceKey TraceKey
+			lex.DecodeOrDie(record.Key, &recordTarPath, &traceKey)
+			outputChan <- &store.Record{
+				Key:   lex.EncodeOrDie(&traceKey),
+				Value: lex.EncodeOrDie(tarPath),
+			}
+		}
+	}
+}
+
+// A candidate is stale if we kept the copy of the trace from that tarball. If
+// we kept a copy from another tarball, the trace isn't stale. We don't keep
+// duplicate copies, so if another tarball also contains a stale trace, the
+// trace is gone until we index that tarball again.
+func findStaleTraces(inputChan, outputChan chan *store.Record) {
+	var traceKey TraceKey
+	grouper := transformer.GroupRecords(inputChan, &traceKey)
+	for grouper.NextGroup() {
+		var keptTarPath, keptMemberName string
+		var candidateTarPaths []string
+		for grouper.NextRecord() {
+			record := grouper.Read()
+			switch record.DatabaseIndex {
+			case 0:
+				lex.DecodeOrDie(record.Value, &keptTarPath, &keptMemberName)
+			case 1:
+				var tarPath string
+				lex.DecodeOrDie(record.Value, &tarPath)
+				candidateTarPaths = append(candidateTarPaths, tarPath)
+			}
+		}
+		for _, tarPath := range candidateTarPaths {
+			if tarPath == keptTarPath {
+				outputChan <- &store.Record{
+					Key: lex.EncodeOrDie(&traceKey),
+				}
+				break
+			}
+		}
+	}
+}
+
+// What we know about a tarball, which tells us whether it changed since we
+// indexed it. ModificationTime is in nanoseconds since epoch and Hash is the
+// hex encoded SHA-1 hash of the tarball.
+type tarballInfo struct {
+	Size             int64
+	ModificationTime int64
+	Hash             string
+}
+
+func statTarball(record *store.Record, outputChan chan *store.Record) {
+	var tarPath string
+	lex.DecodeOrDie(record.Key, &tarPath)
+	fileinfo, err := os.Stat(tarPath)
+	if err != nil {
+		log.Printf("Error stating %s: %s\n", tarPath, err)
+		tarsFailed.Add(int64(1))
+		return
+	}
+	outputChan <- &store.Record{
+		Key:   record.Key,
+		Value: lex.EncodeOrDie(fileinfo.Size(), fileinfo.ModTime().UnixNano()),
+	}
+}
+
+func hashTarball(tarPath string) (string, error) {
+	handle, err := os.Open(tarPath)
+	if err != nil {
+		return "", err
+	}
+	defer handle.Close()
+	hasher := sha1.New()
+	if _, err := io.Copy(hasher, handle); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
 func traceKey(trace *Trace) []byte {
@@ -62,8 +250,16 @@ func traceKey(trace *Trace) []byte {
 		*trace.SequenceNumber)
 }
 
-func indexTarball(tarPath string, tracesChan chan *store.Record) bool {
+// Index the traces in a tarball whose hash is hash, and record that they came
+// from it in tarnames-traces.
+func indexTarball(tarPath, hash string, parse func([]byte) (*Trace, error), tracesChan, failedChan, tarnamesTracesChan chan *store.Record) bool {
 	currentTar.Set(tarPath)
+	format := archiveFormat(tarPath)
+	if format == "" {
+		log.Printf("Unknown archive format for %s\n", tarPath)
+		tarsFailed.Add(int64(1))
+		return false
+	}
 	handle, err := os.Open(tarPath)
 	if err != nil {
 		log.Printf("Error reading %s: %s\n", tarPath, err)
@@ -78,57 +274,66 @@ func indexTarball(tarPath string, tracesChan chan *store.Record) bool {
 		return false
 	}
 	tarBytesRead.Add(fileinfo.Size())
-	unzippedHandle, err := gzip.NewReader(handle)
+	archiveBytesRead.Add(format, fileinfo.Size())
+	archive, err := openArchive(format, handle, fileinfo.Size())
 	if err != nil {
-		log.Printf("Error unzipping tarball %s: %s\n", tarPath, err)
+		log.Printf("Error opening %s archive %s: %s\n", format, tarPath, err)
 		tarsFailed.Add(int64(1))
 		return false
 	}
-	tr := tar.NewReader(unzippedHandle)
+	// If we can't read the whole archive, we don't record that we indexed
+	// it, so we'll index it again next time.
+	failed := false
 	for {
-		header, err := tr.Next()
+		memberName, memberContents, err := archive.Next()
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			tarsFailed.Add(1)
 			log.Printf("Error indexing %v: %v", tarPath, err)
+			failed = true
 			break
 		}
-		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
-			continue
-		}
 		var traceContents []byte
-		if filepath.Ext(header.Name) == ".gz" {
-			gzipHandle, err := gzip.NewReader(tr)
+		if filepath.Ext(memberName) == ".gz" {
+			gzipHandle, err := gzip.NewReader(memberContents)
 			if err != nil {
 				tracesFailed.Add(1)
-				log.Printf("Error gunzipping trace %s/%s: %v", tarPath, header.Name, err)
+				log.Printf("Error gunzipping trace %s/%s: %v", tarPath, memberName, err)
 				continue
 			}
 			contents, err := ioutil.ReadAll(gzipHandle)
 			if err != nil {
 				tracesFailed.Add(1)
-				log.Printf("%s/%s: %v", tarPath, header.Name, err)
+				log.Printf("%s/%s: %v", tarPath, memberName, err)
 				continue
 			}
 			gzipHandle.Close()
 			traceContents = contents
 		} else {
-			contents, err := ioutil.ReadAll(tr)
+			contents, err := ioutil.ReadAll(memberContents)
 			if err != nil {
 				tracesFailed.Add(1)
-				log.Printf("%s/%s: %v", tarPath, header.Name, err)
+				log.Printf("%s/%s: %v", tarPath, memberName, err)
 				continue
 			}
 			traceContents = contents
 		}
-		trace, err := parseTrace(traceContents)
+		trace, err := parse(traceContents)
 		if err != nil {
 			tracesFailed.Add(1)
-			log.Printf("%s:%s: %q", tarPath, header.Name, err)
+			log.Printf("%s:%s: %q", tarPath, memberName, err)
+			if parseError, ok := err.(*TraceParseError); ok {
+				traceParseErrors.Add(fmt.Sprintf("%d/%s/%s", parseError.FileFormatVersion, parseError.Section, parseError.Code), 1)
+				failedChan <- encodeFailedTrace(newFailedTrace(tarPath, memberName, traceContents, parseError))
+			}
 			continue
 		}
-		key := traceKey(trace)
+		if len(trace.SectionDamage) > 0 {
+			tracesSalvaged.Add(1)
+		}
+		// Remember where the trace came from, so we can tell duplicate
+		// traces apart from traces we indexed again.
+		key := append(traceKey(trace), lex.EncodeOrDie(tarPath, memberName)...)
 		value, err := proto.Marshal(trace)
 		if err != nil {
 			panic(fmt.Errorf("Error encoding protocol buffer: %v", err))
@@ -137,29 +342,230 @@ func indexTarball(tarPath string, tracesChan chan *store.Record) bool {
 			Key:   key,
 			Value: value,
 		}
+		tarnamesTracesChan <- &store.Record{
+			Key:   append(lex.EncodeOrDie(tarPath), traceKey(trace)...),
+			Value: lex.EncodeOrDie(hash),
+		}
 		tracesIndexed.Add(int64(1))
 	}
+	// Closing an xz archive reports whether the xz command succeeded, e.g.,
+	// whether the archive was truncated or corrupt.
+	if err := archive.Close(); err != nil {
+		log.Printf("Error closing %s archive %s: %v", format, tarPath, err)
+		failed = true
+	}
+	if failed {
+		tarsFailed.Add(1)
+		return false
+	}
 	tarsIndexed.Add(int64(1))
+	archivesIndexed.Add(format, 1)
 	return true
 }
 
 func IndexTarballs(inputRecords []*store.Record, outputChans ...chan *store.Record) {
-	if len(inputRecords) != 1 {
+	indexTarballs(parseTrace, inputRecords, outputChans...)
+}
+
+func IndexTarballsLeniently(inputRecords []*store.Record, outputChans ...chan *store.Record) {
+	indexTarballs(parseTraceLeniently, inputRecords, outputChans...)
+}
+
+func indexTarballs(parse func([]byte) (*Trace, error), inputRecords []*store.Record, outputChans ...chan *store.Record) {
+	tracesChan := outputChans[0]
+	tarnamesChan := outputChans[1]
+	failedChan := outputChans[2]
+	reindexedChan := outputChans[3]
+	tarnamesTracesChan := outputChans[4]
+	tarnamesFailedChan := outputChans[5]
+
+	var currentRecord, indexedRecord, failedRecord *store.Record
+	for _, record := range inputRecords {
+		switch record.DatabaseIndex {
+		case 0:
+			currentRecord = record
+		case 1:
+			indexedRecord = record
+		case 2:
+			failedRecord = record
+		}
+	}
+	if currentRecord == nil {
+		// We indexed this tarball before, but it isn't there anymore.
+		return
+	}
+
+	var tarPath string
+	lex.DecodeOrDie(currentRecord.Key, &tarPath)
+	var current tarballInfo
+	lex.DecodeOrDie(currentRecord.Value, &current.Size, &current.ModificationTime)
+
+	var indexed *tarballInfo
+	if indexedRecord != nil {
+		indexed = new(tarballInfo)
+		// Tarballs we indexed before we started recording tarballInfo
+		// don't have values.
+		if len(indexedRecord.Value) > 0 {
+			lex.DecodeOrDie(indexedRecord.Value, &indexed.Size, &indexed.ModificationTime, &indexed.Hash)
+		}
+		if indexed.Size == current.Size && indexed.ModificationTime == current.ModificationTime {
+			tarsSkipped.Add(1)
+			return
+		}
+	}
+
+	// Don't try a tarball we failed to index again until it changes.
+	if failedRecord != nil {
+		var failed tarballInfo
+		lex.DecodeOrDie(failedRecord.Value, &failed.Size, &failed.ModificationTime)
+		if failed.Size == current.Size && failed.ModificationTime == current.ModificationTime {
+			log.Printf("Skipping %s, which we failed to index before\n", tarPath)
+			tarsSkipped.Add(1)
+			return
+		}
+	}
+	failedTarnameRecord := &store.Record{
+		Key:   currentRecord.Key,
+		Value: lex.EncodeOrDie(current.Size, current.ModificationTime),
+	}
+
+	hash, err := hashTarball(tarPath)
+	if err != nil {
+		log.Printf("Error hashing %s: %s\n", tarPath, err)
+		tarsFailed.Add(int64(1))
+		tarnamesFailedChan <- failedTarnameRecord
+		return
+	}
+	current.Hash = hash
+	indexedTarnameRecord := &store.Record{
+		Key:   lex.EncodeOrDie(tarPath),
+		Value: lex.EncodeOrDie(current.Size, current.ModificationTime, current.Hash),
+	}
+
+	// If the contents didn't change then we only need to remember the new
+	// size and modification time. We also assume tarballs we indexed before
+	// we started recording hashes haven't changed, rather than indexing
+	// every old tarball again.
+	if indexed != nil && (indexed.Hash == "" || indexed.Hash == current.Hash) {
 		tarsSkipped.Add(1)
+		tarnamesChan <- indexedTarnameRecord
 		return
 	}
-	if inputRecords[0].DatabaseIndex != 0 {
+
+	if !indexTarball(tarPath, current.Hash, parse, tracesChan, failedChan, tarnamesTracesChan) {
+		tarnamesFailedChan <- failedTarnameRecord
 		return
 	}
+	tarnamesChan <- indexedTarnameRecord
+	if indexed != nil {
+		tarsReindexed.Add(int64(1))
+		reindexedChan <- &store.Record{
+			Key:   lex.EncodeOrDie(tarPath),
+			Value: lex.EncodeOrDie(indexed.Size, indexed.ModificationTime, indexed.Hash, current.Size, current.ModificationTime, current.Hash),
+		}
+	}
+}
 
-	tracesChan := outputChans[0]
-	tarnamesChan := outputChans[1]
+type reindexedTarballsTextStore struct {
+	writer    io.Writer
+	reindexed int
+}
+
+func (store *reindexedTarballsTextStore) BeginWriting() error {
+	store.reindexed = 0
+	return nil
+}
 
+func (store *reindexedTarballsTextStore) WriteRecord(record *store.Record) error {
 	var tarPath string
-	lex.DecodeOrDie(inputRecords[0].Key, &tarPath)
-	if indexTarball(tarPath, tracesChan) {
-		tarnamesChan <- &store.Record{
-			Key: lex.EncodeOrDie(tarPath),
+	var previous, current tarballInfo
+	lex.DecodeOrDie(record.Key, &tarPath)
+	lex.DecodeOrDie(record.Value, &previous.Size, &previous.ModificationTime, &previous.Hash, &current.Size, &current.ModificationTime, &current.Hash)
+	formatTime := func(nanoseconds int64) string {
+		return time.Unix(0, nanoseconds).UTC().Format(time.RFC3339)
+	}
+	if _, err := fmt.Fprintf(store.writer, "Reindexed %s: size %d -> %d, modified %s -> %s, sha1 %s -> %s\n", tarPath, previous.Size, current.Size, formatTime(previous.ModificationTime), formatTime(current.ModificationTime), previous.Hash, current.Hash); err != nil {
+		return err
+	}
+	store.reindexed++
+	return nil
+}
+
+func (store *reindexedTarballsTextStore) EndWriting() error {
+	if store.reindexed == 0 {
+		return nil
+	}
+	pipelines := strings.Join(traceRangesPipelines(), ",")
+	if _, err := fmt.Fprintf(store.writer, "Reset these pipelines, which will process every trace again on their next run: %s\n", pipelines); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Empty the intermediate and bookkeeping stores of traceRangesPipelines if we
+// indexed any tarballs again.
+func resetTraceRangesPipelinesStages(levelDbManager store.Manager, tarnamesReindexedStore store.Reader) []transformer.PipelineStage {
+	reset := make(map[string]bool)
+	for _, pipeline := range traceRangesPipelines() {
+		reset[pipeline] = true
+	}
+	var stages []transformer.PipelineStage
+	for _, schema := range StoreSchemas() {
+		if !reset[schema.Pipeline] || !(schema.Intermediate || schema.Bookkeeping) {
+			continue
+		}
+		stages = append(stages, transformer.PipelineStage{
+			Name:   fmt.Sprintf("Reset %s", schema.Name),
+			Reader: &store.SliceStore{},
+			Writer: &unlessEmptyWriter{Writer: store.NewTruncatingWriter(levelDbManager.Deleter(schema.Name)), condition: tarnamesReindexedStore},
+		})
+	}
+	return stages
+}
+
+// Like RemoveRecordsPipeline, but remove the records of a store keyed by trace
+// key whose keys are in staleStore. Rewriting traces is expensive, so we leave
+// the store alone unless there are stale traces. We refuse to start if keptStore
+// still has records from a run that stopped partway.
+func removeStaleTracesPipeline(recordsStore, keptStore store.ReadingDeleter, staleStore store.Reader, removedStore store.Writer) []transformer.PipelineStage {
+	return []transformer.PipelineStage{
+		transformer.PipelineStage{
+			Name:        "RemoveStaleTraces",
+			Reader:      &unlessEmptyReader{Reader: &emptyScratchReader{Reader: store.NewDemuxingReader(recordsStore, staleStore), scratch: keptStore}, condition: staleStore},
+			Transformer: transformer.TransformFunc(removeStaleTraces),
+			Writer:      store.NewMuxingWriter(store.NewTruncatingWriter(keptStore), removedStore),
+		},
+		transformer.PipelineStage{
+			Name:   "RestoreKeptTraces",
+			Reader: keptStore,
+			Writer: &unlessEmptyWriter{Writer: store.NewTruncatingWriter(recordsStore), condition: staleStore},
+		},
+		clearStoreStage(keptStore),
+	}
+}
+
+func removeStaleTraces(inputChan, outputChan chan *store.Record) {
+	var traceKey TraceKey
+	grouper := transformer.GroupRecords(inputChan, &traceKey)
+	for grouper.NextGroup() {
+		var records []*store.Record
+		stale := false
+		for grouper.NextRecord() {
+			record := grouper.Read()
+			switch record.DatabaseIndex {
+			case 0:
+				records = append(records, record)
+			case 1:
+				stale = true
+			}
+		}
+		for _, record := range records {
+			if stale {
+				record.DatabaseIndex = 1
+			} else {
+				record.DatabaseIndex = 0
+			}
+			outputChan <- record
 		}
 	}
 }
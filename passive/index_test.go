@@ -0,0 +1,190 @@
+package passive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sburnett/lexicographic-tuples"
+	"github.com/sburnett/transformer"
+	"github.com/sburnett/transformer/store"
+)
+
+func writeTestTarball(tarPath string, modificationTime time.Time, traces ...[]byte) {
+	if err := os.MkdirAll(filepath.Dir(tarPath), 0755); err != nil {
+		panic(err)
+	}
+	handle, err := os.Create(tarPath)
+	if err != nil {
+		panic(err)
+	}
+	gzipHandle := gzip.NewWriter(handle)
+	tarHandle := tar.NewWriter(gzipHandle)
+	for index, contents := range traces {
+		header := tar.Header{
+			Name: fmt.Sprintf("%d", index),
+			Mode: 0644,
+			Size: int64(len(contents)),
+		}
+		if err := tarHandle.WriteHeader(&header); err != nil {
+			panic(err)
+		}
+		if _, err := tarHandle.Write(contents); err != nil {
+			panic(err)
+		}
+	}
+	tarHandle.Close()
+	gzipHandle.Close()
+	handle.Close()
+	if err := os.Chtimes(tarPath, modificationTime, modificationTime); err != nil {
+		panic(err)
+	}
+}
+
+func printIndexedTraces(levelDbManager store.Manager, tarballsPath string) {
+	tracesStore := levelDbManager.Reader("traces")
+	tracesStore.BeginReading()
+	for {
+		record, err := tracesStore.ReadRecord()
+		if err != nil {
+			panic(err)
+		}
+		if record == nil {
+			break
+		}
+		var traceKey TraceKey
+		lex.DecodeOrDie(record.Key, &traceKey)
+		fmt.Printf("traces: %s %d %d\n", traceKey.NodeId, traceKey.SessionId, traceKey.SequenceNumber)
+	}
+	tracesStore.EndReading()
+
+	reindexedStore := levelDbManager.Reader("tarnames-reindexed")
+	reindexedStore.BeginReading()
+	for {
+		record, err := reindexedStore.ReadRecord()
+		if err != nil {
+			panic(err)
+		}
+		if record == nil {
+			break
+		}
+		var tarPath string
+		lex.DecodeOrDie(record.Key, &tarPath)
+		relativePath, err := filepath.Rel(tarballsPath, tarPath)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("reindexed: %s\n", relativePath)
+	}
+	reindexedStore.EndReading()
+}
+
+func ExampleIndexTarballsPipeline_reindex() {
+	tarballsPath, err := ioutil.TempDir("", "index")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tarballsPath)
+	tarPath := filepath.Join(tarballsPath, "NODE", "2013-01-01", "NODE_1.tar.gz")
+	levelDbManager := store.NewSliceManager()
+	runPipeline := func(message string) {
+		fmt.Println(message)
+		transformer.RunPipeline(IndexTarballsPipeline(tarballsPath, []string{"*/*/*.tar.gz"}, false, levelDbManager, ioutil.Discard))
+		printIndexedTraces(levelDbManager, tarballsPath)
+	}
+
+	writeTestTarball(tarPath, time.Unix(100, 0), makeValidTraceContents("NODE", 0))
+	runPipeline("New tarball:")
+	runPipeline("Unchanged tarball:")
+	writeTestTarball(tarPath, time.Unix(200, 0), makeValidTraceContents("NODE", 0))
+	runPipeline("Touched tarball:")
+	writeTestTarball(tarPath, time.Unix(300, 0), makeValidTraceContents("NODE", 0), makeValidTraceContents("NODE", 1))
+	runPipeline("Appended tarball:")
+
+	// Output:
+	// New tarball:
+	// traces: NODE 10 0
+	// Unchanged tarball:
+	// traces: NODE 10 0
+	// Touched tarball:
+	// traces: NODE 10 0
+	// Appended tarball:
+	// traces: NODE 10 0
+	// traces: NODE 10 1
+	// reindexed: NODE/2013-01-01/NODE_1.tar.gz
+}
+
+func ExampleIndexTarballsPipeline_removeStaleTraces() {
+	tarballsPath, err := ioutil.TempDir("", "index")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tarballsPath)
+	tarPath := filepath.Join(tarballsPath, "NODE", "2013-01-01", "NODE_1.tar.gz")
+	levelDbManager := store.NewSliceManager()
+	runPipeline := func(message string) {
+		fmt.Println(message)
+		transformer.RunPipeline(IndexTarballsPipeline(tarballsPath, []string{"*/*/*.tar.gz"}, false, levelDbManager, ioutil.Discard))
+		printIndexedTraces(levelDbManager, tarballsPath)
+	}
+
+	writeTestTarball(tarPath, time.Unix(100, 0), makeValidTraceContents("NODE", 0), makeValidTraceContents("NODE", 1))
+	runPipeline("New tarball:")
+	writeTestTarball(tarPath, time.Unix(200, 0), makeValidTraceContents("NODE", 1))
+	runPipeline("Truncated tarball:")
+	fmt.Printf("traces-sources: %d records\n", len(readAllRecords(levelDbManager.Reader("traces-sources"))))
+
+	// Output:
+	// New tarball:
+	// traces: NODE 10 0
+	// traces: NODE 10 1
+	// Truncated tarball:
+	// traces: NODE 10 1
+	// reindexed: NODE/2013-01-01/NODE_1.tar.gz
+	// traces-sources: 1 records
+}
+
+func ExampleIndexTarballsPipeline_resetTraceRangesPipelines() {
+	tarballsPath, err := ioutil.TempDir("", "index")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tarballsPath)
+	tarPath := filepath.Join(tarballsPath, "NODE", "2013-01-01", "NODE_1.tar.gz")
+	levelDbManager := store.NewSliceManager()
+	runPipeline := func(message string) {
+		fmt.Println(message)
+		transformer.RunPipeline(IndexTarballsPipeline(tarballsPath, []string{"*/*/*.tar.gz"}, false, levelDbManager, ioutil.Discard))
+		for _, name := range []string{"availability-done", "bytesperminute-trace-key-ranges"} {
+			fmt.Printf("%s: %d records\n", name, len(readAllRecords(levelDbManager.Reader(name))))
+		}
+	}
+
+	writeTestTarball(tarPath, time.Unix(100, 0), makeValidTraceContents("NODE", 0))
+	runPipeline("New tarball:")
+	for _, name := range []string{"availability-done", "bytesperminute-trace-key-ranges"} {
+		writer := levelDbManager.Writer(name)
+		writer.BeginWriting()
+		traceKey := lex.EncodeOrDie(&TraceKey{[]byte("NODE"), []byte("context"), 10, 0})
+		writer.WriteRecord(&store.Record{Key: traceKey, Value: traceKey})
+		writer.EndWriting()
+	}
+	runPipeline("Unchanged tarball:")
+	writeTestTarball(tarPath, time.Unix(200, 0), makeValidTraceContents("NODE", 0), makeValidTraceContents("NODE", 1))
+	runPipeline("Appended tarball:")
+
+	// Output:
+	// New tarball:
+	// availability-done: 0 records
+	// bytesperminute-trace-key-ranges: 0 records
+	// Unchanged tarball:
+	// availability-done: 1 records
+	// bytesperminute-trace-key-ranges: 1 records
+	// Appended tarball:
+	// availability-done: 0 records
+	// bytesperminute-trace-key-ranges: 0 records
+}
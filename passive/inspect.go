@@ -0,0 +1,162 @@
+package passive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/sburnett/lexicographic-tuples"
+	"github.com/sburnett/transformer"
+	"github.com/sburnett/transformer/store"
+)
+
+type inspectTraces struct {
+	FirstSessionId      int64
+	LastSessionId       int64
+	FirstSequenceNumber int32
+	LastSequenceNumber  int32
+}
+
+// Print every trace from nodeId whose session ID (i.e., process start time in
+// microseconds) and sequence number fall within the given inclusive ranges.
+// format is one of "json" (one JSON object per line), "text" (protocol
+// buffer text format) or "trace" (the bismark-passive text format, using each
+// trace's original file format version). The text and trace formats begin each
+// trace with a line like "# <node id> <session id> <sequence number>".
+//
+// We seek past the traces outside the ranges instead of reading them.
+func InspectTracesPipeline(levelDbManager store.Manager, nodeId string, firstSessionId, lastSessionId int64, firstSequenceNumber, lastSequenceNumber int32, format string, writer io.Writer) transformer.Pipeline {
+	tracesStore := levelDbManager.Seeker("traces")
+	parameters := inspectTraces{
+		FirstSessionId:      firstSessionId,
+		LastSessionId:       lastSessionId,
+		FirstSequenceNumber: firstSequenceNumber,
+		LastSequenceNumber:  lastSequenceNumber,
+	}
+	return []transformer.PipelineStage{
+		transformer.PipelineStage{
+			Name:   "InspectTraces",
+			Reader: &inspectTracesReader{seeker: tracesStore, nodeId: nodeId, parameters: parameters},
+			Writer: &traceInspectionStore{writer: writer, format: format},
+		},
+	}
+}
+
+// Reads the traces of one node within the ranges of inspectTraces.
+type inspectTracesReader struct {
+	seeker     store.Seeker
+	nodeId     string
+	parameters inspectTraces
+}
+
+func (reader *inspectTracesReader) BeginReading() error {
+	if err := reader.seeker.BeginReading(); err != nil {
+		return err
+	}
+	return reader.seeker.Seek(lex.EncodeOrDie(reader.nodeId))
+}
+
+// A key after every trace in sessionId of traceKey's node and anonymization
+// context, and before the traces of later sessions.
+func traceKeyAfter(traceKey *TraceKey, sessionId int64) []byte {
+	return lex.Concatenate(lex.EncodeOrDie(traceKey.NodeId, traceKey.AnonymizationContext, sessionId, int32(math.MaxInt32)), []byte{0})
+}
+
+func (reader *inspectTracesReader) ReadRecord() (*store.Record, error) {
+	parameters := reader.parameters
+	for {
+		record, err := reader.seeker.ReadRecord()
+		if record == nil || err != nil {
+			return record, err
+		}
+		var traceKey TraceKey
+		lex.DecodeOrDie(record.Key, &traceKey)
+		if string(traceKey.NodeId) != reader.nodeId {
+			return nil, nil
+		}
+		var next []byte
+		switch {
+		case traceKey.SessionId < parameters.FirstSessionId:
+			next = lex.EncodeOrDie(traceKey.NodeId, traceKey.AnonymizationContext, parameters.FirstSessionId, parameters.FirstSequenceNumber)
+		case traceKey.SessionId > parameters.LastSessionId:
+			// Skip to the node's next anonymization context.
+			next = traceKeyAfter(&traceKey, math.MaxInt64)
+		case traceKey.SequenceNumber < parameters.FirstSequenceNumber:
+			next = lex.EncodeOrDie(traceKey.NodeId, traceKey.AnonymizationContext, traceKey.SessionId, parameters.FirstSequenceNumber)
+		case traceKey.SequenceNumber > parameters.LastSequenceNumber:
+			next = traceKeyAfter(&traceKey, traceKey.SessionId)
+		default:
+			return record, nil
+		}
+		if err := reader.seeker.Seek(next); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (reader *inspectTracesReader) EndReading() error {
+	return reader.seeker.EndReading()
+}
+
+type traceInspectionStore struct {
+	writer io.Writer
+	format string
+}
+
+func (store *traceInspectionStore) BeginWriting() error {
+	switch store.format {
+	case "json", "text", "trace":
+		return nil
+	}
+	return fmt.Errorf("Unknown inspection format %q", store.format)
+}
+
+func (store *traceInspectionStore) WriteRecord(record *store.Record) error {
+	var trace Trace
+	if err := proto.Unmarshal(record.Value, &trace); err != nil {
+		return err
+	}
+	switch store.format {
+	case "json":
+		encoded, err := json.Marshal(&trace)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(store.writer, "%s\n", encoded); err != nil {
+			return err
+		}
+	case "text":
+		if err := store.writeHeader(record); err != nil {
+			return err
+		}
+		if err := proto.MarshalText(store.writer, &trace); err != nil {
+			return err
+		}
+	case "trace":
+		contents, err := FormatTrace(&trace, trace.GetFileFormatVersion())
+		if err != nil {
+			return err
+		}
+		if err := store.writeHeader(record); err != nil {
+			return err
+		}
+		if _, err := store.writer.Write(contents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write a line identifying the trace, which separates it from the previous one.
+func (store *traceInspectionStore) writeHeader(record *store.Record) error {
+	var traceKey TraceKey
+	lex.DecodeOrDie(record.Key, &traceKey)
+	_, err := fmt.Fprintf(store.writer, "# %s %d %d\n", traceKey.NodeId, traceKey.SessionId, traceKey.SequenceNumber)
+	return err
+}
+
+func (store *traceInspectionStore) EndWriting() error {
+	return nil
+}
@@ -0,0 +1,64 @@
+package passive
+
+import (
+	"bytes"
+	"fmt"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/sburnett/transformer"
+	"github.com/sburnett/transformer/store"
+)
+
+func writeTraces(levelDbManager store.Manager, contents ...[]byte) {
+	tracesStore := levelDbManager.Writer("traces")
+	tracesStore.BeginWriting()
+	for _, traceContents := range contents {
+		trace, err := parseTrace(traceContents)
+		if err != nil {
+			panic(err)
+		}
+		value, err := proto.Marshal(trace)
+		if err != nil {
+			panic(err)
+		}
+		tracesStore.WriteRecord(&store.Record{
+			Key:   traceKey(trace),
+			Value: value,
+		})
+	}
+	tracesStore.EndWriting()
+}
+
+func ExampleInspectTracesPipeline() {
+	levelDbManager := store.NewSliceManager()
+	writeTraces(levelDbManager,
+		makeValidTraceContents("NODE", 0),
+		makeValidTraceContents("NODE", 1),
+		makeValidTraceContents("NODE", 2),
+		makeValidTraceContents("OTHER", 1))
+
+	writer := bytes.NewBuffer([]byte{})
+	transformer.RunPipeline(InspectTracesPipeline(levelDbManager, "NODE", 0, 10, 1, 1, "json", writer))
+	transformer.RunPipeline(InspectTracesPipeline(levelDbManager, "NODE", 10, 10, 2, 5, "text", writer))
+	transformer.RunPipeline(InspectTracesPipeline(levelDbManager, "NODE", 11, 20, 0, 5, "json", writer))
+	fmt.Printf("%s", writer.Bytes())
+
+	// Output:
+	// {"file_format_version":5,"build_id":"UNKNOWN","node_id":"NODE","process_start_time_microseconds":10,"sequence_number":1,"trace_creation_timestamp":20,"packet_series_dropped":0,"flow_table_baseline":0,"flow_table_size":0,"flow_table_expired":0,"flow_table_dropped":0,"a_records_dropped":0,"cname_records_dropped":0,"address_table_first_id":0,"address_table_size":0}
+	// # NODE 10 2
+	// file_format_version: 5
+	// build_id: "UNKNOWN"
+	// node_id: "NODE"
+	// process_start_time_microseconds: 10
+	// sequence_number: 2
+	// trace_creation_timestamp: 20
+	// packet_series_dropped: 0
+	// flow_table_baseline: 0
+	// flow_table_size: 0
+	// flow_table_expired: 0
+	// flow_table_dropped: 0
+	// a_records_dropped: 0
+	// cname_records_dropped: 0
+	// address_table_first_id: 0
+	// address_table_size: 0
+}
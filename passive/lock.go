@@ -0,0 +1,43 @@
+package passive
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// LevelDB won't let two processes open the same database, so commands that
+// use a LevelDB root take turns using it by locking this file in the root.
+// GarbageCollectPipeline only looks at directories, so it ignores the file.
+const levelDbRootLockName = ".lock"
+
+type LevelDbRootLock struct {
+	handle *os.File
+}
+
+// Lock dbRoot against other processes, waiting for them to unlock it if
+// necessary. The lock lasts until we call Unlock or the process exits.
+func LockLevelDbRoot(dbRoot string) (*LevelDbRootLock, error) {
+	if err := os.MkdirAll(dbRoot, 0755); err != nil {
+		return nil, err
+	}
+	handle, err := os.OpenFile(filepath.Join(dbRoot, levelDbRootLockName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(handle.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		log.Printf("Waiting for another process to unlock %s", dbRoot)
+		err = syscall.Flock(int(handle.Fd()), syscall.LOCK_EX)
+	}
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+	return &LevelDbRootLock{handle: handle}, nil
+}
+
+func (lock *LevelDbRootLock) Unlock() error {
+	return lock.handle.Close()
+}
@@ -0,0 +1,43 @@
+package passive
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLockLevelDbRoot(t *testing.T) {
+	dbRoot, err := ioutil.TempDir("", "lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbRoot)
+
+	lock, err := LockLevelDbRoot(dbRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan *LevelDbRootLock)
+	go func() {
+		secondLock, err := LockLevelDbRoot(dbRoot)
+		if err != nil {
+			t.Error(err)
+		}
+		locked <- secondLock
+	}()
+	select {
+	case <-locked:
+		t.Fatal("Locked the root while it was already locked")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case secondLock := <-locked:
+		secondLock.Unlock()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Didn't lock the root after it was unlocked")
+	}
+}
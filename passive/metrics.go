@@ -0,0 +1,316 @@
+package passive
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/sburnett/transformer"
+	"github.com/sburnett/transformer/store"
+)
+
+var postgresRowsWritten, postgresBatchesWritten, postgresCopyFallbacks *expvar.Map
+
+func init() {
+	postgresRowsWritten = expvar.NewMap("PostgresRowsWritten")
+	postgresBatchesWritten = expvar.NewMap("PostgresBatchesWritten")
+	postgresCopyFallbacks = expvar.NewMap("PostgresCopyFallbacks")
+}
+
+// The labels of each expvar.Map's keys when we export it as a Prometheus
+// metric. Keys of maps with more than one label are the label values joined by
+// slashes. Other maps use the label "key".
+var expvarMapLabels = map[string][]string{
+	"ArchiveBytesRead":       {"format"},
+	"ArchivesIndexed":        {"format"},
+	"PostgresBatchesWritten": {"table"},
+	"PostgresCopyFallbacks":  {"table"},
+	"PostgresRowsWritten":    {"table"},
+	"TraceParseErrors":       {"file_format_version", "section", "code"},
+}
+
+// Throughput and latency of one pipeline stage, accumulated over every run of
+// the stage since the process started.
+type stageMetrics struct {
+	RecordsRead    int64
+	RecordsWritten int64
+	Runs           int64
+	DurationNanos  int64
+}
+
+type stageMetricsKey struct {
+	Pipeline, Stage string
+}
+
+type stageMetricsKeys []stageMetricsKey
+
+func (keys stageMetricsKeys) Len() int      { return len(keys) }
+func (keys stageMetricsKeys) Swap(i, j int) { keys[i], keys[j] = keys[j], keys[i] }
+func (keys stageMetricsKeys) Less(i, j int) bool {
+	if keys[i].Pipeline != keys[j].Pipeline {
+		return keys[i].Pipeline < keys[j].Pipeline
+	}
+	return keys[i].Stage < keys[j].Stage
+}
+
+var stageMetricsMutex sync.Mutex
+var allStageMetrics = make(map[stageMetricsKey]*stageMetrics)
+
+func lookupStageMetrics(pipeline, stage string) *stageMetrics {
+	stageMetricsMutex.Lock()
+	defer stageMetricsMutex.Unlock()
+	key := stageMetricsKey{Pipeline: pipeline, Stage: stage}
+	metrics, found := allStageMetrics[key]
+	if !found {
+		metrics = new(stageMetrics)
+		allStageMetrics[key] = metrics
+	}
+	return metrics
+}
+
+// Measure the number of records each stage of the pipeline reads and writes,
+// and how long each stage takes, for WriteMetrics. name identifies the
+// pipeline in the metrics' labels.
+func InstrumentPipeline(name string, pipeline transformer.Pipeline) transformer.Pipeline {
+	var instrumented []transformer.PipelineStage
+	for _, stage := range pipeline {
+		timer := &stageTimer{metrics: lookupStageMetrics(name, stage.Name)}
+		if stage.Reader != nil {
+			stage.Reader = &meteredReader{Reader: stage.Reader, timer: timer, endsStage: stage.Writer == nil}
+		}
+		if stage.Writer != nil {
+			stage.Writer = &meteredWriter{Writer: stage.Writer, timer: timer}
+		}
+		instrumented = append(instrumented, stage)
+	}
+	return instrumented
+}
+
+// A stage starts when it begins reading and ends when it finishes writing,
+// or when it finishes reading if it doesn't write anything.
+type stageTimer struct {
+	metrics   *stageMetrics
+	startTime time.Time
+}
+
+func (timer *stageTimer) start() {
+	timer.startTime = time.Now()
+}
+
+func (timer *stageTimer) stop() {
+	atomic.AddInt64(&timer.metrics.Runs, 1)
+	atomic.AddInt64(&timer.metrics.DurationNanos, int64(time.Since(timer.startTime)))
+}
+
+type meteredReader struct {
+	store.Reader
+	timer     *stageTimer
+	endsStage bool
+}
+
+func (reader *meteredReader) BeginReading() error {
+	reader.timer.start()
+	return reader.Reader.BeginReading()
+}
+
+func (reader *meteredReader) ReadRecord() (*store.Record, error) {
+	record, err := reader.Reader.ReadRecord()
+	if record != nil {
+		atomic.AddInt64(&reader.timer.metrics.RecordsRead, 1)
+	}
+	return record, err
+}
+
+func (reader *meteredReader) EndReading() error {
+	err := reader.Reader.EndReading()
+	if reader.endsStage {
+		reader.timer.stop()
+	}
+	return err
+}
+
+type meteredWriter struct {
+	store.Writer
+	timer *stageTimer
+}
+
+func (writer *meteredWriter) WriteRecord(record *store.Record) error {
+	if err := writer.Writer.WriteRecord(record); err != nil {
+		return err
+	}
+	atomic.AddInt64(&writer.timer.metrics.RecordsWritten, 1)
+	return nil
+}
+
+func (writer *meteredWriter) EndWriting() error {
+	err := writer.Writer.EndWriting()
+	writer.timer.stop()
+	return err
+}
+
+// Convert an expvar name like TarsIndexed to a metric name like
+// bismark_passive_tars_indexed.
+func metricName(expvarName string) string {
+	name := []rune("bismark_passive_")
+	for idx, r := range expvarName {
+		switch {
+		case unicode.IsUpper(r):
+			if idx > 0 {
+				name = append(name, '_')
+			}
+			name = append(name, unicode.ToLower(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			name = append(name, r)
+		default:
+			name = append(name, '_')
+		}
+	}
+	return string(name)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names []string, values []string) string {
+	var labels []string
+	for idx, name := range names {
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, name, labelValueReplacer.Replace(values[idx])))
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// The samples of one metric in Prometheus's text exposition format.
+type metricFamily struct {
+	Name, Help, Type string
+	// Each sample line without its trailing newline.
+	Samples []string
+}
+
+type metricFamiliesByName []*metricFamily
+
+func (families metricFamiliesByName) Len() int { return len(families) }
+func (families metricFamiliesByName) Swap(i, j int) {
+	families[i], families[j] = families[j], families[i]
+}
+func (families metricFamiliesByName) Less(i, j int) bool {
+	return families[i].Name < families[j].Name
+}
+
+func (family *metricFamily) add(suffix, labels string, value interface{}) {
+	family.Samples = append(family.Samples, fmt.Sprintf("%s%s%s %v", family.Name, suffix, labels, value))
+}
+
+func (family *metricFamily) write(writer io.Writer) error {
+	if len(family.Samples) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", family.Name, family.Help, family.Name, family.Type); err != nil {
+		return err
+	}
+	for _, sample := range family.Samples {
+		if _, err := fmt.Fprintln(writer, sample); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Export every integer and floating point expvar, and every expvar.Map of
+// them, which includes the indexer's counters. We don't know whether an expvar
+// is a counter or a gauge, so the metrics are untyped.
+func expvarMetricFamilies() []*metricFamily {
+	var families []*metricFamily
+	expvar.Do(func(variable expvar.KeyValue) {
+		family := &metricFamily{
+			Name: metricName(variable.Key),
+			Help: fmt.Sprintf("The %s expvar.", variable.Key),
+			Type: "untyped",
+		}
+		switch value := variable.Value.(type) {
+		case *expvar.Int, *expvar.Float:
+			family.add("", "", value.String())
+		case *expvar.Map:
+			labels, found := expvarMapLabels[variable.Key]
+			if !found {
+				labels = []string{"key"}
+			}
+			value.Do(func(entry expvar.KeyValue) {
+				labelValues := strings.SplitN(entry.Key, "/", len(labels))
+				if len(labelValues) != len(labels) {
+					return
+				}
+				switch entry.Value.(type) {
+				case *expvar.Int, *expvar.Float:
+					family.add("", formatLabels(labels, labelValues), entry.Value.String())
+				}
+			})
+		}
+		families = append(families, family)
+	})
+	return families
+}
+
+func stageMetricFamilies() []*metricFamily {
+	stageMetricsMutex.Lock()
+	var keys stageMetricsKeys
+	for key := range allStageMetrics {
+		keys = append(keys, key)
+	}
+	stageMetricsMutex.Unlock()
+	sort.Sort(keys)
+
+	recordsRead := &metricFamily{
+		Name: "bismark_passive_stage_records_read_total",
+		Help: "Records read by each pipeline stage.",
+		Type: "counter",
+	}
+	recordsWritten := &metricFamily{
+		Name: "bismark_passive_stage_records_written_total",
+		Help: "Records written by each pipeline stage.",
+		Type: "counter",
+	}
+	duration := &metricFamily{
+		Name: "bismark_passive_stage_duration_seconds",
+		Help: "Time each pipeline stage took to run.",
+		Type: "summary",
+	}
+	for _, key := range keys {
+		metrics := lookupStageMetrics(key.Pipeline, key.Stage)
+		labels := formatLabels([]string{"pipeline", "stage"}, []string{key.Pipeline, key.Stage})
+		recordsRead.add("", labels, atomic.LoadInt64(&metrics.RecordsRead))
+		recordsWritten.add("", labels, atomic.LoadInt64(&metrics.RecordsWritten))
+		seconds := time.Duration(atomic.LoadInt64(&metrics.DurationNanos)).Seconds()
+		duration.add("_sum", labels, strconv.FormatFloat(seconds, 'g', -1, 64))
+		duration.add("_count", labels, atomic.LoadInt64(&metrics.Runs))
+	}
+	return []*metricFamily{recordsRead, recordsWritten, duration}
+}
+
+// Write every metric in Prometheus's text exposition format.
+func WriteMetrics(writer io.Writer) error {
+	families := append(expvarMetricFamilies(), stageMetricFamilies()...)
+	sort.Sort(metricFamiliesByName(families))
+	for _, family := range families {
+		if err := family.write(writer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Serves WriteMetrics to Prometheus.
+type MetricsHandler struct{}
+
+func (MetricsHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := WriteMetrics(writer); err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+	}
+}
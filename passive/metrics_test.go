@@ -0,0 +1,98 @@
+package passive
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/sburnett/transformer"
+	"github.com/sburnett/transformer/store"
+)
+
+func TestMetricName(t *testing.T) {
+	names := map[string]string{
+		"TarsIndexed":         "bismark_passive_tars_indexed",
+		"PostgresRowsWritten": "bismark_passive_postgres_rows_written",
+		"cmdline":             "bismark_passive_cmdline",
+		"Weird-Name":          "bismark_passive_weird__name",
+	}
+	for expvarName, expected := range names {
+		if actual := metricName(expvarName); actual != expected {
+			t.Errorf("metricName(%q) = %q, expected %q", expvarName, actual, expected)
+		}
+	}
+}
+
+// Run a stage of an instrumented pipeline by hand, since it doesn't have a
+// transformer.
+func runInstrumentedStage(stage transformer.PipelineStage) {
+	stage.Reader.BeginReading()
+	stage.Writer.BeginWriting()
+	for {
+		record, err := stage.Reader.ReadRecord()
+		if err != nil {
+			panic(err)
+		}
+		if record == nil {
+			break
+		}
+		stage.Writer.WriteRecord(record)
+	}
+	stage.Reader.EndReading()
+	stage.Writer.EndWriting()
+}
+
+func TestWriteMetrics(t *testing.T) {
+	traceParseErrors.Add(fmt.Sprintf("%d/%s/%s", 4, SectionPacketSeries, ErrorInvalidField), 2)
+	postgresRowsWritten.Add("bytes_per_hour", 3)
+	reader := &fixedRecordsReader{records: []*store.Record{{Key: []byte("a")}, {Key: []byte("b")}}}
+	pipeline := InstrumentPipeline("Test\"Pipeline", []transformer.PipelineStage{
+		{Name: "Copy", Reader: reader, Writer: &runHistoryTextStore{writer: &bytes.Buffer{}}},
+	})
+	runInstrumentedStage(pipeline[0])
+
+	output := bytes.NewBuffer([]byte{})
+	if err := WriteMetrics(output); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"# TYPE bismark_passive_trace_parse_errors untyped\n",
+		"bismark_passive_trace_parse_errors{file_format_version=\"4\",section=\"packet series\",code=\"invalid-field\"} 2\n",
+		"bismark_passive_postgres_rows_written{table=\"bytes_per_hour\"} 3\n",
+		"bismark_passive_tars_indexed 0\n",
+		"# TYPE bismark_passive_stage_records_read_total counter\n",
+		"bismark_passive_stage_records_read_total{pipeline=\"Test\\\"Pipeline\",stage=\"Copy\"} 2\n",
+		"bismark_passive_stage_records_written_total{pipeline=\"Test\\\"Pipeline\",stage=\"Copy\"} 2\n",
+		"# TYPE bismark_passive_stage_duration_seconds summary\n",
+		"bismark_passive_stage_duration_seconds_count{pipeline=\"Test\\\"Pipeline\",stage=\"Copy\"} 1\n",
+	} {
+		if !strings.Contains(output.String(), expected) {
+			t.Errorf("Metrics don't contain %q:\n%s", expected, output)
+		}
+	}
+	if strings.Contains(output.String(), "current_tar") {
+		t.Errorf("Metrics contain a string expvar:\n%s", output)
+	}
+}
+
+type fixedRecordsReader struct {
+	records []*store.Record
+}
+
+func (reader *fixedRecordsReader) BeginReading() error {
+	return nil
+}
+
+func (reader *fixedRecordsReader) ReadRecord() (*store.Record, error) {
+	if len(reader.records) == 0 {
+		return nil, nil
+	}
+	record := reader.records[0]
+	reader.records = reader.records[1:]
+	return record, nil
+}
+
+func (reader *fixedRecordsReader) EndReading() error {
+	return nil
+}
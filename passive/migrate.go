@@ -0,0 +1,164 @@
+package passive
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+
+	_ "github.com/lib/pq"
+)
+
+// One version of the bismark_passive Postgres schema. Never edit a migration
+// once it's released; add another one instead.
+type postgresMigration struct {
+	Version     int
+	Description string
+	// Run in order, in the bismark_passive schema.
+	Statements []string
+}
+
+// Every version of the schema, in order. We create tables and indexes only if
+// they don't exist, since deployments that predate migrations created the
+// tables by hand.
+var postgresMigrations = []postgresMigration{
+	{
+		Version:     1,
+		Description: "Create the bytes per hour, device and domain tables",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS bytes_per_hour (
+				node_id varchar NOT NULL,
+				timestamp timestamp with time zone NOT NULL,
+				bytes bigint NOT NULL,
+				PRIMARY KEY (node_id, timestamp)
+			)`,
+			`CREATE INDEX IF NOT EXISTS bytes_per_hour_timestamp ON bytes_per_hour (timestamp)`,
+			`CREATE TABLE IF NOT EXISTS bytes_per_device_per_hour (
+				node_id varchar NOT NULL,
+				mac_address varchar NOT NULL,
+				timestamp timestamp with time zone NOT NULL,
+				bytes bigint NOT NULL,
+				PRIMARY KEY (node_id, mac_address, timestamp)
+			)`,
+			`CREATE INDEX IF NOT EXISTS bytes_per_device_per_hour_timestamp ON bytes_per_device_per_hour (timestamp)`,
+			`CREATE TABLE IF NOT EXISTS bytes_per_domain_per_hour (
+				node_id varchar NOT NULL,
+				domain varchar NOT NULL,
+				timestamp timestamp with time zone NOT NULL,
+				bytes bigint NOT NULL,
+				PRIMARY KEY (node_id, domain, timestamp)
+			)`,
+			`CREATE INDEX IF NOT EXISTS bytes_per_domain_per_hour_timestamp ON bytes_per_domain_per_hour (timestamp)`,
+			`CREATE INDEX IF NOT EXISTS bytes_per_domain_per_hour_domain ON bytes_per_domain_per_hour (domain)`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "Add unique indexes on the key columns of the bytes per hour, device and domain tables",
+		// Tables created by hand may lack primary keys, so upserts can't use
+		// ON CONFLICT and have to scan the whole table. Before adding the
+		// indexes, delete duplicate rows, which upserts kept identical.
+		Statements: []string{
+			`DELETE FROM bytes_per_hour AS duplicate USING bytes_per_hour AS kept
+				WHERE duplicate.node_id = kept.node_id AND duplicate.timestamp = kept.timestamp AND duplicate.ctid > kept.ctid`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS bytes_per_hour_key ON bytes_per_hour (node_id, timestamp)`,
+			`DELETE FROM bytes_per_device_per_hour AS duplicate USING bytes_per_device_per_hour AS kept
+				WHERE duplicate.node_id = kept.node_id AND duplicate.mac_address = kept.mac_address AND duplicate.timestamp = kept.timestamp AND duplicate.ctid > kept.ctid`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS bytes_per_device_per_hour_key ON bytes_per_device_per_hour (node_id, mac_address, timestamp)`,
+			`DELETE FROM bytes_per_domain_per_hour AS duplicate USING bytes_per_domain_per_hour AS kept
+				WHERE duplicate.node_id = kept.node_id AND duplicate.domain = kept.domain AND duplicate.timestamp = kept.timestamp AND duplicate.ctid > kept.ctid`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS bytes_per_domain_per_hour_key ON bytes_per_domain_per_hour (node_id, domain, timestamp)`,
+		},
+	},
+}
+
+// The latest version of the schema that this build knows about.
+func LatestPostgresSchemaVersion() int {
+	return postgresMigrations[len(postgresMigrations)-1].Version
+}
+
+// The schema version that the Postgres stores need to upsert rows, which added
+// unique indexes on the tables' key columns.
+const postgresUpsertSchemaVersion = 2
+
+// Check that migrations have brought the schema up to at least version
+// minimum. transaction's search path must be the bismark_passive schema.
+func checkPostgresSchemaVersion(transaction *sql.Tx, minimum int) error {
+	var version int
+	if err := transaction.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version); err != nil {
+		return fmt.Errorf("Error reading the schema version, so run db migrate: %v", err)
+	}
+	if version < minimum {
+		return fmt.Errorf("Schema version %d is older than version %d, so run db migrate", version, minimum)
+	}
+	return nil
+}
+
+// Create the bismark_passive schema if it doesn't exist and apply every
+// migration newer than the schema's version, all in one transaction. We record
+// each migration we apply in bismark_passive.schema_migrations, and write one
+// line per migration to writer.
+//
+// Connect to Postgres using dataSourceName, or using the PG* environment
+// variables if it's empty.
+func MigratePostgres(dataSourceName string, writer io.Writer) error {
+	conn, err := sql.Open(postgresDriverName, dataSourceName)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	transaction, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	if err := migratePostgres(transaction, writer); err != nil {
+		transaction.Rollback()
+		return err
+	}
+	return transaction.Commit()
+}
+
+func migratePostgres(transaction *sql.Tx, writer io.Writer) error {
+	setup := []string{
+		"CREATE SCHEMA IF NOT EXISTS bismark_passive",
+		"SET search_path TO bismark_passive",
+		`CREATE TABLE IF NOT EXISTS schema_migrations (
+			version integer PRIMARY KEY,
+			description varchar NOT NULL,
+			applied_at timestamp with time zone NOT NULL DEFAULT now()
+		)`,
+		// Concurrent migrations wait for us and then find nothing to do.
+		"LOCK TABLE schema_migrations IN EXCLUSIVE MODE",
+	}
+	for _, statement := range setup {
+		if _, err := transaction.Exec(statement); err != nil {
+			return err
+		}
+	}
+	var version int
+	if err := transaction.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version); err != nil {
+		return err
+	}
+	if version > LatestPostgresSchemaVersion() {
+		return fmt.Errorf("Schema version %d is newer than this build's version %d", version, LatestPostgresSchemaVersion())
+	}
+	for _, migration := range postgresMigrations {
+		if migration.Version <= version {
+			continue
+		}
+		for _, statement := range migration.Statements {
+			if _, err := transaction.Exec(statement); err != nil {
+				return fmt.Errorf("Migration %d: %v", migration.Version, err)
+			}
+		}
+		if _, err := transaction.Exec("INSERT INTO schema_migrations (version, description) VALUES ($1, $2)", migration.Version, migration.Description); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(writer, "applied\t%d\t%s\n", migration.Version, migration.Description); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(writer, "version\t%d\n", LatestPostgresSchemaVersion()); err != nil {
+		return err
+	}
+	return nil
+}
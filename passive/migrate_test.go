@@ -0,0 +1,53 @@
+package passive
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPostgresMigrations_Versions(t *testing.T) {
+	for idx, migration := range postgresMigrations {
+		if migration.Version != idx+1 {
+			t.Errorf("Migration %d has version %d; versions must count up from 1", idx, migration.Version)
+		}
+		if migration.Description == "" || len(migration.Statements) == 0 {
+			t.Errorf("Migration %d must have a description and statements", migration.Version)
+		}
+	}
+}
+
+// Every table that the Postgres stores write to must be created by some
+// migration.
+func TestPostgresMigrations_CreateTables(t *testing.T) {
+	var statements []string
+	for _, migration := range postgresMigrations {
+		statements = append(statements, migration.Statements...)
+	}
+	allStatements := strings.Join(statements, "\n")
+	for _, table := range purgeNodePostgresTables {
+		if !strings.Contains(allStatements, "CREATE TABLE IF NOT EXISTS "+table+" (") {
+			t.Errorf("No migration creates %s", table)
+		}
+	}
+}
+
+// Upserts use ON CONFLICT, which needs a unique index on each table's key
+// columns.
+func TestPostgresMigrations_UniqueKeys(t *testing.T) {
+	var statements []string
+	for _, migration := range postgresMigrations {
+		statements = append(statements, migration.Statements...)
+	}
+	allStatements := strings.Join(statements, "\n")
+	for _, table := range []postgresTable{
+		NewBytesPerHourPostgresStore("", PostgresOptions{}).table,
+		NewBytesPerDevicePostgresStore("", PostgresOptions{}).table,
+		NewBytesPerDomainPostgresStore("", PostgresOptions{}).table,
+	} {
+		index := fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s_key ON %s (%s)", table.name, table.name, strings.Join(table.keyColumns, ", "))
+		if !strings.Contains(allStatements, index) {
+			t.Errorf("No migration adds a unique index on the key columns of %s", table.name)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package passive
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/sburnett/transformer/store"
+)
+
+// How the Postgres stores load their tables.
+type PostgresOptions struct {
+	// Delete every row from the table and insert the rows we're given, instead
+	// of upserting them. The pipeline must then send every row.
+	FullReload bool
+	// Load rows using COPY in batches of this many rows, which is much faster
+	// than one INSERT per row. If it's zero, or the server refuses COPY, we use
+	// INSERT instead.
+	BatchSize int
+}
+
+// The batch size the Postgres stores use unless configured otherwise.
+const DefaultPostgresBatchSize = 10000
+
+// The database/sql driver we connect to Postgres with. Tests replace it.
+var postgresDriverName = "postgres"
+
+// Loads rows into one of the Postgres tables that the pipelines in this
+// package populate. By default, we upsert each row we're given, so pipelines
+// only need to send the rows that changed since the last run; see
+// PostgresOptions for the alternatives.
+type postgresTable struct {
+	name string
+	// The columns that identify a row, followed by the columns we update.
+	keyColumns, valueColumns []string
+	options                  PostgresOptions
+
+	conn        *sql.DB
+	transaction *sql.Tx
+	insert      *sql.Stmt
+
+	// Whether we're loading rows using COPY. When we upsert, we copy each
+	// batch into a temporary staging table and merge it into the table.
+	copying bool
+	// The COPY statement for the current batch, if we've started one.
+	copyStatement *sql.Stmt
+	batchRows     int
+}
+
+func newPostgresTable(name string, keyColumns, valueColumns []string, options PostgresOptions) postgresTable {
+	return postgresTable{
+		name:         name,
+		keyColumns:   keyColumns,
+		valueColumns: valueColumns,
+		options:      options,
+	}
+}
+
+// The SQL parameters $first through $first+len(columns)-1.
+func postgresParameters(columns []string, first int) []string {
+	var parameters []string
+	for idx := range columns {
+		parameters = append(parameters, fmt.Sprintf("$%d", first+idx))
+	}
+	return parameters
+}
+
+func (table *postgresTable) columns() []string {
+	return append(append([]string{}, table.keyColumns...), table.valueColumns...)
+}
+
+func (table *postgresTable) stagingTable() string {
+	return table.name + "_staging"
+}
+
+// Insert a row, or upsert it unless we're reloading the whole table.
+func (table *postgresTable) insertStatement() string {
+	columns := table.columns()
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)%s", table.name, strings.Join(columns, ", "), strings.Join(postgresParameters(columns, 1), ", "), table.onConflictClause())
+}
+
+// Update rows that already exist, using the unique indexes that migration 2
+// added on the key columns.
+func (table *postgresTable) onConflictClause() string {
+	if table.options.FullReload {
+		return ""
+	}
+	var assignments []string
+	for _, column := range table.valueColumns {
+		assignments = append(assignments, fmt.Sprintf("%s = EXCLUDED.%s", column, column))
+	}
+	return fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(table.keyColumns, ", "), strings.Join(assignments, ", "))
+}
+
+// Copy rows into the table, or into the staging table if we're upserting.
+// Executing the prepared statement with a row's values buffers the row, and
+// executing it without values finishes the COPY.
+func (table *postgresTable) copyStatementText() string {
+	target := table.name
+	if !table.options.FullReload {
+		target = table.stagingTable()
+	}
+	return pq.CopyIn(target, table.columns()...)
+}
+
+// Upsert the rows of the staging table into the table, the same way as
+// insertStatement, and empty the staging table.
+func (table *postgresTable) mergeStatements() []string {
+	columns := strings.Join(table.columns(), ", ")
+	return []string{
+		fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s%s", table.name, columns, columns, table.stagingTable(), table.onConflictClause()),
+		fmt.Sprintf("TRUNCATE %s", table.stagingTable()),
+	}
+}
+
+// Connect to Postgres using dataSourceName, or using the PG* environment
+// variables if it's empty, and start a transaction.
+func (table *postgresTable) begin(dataSourceName string) error {
+	conn, err := sql.Open(postgresDriverName, dataSourceName)
+	if err != nil {
+		return err
+	}
+	transaction, err := conn.Begin()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	abort := func(err error) error {
+		transaction.Rollback()
+		conn.Close()
+		return err
+	}
+	if _, err := transaction.Exec("SET search_path TO bismark_passive"); err != nil {
+		return abort(err)
+	}
+	if !table.options.FullReload {
+		if err := checkPostgresSchemaVersion(transaction, postgresUpsertSchemaVersion); err != nil {
+			return abort(err)
+		}
+	}
+	if table.options.FullReload {
+		if _, err := transaction.Exec(fmt.Sprintf("DELETE FROM %s", table.name)); err != nil {
+			return abort(err)
+		}
+	}
+	table.conn = conn
+	table.transaction = transaction
+	table.insert, table.copyStatement = nil, nil
+	table.batchRows = 0
+
+	table.copying = false
+	if table.options.BatchSize > 0 {
+		err := table.probeCopy()
+		if err == nil {
+			table.copying = true
+			return nil
+		}
+		log.Printf("Loading %s using INSERT because COPY failed: %v", table.name, err)
+		postgresCopyFallbacks.Add(table.name, 1)
+	}
+	insert, err := transaction.Prepare(table.insertStatement())
+	if err != nil {
+		return abort(err)
+	}
+	table.insert = insert
+	return nil
+}
+
+// Create the staging table if we need it, and copy an empty batch to check
+// that the server lets us COPY. If it doesn't, we roll back to before the
+// check so we can continue the transaction without COPY.
+func (table *postgresTable) probeCopy() error {
+	if _, err := table.transaction.Exec("SAVEPOINT probe_copy"); err != nil {
+		return err
+	}
+	probe := func() error {
+		if !table.options.FullReload {
+			if _, err := table.transaction.Exec(fmt.Sprintf("CREATE TEMPORARY TABLE %s (LIKE %s) ON COMMIT DROP", table.stagingTable(), table.name)); err != nil {
+				return err
+			}
+		}
+		statement, err := table.transaction.Prepare(table.copyStatementText())
+		if err != nil {
+			return err
+		}
+		if _, err := statement.Exec(); err != nil {
+			statement.Close()
+			return err
+		}
+		return statement.Close()
+	}
+	if err := probe(); err != nil {
+		if _, rollbackErr := table.transaction.Exec("ROLLBACK TO SAVEPOINT probe_copy"); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+	_, err := table.transaction.Exec("RELEASE SAVEPOINT probe_copy")
+	return err
+}
+
+// Write one row. values are the values of the key columns followed by the
+// values of the value columns.
+func (table *postgresTable) write(values ...interface{}) error {
+	if table.copying {
+		return table.copyRow(values...)
+	}
+	if _, err := table.insert.Exec(values...); err != nil {
+		return err
+	}
+	postgresRowsWritten.Add(table.name, 1)
+	return nil
+}
+
+func (table *postgresTable) copyRow(values ...interface{}) error {
+	if table.copyStatement == nil {
+		statement, err := table.transaction.Prepare(table.copyStatementText())
+		if err != nil {
+			return err
+		}
+		table.copyStatement = statement
+	}
+	if _, err := table.copyStatement.Exec(values...); err != nil {
+		return err
+	}
+	table.batchRows++
+	if table.batchRows >= table.options.BatchSize {
+		return table.flush()
+	}
+	return nil
+}
+
+// Finish copying the current batch, and merge it into the table if we're
+// upserting.
+func (table *postgresTable) flush() error {
+	if table.copyStatement == nil {
+		return nil
+	}
+	// Executing a COPY statement without values sends the buffered rows.
+	if _, err := table.copyStatement.Exec(); err != nil {
+		return err
+	}
+	if err := table.copyStatement.Close(); err != nil {
+		return err
+	}
+	table.copyStatement = nil
+	if !table.options.FullReload {
+		for _, statement := range table.mergeStatements() {
+			if _, err := table.transaction.Exec(statement); err != nil {
+				return err
+			}
+		}
+	}
+	postgresRowsWritten.Add(table.name, int64(table.batchRows))
+	postgresBatchesWritten.Add(table.name, 1)
+	table.batchRows = 0
+	return nil
+}
+
+func (table *postgresTable) end() error {
+	if err := table.flush(); err != nil {
+		return err
+	}
+	if table.insert != nil {
+		if err := table.insert.Close(); err != nil {
+			return err
+		}
+	}
+	if err := table.transaction.Commit(); err != nil {
+		return err
+	}
+	if err := table.conn.Close(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// The records a pipeline's Postgres stage should read from rowsStore. Unless
+// we're reloading the whole table, that's only the records whose keys are in
+// changedRowsStore, which the pipeline truncates and refills on every run.
+func postgresRowsReader(rowsStore store.Seeker, changedRowsStore store.Reader, fullReload bool) store.Reader {
+	if fullReload {
+		return rowsStore
+	}
+	return store.NewPrefixIncludingReader(rowsStore, changedRowsStore)
+}
@@ -0,0 +1,192 @@
+package passive
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPostgresTable_Statements(t *testing.T) {
+	table := newPostgresTable("bytes_per_device_per_hour", []string{"node_id", "mac_address", "timestamp"}, []string{"bytes"}, PostgresOptions{})
+	if expected, actual := "INSERT INTO bytes_per_device_per_hour (node_id, mac_address, timestamp, bytes) VALUES ($1, $2, $3, $4) ON CONFLICT (node_id, mac_address, timestamp) DO UPDATE SET bytes = EXCLUDED.bytes", table.insertStatement(); actual != expected {
+		t.Errorf("Insert statement should be %q, not %q", expected, actual)
+	}
+
+	table.options.FullReload = true
+	if expected, actual := "INSERT INTO bytes_per_device_per_hour (node_id, mac_address, timestamp, bytes) VALUES ($1, $2, $3, $4)", table.insertStatement(); actual != expected {
+		t.Errorf("Insert statement should be %q, not %q", expected, actual)
+	}
+}
+
+func TestPostgresTable_CopyStatements(t *testing.T) {
+	table := newPostgresTable("bytes_per_hour", []string{"node_id", "timestamp"}, []string{"bytes"}, PostgresOptions{BatchSize: 10})
+	if expected, actual := `COPY "bytes_per_hour_staging" ("node_id", "timestamp", "bytes") FROM STDIN`, table.copyStatementText(); actual != expected {
+		t.Errorf("Copy statement should be %q, not %q", expected, actual)
+	}
+	expectedMerge := []string{
+		"INSERT INTO bytes_per_hour (node_id, timestamp, bytes) SELECT node_id, timestamp, bytes FROM bytes_per_hour_staging ON CONFLICT (node_id, timestamp) DO UPDATE SET bytes = EXCLUDED.bytes",
+		"TRUNCATE bytes_per_hour_staging",
+	}
+	if actual := table.mergeStatements(); !reflect.DeepEqual(actual, expectedMerge) {
+		t.Errorf("Merge statements should be %q, not %q", expectedMerge, actual)
+	}
+
+	table.options.FullReload = true
+	if expected, actual := `COPY "bytes_per_hour" ("node_id", "timestamp", "bytes") FROM STDIN`, table.copyStatementText(); actual != expected {
+		t.Errorf("Copy statement should be %q, not %q", expected, actual)
+	}
+}
+
+// A database/sql driver that understands just enough of what postgresTable
+// sends to record the rows it copies and the other statements it executes.
+type fakePostgresDriver struct {
+	conn *fakePostgresConn
+}
+
+func (fake *fakePostgresDriver) Open(name string) (driver.Conn, error) {
+	return fake.conn, nil
+}
+
+var fakePostgres = &fakePostgresDriver{}
+
+func init() {
+	sql.Register("fakepostgres", fakePostgres)
+}
+
+type fakePostgresConn struct {
+	// Statements other than COPY, in the order we executed them.
+	statements []string
+	// The rows copied into each table, and the number of COPYs we finished.
+	copied    map[string][][]driver.Value
+	copies    int
+	commits   int
+	rollbacks int
+}
+
+func (conn *fakePostgresConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakePostgresStmt{conn: conn, query: query}, nil
+}
+
+func (conn *fakePostgresConn) Close() error {
+	return nil
+}
+
+func (conn *fakePostgresConn) Begin() (driver.Tx, error) {
+	return conn, nil
+}
+
+func (conn *fakePostgresConn) Commit() error {
+	conn.commits++
+	return nil
+}
+
+func (conn *fakePostgresConn) Rollback() error {
+	conn.rollbacks++
+	return nil
+}
+
+type fakePostgresStmt struct {
+	conn  *fakePostgresConn
+	query string
+}
+
+func (stmt *fakePostgresStmt) Close() error {
+	return nil
+}
+
+func (stmt *fakePostgresStmt) NumInput() int {
+	return -1
+}
+
+func (stmt *fakePostgresStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if !strings.HasPrefix(stmt.query, "COPY ") {
+		stmt.conn.statements = append(stmt.conn.statements, stmt.query)
+		return driver.RowsAffected(0), nil
+	}
+	if len(args) == 0 {
+		stmt.conn.copies++
+		return driver.RowsAffected(0), nil
+	}
+	table := strings.Trim(strings.Fields(stmt.query)[1], `"`)
+	stmt.conn.copied[table] = append(stmt.conn.copied[table], args)
+	return driver.RowsAffected(1), nil
+}
+
+// Every query reads the schema version.
+func (stmt *fakePostgresStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return &fakePostgresRows{}, nil
+}
+
+type fakePostgresRows struct {
+	done bool
+}
+
+func (rows *fakePostgresRows) Columns() []string {
+	return []string{"version"}
+}
+
+func (rows *fakePostgresRows) Close() error {
+	return nil
+}
+
+func (rows *fakePostgresRows) Next(dest []driver.Value) error {
+	if rows.done {
+		return io.EOF
+	}
+	rows.done = true
+	dest[0] = int64(LatestPostgresSchemaVersion())
+	return nil
+}
+
+func TestPostgresTable_CopyRows(t *testing.T) {
+	conn := &fakePostgresConn{copied: make(map[string][][]driver.Value)}
+	fakePostgres.conn = conn
+	postgresDriverName = "fakepostgres"
+	defer func() { postgresDriverName = "postgres" }()
+
+	table := newPostgresTable("bytes_per_hour", []string{"node_id", "timestamp"}, []string{"bytes"}, PostgresOptions{BatchSize: 2})
+	if err := table.begin(""); err != nil {
+		t.Fatal(err)
+	}
+	if !table.copying {
+		t.Fatalf("Should load rows using COPY")
+	}
+	var rows [][]driver.Value
+	for idx := int64(0); idx < 3; idx++ {
+		if err := table.write("node0", time.Unix(idx*3600, 0), idx); err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, []driver.Value{"node0", time.Unix(idx*3600, 0), idx})
+	}
+	if err := table.end(); err != nil {
+		t.Fatal(err)
+	}
+
+	if actual := conn.copied["bytes_per_hour_staging"]; !reflect.DeepEqual(actual, rows) {
+		t.Errorf("Should copy %v into the staging table, not %v", rows, actual)
+	}
+	if len(conn.copied) != 1 {
+		t.Errorf("Should only copy into the staging table, not %v", conn.copied)
+	}
+	// One COPY checks that the server supports it, and the others copy the
+	// two batches.
+	if conn.copies != 3 {
+		t.Errorf("Should finish 3 COPYs, not %d", conn.copies)
+	}
+	merges := 0
+	for _, statement := range conn.statements {
+		if statement == table.mergeStatements()[0] {
+			merges++
+		}
+	}
+	if merges != 2 {
+		t.Errorf("Should merge 2 batches, not %d: %q", merges, conn.statements)
+	}
+	if conn.commits != 1 || conn.rollbacks != 0 {
+		t.Errorf("Should commit once, not commit %d times and roll back %d times", conn.commits, conn.rollbacks)
+	}
+}
@@ -0,0 +1,311 @@
+package passive
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sburnett/lexicographic-tuples"
+	"github.com/sburnett/transformer"
+	"github.com/sburnett/transformer/store"
+)
+
+// The Postgres tables that the pipelines in this package populate, all of
+// which have a node_id column.
+var purgeNodePostgresTables = []string{
+	"bytes_per_device_per_hour",
+	"bytes_per_domain_per_hour",
+	"bytes_per_hour",
+}
+
+type purgeNode struct {
+	Schema *StoreSchema
+	// The lex encoded node ID, which prefixes the keys of most stores.
+	NodePrefix []byte
+	NodeId     string
+	// The node's tarballs are in this directory.
+	TarballsPrefix string
+}
+
+// Delete the node's tarballs and remove every record about nodeId from every
+// store whose keys contain a node ID or the path of a tarball, including the
+// indexed tarball bookkeeping. We assume the node's tarballs are in
+// tarballsPath/<nodeId>/, as UploadPipeline writes them. We delete the
+// tarballs first, since otherwise IndexTarballsPipeline would index them again
+// once we remove the bookkeeping.
+//
+// We write the path of every tarball and the key of every record we remove to
+// auditWriter, one per line after "tarballs" or the name of the store,
+// followed by the number we removed from each. If postgresStore isn't nil, we
+// also use it to remove the node from Postgres; see
+// NewPurgeNodePostgresStore.
+func PurgeNodePipeline(levelDbManager store.Manager, nodeId, tarballsPath string, postgresStore store.Writer, auditWriter io.Writer) transformer.Pipeline {
+	keptStore := levelDbManager.ReadingDeleter("purge-node-kept")
+	tarballsDirectory := filepath.Join(tarballsPath, nodeId)
+	stages := []transformer.PipelineStage{
+		transformer.PipelineStage{
+			Name:   "PurgeNodeTarballs",
+			Reader: &directoryFilesReader{directory: tarballsDirectory},
+			Writer: &fileRemovingStore{directory: tarballsDirectory, auditWriter: auditWriter},
+		},
+	}
+	for _, schema := range StoreSchemas() {
+		if !schema.hasNodeColumn() {
+			continue
+		}
+		parameters := purgeNode{
+			Schema:         schema,
+			NodePrefix:     lex.EncodeOrDie(nodeId),
+			NodeId:         nodeId,
+			TarballsPrefix: tarballsDirectory + string(filepath.Separator),
+		}
+		removedStore := &removedRecordsStore{writer: auditWriter, schema: schema, action: "purged", logKeys: true}
+		stages = append(stages, RemoveRecordsPipeline(levelDbManager.ReadingDeleter(schema.Name), keptStore, parameters, removedStore)...)
+	}
+	if postgresStore != nil {
+		nodesStore := store.SliceStore{}
+		nodesStore.BeginWriting()
+		nodesStore.WriteRecord(&store.Record{
+			Key: lex.EncodeOrDie(nodeId),
+		})
+		nodesStore.EndWriting()
+		stages = append(stages, transformer.PipelineStage{
+			Name:   "PurgeNodePostgres",
+			Reader: &nodesStore,
+			Writer: postgresStore,
+		})
+	}
+	return stages
+}
+
+// Reads the path of every file under a directory, which needn't exist.
+type directoryFilesReader struct {
+	directory string
+	paths     []string
+}
+
+func (reader *directoryFilesReader) BeginReading() error {
+	reader.paths = nil
+	err := filepath.Walk(reader.directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			reader.paths = append(reader.paths, path)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (reader *directoryFilesReader) ReadRecord() (*store.Record, error) {
+	if len(reader.paths) == 0 {
+		return nil, nil
+	}
+	path := reader.paths[0]
+	reader.paths = reader.paths[1:]
+	return &store.Record{
+		Key: lex.EncodeOrDie(path),
+	}, nil
+}
+
+func (reader *directoryFilesReader) EndReading() error {
+	return nil
+}
+
+// Deletes the files whose paths it's given, writes each path to auditWriter,
+// and then deletes the directory they were in.
+type fileRemovingStore struct {
+	directory   string
+	auditWriter io.Writer
+	removed     int64
+}
+
+func (store *fileRemovingStore) BeginWriting() error {
+	store.removed = 0
+	return nil
+}
+
+func (store *fileRemovingStore) WriteRecord(record *store.Record) error {
+	var path string
+	lex.DecodeOrDie(record.Key, &path)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	store.removed++
+	if _, err := fmt.Fprintf(store.auditWriter, "removed\ttarballs\t%s\n", path); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (store *fileRemovingStore) EndWriting() error {
+	if err := os.RemoveAll(store.directory); err != nil {
+		return err
+	}
+	if store.removed == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintf(store.auditWriter, "purged\ttarballs\t%d\n", store.removed); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Whether the store's keys tell us which node a record belongs to.
+func (schema *StoreSchema) hasNodeColumn() bool {
+	for _, column := range schema.Key {
+		if column.Name == "node_id" || column.Name == "tar_path" {
+			return true
+		}
+	}
+	return false
+}
+
+func (parameters purgeNode) removes(key []byte) bool {
+	if parameters.Schema.HasNodePrefix() {
+		return bytes.HasPrefix(key, parameters.NodePrefix)
+	}
+	values, err := decodeColumns(parameters.Schema.Key, key)
+	if err != nil {
+		return false
+	}
+	for idx, column := range parameters.Schema.Key {
+		switch column.Name {
+		case "node_id":
+			if values[idx].(string) == parameters.NodeId {
+				return true
+			}
+		case "tar_path":
+			if strings.HasPrefix(values[idx].(string), parameters.TarballsPrefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Send records we keep to the first writer and records we remove to the
+// second.
+func (parameters purgeNode) Do(inputChan, outputChan chan *store.Record) {
+	for record := range inputChan {
+		if parameters.removes(record.Key) {
+			record.DatabaseIndex = 1
+		} else {
+			record.DatabaseIndex = 0
+		}
+		outputChan <- record
+	}
+}
+
+// Counts the records we remove from a store, and optionally logs their keys.
+type removedRecordsStore struct {
+	writer  io.Writer
+	schema  *StoreSchema
+	action  string
+	logKeys bool
+	removed int64
+}
+
+func (store *removedRecordsStore) BeginWriting() error {
+	return nil
+}
+
+func (store *removedRecordsStore) WriteRecord(record *store.Record) error {
+	store.removed++
+	if !store.logKeys {
+		return nil
+	}
+	values, err := decodeColumns(store.schema.Key, record.Key)
+	var key string
+	if err != nil {
+		key = fmt.Sprintf("%q", record.Key)
+	} else if key, err = formatTsvLine(values); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(store.writer, "removed\t%s\t%s\n", store.schema.Name, key); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (store *removedRecordsStore) EndWriting() error {
+	if store.removed == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintf(store.writer, "%s\t%s\t%d\n", store.action, store.schema.Name, store.removed); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Removes nodes from every table in purgeNodePostgresTables and writes the
+// number of rows it removed to an audit log.
+type PurgeNodePostgresStore struct {
+	dataSourceName string
+	auditWriter    io.Writer
+	conn           *sql.DB
+	transaction    *sql.Tx
+}
+
+// Connect to Postgres using dataSourceName, or using the PG* environment
+// variables if it's empty.
+func NewPurgeNodePostgresStore(dataSourceName string, auditWriter io.Writer) *PurgeNodePostgresStore {
+	return &PurgeNodePostgresStore{dataSourceName: dataSourceName, auditWriter: auditWriter}
+}
+
+func (store *PurgeNodePostgresStore) BeginWriting() error {
+	conn, err := sql.Open(postgresDriverName, store.dataSourceName)
+	if err != nil {
+		return err
+	}
+	transaction, err := conn.Begin()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if _, err := transaction.Exec("SET search_path TO bismark_passive"); err != nil {
+		transaction.Rollback()
+		conn.Close()
+		return err
+	}
+	store.conn = conn
+	store.transaction = transaction
+	return nil
+}
+
+func (store *PurgeNodePostgresStore) WriteRecord(record *store.Record) error {
+	var nodeId []byte
+	lex.DecodeOrDie(record.Key, &nodeId)
+	for _, table := range purgeNodePostgresTables {
+		result, err := store.transaction.Exec(fmt.Sprintf("DELETE FROM %s WHERE node_id = $1", table), nodeId)
+		if err != nil {
+			return err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(store.auditWriter, "purged\tpostgres:%s\t%d\n", table, rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *PurgeNodePostgresStore) EndWriting() error {
+	if err := store.transaction.Commit(); err != nil {
+		return err
+	}
+	if err := store.conn.Close(); err != nil {
+		return err
+	}
+	return nil
+}
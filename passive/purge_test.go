@@ -0,0 +1,113 @@
+package passive
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sburnett/lexicographic-tuples"
+	"github.com/sburnett/transformer"
+	"github.com/sburnett/transformer/store"
+)
+
+// Print the decoded key of every record in each store.
+func printStoreKeys(levelDbManager store.Manager, names ...string) {
+	for _, name := range names {
+		reader := levelDbManager.Reader(name)
+		reader.BeginReading()
+		for {
+			record, err := reader.ReadRecord()
+			if err != nil {
+				panic(err)
+			}
+			if record == nil {
+				break
+			}
+			values, err := decodeColumns(LookupStoreSchema(name).Key, record.Key)
+			if err != nil {
+				panic(err)
+			}
+			line, err := formatTsvLine(values)
+			if err != nil {
+				panic(err)
+			}
+			fmt.Printf("kept\t%s\t%s\n", name, line)
+		}
+		reader.EndReading()
+	}
+}
+
+func ExamplePurgeNodePipeline() {
+	levelDbManager := store.NewSliceManager()
+	writeTraces(levelDbManager,
+		makeValidTraceContents("NODE1", 0),
+		makeValidTraceContents("NODE1", 1),
+		makeValidTraceContents("NODE10", 0),
+		makeValidTraceContents("NODE2", 0))
+	tarnamesIndexedStore := levelDbManager.Writer("tarnames-indexed")
+	tarnamesIndexedStore.BeginWriting()
+	for _, tarPath := range []string{"/tarballs/NODE1/2013-01-01/NODE1_1.tar.gz", "/tarballs/NODE10/2013-01-01/NODE10_1.tar.gz"} {
+		tarnamesIndexedStore.WriteRecord(&store.Record{
+			Key:   lex.EncodeOrDie(tarPath),
+			Value: lex.EncodeOrDie(int64(10), int64(20), "hash"),
+		})
+	}
+	tarnamesIndexedStore.EndWriting()
+	tracesFailedStore := levelDbManager.Writer("traces-failed")
+	tracesFailedStore.BeginWriting()
+	tracesFailedStore.WriteRecord(&store.Record{
+		Key:   lex.EncodeOrDie("/tarballs/NODE1/2013-01-01/NODE1_1.tar.gz", "bad.gz"),
+		Value: lex.EncodeOrDie([]byte("contents"), int32(0), int32(1), "message", "error"),
+	})
+	tracesFailedStore.EndWriting()
+
+	auditWriter := bytes.NewBuffer([]byte{})
+	transformer.RunPipeline(PurgeNodePipeline(levelDbManager, "NODE1", "/tarballs", nil, auditWriter))
+	fmt.Printf("%s", auditWriter.Bytes())
+
+	printStoreKeys(levelDbManager, "tarnames-indexed", "traces-failed", "traces")
+
+	// Output:
+	// removed	tarnames-indexed	/tarballs/NODE1/2013-01-01/NODE1_1.tar.gz
+	// purged	tarnames-indexed	1
+	// removed	traces-failed	/tarballs/NODE1/2013-01-01/NODE1_1.tar.gz	bad.gz
+	// purged	traces-failed	1
+	// removed	traces	NODE1		10	0
+	// removed	traces	NODE1		10	1
+	// purged	traces	2
+	// kept	tarnames-indexed	/tarballs/NODE10/2013-01-01/NODE10_1.tar.gz
+	// kept	traces	NODE10		10	0
+	// kept	traces	NODE2		10	0
+}
+
+// Purging a node deletes its tarballs, so indexing again doesn't bring its
+// traces back.
+func ExamplePurgeNodePipeline_reindex() {
+	tarballsPath, err := ioutil.TempDir("", "purge")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tarballsPath)
+	writeTestTarball(filepath.Join(tarballsPath, "NODE1", "2013-01-01", "NODE1_1.tar.gz"), time.Unix(100, 0), makeValidTraceContents("NODE1", 0))
+	writeTestTarball(filepath.Join(tarballsPath, "NODE2", "2013-01-01", "NODE2_1.tar.gz"), time.Unix(100, 0), makeValidTraceContents("NODE2", 0))
+
+	levelDbManager := store.NewSliceManager()
+	index := func() {
+		transformer.RunPipeline(IndexTarballsPipeline(tarballsPath, []string{"*/*/*.tar.gz"}, false, levelDbManager, ioutil.Discard))
+	}
+	index()
+	transformer.RunPipeline(PurgeNodePipeline(levelDbManager, "NODE1", tarballsPath, nil, ioutil.Discard))
+	index()
+
+	printStoreKeys(levelDbManager, "traces")
+	if _, err := os.Stat(filepath.Join(tarballsPath, "NODE1")); os.IsNotExist(err) {
+		fmt.Println("NODE1's tarballs are gone")
+	}
+
+	// Output:
+	// kept	traces	NODE2		10	0
+	// NODE1's tarballs are gone
+}
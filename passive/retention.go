@@ -0,0 +1,276 @@
+package passive
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/sburnett/lexicographic-tuples"
+	"github.com/sburnett/transformer"
+	"github.com/sburnett/transformer/store"
+)
+
+// The maximum age of the records in each store, keyed by store name. Stores
+// that aren't in the policy keep their records forever.
+type RetentionPolicy map[string]time.Duration
+
+type expireRecords struct {
+	Schema *StoreSchema
+	// Expire records whose key's first timestamp is before this time, in
+	// seconds since the epoch.
+	Horizon int64
+}
+
+// Stores that record ranges of traces, either the traces the incremental
+// pipelines have processed or the traces that are consistent enough to
+// process. If they expired before the traces themselves, the pipelines would
+// process those traces again, so they always expire along with the traces
+// store instead of having their own maximum ages. availability-intervals
+// isn't one of them: it's the history the dashboard plots, so it keeps its
+// own maximum age, if any.
+func expiresWithTraces(schema *StoreSchema) bool {
+	return schema.isTraceKeyRanges()
+}
+
+// Parse a retention policy. Each line contains a store name and the maximum
+// age of its records separated by whitespace. Ages are either "forever", a
+// number of days like "548d", or a duration that time.ParseDuration accepts.
+// Blank lines and lines starting with # are ignored.
+func ParseRetentionPolicy(reader io.Reader) (RetentionPolicy, error) {
+	policy := make(RetentionPolicy)
+	scanner := bufio.NewScanner(reader)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Line %d: expected a store name and a maximum age", lineNumber)
+		}
+		if fields[1] == "forever" {
+			continue
+		}
+		age, err := ParseRetentionAge(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", lineNumber, err)
+		}
+		policy[fields[0]] = age
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Parse a number of days like "548d", or a duration that time.ParseDuration
+// accepts.
+func ParseRetentionAge(age string) (time.Duration, error) {
+	if strings.HasSuffix(age, "d") {
+		days, err := strconv.ParseInt(strings.TrimSuffix(age, "d"), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid age %q", age)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	duration, err := time.ParseDuration(age)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid age %q", age)
+	}
+	return duration, nil
+}
+
+// Check that we can expire records from every store in the policy.
+func (policy RetentionPolicy) Validate() error {
+	for name, age := range policy {
+		schema := LookupStoreSchema(name)
+		if schema == nil {
+			return fmt.Errorf("Unknown store %q", name)
+		}
+		if age <= 0 {
+			return fmt.Errorf("%s must have a positive maximum age", name)
+		}
+		if schema.TimeColumn() < 0 {
+			return fmt.Errorf("Can't expire records from %s because its keys don't contain a timestamp", name)
+		}
+		if expiresWithTraces(schema) {
+			return fmt.Errorf("%s expires along with traces, so it can't have its own maximum age", name)
+		}
+	}
+	return nil
+}
+
+// Remove records that are older than the maximum age of their store in policy,
+// and write the number of records we removed from each store to auditWriter.
+// now is in seconds since the epoch.
+//
+// We judge most records' ages by the first timestamp in their keys. Keys of
+// traces and other session-derived stores begin with the session ID, which is
+// when the node's process started, and a session can run for months. So we
+// judge those records by the session's last trace, using its
+// TraceCreationTimestamp, and expire whole sessions at a time once their last
+// trace is older than the maximum age. We only fall back to the session ID
+// for sessions whose traces are already gone.
+//
+// Pipelines that incrementally process traces remember which traces they've
+// processed, and availability records which traces are consistent. We expire
+// those records along with the traces they describe, so pipelines never
+// process an expired trace, nor process a trace again because we expired its
+// bookkeeping early.
+func ExpireRecordsPipeline(levelDbManager store.Manager, policy RetentionPolicy, now int64, auditWriter io.Writer) transformer.Pipeline {
+	keptStore := levelDbManager.ReadingDeleter("expire-records-kept")
+	lastTracesStore := levelDbManager.ReadingDeleter("expire-records-last-traces")
+	stages := []transformer.PipelineStage{
+		transformer.PipelineStage{
+			Name:        "FindSessionLastTraces",
+			Reader:      levelDbManager.Reader("traces"),
+			Transformer: transformer.TransformFunc(sessionLastTraces),
+			Writer:      store.NewTruncatingWriter(lastTracesStore),
+		},
+	}
+	for _, schema := range StoreSchemas() {
+		var age time.Duration
+		var found bool
+		if expiresWithTraces(schema) {
+			age, found = policy["traces"]
+		} else {
+			age, found = policy[schema.Name]
+		}
+		if !found {
+			continue
+		}
+		parameters := expireRecords{
+			Schema:  schema,
+			Horizon: now - int64(age/time.Second),
+		}
+		recordsStore := levelDbManager.ReadingDeleter(schema.Name)
+		removedStore := &removedRecordsStore{writer: auditWriter, schema: schema, action: "expired"}
+		if schema.hasSessionPrefix() {
+			stages = append(stages, expireSessionsPipeline(recordsStore, keptStore, lastTracesStore, parameters, removedStore)...)
+		} else {
+			stages = append(stages, RemoveRecordsPipeline(recordsStore, keptStore, parameters, removedStore)...)
+		}
+	}
+	return append(stages, clearStoreStage(lastTracesStore))
+}
+
+func (parameters expireRecords) Do(inputChan, outputChan chan *store.Record) {
+	for record := range inputChan {
+		timestamp, err := parameters.Schema.KeyTime(record.Key)
+		if err == nil && timestamp < parameters.Horizon {
+			record.DatabaseIndex = 1
+		} else {
+			record.DatabaseIndex = 0
+		}
+		outputChan <- record
+	}
+}
+
+// The latest TraceCreationTimestamp of each session's traces, in seconds since
+// the epoch, keyed by session. Sessions whose traces don't have creation
+// timestamps are left out.
+func sessionLastTraces(inputChan, outputChan chan *store.Record) {
+	var session SessionKey
+	grouper := transformer.GroupRecords(inputChan, &session)
+	for grouper.NextGroup() {
+		var lastTrace int64
+		found := false
+		for grouper.NextRecord() {
+			record := grouper.Read()
+			var trace Trace
+			if err := proto.Unmarshal(record.Value, &trace); err != nil {
+				log.Printf("Error unmarshaling protocol buffer: %v", err)
+				continue
+			}
+			if trace.TraceCreationTimestamp == nil {
+				continue
+			}
+			if !found || trace.GetTraceCreationTimestamp() > lastTrace {
+				lastTrace = trace.GetTraceCreationTimestamp()
+				found = true
+			}
+		}
+		if found {
+			outputChan <- &store.Record{
+				Key:   lex.EncodeOrDie(&session),
+				Value: lex.EncodeOrDie(lastTrace),
+			}
+		}
+	}
+}
+
+// Like RemoveRecordsPipeline, but judges each session's records by the
+// session's last trace in lastTracesStore.
+func expireSessionsPipeline(recordsStore, keptStore store.ReadingDeleter, lastTracesStore store.Reader, parameters expireRecords, removedStore store.Writer) []transformer.PipelineStage {
+	return []transformer.PipelineStage{
+		transformer.PipelineStage{
+			Name:        "ExpireSessions",
+			Reader:      &emptyScratchReader{Reader: store.NewDemuxingReader(recordsStore, lastTracesStore), scratch: keptStore},
+			Transformer: expireSessions(parameters),
+			Writer:      store.NewMuxingWriter(store.NewTruncatingWriter(keptStore), removedStore),
+		},
+		transformer.PipelineStage{
+			Name:   "RestoreKeptRecords",
+			Reader: keptStore,
+			Writer: store.NewTruncatingWriter(recordsStore),
+		},
+		clearStoreStage(keptStore),
+	}
+}
+
+type expireSessions expireRecords
+
+func (parameters expireSessions) Do(inputChan, outputChan chan *store.Record) {
+	var session SessionKey
+	grouper := transformer.GroupRecords(inputChan, &session)
+	for grouper.NextGroup() {
+		// A session's last trace sorts before its records, except records
+		// keyed by the session alone, so we rarely hold on to any records.
+		var pending []*store.Record
+		var lastTrace int64
+		found := false
+		expire := func(record *store.Record) {
+			timestamp := lastTrace
+			if !found {
+				timestamp = convertMicrosecondsToSeconds(session.SessionId)
+			}
+			if timestamp < parameters.Horizon {
+				record.DatabaseIndex = 1
+			} else {
+				record.DatabaseIndex = 0
+			}
+			outputChan <- record
+		}
+		for grouper.NextRecord() {
+			record := grouper.Read()
+			switch record.DatabaseIndex {
+			case 0:
+				if found {
+					expire(record)
+				} else {
+					pending = append(pending, record)
+				}
+			case 1:
+				lex.DecodeOrDie(record.Value, &lastTrace)
+				found = true
+				for _, pendingRecord := range pending {
+					expire(pendingRecord)
+				}
+				pending = nil
+			}
+		}
+		for _, pendingRecord := range pending {
+			expire(pendingRecord)
+		}
+	}
+}
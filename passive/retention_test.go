@@ -0,0 +1,126 @@
+package passive
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/sburnett/lexicographic-tuples"
+	"github.com/sburnett/transformer"
+	"github.com/sburnett/transformer/store"
+)
+
+func TestParseRetentionPolicy(t *testing.T) {
+	policy, err := ParseRetentionPolicy(strings.NewReader("# Comment\ntraces 548d\n\nbytesperminute  36h\nbytesperhour forever\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policy) != 2 || policy["traces"] != 548*24*time.Hour || policy["bytesperminute"] != 36*time.Hour {
+		t.Fatalf("Unexpected retention policy: %v", policy)
+	}
+
+	invalidPolicies := []string{
+		"traces\n",
+		"traces 1d extra\n",
+		"traces 1y\n",
+		"traces -1d\n",
+		"not-a-store 1d\n",
+		"availability-nodes 1d\n",
+		"availability-done 1d\n",
+		"bytesperdevice-trace-key-ranges 1d\n",
+		"consistent-ranges 1d\n",
+	}
+	for _, invalid := range invalidPolicies {
+		if _, err := ParseRetentionPolicy(strings.NewReader(invalid)); err == nil {
+			t.Errorf("Expected an error parsing %q", invalid)
+		}
+	}
+}
+
+func ExampleExpireRecordsPipeline() {
+	levelDbManager := store.NewSliceManager()
+	writeTraces(levelDbManager,
+		makeValidTraceContents("NODE", 0),
+		makeValidTraceContents("NODE", 1))
+	day := int64(24 * 60 * 60)
+	tracesStore := levelDbManager.Writer("traces")
+	tracesStore.BeginWriting()
+	tracesStore.WriteRecord(&store.Record{Key: lex.EncodeOrDie("NODE", "", 10*day*1000000, int32(0))})
+	tracesStore.EndWriting()
+	doneStore := levelDbManager.Writer("availability-done")
+	doneStore.BeginWriting()
+	doneStore.WriteRecord(&store.Record{Key: lex.EncodeOrDie("NODE", "", int64(10), int32(0)), Value: lex.EncodeOrDie("NODE", "", int64(10), int32(1))})
+	doneStore.WriteRecord(&store.Record{Key: lex.EncodeOrDie("NODE", "", 10*day*1000000, int32(0)), Value: lex.EncodeOrDie("NODE", "", 10*day*1000000, int32(0))})
+	doneStore.EndWriting()
+	bytesPerHourStore := levelDbManager.Writer("bytesperhour")
+	bytesPerHourStore.BeginWriting()
+	bytesPerHourStore.WriteRecord(&store.Record{Key: lex.EncodeOrDie("NODE", 3*day), Value: lex.EncodeOrDie(int64(10))})
+	bytesPerHourStore.WriteRecord(&store.Record{Key: lex.EncodeOrDie("NODE", 5*day), Value: lex.EncodeOrDie(int64(20))})
+	bytesPerHourStore.EndWriting()
+
+	policy := RetentionPolicy{
+		"traces":       5 * 24 * time.Hour,
+		"bytesperhour": 6 * 24 * time.Hour,
+	}
+	writer := bytes.NewBuffer([]byte{})
+	transformer.RunPipeline(ExpireRecordsPipeline(levelDbManager, policy, 10*day, writer))
+	fmt.Printf("%s", writer.Bytes())
+	printStoreKeys(levelDbManager, "traces", "availability-done", "bytesperhour")
+
+	// Output:
+	// expired	traces	2
+	// expired	availability-done	1
+	// expired	bytesperhour	1
+	// kept	traces	NODE		864000000000	0
+	// kept	availability-done	NODE		864000000000	0
+	// kept	bytesperhour	NODE	432000
+}
+
+// Sessions expire once their last trace is older than the maximum age, no
+// matter when they began, and availability-intervals keeps its history.
+func ExampleExpireRecordsPipeline_longSession() {
+	levelDbManager := store.NewSliceManager()
+	day := int64(24 * 60 * 60)
+	tracesStore := levelDbManager.Writer("traces")
+	tracesStore.BeginWriting()
+	for _, trace := range []*Trace{
+		{NodeId: proto.String("NODE"), ProcessStartTimeMicroseconds: proto.Int64(day * 1000000), SequenceNumber: proto.Int32(0), TraceCreationTimestamp: proto.Int64(day)},
+		{NodeId: proto.String("NODE"), ProcessStartTimeMicroseconds: proto.Int64(day * 1000000), SequenceNumber: proto.Int32(1), TraceCreationTimestamp: proto.Int64(9 * day)},
+		{NodeId: proto.String("NODE"), ProcessStartTimeMicroseconds: proto.Int64(2 * day * 1000000), SequenceNumber: proto.Int32(0), TraceCreationTimestamp: proto.Int64(2 * day)},
+	} {
+		value, err := proto.Marshal(trace)
+		if err != nil {
+			panic(err)
+		}
+		tracesStore.WriteRecord(&store.Record{Key: traceKey(trace), Value: value})
+	}
+	tracesStore.EndWriting()
+	doneStore := levelDbManager.Writer("availability-done")
+	doneStore.BeginWriting()
+	doneStore.WriteRecord(&store.Record{Key: lex.EncodeOrDie("NODE", "", day*1000000, int32(0)), Value: lex.EncodeOrDie("NODE", "", day*1000000, int32(1))})
+	doneStore.WriteRecord(&store.Record{Key: lex.EncodeOrDie("NODE", "", 2*day*1000000, int32(0)), Value: lex.EncodeOrDie("NODE", "", 2*day*1000000, int32(0))})
+	doneStore.EndWriting()
+	intervalsStore := levelDbManager.Writer("availability-intervals")
+	intervalsStore.BeginWriting()
+	intervalsStore.WriteRecord(&store.Record{Key: lex.EncodeOrDie("NODE", "", day*1000000, int32(0), int32(1)), Value: lex.EncodeOrDie(day, 9*day)})
+	intervalsStore.WriteRecord(&store.Record{Key: lex.EncodeOrDie("NODE", "", 2*day*1000000, int32(0), int32(0)), Value: lex.EncodeOrDie(2*day, 2*day)})
+	intervalsStore.EndWriting()
+
+	policy := RetentionPolicy{"traces": 5 * 24 * time.Hour}
+	writer := bytes.NewBuffer([]byte{})
+	transformer.RunPipeline(ExpireRecordsPipeline(levelDbManager, policy, 10*day, writer))
+	fmt.Printf("%s", writer.Bytes())
+	printStoreKeys(levelDbManager, "traces", "availability-done", "availability-intervals")
+
+	// Output:
+	// expired	traces	1
+	// expired	availability-done	1
+	// kept	traces	NODE		86400000000	0
+	// kept	traces	NODE		86400000000	1
+	// kept	availability-done	NODE		86400000000	0
+	// kept	availability-intervals	NODE		86400000000	0	1
+	// kept	availability-intervals	NODE		172800000000	0	0
+}
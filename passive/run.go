@@ -0,0 +1,309 @@
+package passive
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/sburnett/lexicographic-tuples"
+	"github.com/sburnett/transformer"
+	"github.com/sburnett/transformer/store"
+)
+
+type pipelineDependencies struct {
+	// Other pipelines whose stages this pipeline includes, and whose stores
+	// it therefore also writes.
+	Includes []string
+	// The stores this pipeline reads that other pipelines write.
+	Inputs []string
+	// After the pipeline runs, this store contains one record per new input it
+	// processed. If it's empty, the run didn't change the pipeline's outputs.
+	// Pipelines without inputs always run, since their inputs are outside
+	// the leveldbs; the others run when their inputs change.
+	NewInputsStore string
+}
+
+// The pipelines that RunPipelines can schedule, keyed by the exported
+// function that constructs each pipeline, as in StoreSchema.Pipeline.
+var schedulablePipelines = map[string]pipelineDependencies{
+	"IndexTarballsPipeline": {
+		Includes:       []string{"DuplicateTracesPipeline"},
+		NewInputsStore: "traces-new-keys",
+	},
+	"AvailabilityPipeline":        {Inputs: []string{"traces"}},
+	"BytesPerMinutePipeline":      {Inputs: []string{"traces"}},
+	"BytesPerDevicePipeline":      {Inputs: []string{"traces", "consistent-ranges"}},
+	"BytesPerDomainPipeline":      {Inputs: []string{"traces", "consistent-ranges"}},
+	"LookupsPerDevicePipeline":    {Inputs: []string{"traces", "consistent-ranges", "bytesperdomain-address-id-table"}},
+	"AggregateStatisticsPipeline": {Inputs: []string{"traces", "consistent-ranges"}},
+}
+
+// The names of the pipelines RunPipelines can schedule.
+func SchedulablePipelineNames() []string {
+	var names []string
+	for name := range schedulablePipelines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The pipeline that writes a store, accounting for pipelines that include
+// other pipelines.
+func storeWriter(name string) string {
+	schema := LookupStoreSchema(name)
+	if schema == nil {
+		return ""
+	}
+	for pipeline, dependencies := range schedulablePipelines {
+		for _, included := range dependencies.Includes {
+			if included == schema.Pipeline {
+				return pipeline
+			}
+		}
+	}
+	return schema.Pipeline
+}
+
+// The stores a pipeline writes, including those of the pipelines it includes.
+func pipelineOutputs(pipeline string) map[string]bool {
+	outputs := make(map[string]bool)
+	for _, schema := range StoreSchemas() {
+		if storeWriter(schema.Name) == pipeline {
+			outputs[schema.Name] = true
+		}
+	}
+	return outputs
+}
+
+// The stores a pipeline reads or writes.
+func pipelineStores(pipeline string) map[string]bool {
+	stores := pipelineOutputs(pipeline)
+	for _, input := range schedulablePipelines[pipeline].Inputs {
+		stores[input] = true
+	}
+	return stores
+}
+
+// Whether two pipelines would interfere if they ran at the same time, because
+// they use a store in common. Even concurrent reads of a store interfere, since
+// the pipelines share one store.Manager.
+func pipelinesConflict(first, second string) bool {
+	secondStores := pipelineStores(second)
+	for name := range pipelineStores(first) {
+		if secondStores[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// When each pipeline last completed and last changed its outputs, as
+// generations of the run-completions store. Generations increase by one every
+// time any pipeline completes.
+type runCompletion struct {
+	CompletedGeneration int64
+	ChangedGeneration   int64
+}
+
+func readRunCompletions(levelDbManager store.Manager) (map[string]runCompletion, error) {
+	reader := levelDbManager.Reader("run-completions")
+	if err := reader.BeginReading(); err != nil {
+		return nil, err
+	}
+	completions := make(map[string]runCompletion)
+	for {
+		record, err := reader.ReadRecord()
+		if err != nil {
+			return nil, err
+		}
+		if record == nil {
+			break
+		}
+		var pipeline string
+		var completion runCompletion
+		lex.DecodeOrDie(record.Key, &pipeline)
+		lex.DecodeOrDie(record.Value, &completion.CompletedGeneration, &completion.ChangedGeneration)
+		completions[pipeline] = completion
+	}
+	if err := reader.EndReading(); err != nil {
+		return nil, err
+	}
+	return completions, nil
+}
+
+func writeRunCompletion(levelDbManager store.Manager, pipeline string, completion runCompletion) error {
+	writer := runsWriter{levelDbManager.Writer("run-completions")}
+	if err := writer.BeginWriting(); err != nil {
+		return err
+	}
+	if err := writer.WriteRecord(&store.Record{
+		Key:   lex.EncodeOrDie(pipeline),
+		Value: lex.EncodeOrDie(completion.CompletedGeneration, completion.ChangedGeneration),
+	}); err != nil {
+		return err
+	}
+	return writer.EndWriting()
+}
+
+func storeIsEmpty(levelDbManager store.Manager, name string) (bool, error) {
+	return readerIsEmpty(levelDbManager.Reader(name))
+}
+
+type pipelineScheduler struct {
+	levelDbManager store.Manager
+	thunks         map[string]transformer.PipelineThunk
+	force          bool
+
+	completions map[string]runCompletion
+	generation  int64
+	// Pipelines we're running or finished running or skipping.
+	running, done map[string]bool
+}
+
+// Why a pipeline needs to run, or the empty string if it's up to date.
+func (scheduler *pipelineScheduler) staleReason(pipeline string) string {
+	if scheduler.force {
+		return "forced"
+	}
+	completion, found := scheduler.completions[pipeline]
+	if !found {
+		return "never ran"
+	}
+	inputs := schedulablePipelines[pipeline].Inputs
+	if len(inputs) == 0 {
+		return "external inputs"
+	}
+	for _, input := range inputs {
+		writer := storeWriter(input)
+		if scheduler.completions[writer].ChangedGeneration > completion.CompletedGeneration {
+			return fmt.Sprintf("%s changed", input)
+		}
+	}
+	return ""
+}
+
+// Whether the pipeline's dependencies have finished, and it doesn't conflict
+// with any running pipeline.
+func (scheduler *pipelineScheduler) ready(pipeline string) bool {
+	for _, input := range schedulablePipelines[pipeline].Inputs {
+		writer := storeWriter(input)
+		if _, scheduled := scheduler.thunks[writer]; scheduled && writer != pipeline && !scheduler.done[writer] {
+			return false
+		}
+	}
+	for running := range scheduler.running {
+		if pipelinesConflict(pipeline, running) {
+			return false
+		}
+	}
+	return true
+}
+
+func (scheduler *pipelineScheduler) complete(pipeline string) error {
+	changed := true
+	if newInputsStore := schedulablePipelines[pipeline].NewInputsStore; newInputsStore != "" {
+		empty, err := storeIsEmpty(scheduler.levelDbManager, newInputsStore)
+		if err != nil {
+			return err
+		}
+		changed = !empty
+	}
+	scheduler.generation++
+	completion := runCompletion{
+		CompletedGeneration: scheduler.generation,
+		ChangedGeneration:   scheduler.completions[pipeline].ChangedGeneration,
+	}
+	if changed {
+		completion.ChangedGeneration = scheduler.generation
+	}
+	scheduler.completions[pipeline] = completion
+	return writeRunCompletion(scheduler.levelDbManager, pipeline, completion)
+}
+
+// Run pipelines in dependency order, skipping those whose inputs haven't
+// changed since they last ran unless force is true. thunks construct the
+// pipelines to run, keyed by names from SchedulablePipelineNames. We run up to
+// parallelism pipelines at once, as long as none of them uses a store that
+// another uses. Pipelines wrapped in RecordRunPipeline all write the
+// runs stores, so they take turns doing so. All the pipelines must use
+// levelDbManager, where we record when each pipeline ran in the run-completions
+// store.
+//
+// We write a line to writer whenever we start, finish or skip a pipeline.
+func RunPipelines(levelDbManager store.Manager, thunks map[string]transformer.PipelineThunk, force bool, parallelism int, writer io.Writer) error {
+	if parallelism < 1 {
+		return fmt.Errorf("Parallelism must be at least 1")
+	}
+	var names []string
+	for name := range thunks {
+		if _, found := schedulablePipelines[name]; !found {
+			return fmt.Errorf("Can't schedule unknown pipeline %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	completions, err := readRunCompletions(levelDbManager)
+	if err != nil {
+		return err
+	}
+	scheduler := pipelineScheduler{
+		levelDbManager: levelDbManager,
+		thunks:         thunks,
+		force:          force,
+		completions:    completions,
+		running:        make(map[string]bool),
+		done:           make(map[string]bool),
+	}
+	for _, completion := range completions {
+		if completion.CompletedGeneration > scheduler.generation {
+			scheduler.generation = completion.CompletedGeneration
+		}
+	}
+
+	type result struct {
+		pipeline string
+		duration time.Duration
+	}
+	results := make(chan result, len(names))
+	for len(scheduler.done) < len(names) {
+		// Start or skip the first ready pipeline in name order, and repeat
+		// until nothing else is ready, since skipping a pipeline can make
+		// pipelines before it ready.
+		for progress := true; progress && len(scheduler.running) < parallelism; {
+			progress = false
+			for _, name := range names {
+				if scheduler.done[name] || scheduler.running[name] || !scheduler.ready(name) {
+					continue
+				}
+				progress = true
+				reason := scheduler.staleReason(name)
+				if reason == "" {
+					fmt.Fprintf(writer, "skip\t%s\tup to date\n", name)
+					scheduler.done[name] = true
+					break
+				}
+				fmt.Fprintf(writer, "run\t%s\t%s\n", name, reason)
+				scheduler.running[name] = true
+				go func(name string) {
+					start := time.Now()
+					transformer.RunPipeline(thunks[name]())
+					results <- result{pipeline: name, duration: time.Since(start)}
+				}(name)
+				break
+			}
+		}
+		if len(scheduler.running) == 0 {
+			break
+		}
+		finished := <-results
+		delete(scheduler.running, finished.pipeline)
+		scheduler.done[finished.pipeline] = true
+		if err := scheduler.complete(finished.pipeline); err != nil {
+			return err
+		}
+		fmt.Fprintf(writer, "done\t%s\t%s\n", finished.pipeline, finished.duration)
+	}
+	return nil
+}
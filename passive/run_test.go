@@ -0,0 +1,292 @@
+package passive
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sburnett/lexicographic-tuples"
+	"github.com/sburnett/transformer"
+	"github.com/sburnett/transformer/store"
+)
+
+func TestSchedulablePipelines_Consistent(t *testing.T) {
+	for pipeline, dependencies := range schedulablePipelines {
+		if len(pipelineOutputs(pipeline)) == 0 {
+			t.Errorf("%s doesn't write any stores", pipeline)
+		}
+		for _, input := range dependencies.Inputs {
+			writer := storeWriter(input)
+			if _, found := schedulablePipelines[writer]; !found {
+				t.Errorf("%s reads %s, which no schedulable pipeline writes", pipeline, input)
+			}
+			if writer == pipeline {
+				t.Errorf("%s reads its own output %s", pipeline, input)
+			}
+		}
+		if dependencies.NewInputsStore != "" && storeWriter(dependencies.NewInputsStore) != pipeline {
+			t.Errorf("%s doesn't write %s", pipeline, dependencies.NewInputsStore)
+		}
+	}
+}
+
+func TestPipelinesConflict(t *testing.T) {
+	conflicts := [][2]string{
+		{"IndexTarballsPipeline", "AvailabilityPipeline"},
+		{"AvailabilityPipeline", "BytesPerDevicePipeline"},
+		{"BytesPerDomainPipeline", "LookupsPerDevicePipeline"},
+		// These only read stores in common.
+		{"BytesPerDevicePipeline", "BytesPerDomainPipeline"},
+		{"BytesPerMinutePipeline", "AvailabilityPipeline"},
+		{"AggregateStatisticsPipeline", "LookupsPerDevicePipeline"},
+	}
+	for _, pipelines := range conflicts {
+		if !pipelinesConflict(pipelines[0], pipelines[1]) || !pipelinesConflict(pipelines[1], pipelines[0]) {
+			t.Errorf("Expected %s and %s to conflict", pipelines[0], pipelines[1])
+		}
+	}
+}
+
+func TestRunPipelines(t *testing.T) {
+	levelDbManager := store.NewSliceManager()
+	newTraces := 1
+	thunks := make(map[string]transformer.PipelineThunk)
+	for _, name := range SchedulablePipelineNames() {
+		thunks[name] = func() transformer.Pipeline { return transformer.Pipeline{} }
+	}
+	thunks["IndexTarballsPipeline"] = func() transformer.Pipeline {
+		newKeysStore := levelDbManager.Deleter("traces-new-keys")
+		newKeysStore.BeginWriting()
+		newKeysStore.DeleteAllRecords()
+		for idx := 0; idx < newTraces; idx++ {
+			newKeysStore.WriteRecord(&store.Record{Key: lex.EncodeOrDie("NODE", "", int64(0), int32(idx))})
+		}
+		newKeysStore.EndWriting()
+		return transformer.Pipeline{}
+	}
+	durations := regexp.MustCompile(`(?m)^(done\t\w+)\t.*$`)
+	run := func(force bool) string {
+		writer := bytes.NewBuffer([]byte{})
+		if err := RunPipelines(levelDbManager, thunks, force, 1, writer); err != nil {
+			t.Fatal(err)
+		}
+		return durations.ReplaceAllString(writer.String(), "$1")
+	}
+
+	expected := strings.Join([]string{
+		"run\tIndexTarballsPipeline\tnever ran",
+		"done\tIndexTarballsPipeline",
+		"run\tAvailabilityPipeline\tnever ran",
+		"done\tAvailabilityPipeline",
+		"run\tAggregateStatisticsPipeline\tnever ran",
+		"done\tAggregateStatisticsPipeline",
+		"run\tBytesPerDevicePipeline\tnever ran",
+		"done\tBytesPerDevicePipeline",
+		"run\tBytesPerDomainPipeline\tnever ran",
+		"done\tBytesPerDomainPipeline",
+		"run\tBytesPerMinutePipeline\tnever ran",
+		"done\tBytesPerMinutePipeline",
+		"run\tLookupsPerDevicePipeline\tnever ran",
+		"done\tLookupsPerDevicePipeline",
+	}, "\n") + "\n"
+	if output := run(false); output != expected {
+		t.Fatalf("Expected:\n%s\nGot:\n%s", expected, output)
+	}
+
+	newTraces = 0
+	expected = strings.Join([]string{
+		"run\tIndexTarballsPipeline\texternal inputs",
+		"done\tIndexTarballsPipeline",
+		"skip\tAvailabilityPipeline\tup to date",
+		"skip\tAggregateStatisticsPipeline\tup to date",
+		"skip\tBytesPerDevicePipeline\tup to date",
+		"skip\tBytesPerDomainPipeline\tup to date",
+		"skip\tBytesPerMinutePipeline\tup to date",
+		"skip\tLookupsPerDevicePipeline\tup to date",
+	}, "\n") + "\n"
+	if output := run(false); output != expected {
+		t.Fatalf("Expected:\n%s\nGot:\n%s", expected, output)
+	}
+
+	newTraces = 2
+	delete(thunks, "AvailabilityPipeline")
+	expected = strings.Join([]string{
+		"run\tIndexTarballsPipeline\texternal inputs",
+		"done\tIndexTarballsPipeline",
+		"run\tAggregateStatisticsPipeline\ttraces changed",
+		"done\tAggregateStatisticsPipeline",
+		"run\tBytesPerDevicePipeline\ttraces changed",
+		"done\tBytesPerDevicePipeline",
+		"run\tBytesPerDomainPipeline\ttraces changed",
+		"done\tBytesPerDomainPipeline",
+		"run\tBytesPerMinutePipeline\ttraces changed",
+		"done\tBytesPerMinutePipeline",
+		"run\tLookupsPerDevicePipeline\ttraces changed",
+		"done\tLookupsPerDevicePipeline",
+	}, "\n") + "\n"
+	if output := run(false); output != expected {
+		t.Fatalf("Expected:\n%s\nGot:\n%s", expected, output)
+	}
+}
+
+// Blocks until every pipeline sharing the barrier has begun reading.
+type barrierReader struct {
+	barrier *sync.WaitGroup
+}
+
+func (reader *barrierReader) BeginReading() error {
+	reader.barrier.Done()
+	reader.barrier.Wait()
+	return nil
+}
+
+func (reader *barrierReader) ReadRecord() (*store.Record, error) {
+	return nil, nil
+}
+
+func (reader *barrierReader) EndReading() error {
+	return nil
+}
+
+// Pipelines running in parallel all record their runs.
+func TestRunPipelines_RecordsParallelRuns(t *testing.T) {
+	levelDbManager := store.NewSliceManager()
+	var barrier sync.WaitGroup
+	names := []string{"AvailabilityPipeline", "BytesPerMinutePipeline"}
+	barrier.Add(len(names))
+	thunks := make(map[string]transformer.PipelineThunk)
+	for _, name := range names {
+		name := name
+		thunks[name] = func() transformer.Pipeline {
+			return RecordRunPipeline(levelDbManager, name, "build", transformer.Pipeline{
+				transformer.PipelineStage{
+					Name:   "Wait",
+					Reader: &barrierReader{barrier: &barrier},
+					Writer: levelDbManager.Writer(name),
+				},
+			})
+		}
+	}
+	if err := RunPipelines(levelDbManager, thunks, false, len(names), bytes.NewBuffer([]byte{})); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expectedRecords := range map[string]int{"runs": 2, "runs-stages": 2, "run-completions": 2} {
+		reader := levelDbManager.Reader(name)
+		if err := reader.BeginReading(); err != nil {
+			t.Fatal(err)
+		}
+		records := 0
+		for {
+			record, err := reader.ReadRecord()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if record == nil {
+				break
+			}
+			records++
+			if name == "runs" {
+				var endTime int64
+				lex.DecodeOrDie(record.Value, &endTime)
+				if endTime == 0 {
+					t.Errorf("Run %q didn't finish", record.Key)
+				}
+			}
+		}
+		if err := reader.EndReading(); err != nil {
+			t.Fatal(err)
+		}
+		if records != expectedRecords {
+			t.Errorf("%s should contain %d records, not %d", name, expectedRecords, records)
+		}
+	}
+}
+
+// Counts how many readers are reading at once.
+type concurrencyCountingReader struct {
+	store.Reader
+	mutex         *sync.Mutex
+	current, most *int
+}
+
+func (reader *concurrencyCountingReader) BeginReading() error {
+	reader.mutex.Lock()
+	*reader.current++
+	if *reader.current > *reader.most {
+		*reader.most = *reader.current
+	}
+	reader.mutex.Unlock()
+	return reader.Reader.BeginReading()
+}
+
+func (reader *concurrencyCountingReader) EndReading() error {
+	reader.mutex.Lock()
+	*reader.current--
+	reader.mutex.Unlock()
+	return reader.Reader.EndReading()
+}
+
+// Pipelines that read the same LevelDB store take turns, however many we may
+// run at once.
+func TestRunPipelines_SharedInputsLevelDb(t *testing.T) {
+	dbRoot, err := ioutil.TempDir("", "run-pipelines")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbRoot)
+	levelDbManager := store.NewLevelDbManager(dbRoot)
+	writeTraces(levelDbManager,
+		makeValidTraceContents("NODE", 0),
+		makeValidTraceContents("NODE", 1))
+
+	var mutex sync.Mutex
+	var current, most int
+	names := []string{"AvailabilityPipeline", "BytesPerDevicePipeline", "BytesPerMinutePipeline"}
+	thunks := make(map[string]transformer.PipelineThunk)
+	for _, name := range names {
+		name := name
+		thunks[name] = func() transformer.Pipeline {
+			return transformer.Pipeline{
+				transformer.PipelineStage{
+					Name:   "CopyTraces",
+					Reader: &concurrencyCountingReader{Reader: levelDbManager.Reader("traces"), mutex: &mutex, current: &current, most: &most},
+					Writer: levelDbManager.Writer(name + "-copy"),
+				},
+			}
+		}
+	}
+	if err := RunPipelines(levelDbManager, thunks, false, len(names), bytes.NewBuffer([]byte{})); err != nil {
+		t.Fatal(err)
+	}
+	if most != 1 {
+		t.Errorf("%d pipelines read traces at once", most)
+	}
+	for _, name := range names {
+		reader := levelDbManager.Reader(name + "-copy")
+		if err := reader.BeginReading(); err != nil {
+			t.Fatal(err)
+		}
+		records := 0
+		for {
+			record, err := reader.ReadRecord()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if record == nil {
+				break
+			}
+			records++
+		}
+		if err := reader.EndReading(); err != nil {
+			t.Fatal(err)
+		}
+		if records != 2 {
+			t.Errorf("%s should copy 2 traces, not %d", name, records)
+		}
+	}
+}
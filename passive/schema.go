@@ -0,0 +1,789 @@
+package passive
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/sburnett/lexicographic-tuples"
+	"github.com/sburnett/transformer/store"
+)
+
+// The type of one element of a store's key or value tuple.
+type ColumnType int
+
+const (
+	// A string or []byte.
+	StringColumn ColumnType = iota
+	BoolColumn
+	Int32Column
+	Int64Column
+	// An int64 timestamp in seconds since the epoch.
+	SecondsColumn
+	// An int64 timestamp in microseconds since the epoch.
+	MicrosecondsColumn
+	Int32SliceColumn
+	Int64SliceColumn
+	// A []string or [][]byte.
+	StringSliceColumn
+	// A Trace protocol buffer. It occupies the entire value.
+	TraceColumn
+	// An AggregateStatistics protocol buffer. It occupies the entire value.
+	AggregateStatisticsColumn
+	// A JSON document. It occupies the entire value.
+	JsonColumn
+)
+
+var columnTypeNames = []string{
+	StringColumn:              "string",
+	BoolColumn:                "bool",
+	Int32Column:               "int32",
+	Int64Column:               "int64",
+	SecondsColumn:             "seconds",
+	MicrosecondsColumn:        "microseconds",
+	Int32SliceColumn:          "[]int32",
+	Int64SliceColumn:          "[]int64",
+	StringSliceColumn:         "[]string",
+	TraceColumn:               "Trace",
+	AggregateStatisticsColumn: "AggregateStatistics",
+	JsonColumn:                "json",
+}
+
+func (columnType ColumnType) String() string {
+	if columnType < 0 || int(columnType) >= len(columnTypeNames) {
+		return fmt.Sprintf("ColumnType(%d)", columnType)
+	}
+	return columnTypeNames[columnType]
+}
+
+type Column struct {
+	Name string
+	Type ColumnType
+}
+
+// The layout of the records in a store, which the pipeline that writes the
+// store encodes using lex.EncodeOrDie.
+type StoreSchema struct {
+	Name string
+	// The exported function that constructs the pipeline that writes the
+	// store.
+	Pipeline string
+	// Intermediate stores only pass records between stages of their pipeline.
+	// Other stores hold a pipeline's results, or bookkeeping that other
+	// pipelines or later runs of the same pipeline depend on.
+	Intermediate bool
+	// Incremental intermediate stores carry records from one run of their
+	// pipeline into later runs, so we can only delete them when we also delete
+	// the pipeline's bookkeeping stores. Other intermediate stores are
+	// rewritten on every run.
+	Incremental bool
+	// Bookkeeping stores record which inputs the pipeline has already
+	// processed. Deleting them makes the next run reprocess every input.
+	Bookkeeping bool
+	Key         []Column
+	Value       []Column
+}
+
+// Decode a column from the beginning of encoded, returning the decoded value
+// and the rest of encoded.
+func (columnType ColumnType) decode(encoded []byte) (interface{}, []byte, error) {
+	decodeTuple := func(value interface{}) ([]byte, error) {
+		return lex.Decode(encoded, value)
+	}
+	switch columnType {
+	case StringColumn:
+		var value []byte
+		remainder, err := decodeTuple(&value)
+		return string(value), remainder, err
+	case BoolColumn:
+		var value bool
+		remainder, err := decodeTuple(&value)
+		return value, remainder, err
+	case Int32Column:
+		var value int32
+		remainder, err := decodeTuple(&value)
+		return value, remainder, err
+	case Int64Column, SecondsColumn, MicrosecondsColumn:
+		var value int64
+		remainder, err := decodeTuple(&value)
+		return value, remainder, err
+	case Int32SliceColumn:
+		var value []int32
+		remainder, err := decodeTuple(&value)
+		return value, remainder, err
+	case Int64SliceColumn:
+		var value []int64
+		remainder, err := decodeTuple(&value)
+		return value, remainder, err
+	case StringSliceColumn:
+		var value []string
+		remainder, err := decodeTuple(&value)
+		return value, remainder, err
+	case TraceColumn:
+		value := new(Trace)
+		return value, nil, proto.Unmarshal(encoded, value)
+	case AggregateStatisticsColumn:
+		value := new(AggregateStatistics)
+		return value, nil, proto.Unmarshal(encoded, value)
+	case JsonColumn:
+		return string(encoded), nil, nil
+	}
+	return nil, nil, fmt.Errorf("Unknown column type %d", columnType)
+}
+
+func decodeColumns(columns []Column, encoded []byte) ([]interface{}, error) {
+	values := make([]interface{}, len(columns))
+	for idx, column := range columns {
+		value, remainder, err := column.Type.decode(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding column %s: %v", column.Name, err)
+		}
+		values[idx] = value
+		encoded = remainder
+	}
+	if len(encoded) > 0 {
+		return nil, fmt.Errorf("%d bytes left over after decoding all columns", len(encoded))
+	}
+	return values, nil
+}
+
+// Decode a record into one value per column, key columns first.
+func (schema *StoreSchema) DecodeRecord(record *store.Record) ([]interface{}, error) {
+	keyValues, err := decodeColumns(schema.Key, record.Key)
+	if err != nil {
+		return nil, fmt.Errorf("Key: %v", err)
+	}
+	valueValues, err := decodeColumns(schema.Value, record.Value)
+	if err != nil {
+		return nil, fmt.Errorf("Value: %v", err)
+	}
+	return append(keyValues, valueValues...), nil
+}
+
+// The fields of AggregateStatistics, which flattenValues returns separately.
+var aggregateStatisticsColumnNames = []string{"traces", "packets", "packet_series_dropped", "pcap_dropped", "interface_dropped", "flows", "dropped_flows", "bytes"}
+
+// The names of the values that flattenValues returns for the columns.
+func flattenedColumnNames(columns []Column) []string {
+	var names []string
+	for _, column := range columns {
+		if column.Type == AggregateStatisticsColumn {
+			names = append(names, aggregateStatisticsColumnNames...)
+		} else {
+			names = append(names, column.Name)
+		}
+	}
+	return names
+}
+
+func int64OrZero(value *int64) int64 {
+	if value == nil {
+		return 0
+	}
+	return *value
+}
+
+// Convert the values that DecodeRecord returns into scalars, for tabular
+// formats. We split AggregateStatistics into one int64 per field, and encode
+// lists and traces as JSON text. JSON documents stay strings.
+func flattenValues(columns []Column, values []interface{}) ([]interface{}, error) {
+	var flattened []interface{}
+	for idx, column := range columns {
+		value := values[idx]
+		switch column.Type {
+		case BoolColumn, StringColumn, Int32Column, Int64Column, SecondsColumn, MicrosecondsColumn, JsonColumn:
+			flattened = append(flattened, value)
+		case AggregateStatisticsColumn:
+			statistics := value.(*AggregateStatistics)
+			for _, field := range []*int64{statistics.Traces, statistics.Packets, statistics.PacketSeriesDropped, statistics.PcapDropped, statistics.InterfaceDropped, statistics.Flows, statistics.DroppedFlows, statistics.Bytes} {
+				flattened = append(flattened, int64OrZero(field))
+			}
+		default:
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return nil, fmt.Errorf("Error encoding column %s: %v", column.Name, err)
+			}
+			flattened = append(flattened, string(encoded))
+		}
+	}
+	return flattened, nil
+}
+
+// All the key and value columns, in the order DecodeRecord returns them.
+func (schema *StoreSchema) Columns() []Column {
+	return joinColumns(schema.Key, schema.Value)
+}
+
+// Whether the store's keys begin with the node ID, so we can efficiently
+// select a node's records by prefix.
+func (schema *StoreSchema) HasNodePrefix() bool {
+	return len(schema.Key) > 0 && schema.Key[0].Name == "node_id"
+}
+
+// Whether the store's keys begin with a session key.
+func (schema *StoreSchema) hasSessionPrefix() bool {
+	return len(schema.Key) >= len(sessionKeyColumns) && reflect.DeepEqual(schema.Key[:len(sessionKeyColumns)], sessionKeyColumns)
+}
+
+// Whether the store records ranges of traces, keyed by their first trace.
+// Scratch stores used to consolidate ranges don't count.
+func (schema *StoreSchema) isTraceKeyRanges() bool {
+	return !schema.Intermediate && reflect.DeepEqual(schema.Key, traceKeyColumns) && reflect.DeepEqual(schema.Value, traceKeyEndColumns)
+}
+
+// The index of the first timestamp in the key, or -1 if the key doesn't
+// contain a timestamp.
+func (schema *StoreSchema) TimeColumn() int {
+	for idx, column := range schema.Key {
+		if column.Type == SecondsColumn || column.Type == MicrosecondsColumn {
+			return idx
+		}
+	}
+	return -1
+}
+
+// Decode the key's first timestamp, in seconds since the epoch.
+func (schema *StoreSchema) KeyTime(key []byte) (int64, error) {
+	timeColumn := schema.TimeColumn()
+	if timeColumn < 0 {
+		return 0, fmt.Errorf("%s keys don't contain a timestamp", schema.Name)
+	}
+	var timestamp interface{}
+	for _, column := range schema.Key[:timeColumn+1] {
+		value, remainder, err := column.Type.decode(key)
+		if err != nil {
+			return 0, fmt.Errorf("Error decoding column %s: %v", column.Name, err)
+		}
+		timestamp = value
+		key = remainder
+	}
+	seconds := timestamp.(int64)
+	if schema.Key[timeColumn].Type == MicrosecondsColumn {
+		seconds = convertMicrosecondsToSeconds(seconds)
+	}
+	return seconds, nil
+}
+
+func joinColumns(columnLists ...[]Column) []Column {
+	var columns []Column
+	for _, columnList := range columnLists {
+		columns = append(columns, columnList...)
+	}
+	return columns
+}
+
+var (
+	sessionKeyColumns = []Column{
+		{"node_id", StringColumn},
+		{"anonymization_context", StringColumn},
+		{"session_id", MicrosecondsColumn},
+	}
+	traceKeyColumns    = joinColumns(sessionKeyColumns, []Column{{"sequence_number", Int32Column}})
+	traceSourceColumns = []Column{{"tar_path", StringColumn}, {"member_name", StringColumn}}
+	traceKeyEndColumns = []Column{
+		{"last_node_id", StringColumn},
+		{"last_anonymization_context", StringColumn},
+		{"last_session_id", MicrosecondsColumn},
+		{"last_sequence_number", Int32Column},
+	}
+	failedTraceValueColumns = []Column{
+		{"contents", StringColumn},
+		{"section", Int32Column},
+		{"line_number", Int32Column},
+		{"message", StringColumn},
+		{"error", StringColumn},
+	}
+	runKeyColumns = []Column{{"start_time", MicrosecondsColumn}, {"pipeline", StringColumn}}
+	sizeColumns   = []Column{{"size", Int64Column}}
+	countColumns  = []Column{{"count", Int64Column}}
+)
+
+// Stores whose keys are ranges of trace keys, as written by
+// TraceKeyRangesPipeline.
+func traceKeyRangesSchema(name string, bookkeeping bool) *StoreSchema {
+	return &StoreSchema{Name: name, Key: traceKeyColumns, Value: traceKeyEndColumns, Bookkeeping: bookkeeping}
+}
+
+// The scratch stores TraceKeyRangesPipeline uses to consolidate trace key
+// ranges.
+func consolidatedTraceKeyRangesSchema(name string) *StoreSchema {
+	return &StoreSchema{Name: name, Key: traceKeyColumns, Value: traceKeyEndColumns, Intermediate: true}
+}
+
+// Set the owning pipeline of each schema.
+func pipelineStoreSchemas(pipeline string, schemas []*StoreSchema) []*StoreSchema {
+	for _, schema := range schemas {
+		schema.Pipeline = pipeline
+	}
+	return schemas
+}
+
+func joinStoreSchemas(schemaLists ...[]*StoreSchema) []*StoreSchema {
+	var schemas []*StoreSchema
+	for _, schemaList := range schemaLists {
+		schemas = append(schemas, schemaList...)
+	}
+	return schemas
+}
+
+// Every store that the pipelines in this package write, grouped by the
+// pipeline that writes them.
+var storeSchemas = joinStoreSchemas(
+	pipelineStoreSchemas("IndexTarballsPipeline", []*StoreSchema{
+		{
+			Name:         "tarnames",
+			Intermediate: true,
+			Key:          []Column{{"tar_path", StringColumn}},
+			Value:        []Column{{"size", Int64Column}, {"modification_time", Int64Column}},
+		},
+		{
+			// Tarballs indexed before we recorded their sizes, modification times
+			// and hashes have empty values, which this schema doesn't describe.
+			Name:        "tarnames-indexed",
+			Bookkeeping: true,
+			Key:         []Column{{"tar_path", StringColumn}},
+			Value:       []Column{{"size", Int64Column}, {"modification_time", Int64Column}, {"sha1", StringColumn}},
+		},
+		{
+			// The size and modification time of each tarball we last failed to
+			// index, so we don't try it again until it changes.
+			Name:        "tarnames-failed",
+			Bookkeeping: true,
+			Key:         []Column{{"tar_path", StringColumn}},
+			Value:       []Column{{"size", Int64Column}, {"modification_time", Int64Column}},
+		},
+		{
+			Name: "tarnames-reindexed",
+			Key:  []Column{{"tar_path", StringColumn}},
+			Value: []Column{
+				{"old_size", Int64Column},
+				{"old_modification_time", Int64Column},
+				{"old_sha1", StringColumn},
+				{"new_size", Int64Column},
+				{"new_modification_time", Int64Column},
+				{"new_sha1", StringColumn},
+			},
+		},
+		{
+			// The hash of the copy of the tarball we last indexed the trace from.
+			Name:        "tarnames-traces",
+			Bookkeeping: true,
+			Key:         joinColumns([]Column{{"tar_path", StringColumn}}, traceKeyColumns),
+			Value:       []Column{{"sha1", StringColumn}},
+		},
+		{Name: "traces-stale-candidates", Key: traceKeyColumns, Value: []Column{{"tar_path", StringColumn}}, Intermediate: true},
+		{Name: "traces-stale", Key: traceKeyColumns, Intermediate: true},
+		{Name: "traces-new", Key: joinColumns(traceKeyColumns, traceSourceColumns), Value: []Column{{"trace", TraceColumn}}, Intermediate: true, Incremental: true},
+		{Name: "traces-failed", Key: traceSourceColumns, Value: failedTraceValueColumns},
+	}),
+	pipelineStoreSchemas("DuplicateTracesPipeline", []*StoreSchema{
+		{Name: "traces-new-keys", Key: traceKeyColumns, Intermediate: true},
+		{Name: "traces", Key: traceKeyColumns, Value: []Column{{"trace", TraceColumn}}},
+		{Name: "traces-sources", Key: traceKeyColumns, Value: traceSourceColumns},
+		{Name: "traces-conflicting", Key: joinColumns(traceKeyColumns, traceSourceColumns), Value: []Column{{"trace", TraceColumn}}},
+		{
+			Name:         "traces-duplicates",
+			Intermediate: true,
+			Incremental:  true,
+			Key:          joinColumns(traceKeyColumns, traceSourceColumns),
+			Value:        []Column{{"identical", Int64Column}, {"conflicting", Int64Column}},
+		},
+		{
+			Name:  "traces-duplicates-per-node",
+			Key:   []Column{{"node_id", StringColumn}},
+			Value: []Column{{"identical", Int64Column}, {"conflicting", Int64Column}},
+		},
+	}),
+	pipelineStoreSchemas("SummarizeFailedTracesPipeline", []*StoreSchema{
+		{
+			Name:         "traces-failed-by-error",
+			Intermediate: true,
+			Key:          joinColumns([]Column{{"section", Int32Column}, {"message", StringColumn}}, traceSourceColumns),
+		},
+	}),
+	pipelineStoreSchemas("ReportFailedTracesPipeline", []*StoreSchema{
+		{
+			Name:         "traces-failed-by-build",
+			Intermediate: true,
+			Key: joinColumns([]Column{
+				{"build_id", StringColumn},
+				{"file_format_version", Int32Column},
+				{"section", Int32Column},
+				{"code", StringColumn},
+				{"message", StringColumn},
+			}, traceSourceColumns),
+		},
+	}),
+	pipelineStoreSchemas("RetryFailedTracesPipeline", []*StoreSchema{
+		{Name: "traces-still-failed", Key: traceSourceColumns, Value: failedTraceValueColumns, Intermediate: true},
+	}),
+	pipelineStoreSchemas("RunPipelines", []*StoreSchema{
+		{
+			Name:  "run-completions",
+			Key:   []Column{{"pipeline", StringColumn}},
+			Value: []Column{{"completed_generation", Int64Column}, {"changed_generation", Int64Column}},
+		},
+	}),
+	pipelineStoreSchemas("RecordRunPipeline", []*StoreSchema{
+		{
+			Name:  "runs",
+			Key:   runKeyColumns,
+			Value: []Column{{"end_time", MicrosecondsColumn}, {"build", StringColumn}, {"error", StringColumn}},
+		},
+		{
+			Name:  "runs-stages",
+			Key:   joinColumns(runKeyColumns, []Column{{"stage", Int32Column}}),
+			Value: []Column{{"name", StringColumn}, {"records_read", Int64Column}, {"records_written", Int64Column}, {"error", StringColumn}},
+		},
+		{Name: "runs-trace-key-ranges", Key: joinColumns(runKeyColumns, traceKeyColumns), Value: traceKeyEndColumns},
+	}),
+	pipelineStoreSchemas("AvailabilityPipeline", []*StoreSchema{
+		{
+			Name:         "availability-intervals",
+			Intermediate: true,
+			Incremental:  true,
+			Key:          joinColumns(sessionKeyColumns, []Column{{"first_sequence_number", Int32Column}, {"last_sequence_number", Int32Column}}),
+			Value:        []Column{{"start_timestamp", SecondsColumn}, {"end_timestamp", SecondsColumn}},
+		},
+		{
+			Name:         "availability-consolidated",
+			Intermediate: true,
+			Key:          joinColumns(sessionKeyColumns, []Column{{"first_sequence_number", Int32Column}, {"last_sequence_number", Int32Column}}),
+			Value:        []Column{{"start_timestamp", SecondsColumn}, {"end_timestamp", SecondsColumn}},
+		},
+		{Name: "availability-nodes", Key: []Column{{"node_id", StringColumn}}, Value: []Column{{"points", JsonColumn}}},
+		traceKeyRangesSchema("availability-done", true),
+		traceKeyRangesSchema("consistent-ranges", false),
+	}),
+	pipelineStoreSchemas("BytesPerDevicePipeline", []*StoreSchema{
+		{Name: "bytesperdevice-session", Key: sessionKeyColumns, Intermediate: true},
+		{
+			Name:         "bytesperdevice-address-table",
+			Intermediate: true,
+			Incremental:  true,
+			Key:          joinColumns(sessionKeyColumns, []Column{{"ip_address", StringColumn}, {"sequence_number", Int32Column}}),
+			Value:        []Column{{"mac_address", StringColumn}},
+		},
+		{
+			Name:         "bytesperdevice-flow-table",
+			Intermediate: true,
+			Incremental:  true,
+			Key:          joinColumns(sessionKeyColumns, []Column{{"ip_address", StringColumn}, {"sequence_number", Int32Column}}),
+			Value:        []Column{{"flow_ids", Int32SliceColumn}},
+		},
+		{
+			Name:         "bytesperdevice-packets",
+			Intermediate: true,
+			Incremental:  true,
+			Key:          joinColumns(sessionKeyColumns, []Column{{"flow_id", Int32Column}, {"sequence_number", Int32Column}}),
+			Value:        []Column{{"timestamps", Int64SliceColumn}, {"sizes", Int64SliceColumn}},
+		},
+		{
+			Name:         "bytesperdevice-flow-id-to-mac",
+			Intermediate: true,
+			Incremental:  true,
+			Key:          joinColumns(sessionKeyColumns, []Column{{"flow_id", Int32Column}, {"sequence_number", Int32Column}, {"mac_address", StringColumn}}),
+		},
+		{
+			Name:         "bytesperdevice-flow-id-to-macs",
+			Intermediate: true,
+			Incremental:  true,
+			Key:          joinColumns(sessionKeyColumns, []Column{{"flow_id", Int32Column}, {"sequence_number", Int32Column}}),
+			Value:        []Column{{"mac_addresses", StringSliceColumn}},
+		},
+		{
+			Name:         "bytesperdevice-unreduced",
+			Intermediate: true,
+			Incremental:  true,
+			Key: joinColumns(sessionKeyColumns, []Column{
+				{"mac_address", StringColumn},
+				{"timestamp", SecondsColumn},
+				{"flow_id", Int32Column},
+				{"sequence_number", Int32Column},
+			}),
+			Value: sizeColumns,
+		},
+		{
+			Name:         "bytesperdevice-reduced-sessions",
+			Intermediate: true,
+			Incremental:  true,
+			Key: []Column{
+				{"node_id", StringColumn},
+				{"mac_address", StringColumn},
+				{"timestamp", SecondsColumn},
+				{"anonymization_context", StringColumn},
+				{"session_id", MicrosecondsColumn},
+			},
+			Value: sizeColumns,
+		},
+		{
+			Name:  "bytesperdevice",
+			Key:   []Column{{"node_id", StringColumn}, {"mac_address", StringColumn}, {"timestamp", SecondsColumn}},
+			Value: sizeColumns,
+		},
+		{
+			Name:         "bytesperdevice-changed-rows",
+			Intermediate: true,
+			Key:          []Column{{"node_id", StringColumn}, {"mac_address", StringColumn}, {"timestamp", SecondsColumn}},
+		},
+		traceKeyRangesSchema("bytesperdevice-trace-key-ranges", true),
+		consolidatedTraceKeyRangesSchema("bytesperdevice-consolidated-trace-key-ranges"),
+	}),
+	pipelineStoreSchemas("BytesPerDomainPipeline", []*StoreSchema{
+		{Name: "bytesperdomain-sessions", Key: sessionKeyColumns, Intermediate: true},
+		{
+			Name:         "bytesperdomain-address-id-table",
+			Intermediate: true,
+			Incremental:  true,
+			Key:          joinColumns(sessionKeyColumns, []Column{{"address_id", Int32Column}, {"sequence_number", Int32Column}}),
+			Value:        []Column{{"mac_address", StringColumn}},
+		},
+		{
+			Name:         "bytesperdomain-a-record-table",
+			Intermediate: true,
+			Incremental:  true,
+			Key: joinColumns(sessionKeyColumns, []Column{
+				{"address_id", Int32Column},
+				{"sequence_number", Int32Column},
+				{"domain", StringColumn},
+				{"anonymized", BoolColumn},
+				{"start_timestamp", MicrosecondsColumn},
+				{"end_timestamp", MicrosecondsColumn},
+				{"ip_address", StringColumn},
+			}),
+		},
+		{
+			Name:         "bytesperdomain-cname-record-table",
+			Intermediate: true,
+			Incremental:  true,
+			Key: joinColumns(sessionKeyColumns, []Column{
+				{"address_id", Int32Column},
+				{"sequence_number", Int32Column},
+				{"cname", StringColumn},
+				{"cname_anonymized", BoolColumn},
+				{"start_timestamp", MicrosecondsColumn},
+				{"end_timestamp", MicrosecondsColumn},
+				{"domain", StringColumn},
+			}),
+		},
+		{
+			Name:         "bytesperdomain-flow-ips-table",
+			Intermediate: true,
+			Incremental:  true,
+			Key: joinColumns(sessionKeyColumns, []Column{
+				{"local_ip", StringColumn},
+				{"sequence_number", Int32Column},
+				{"remote_ip", StringColumn},
+				{"timestamp", MicrosecondsColumn},
+				{"flow_id", Int32Column},
+			}),
+		},
+		{
+			Name:         "bytesperdomain-address-ip-table",
+			Intermediate: true,
+			Incremental:  true,
+			Key:          joinColumns(sessionKeyColumns, []Column{{"ip_address", StringColumn}, {"sequence_number", Int32Column}}),
+			Value:        []Column{{"mac_address", StringColumn}},
+		},
+		{
+			Name:         "bytesperdomain-bytes-per-timestamp-sharded",
+			Intermediate: true,
+			Incremental:  true,
+			Key:          joinColumns(sessionKeyColumns, []Column{{"flow_id", Int32Column}, {"sequence_number", Int32Column}, {"timestamp", SecondsColumn}}),
+			Value:        sizeColumns,
+		},
+		{Name: "bytesperdomain-whitelist", Key: sessionKeyColumns, Value: []Column{{"whitelist", StringSliceColumn}}, Intermediate: true, Incremental: true},
+		{
+			Name:         "bytesperdomain-a-records-with-mac",
+			Intermediate: true,
+			Incremental:  true,
+			Key: joinColumns(sessionKeyColumns, []Column{
+				{"mac_address", StringColumn},
+				{"domain", StringColumn},
+				{"anonymized", BoolColumn},
+				{"start_timestamp", MicrosecondsColumn},
+				{"end_timestamp", MicrosecondsColumn},
+				{"ip_address", StringColumn},
+			}),
+		},
+		{
+			Name:         "bytesperdomain-cname-records-with-mac",
+			Intermediate: true,
+			Incremental:  true,
+			Key: joinColumns(sessionKeyColumns, []Column{
+				{"mac_address", StringColumn},
+				{"cname", StringColumn},
+				{"cname_anonymized", BoolColumn},
+				{"start_timestamp", MicrosecondsColumn},
+				{"end_timestamp", MicrosecondsColumn},
+				{"domain", StringColumn},
+			}),
+		},
+		{
+			Name:         "bytesperdomain-all-dns-mappings",
+			Intermediate: true,
+			Incremental:  true,
+			Key: joinColumns(sessionKeyColumns, []Column{
+				{"domain", StringColumn},
+				{"mac_address", StringColumn},
+				{"ip_address", StringColumn},
+				{"start_timestamp", MicrosecondsColumn},
+				{"end_timestamp", MicrosecondsColumn},
+			}),
+		},
+		{
+			Name:         "bytesperdomain-all-whitelisted-mappings",
+			Intermediate: true,
+			Incremental:  true,
+			Key: joinColumns(sessionKeyColumns, []Column{
+				{"mac_address", StringColumn},
+				{"ip_address", StringColumn},
+				{"start_timestamp", MicrosecondsColumn},
+				{"end_timestamp", MicrosecondsColumn},
+				{"domain", StringColumn},
+			}),
+		},
+		{
+			Name:         "bytesperdomain-flow-macs-table",
+			Intermediate: true,
+			Incremental:  true,
+			Key: joinColumns(sessionKeyColumns, []Column{
+				{"mac_address", StringColumn},
+				{"remote_ip", StringColumn},
+				{"timestamp", MicrosecondsColumn},
+				{"infinity", Int64Column},
+				{"sequence_number", Int32Column},
+				{"flow_id", Int32Column},
+			}),
+		},
+		{
+			Name:         "bytesperdomain-flow-domains-table",
+			Intermediate: true,
+			Incremental:  true,
+			Key: joinColumns(sessionKeyColumns, []Column{
+				{"flow_id", Int32Column},
+				{"sequence_number", Int32Column},
+				{"domain", StringColumn},
+				{"mac_address", StringColumn},
+			}),
+		},
+		{
+			Name:         "bytesperdomain-flow-domains-grouped-table",
+			Intermediate: true,
+			Incremental:  true,
+			Key:          joinColumns(sessionKeyColumns, []Column{{"flow_id", Int32Column}, {"sequence_number", Int32Column}}),
+			Value:        []Column{{"domains", StringSliceColumn}, {"mac_addresses", StringSliceColumn}},
+		},
+		{
+			Name:         "bytesperdomain-bytes-per-domain-sharded",
+			Intermediate: true,
+			Incremental:  true,
+			Key: []Column{
+				{"node_id", StringColumn},
+				{"domain", StringColumn},
+				{"timestamp", SecondsColumn},
+				{"mac_address", StringColumn},
+				{"anonymization_context", StringColumn},
+				{"session_id", MicrosecondsColumn},
+				{"flow_id", Int32Column},
+				{"sequence_number", Int32Column},
+			},
+			Value: sizeColumns,
+		},
+		{
+			Name:  "bytesperdomain-bytes-per-domain-per-device",
+			Key:   []Column{{"node_id", StringColumn}, {"mac_address", StringColumn}, {"domain", StringColumn}, {"timestamp", SecondsColumn}},
+			Value: sizeColumns,
+		},
+		{
+			Name:  "bytesperdomain-bytes-per-domain",
+			Key:   []Column{{"node_id", StringColumn}, {"domain", StringColumn}, {"timestamp", SecondsColumn}},
+			Value: sizeColumns,
+		},
+		{
+			Name:         "bytesperdomain-changed-rows",
+			Intermediate: true,
+			Key:          []Column{{"node_id", StringColumn}, {"domain", StringColumn}, {"timestamp", SecondsColumn}},
+		},
+		traceKeyRangesSchema("bytesperdomain-trace-key-ranges", true),
+		consolidatedTraceKeyRangesSchema("bytesperdomain-consolidated-trace-key-ranges"),
+	}),
+	pipelineStoreSchemas("BytesPerMinutePipeline", []*StoreSchema{
+		{
+			Name:         "bytesperminute-mapped",
+			Intermediate: true,
+			Incremental:  true,
+			Key:          []Column{{"node_id", StringColumn}, {"timestamp", SecondsColumn}, {"nonce", Int64Column}},
+			Value:        sizeColumns,
+		},
+		{Name: "bytesperminute", Key: []Column{{"node_id", StringColumn}, {"timestamp", SecondsColumn}}, Value: sizeColumns},
+		{Name: "bytesperhour", Key: []Column{{"node_id", StringColumn}, {"timestamp", SecondsColumn}}, Value: sizeColumns},
+		{Name: "bytesperminute-changed-hours", Key: []Column{{"node_id", StringColumn}, {"timestamp", SecondsColumn}}, Intermediate: true},
+		traceKeyRangesSchema("bytesperminute-trace-key-ranges", true),
+		consolidatedTraceKeyRangesSchema("bytesperminute-consolidated-trace-key-ranges"),
+	}),
+	pipelineStoreSchemas("LookupsPerDevicePipeline", []*StoreSchema{
+		{
+			Name:         "lookupsperdevice-address-id-to-domain",
+			Intermediate: true,
+			Key:          joinColumns(sessionKeyColumns, []Column{{"address_id", Int32Column}, {"sequence_number", Int32Column}, {"domain", StringColumn}}),
+			Value:        countColumns,
+		},
+		{
+			Name:         "lookupsperdevice-sharded",
+			Intermediate: true,
+			Key: []Column{
+				{"node_id", StringColumn},
+				{"mac_address", StringColumn},
+				{"domain", StringColumn},
+				{"anonymization_context", StringColumn},
+				{"session_id", MicrosecondsColumn},
+				{"sequence_number", Int32Column},
+			},
+			Value: countColumns,
+		},
+		{
+			Name:  "lookupsperdevice-lookups-per-device",
+			Key:   []Column{{"node_id", StringColumn}, {"mac_address", StringColumn}, {"domain", StringColumn}},
+			Value: countColumns,
+		},
+		{
+			Name:  "lookupsperdevice-lookups-per-device-per-hour",
+			Key:   []Column{{"node_id", StringColumn}, {"mac_address", StringColumn}, {"domain", StringColumn}, {"timestamp", SecondsColumn}},
+			Value: countColumns,
+		},
+	}),
+	pipelineStoreSchemas("AggregateStatisticsPipeline", []*StoreSchema{
+		{Name: "statistics-sessions", Key: sessionKeyColumns, Intermediate: true},
+		{Name: "statistics-trace-aggregates", Key: traceKeyColumns, Value: []Column{{"statistics", AggregateStatisticsColumn}}, Intermediate: true, Incremental: true},
+		{Name: "statistics-session-aggregates", Key: sessionKeyColumns, Value: []Column{{"statistics", AggregateStatisticsColumn}}, Intermediate: true, Incremental: true},
+		{Name: "statistics-node-aggregates", Key: []Column{{"node_id", StringColumn}}, Value: []Column{{"statistics", AggregateStatisticsColumn}}},
+		traceKeyRangesSchema("statistics-trace-key-ranges", true),
+		consolidatedTraceKeyRangesSchema("statistics-consolidated-trace-key-ranges"),
+	}),
+)
+
+// Find the schema for a store, or return nil if we don't know the store.
+func LookupStoreSchema(name string) *StoreSchema {
+	for _, schema := range storeSchemas {
+		if schema.Name == name {
+			return schema
+		}
+	}
+	return nil
+}
+
+// The schemas of every store, grouped by pipeline.
+func StoreSchemas() []*StoreSchema {
+	return storeSchemas
+}
+
+// The names of every store with a known schema.
+func StoreSchemaNames() []string {
+	names := make([]string, len(storeSchemas))
+	for idx, schema := range storeSchemas {
+		names[idx] = schema.Name
+	}
+	return names
+}
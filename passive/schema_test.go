@@ -0,0 +1,169 @@
+package passive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/sburnett/transformer"
+	"github.com/sburnett/transformer/store"
+)
+
+func TestStoreSchemas_Consistent(t *testing.T) {
+	wholeValueTypes := map[ColumnType]bool{TraceColumn: true, AggregateStatisticsColumn: true, JsonColumn: true}
+	names := make(map[string]bool)
+	for _, schema := range StoreSchemas() {
+		if names[schema.Name] {
+			t.Errorf("Duplicate schema for %s", schema.Name)
+		}
+		names[schema.Name] = true
+		if schema.Pipeline == "" {
+			t.Errorf("%s doesn't have a pipeline", schema.Name)
+		}
+		if len(schema.Key) == 0 {
+			t.Errorf("%s doesn't have any key columns", schema.Name)
+		}
+		if schema.Incremental && !schema.Intermediate {
+			t.Errorf("%s is incremental but not intermediate", schema.Name)
+		}
+		if schema.Bookkeeping && schema.Intermediate {
+			t.Errorf("%s is bookkeeping but intermediate", schema.Name)
+		}
+		columnNames := make(map[string]bool)
+		for _, column := range schema.Columns() {
+			if columnNames[column.Name] {
+				t.Errorf("%s has more than one %s column", schema.Name, column.Name)
+			}
+			columnNames[column.Name] = true
+		}
+		for _, column := range schema.Key {
+			if wholeValueTypes[column.Type] {
+				t.Errorf("%s has a %s key column", schema.Name, column.Type)
+			}
+		}
+		for _, column := range schema.Value {
+			if wholeValueTypes[column.Type] && len(schema.Value) > 1 {
+				t.Errorf("%s column %s must be the only value column", schema.Name, column.Name)
+			}
+		}
+	}
+}
+
+func makeSchemaTestTrace() *Trace {
+	return &Trace{
+		NodeId:                       proto.String("RICH"),
+		ProcessStartTimeMicroseconds: proto.Int64(1000000000000000),
+		SequenceNumber:               proto.Int32(0),
+		TraceCreationTimestamp:       proto.Int64(1000000000),
+		PacketSeriesDropped:          proto.Uint32(0),
+		PcapDropped:                  proto.Uint32(0),
+		InterfaceDropped:             proto.Uint32(0),
+		FlowTableDropped:             proto.Int32(0),
+		Whitelist:                    []string{"example.com"},
+		PacketSeries: []*PacketSeriesEntry{
+			&PacketSeriesEntry{
+				TimestampMicroseconds: proto.Int64(1000000000000000),
+				Size:                  proto.Int32(100),
+				FlowId:                proto.Int32(0),
+			},
+		},
+		FlowTableEntry: []*FlowTableEntry{
+			&FlowTableEntry{
+				FlowId:        proto.Int32(0),
+				SourceIp:      proto.String("local1"),
+				DestinationIp: proto.String("remote1"),
+			},
+		},
+		ARecord: []*DnsARecord{
+			&DnsARecord{
+				PacketId:   proto.Int32(0),
+				AddressId:  proto.Int32(0),
+				Anonymized: proto.Bool(false),
+				Domain:     proto.String("m.cdn.com"),
+				IpAddress:  proto.String("remote1"),
+				Ttl:        proto.Int32(60),
+			},
+		},
+		CnameRecord: []*DnsCnameRecord{
+			&DnsCnameRecord{
+				PacketId:         proto.Int32(0),
+				AddressId:        proto.Int32(0),
+				DomainAnonymized: proto.Bool(false),
+				Domain:           proto.String("m.example.com"),
+				CnameAnonymized:  proto.Bool(false),
+				Cname:            proto.String("m.cdn.com"),
+				Ttl:              proto.Int32(60),
+			},
+		},
+		AddressTableFirstId: proto.Int32(0),
+		AddressTableSize:    proto.Int32(255),
+		AddressTableEntry: []*AddressTableEntry{
+			&AddressTableEntry{
+				MacAddress: proto.String("mac1"),
+				IpAddress:  proto.String("local1"),
+			},
+		},
+	}
+}
+
+// Run every pipeline on a few traces, then check that we can decode every
+// record they wrote using the registered schemas.
+func TestStoreSchemas_DecodeWrittenRecords(t *testing.T) {
+	tarballsPath, err := ioutil.TempDir("", "schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tarballsPath)
+
+	levelDbManager := store.NewSliceManager()
+	runPipeline := func(pipeline transformer.Pipeline) {
+		transformer.RunPipeline(pipeline)
+	}
+	index := func() {
+		runPipeline(IndexTarballsPipeline(tarballsPath, []string{"*/*/*.tar.gz"}, false, levelDbManager, ioutil.Discard))
+	}
+
+	original := makeValidTraceContents("NODE", 0)
+	conflicting := makeInvalidTraceContents("NODE 10 0 20\n", "NODE 10 0 21\n")
+	failed := makeInvalidTraceContents("5\n", "InvalidVersion\n")
+	tarPath := filepath.Join(tarballsPath, "NODE", "2013-01-01", "NODE_1.tar.gz")
+	writeTestTarball(tarPath, time.Unix(100, 0), original, failed)
+	writeTestTarball(filepath.Join(tarballsPath, "NODE", "2013-01-01", "NODE_2.tar.gz"), time.Unix(100, 0), conflicting)
+	index()
+	writeTestTarball(tarPath, time.Unix(200, 0), original, failed, makeValidTraceContents("NODE", 1))
+	index()
+	runPipeline(SummarizeFailedTracesPipeline(levelDbManager, ioutil.Discard))
+	runPipeline(RetryFailedTracesPipeline(levelDbManager))
+
+	trace := makeSchemaTestTrace()
+	encodedTrace, err := proto.Marshal(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracesStore := levelDbManager.Writer("traces")
+	tracesStore.BeginWriting()
+	tracesStore.WriteRecord(&store.Record{Key: traceKey(trace), Value: encodedTrace})
+	tracesStore.EndWriting()
+
+	runPipeline(AvailabilityPipeline(levelDbManager, ioutil.Discard, 0))
+	runPipeline(BytesPerDevicePipeline(levelDbManager, &store.SliceStore{}, false))
+	runPipeline(BytesPerDomainPipeline(levelDbManager, &store.SliceStore{}, false))
+	runPipeline(RecordRunPipeline(levelDbManager, "bytesperminute", "build", BytesPerMinutePipeline(levelDbManager, &store.SliceStore{}, false)))
+	runPipeline(LookupsPerDevicePipeline(levelDbManager))
+	runPipeline(AggregateStatisticsPipeline(levelDbManager, ioutil.Discard))
+
+	for _, schema := range StoreSchemas() {
+		records := readAllRecords(levelDbManager.Reader(schema.Name))
+		if len(records) == 0 {
+			t.Logf("%s is empty", schema.Name)
+		}
+		for _, record := range records {
+			if _, err := schema.DecodeRecord(record); err != nil {
+				t.Errorf("Error decoding %s record %q => %q: %v", schema.Name, record.Key, record.Value, err)
+			}
+		}
+	}
+}
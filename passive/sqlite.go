@@ -0,0 +1,162 @@
+package passive
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/sburnett/transformer"
+	"github.com/sburnett/transformer/store"
+)
+
+// How long to wait for another pipeline to finish writing the same SQLite
+// database, e.g., when the run command runs pipelines in parallel.
+const sqliteBusyTimeout = 10 * time.Minute
+
+// The stores that SqliteExportPipeline exports for the pipelines that don't
+// load Postgres, keyed by the exported function that constructs each
+// pipeline. The pipelines that load Postgres can load a SqliteStore instead.
+var SqliteExportStores = map[string][]string{
+	"AvailabilityPipeline":        {"availability-consolidated"},
+	"LookupsPerDevicePipeline":    {"lookupsperdevice-lookups-per-device", "lookupsperdevice-lookups-per-device-per-hour"},
+	"AggregateStatisticsPipeline": {"statistics-node-aggregates"},
+}
+
+// Writes every record of a store to a table of a SQLite database, replacing
+// the table's previous contents. The table has the same name as the store,
+// with underscores instead of hyphens, and the columns that flattenValues
+// returns. Timestamps are integers, in the store's units since the epoch.
+type SqliteStore struct {
+	path        string
+	schema      *StoreSchema
+	conn        *sql.DB
+	transaction *sql.Tx
+	statement   *sql.Stmt
+}
+
+// Write to the SQLite database at path, creating it if it doesn't exist. We
+// write the store described by schema.
+func NewSqliteStore(path string, schema *StoreSchema) *SqliteStore {
+	return &SqliteStore{path: path, schema: schema}
+}
+
+// A pipeline that exports each of the stores to a table of the SQLite
+// database at path, using SqliteStore.
+func SqliteExportPipeline(levelDbManager store.Manager, path string, storeNames ...string) transformer.Pipeline {
+	var stages []transformer.PipelineStage
+	for _, name := range storeNames {
+		schema := LookupStoreSchema(name)
+		if schema == nil {
+			panic(fmt.Errorf("Unknown store %q", name))
+		}
+		stages = append(stages, transformer.PipelineStage{
+			Name:   fmt.Sprintf("ExportSqlite:%s", name),
+			Reader: levelDbManager.Reader(name),
+			Writer: NewSqliteStore(path, schema),
+		})
+	}
+	return stages
+}
+
+func sqliteTableName(schema *StoreSchema) string {
+	return strings.Replace(schema.Name, "-", "_", -1)
+}
+
+func sqliteColumnType(columnType ColumnType) string {
+	switch columnType {
+	case BoolColumn, Int32Column, Int64Column, SecondsColumn, MicrosecondsColumn, AggregateStatisticsColumn:
+		return "INTEGER"
+	}
+	return "TEXT"
+}
+
+// The names and types of the table's columns, key columns first.
+func sqliteColumnDefinitions(columns []Column) []string {
+	var definitions []string
+	for _, column := range columns {
+		for _, name := range flattenedColumnNames([]Column{column}) {
+			definitions = append(definitions, fmt.Sprintf("%s %s", name, sqliteColumnType(column.Type)))
+		}
+	}
+	return definitions
+}
+
+func (store *SqliteStore) createTableStatement() string {
+	definitions := sqliteColumnDefinitions(store.schema.Columns())
+	var keyNames []string
+	for _, column := range store.schema.Key {
+		keyNames = append(keyNames, column.Name)
+	}
+	if len(keyNames) > 0 {
+		definitions = append(definitions, fmt.Sprintf("PRIMARY KEY (%s)", strings.Join(keyNames, ", ")))
+	}
+	return fmt.Sprintf("CREATE TABLE %s (%s)", sqliteTableName(store.schema), strings.Join(definitions, ", "))
+}
+
+func (store *SqliteStore) insertStatement() string {
+	columnCount := len(sqliteColumnDefinitions(store.schema.Columns()))
+	parameters := strings.TrimSuffix(strings.Repeat("?, ", columnCount), ", ")
+	return fmt.Sprintf("INSERT INTO %s VALUES (%s)", sqliteTableName(store.schema), parameters)
+}
+
+func (store *SqliteStore) BeginWriting() error {
+	conn, err := sql.Open("sqlite3", fmt.Sprintf("%s?_busy_timeout=%d", store.path, sqliteBusyTimeout/time.Millisecond))
+	if err != nil {
+		return err
+	}
+	transaction, err := conn.Begin()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	abort := func(err error) error {
+		transaction.Rollback()
+		conn.Close()
+		return err
+	}
+	// Recreate the table in case its schema changed.
+	if _, err := transaction.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", sqliteTableName(store.schema))); err != nil {
+		return abort(err)
+	}
+	if _, err := transaction.Exec(store.createTableStatement()); err != nil {
+		return abort(err)
+	}
+	statement, err := transaction.Prepare(store.insertStatement())
+	if err != nil {
+		return abort(err)
+	}
+	store.conn = conn
+	store.transaction = transaction
+	store.statement = statement
+	return nil
+}
+
+func (store *SqliteStore) WriteRecord(record *store.Record) error {
+	values, err := store.schema.DecodeRecord(record)
+	if err != nil {
+		return err
+	}
+	converted, err := flattenValues(store.schema.Columns(), values)
+	if err != nil {
+		return err
+	}
+	if _, err := store.statement.Exec(converted...); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (store *SqliteStore) EndWriting() error {
+	if err := store.statement.Close(); err != nil {
+		return err
+	}
+	if err := store.transaction.Commit(); err != nil {
+		return err
+	}
+	if err := store.conn.Close(); err != nil {
+		return err
+	}
+	return nil
+}
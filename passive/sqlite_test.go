@@ -0,0 +1,64 @@
+package passive
+
+import (
+	"reflect"
+	"testing"
+
+	"code.google.com/p/goprotobuf/proto"
+)
+
+func TestSqliteStore_Statements(t *testing.T) {
+	sqliteStore := NewSqliteStore("passive.db", LookupStoreSchema("bytesperdomain-bytes-per-domain"))
+	if expected, actual := "CREATE TABLE bytesperdomain_bytes_per_domain (node_id TEXT, domain TEXT, timestamp INTEGER, size INTEGER, PRIMARY KEY (node_id, domain, timestamp))", sqliteStore.createTableStatement(); actual != expected {
+		t.Errorf("Create statement should be %q, not %q", expected, actual)
+	}
+	if expected, actual := "INSERT INTO bytesperdomain_bytes_per_domain VALUES (?, ?, ?, ?)", sqliteStore.insertStatement(); actual != expected {
+		t.Errorf("Insert statement should be %q, not %q", expected, actual)
+	}
+}
+
+func TestSqliteStore_AggregateStatistics(t *testing.T) {
+	sqliteStore := NewSqliteStore("passive.db", LookupStoreSchema("statistics-node-aggregates"))
+	if expected, actual := "CREATE TABLE statistics_node_aggregates (node_id TEXT, traces INTEGER, packets INTEGER, packet_series_dropped INTEGER, pcap_dropped INTEGER, interface_dropped INTEGER, flows INTEGER, dropped_flows INTEGER, bytes INTEGER, PRIMARY KEY (node_id))", sqliteStore.createTableStatement(); actual != expected {
+		t.Errorf("Create statement should be %q, not %q", expected, actual)
+	}
+
+	statistics := &AggregateStatistics{
+		Traces:  proto.Int64(3),
+		Packets: proto.Int64(10),
+		Bytes:   proto.Int64(1000),
+	}
+	values, err := flattenValues(sqliteStore.schema.Columns(), []interface{}{"node0", statistics})
+	if err != nil {
+		t.Fatalf("Error converting values: %v", err)
+	}
+	expected := []interface{}{"node0", int64(3), int64(10), int64(0), int64(0), int64(0), int64(0), int64(0), int64(1000)}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Values should be %v, not %v", expected, values)
+	}
+}
+
+func TestFlattenValues_Lists(t *testing.T) {
+	columns := []Column{{"timestamps", Int64SliceColumn}, {"domains", StringSliceColumn}}
+	values, err := flattenValues(columns, []interface{}{[]int64{1, 2}, []string{"a.com", "b.com"}})
+	if err != nil {
+		t.Fatalf("Error converting values: %v", err)
+	}
+	expected := []interface{}{"[1,2]", `["a.com","b.com"]`}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Values should be %v, not %v", expected, values)
+	}
+}
+
+func TestSqliteExportStores_Exist(t *testing.T) {
+	for pipeline, names := range SqliteExportStores {
+		for _, name := range names {
+			schema := LookupStoreSchema(name)
+			if schema == nil {
+				t.Errorf("%s exports unknown store %s", pipeline, name)
+			} else if schema.Pipeline != pipeline {
+				t.Errorf("%s exports %s, which %s writes", pipeline, name, schema.Pipeline)
+			}
+		}
+	}
+}
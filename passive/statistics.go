@@ -54,18 +54,20 @@ func aggregateStatisticsMapper(record *store.Record) *store.Record {
 	if err := proto.Unmarshal(record.Value, &trace); err != nil {
 		panic(err)
 	}
+	// Salvaged traces may have placeholder packets and be missing the
+	// headers with the drop counts, which count as zero.
 	byteCount := int64(0)
 	for _, packetEntry := range trace.PacketSeries {
-		byteCount += int64(*packetEntry.Size)
+		byteCount += int64(packetEntry.GetSize())
 	}
 	statistics := AggregateStatistics{
 		Traces:              proto.Int64(1),
 		Packets:             proto.Int64(int64(len(trace.PacketSeries))),
-		PacketSeriesDropped: proto.Int64(int64(*trace.PacketSeriesDropped)),
-		PcapDropped:         proto.Int64(int64(*trace.PcapDropped)),
-		InterfaceDropped:    proto.Int64(int64(*trace.InterfaceDropped)),
+		PacketSeriesDropped: proto.Int64(int64(trace.GetPacketSeriesDropped())),
+		PcapDropped:         proto.Int64(int64(trace.GetPcapDropped())),
+		InterfaceDropped:    proto.Int64(int64(trace.GetInterfaceDropped())),
 		Flows:               proto.Int64(int64(len(trace.FlowTableEntry))),
-		DroppedFlows:        proto.Int64(int64(*trace.FlowTableDropped)),
+		DroppedFlows:        proto.Int64(int64(trace.GetFlowTableDropped())),
 		Bytes:               &byteCount,
 	}
 	encodedStatistics, err := proto.Marshal(&statistics)
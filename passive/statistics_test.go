@@ -3,6 +3,7 @@ package passive
 import (
 	"bytes"
 	"fmt"
+	"strings"
 
 	"code.google.com/p/goprotobuf/proto"
 	"github.com/sburnett/lexicographic-tuples"
@@ -144,3 +145,46 @@ func ExampleAggregateStatisticsPipeline_multipleRuns() {
 	// Output:
 	// [["node0",3,7,3,9,12,12]]
 }
+
+// A trace that parsed leniently, with a placeholder for a damaged packet, and
+// without PCAP statistics, a flow table or an address table.
+func makeSalvagedTrace() Trace {
+	formatted, err := FormatTrace(makeTraceForFormatting(), 5)
+	if err != nil {
+		panic(err)
+	}
+	contents := string(formatted)
+	for _, damage := range [][2]string{
+		{"138 1 2\n", ""},
+		{"498 174 -1\n", "498 InvalidSize -1\n"},
+		{"1346479359 34 4 5\n", "1346479359 34 4 InvalidDropped\n"},
+		{"3 256\n", "3 InvalidSize\n"},
+	} {
+		damaged := strings.Replace(contents, damage[0], damage[1], 1)
+		if damaged == contents {
+			panic(fmt.Errorf("Failed to damage trace"))
+		}
+		contents = damaged
+	}
+	trace, err := parseTraceLeniently([]byte(contents))
+	if err != nil {
+		panic(err)
+	}
+	return *trace
+}
+
+func ExampleAggregateStatisticsPipeline_salvagedTrace() {
+	consistentRanges := []*store.Record{
+		&store.Record{
+			Key:   lex.EncodeOrDie("NODEID", "signature", int64(1346479358582428), int32(7)),
+			Value: lex.EncodeOrDie("NODEID", "signature", int64(1346479358582428), int32(7)),
+		},
+	}
+	records := map[string]Trace{
+		string(lex.EncodeOrDie("NODEID", "signature", int64(1346479358582428), int32(7))): makeSalvagedTrace(),
+	}
+	runAggregateStatisticsPipeline(consistentRanges, records)
+
+	// Output:
+	// [["NODEID",1,2,3,0,0,74]]
+}
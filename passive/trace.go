@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+
+	"code.google.com/p/goprotobuf/proto"
 )
 
 type Section int
@@ -20,6 +22,7 @@ const (
 	SectionDnsTableCname
 	SectionAddressTable
 	SectionDropStatistics
+	SectionHttpUrls
 )
 
 func (section Section) String() string {
@@ -42,6 +45,48 @@ func (section Section) String() string {
 		return "MAC addresses"
 	case SectionDropStatistics:
 		return "drop statistics"
+	case SectionHttpUrls:
+		return "HTTP URLs"
+	}
+	return "unknown"
+}
+
+// Identifies the kind of failure that caused a TraceParseError, independently
+// of the details of the trace that failed. Reports and metrics refer to codes
+// by name, so don't rename them.
+type ParseErrorCode int
+
+const (
+	// The parser failed in a way that doesn't have its own code.
+	ErrorUnknown ParseErrorCode = iota
+	// The trace doesn't have a mandatory section.
+	ErrorMissingSection
+	// A line is missing or doesn't have enough fields.
+	ErrorMissingField
+	// A field doesn't have the right type, e.g., it isn't a number.
+	ErrorInvalidField
+	// A section doesn't have one of its lines.
+	ErrorMissingLine
+	// The trace has more sections than its file format defines.
+	ErrorExtraSection
+	// The trace's file format version predates the first version.
+	ErrorUnsupportedVersion
+)
+
+func (code ParseErrorCode) String() string {
+	switch code {
+	case ErrorMissingSection:
+		return "missing-section"
+	case ErrorMissingField:
+		return "missing-field"
+	case ErrorInvalidField:
+		return "invalid-field"
+	case ErrorMissingLine:
+		return "missing-line"
+	case ErrorExtraSection:
+		return "extra-section"
+	case ErrorUnsupportedVersion:
+		return "unsupported-version"
 	}
 	return "unknown"
 }
@@ -52,6 +97,12 @@ type TraceParseError struct {
 	Section    Section
 	LineNumber int
 	Suberror   error
+	Code       ParseErrorCode
+	// The file format version and build of bismark-passive that wrote the
+	// trace, as far as we could parse them. FileFormatVersion is -1 and BuildId
+	// is empty if we couldn't.
+	FileFormatVersion int32
+	BuildId           string
 }
 
 func (err *TraceParseError) Error() string {
@@ -62,13 +113,35 @@ func (err *TraceParseError) Error() string {
 }
 
 func newTraceParseError(section Section, lineNumber int, suberror error) error {
+	code := ErrorUnknown
+	if e, ok := suberror.(*sectionError); ok {
+		code = e.Code
+	}
 	return &TraceParseError{
-		Section:    section,
-		LineNumber: lineNumber,
-		Suberror:   suberror,
+		Section:           section,
+		LineNumber:        lineNumber,
+		Suberror:          suberror,
+		Code:              code,
+		FileFormatVersion: -1,
 	}
 }
 
+// Record which version and build of bismark-passive wrote a trace that we
+// failed to parse, by parsing as much of the intro section as we can.
+func annotateTraceParseError(err error, sections [][]string) error {
+	parseError, ok := err.(*TraceParseError)
+	if !ok || len(sections) == 0 {
+		return err
+	}
+	intro := new(Trace)
+	parseSectionIntro(sections[int(SectionIntro)], intro)
+	if intro.FileFormatVersion != nil {
+		parseError.FileFormatVersion = *intro.FileFormatVersion
+	}
+	parseError.BuildId = intro.GetBuildId()
+	return err
+}
+
 // When parsing a trace, most errors happen within a specific section, as
 // opposed to with the trace as a whole. Use a sectionError for these errors,
 // since they keep extra state that's useful for debugging.
@@ -77,6 +150,7 @@ type sectionError struct {
 	LineNumber int
 	Suberror   error
 	Example    *string
+	Code       ParseErrorCode
 }
 
 func (err *sectionError) Error() string {
@@ -89,25 +163,27 @@ func (err *sectionError) Error() string {
 	return fmt.Sprintf("%s (\"%s\"): %s", err.Message, *err.Example, err.Suberror)
 }
 
-func newSectionConversionError(message string, lineNumber int, example string, suberror error) error {
+func newSectionConversionError(code ParseErrorCode, message string, lineNumber int, example string, suberror error) error {
 	return &sectionError{
 		Message:    message,
 		LineNumber: lineNumber,
 		Suberror:   suberror,
 		Example:    &example,
+		Code:       code,
 	}
 }
 
-func newSectionErrorWithSuberror(message string, lineNumber int, suberror error) error {
+func newSectionErrorWithSuberror(code ParseErrorCode, message string, lineNumber int, suberror error) error {
 	return &sectionError{
 		Message:    message,
 		LineNumber: lineNumber,
 		Suberror:   suberror,
+		Code:       code,
 	}
 }
 
-func newSectionError(message string, lineNumber int) error {
-	return newSectionErrorWithSuberror(message, lineNumber, nil)
+func newSectionError(code ParseErrorCode, message string, lineNumber int) error {
+	return newSectionErrorWithSuberror(code, message, lineNumber, nil)
 }
 
 // Convert a slice of lines from a trace file into a slice of sections,
@@ -184,53 +260,59 @@ func words(str string) []string {
 // [(optional) total packets received by pcap] [(optional) total packets dropped by pcap] [(optional) total packets dropped by interface]
 func parseSectionIntro(sectionLines []string, trace *Trace) error {
 	if len(sectionLines) < 1 {
-		return newSectionError("missing first line", 0)
+		return newSectionError(ErrorMissingLine, "missing first line", 0)
 	}
 	firstLineWords := words(sectionLines[0])
 	if len(firstLineWords) < 1 {
-		return newSectionError("missing file format version", 0)
+		return newSectionError(ErrorMissingField, "missing file format version", 0)
 	}
 	if fileFormatVersion, err := atoi32(firstLineWords[0]); err != nil {
-		return newSectionConversionError("has invalid file format version", 0, firstLineWords[0], err)
+		return newSectionConversionError(ErrorInvalidField, "has invalid file format version", 0, firstLineWords[0], err)
 	} else {
 		trace.FileFormatVersion = &fileFormatVersion
 	}
 
 	if len(sectionLines) < 2 {
-		return newSectionError("missing second line", 1)
+		return newSectionError(ErrorMissingLine, "missing second line", 1)
 	}
 	if len(sectionLines[1]) == 0 {
-		return newSectionError("missing build id", 1)
+		return newSectionError(ErrorMissingField, "missing build id", 1)
 	}
 	trace.BuildId = &sectionLines[1]
+	// Check the version once we know the build, so we can tell which builds
+	// write unsupported versions. Newer versions only add optional sections
+	// and fields, so we parse them as best we can.
+	if *trace.FileFormatVersion < MinFileFormatVersion {
+		return newSectionConversionError(ErrorUnsupportedVersion, "has unsupported file format version", 0, firstLineWords[0], fmt.Errorf("versions start at %d", MinFileFormatVersion))
+	}
 
 	if len(sectionLines) < 3 {
-		return newSectionError("missing third line", 2)
+		return newSectionError(ErrorMissingLine, "missing third line", 2)
 	}
 	thirdLineWords := words(sectionLines[2])
 	switch len(thirdLineWords) {
 	case 0:
-		return newSectionError("missing node id", 2)
+		return newSectionError(ErrorMissingField, "missing node id", 2)
 	case 1:
-		return newSectionError("missing process start time", 2)
+		return newSectionError(ErrorMissingField, "missing process start time", 2)
 	case 2:
-		return newSectionError("missing sequence number", 2)
+		return newSectionError(ErrorMissingField, "missing sequence number", 2)
 	case 3:
-		return newSectionError("missing trace creation timestamp", 2)
+		return newSectionError(ErrorMissingField, "missing trace creation timestamp", 2)
 	}
 	trace.NodeId = &thirdLineWords[0]
 	if processStartTimeMicroseconds, err := atoi64(thirdLineWords[1]); err != nil {
-		return newSectionConversionError("has invalid process start time", 2, thirdLineWords[1], err)
+		return newSectionConversionError(ErrorInvalidField, "has invalid process start time", 2, thirdLineWords[1], err)
 	} else {
 		trace.ProcessStartTimeMicroseconds = &processStartTimeMicroseconds
 	}
 	if sequenceNumber, err := atoi32(thirdLineWords[2]); err != nil {
-		return newSectionConversionError("has invalid sequence number", 2, thirdLineWords[2], err)
+		return newSectionConversionError(ErrorInvalidField, "has invalid sequence number", 2, thirdLineWords[2], err)
 	} else {
 		trace.SequenceNumber = &sequenceNumber
 	}
 	if traceCreationTimestamp, err := atoi64(thirdLineWords[3]); err != nil {
-		return newSectionConversionError("has invalid trace creation timestamp", 2, thirdLineWords[3], err)
+		return newSectionConversionError(ErrorInvalidField, "has invalid trace creation timestamp", 2, thirdLineWords[3], err)
 	} else {
 		trace.TraceCreationTimestamp = &traceCreationTimestamp
 	}
@@ -242,24 +324,24 @@ func parseSectionIntro(sectionLines []string, trace *Trace) error {
 	fourthLineWords := words(sectionLines[3])
 	switch len(fourthLineWords) {
 	case 0:
-		return newSectionError("missing PCAP received", 3)
+		return newSectionError(ErrorMissingField, "missing PCAP received", 3)
 	case 1:
-		return newSectionError("missing PCAP dropped", 3)
+		return newSectionError(ErrorMissingField, "missing PCAP dropped", 3)
 	case 2:
-		return newSectionError("missing interface dropped", 3)
+		return newSectionError(ErrorMissingField, "missing interface dropped", 3)
 	}
 	if pcapReceived, err := atou32(fourthLineWords[0]); err != nil {
-		return newSectionConversionError("invalid PCAP received", 3, fourthLineWords[0], err)
+		return newSectionConversionError(ErrorInvalidField, "invalid PCAP received", 3, fourthLineWords[0], err)
 	} else {
 		trace.PcapReceived = &pcapReceived
 	}
 	if pcapDropped, err := atou32(fourthLineWords[1]); err != nil {
-		return newSectionConversionError("invalid PCAP dropped", 3, fourthLineWords[1], err)
+		return newSectionConversionError(ErrorInvalidField, "invalid PCAP dropped", 3, fourthLineWords[1], err)
 	} else {
 		trace.PcapDropped = &pcapDropped
 	}
 	if interfaceDropped, err := atou32(fourthLineWords[2]); err != nil {
-		return newSectionConversionError("invalid interface dropped", 3, fourthLineWords[2], err)
+		return newSectionConversionError(ErrorInvalidField, "invalid interface dropped", 3, fourthLineWords[2], err)
 	} else {
 		trace.InterfaceDropped = &interfaceDropped
 	}
@@ -283,7 +365,7 @@ func parseSectionWhitelist(sectionLines []string, trace *Trace) error {
 // [hash of anonymization key, or "UNANONYMIZED" if not anonymized]
 func parseSectionAnonymization(sectionLines []string, trace *Trace) error {
 	if len(sectionLines) < 1 {
-		return newSectionError("missing anonymization signature section", 0)
+		return newSectionError(ErrorMissingLine, "missing anonymization signature section", 0)
 	}
 	if sectionLines[0] != "UNANONYMIZED" {
 		trace.AnonymizationSignature = &sectionLines[0]
@@ -300,21 +382,21 @@ func parseSectionAnonymization(sectionLines []string, trace *Trace) error {
 // [microseconds offset from previous packet] [packet size bytes] [flow id]
 func parseSectionPacketSeries(sectionLines []string, trace *Trace) error {
 	if len(sectionLines) < 1 {
-		return newSectionError("missing first line", 0)
+		return newSectionError(ErrorMissingLine, "missing first line", 0)
 	}
 	firstLineWords := words(sectionLines[0])
 	switch len(firstLineWords) {
 	case 0:
-		return newSectionError("missing base timestamp", 0)
+		return newSectionError(ErrorMissingField, "missing base timestamp", 0)
 	case 1:
-		return newSectionError("missing dropped packets count", 0)
+		return newSectionError(ErrorMissingField, "missing dropped packets count", 0)
 	}
 	currentTimestampMicroseconds, err := atoi64(firstLineWords[0])
 	if err != nil {
-		return newSectionConversionError("invalid base timestamp", 0, firstLineWords[0], err)
+		return newSectionConversionError(ErrorInvalidField, "invalid base timestamp", 0, firstLineWords[0], err)
 	}
 	if dropped, err := atou32(firstLineWords[1]); err != nil {
-		return newSectionConversionError("invalid dropped packet count", 0, firstLineWords[1], err)
+		return newSectionConversionError(ErrorInvalidField, "invalid dropped packet count", 0, firstLineWords[1], err)
 	} else {
 		trace.PacketSeriesDropped = &dropped
 	}
@@ -324,25 +406,25 @@ func parseSectionPacketSeries(sectionLines []string, trace *Trace) error {
 		entryWords := words(line)
 		switch len(entryWords) {
 		case 0:
-			return newSectionError("missing offset in packet entry", 1+index)
+			return newSectionError(ErrorMissingField, "missing offset in packet entry", 1+index)
 		case 1:
-			return newSectionError("missing size in packet entry", 1+index)
+			return newSectionError(ErrorMissingField, "missing size in packet entry", 1+index)
 		case 2:
-			return newSectionError("missing flow id in packet entry", 1+index)
+			return newSectionError(ErrorMissingField, "missing flow id in packet entry", 1+index)
 		}
 		if offset, err := atoi32(entryWords[0]); err != nil {
-			return newSectionConversionError("invalid offset in packet entry", 1+index, entryWords[0], err)
+			return newSectionConversionError(ErrorInvalidField, "invalid offset in packet entry", 1+index, entryWords[0], err)
 		} else {
 			currentTimestampMicroseconds += int64(offset)
 		}
 		timestampMicroseconds := currentTimestampMicroseconds
 		size, err := atoi32(entryWords[1])
 		if err != nil {
-			return newSectionConversionError("invalid size in packet entry", 1+index, entryWords[1], err)
+			return newSectionConversionError(ErrorInvalidField, "invalid size in packet entry", 1+index, entryWords[1], err)
 		}
 		flowId, err := atoi32(entryWords[2])
 		if err != nil {
-			return newSectionConversionError("invalid flow id in packet entry", 1+index, entryWords[2], err)
+			return newSectionConversionError(ErrorInvalidField, "invalid flow id in packet entry", 1+index, entryWords[2], err)
 		}
 		newEntry := PacketSeriesEntry{
 			TimestampMicroseconds: &timestampMicroseconds,
@@ -363,36 +445,36 @@ func parseSectionPacketSeries(sectionLines []string, trace *Trace) error {
 // [flow id] [anonymized source?] [(hashed) source IP address] [anonymized destination?] [(hashed) destination IP address] [transport protocol] [source port] [destination port]
 func parseSectionFlowTable(sectionLines []string, trace *Trace) error {
 	if len(sectionLines) < 1 {
-		return newSectionError("missing first line", 0)
+		return newSectionError(ErrorMissingLine, "missing first line", 0)
 	}
 	firstLineWords := words(sectionLines[0])
 	switch len(firstLineWords) {
 	case 0:
-		return newSectionError("missing base timestamp", 0)
+		return newSectionError(ErrorMissingField, "missing base timestamp", 0)
 	case 1:
-		return newSectionError("missing table size", 0)
+		return newSectionError(ErrorMissingField, "missing table size", 0)
 	case 2:
-		return newSectionError("missing expiration time", 0)
+		return newSectionError(ErrorMissingField, "missing expiration time", 0)
 	case 3:
-		return newSectionError("missing dropped entries count", 0)
+		return newSectionError(ErrorMissingField, "missing dropped entries count", 0)
 	}
 	if baseline, err := atoi64(firstLineWords[0]); err != nil {
-		return newSectionConversionError("invalid base timestamp", 0, firstLineWords[0], err)
+		return newSectionConversionError(ErrorInvalidField, "invalid base timestamp", 0, firstLineWords[0], err)
 	} else {
 		trace.FlowTableBaseline = &baseline
 	}
 	if tableSize, err := atou32(firstLineWords[1]); err != nil {
-		return newSectionConversionError("invalid table size", 0, firstLineWords[1], err)
+		return newSectionConversionError(ErrorInvalidField, "invalid table size", 0, firstLineWords[1], err)
 	} else {
 		trace.FlowTableSize = &tableSize
 	}
 	if expired, err := atoi32(firstLineWords[2]); err != nil {
-		return newSectionConversionError("invalid expired count", 0, firstLineWords[2], err)
+		return newSectionConversionError(ErrorInvalidField, "invalid expired count", 0, firstLineWords[2], err)
 	} else {
 		trace.FlowTableExpired = &expired
 	}
 	if dropped, err := atoi32(firstLineWords[3]); err != nil {
-		return newSectionConversionError("invalid dropped count", 0, firstLineWords[3], err)
+		return newSectionConversionError(ErrorInvalidField, "invalid dropped count", 0, firstLineWords[3], err)
 	} else {
 		trace.FlowTableDropped = &dropped
 	}
@@ -402,52 +484,52 @@ func parseSectionFlowTable(sectionLines []string, trace *Trace) error {
 		entryWords := words(line)
 		switch len(entryWords) {
 		case 0:
-			return newSectionError("missing flow id from flow table entry", 1+index)
+			return newSectionError(ErrorMissingField, "missing flow id from flow table entry", 1+index)
 		case 1:
-			return newSectionError("missing source IP anonymized from flow table entry", 1+index)
+			return newSectionError(ErrorMissingField, "missing source IP anonymized from flow table entry", 1+index)
 		case 2:
-			return newSectionError("missing source IP from flow table entry", 1+index)
+			return newSectionError(ErrorMissingField, "missing source IP from flow table entry", 1+index)
 		case 3:
-			return newSectionError("missing destination IP anonymized from flow table entry", 1+index)
+			return newSectionError(ErrorMissingField, "missing destination IP anonymized from flow table entry", 1+index)
 		case 4:
-			return newSectionError("missing destination IP from flow table entry", 1+index)
+			return newSectionError(ErrorMissingField, "missing destination IP from flow table entry", 1+index)
 		case 5:
-			return newSectionError("missing transport protocol from flow table entry", 1+index)
+			return newSectionError(ErrorMissingField, "missing transport protocol from flow table entry", 1+index)
 		case 6:
-			return newSectionError("missing source port from flow table entry", 1+index)
+			return newSectionError(ErrorMissingField, "missing source port from flow table entry", 1+index)
 		case 7:
-			return newSectionError("missing destination port from flow table entry", 1+index)
+			return newSectionError(ErrorMissingField, "missing destination port from flow table entry", 1+index)
 		}
 		newEntry := FlowTableEntry{}
 		if flowId, err := atoi32(entryWords[0]); err != nil {
-			return newSectionConversionError("invalid flow id in flow table entry", 1+index, entryWords[0], err)
+			return newSectionConversionError(ErrorInvalidField, "invalid flow id in flow table entry", 1+index, entryWords[0], err)
 		} else {
 			newEntry.FlowId = &flowId
 		}
 		if sourceIpAnonymized, err := stringIntToBool(entryWords[1]); err != nil {
-			return newSectionConversionError("invalid source IP anonymized", 1+index, entryWords[1], err)
+			return newSectionConversionError(ErrorInvalidField, "invalid source IP anonymized", 1+index, entryWords[1], err)
 		} else {
 			newEntry.SourceIpAnonymized = &sourceIpAnonymized
 		}
 		newEntry.SourceIp = &entryWords[2]
 		if destinationIpAnonymized, err := stringIntToBool(entryWords[3]); err != nil {
-			return newSectionConversionError("invalid destination IP anonymized", 1+index, entryWords[3], err)
+			return newSectionConversionError(ErrorInvalidField, "invalid destination IP anonymized", 1+index, entryWords[3], err)
 		} else {
 			newEntry.DestinationIpAnonymized = &destinationIpAnonymized
 		}
 		newEntry.DestinationIp = &entryWords[4]
 		if transportProtocol, err := atoi32(entryWords[5]); err != nil {
-			return newSectionConversionError("invalid transport protocol", 1+index, entryWords[5], err)
+			return newSectionConversionError(ErrorInvalidField, "invalid transport protocol", 1+index, entryWords[5], err)
 		} else {
 			newEntry.TransportProtocol = &transportProtocol
 		}
 		if sourcePort, err := atoi32(entryWords[6]); err != nil {
-			return newSectionConversionError("invalid source port", 1+index, entryWords[6], err)
+			return newSectionConversionError(ErrorInvalidField, "invalid source port", 1+index, entryWords[6], err)
 		} else {
 			newEntry.SourcePort = &sourcePort
 		}
 		if destinationPort, err := atoi32(entryWords[7]); err != nil {
-			return newSectionConversionError("invalid destination port", 1+index, entryWords[7], err)
+			return newSectionConversionError(ErrorInvalidField, "invalid destination port", 1+index, entryWords[7], err)
 		} else {
 			newEntry.DestinationPort = &destinationPort
 		}
@@ -464,21 +546,21 @@ func parseSectionFlowTable(sectionLines []string, trace *Trace) error {
 // [packet id] [MAC id] [anonymized?] [(hashed) domain name for A record] [(hashed) ip address for A record] [ttl]
 func parseSectionDnsTableA(sectionLines []string, trace *Trace) error {
 	if len(sectionLines) < 1 {
-		return newSectionError("missing first line", 0)
+		return newSectionError(ErrorMissingLine, "missing first line", 0)
 	}
 	firstLineWords := words(sectionLines[0])
 	if len(firstLineWords) < 1 {
-		return newSectionError("missing dropped DNS A records", 0)
+		return newSectionError(ErrorMissingField, "missing dropped DNS A records", 0)
 	} else if len(firstLineWords) < 2 {
-		return newSectionError("missing dropped DNS CNAME records", 0)
+		return newSectionError(ErrorMissingField, "missing dropped DNS CNAME records", 0)
 	}
 	if droppedA, err := atoi32(firstLineWords[0]); err != nil {
-		return newSectionConversionError("invalid dropped A records count", 0, firstLineWords[0], err)
+		return newSectionConversionError(ErrorInvalidField, "invalid dropped A records count", 0, firstLineWords[0], err)
 	} else {
 		trace.ARecordsDropped = &droppedA
 	}
 	if droppedCname, err := atoi32(firstLineWords[1]); err != nil {
-		return newSectionConversionError("invalid dropped CNAME records count", 0, firstLineWords[1], err)
+		return newSectionConversionError(ErrorInvalidField, "invalid dropped CNAME records count", 0, firstLineWords[1], err)
 	} else {
 		trace.CnameRecordsDropped = &droppedCname
 	}
@@ -488,38 +570,38 @@ func parseSectionDnsTableA(sectionLines []string, trace *Trace) error {
 		entryWords := words(line)
 		switch len(entryWords) {
 		case 0:
-			return newSectionError("missing packet id in record", 1+index)
+			return newSectionError(ErrorMissingField, "missing packet id in record", 1+index)
 		case 1:
-			return newSectionError("missing address id in record", 1+index)
+			return newSectionError(ErrorMissingField, "missing address id in record", 1+index)
 		case 2:
-			return newSectionError("missing anonymized in record", 1+index)
+			return newSectionError(ErrorMissingField, "missing anonymized in record", 1+index)
 		case 3:
-			return newSectionError("missing domain in record", 1+index)
+			return newSectionError(ErrorMissingField, "missing domain in record", 1+index)
 		case 4:
-			return newSectionError("missing IP address in record", 1+index)
+			return newSectionError(ErrorMissingField, "missing IP address in record", 1+index)
 		case 5:
-			return newSectionError("missing TTL id in record", 1+index)
+			return newSectionError(ErrorMissingField, "missing TTL id in record", 1+index)
 		}
 		newEntry := DnsARecord{}
 		if packetId, err := atoi32(entryWords[0]); err != nil {
-			return newSectionConversionError("invalid packet id in record", 1+index, entryWords[0], err)
+			return newSectionConversionError(ErrorInvalidField, "invalid packet id in record", 1+index, entryWords[0], err)
 		} else {
 			newEntry.PacketId = &packetId
 		}
 		if addressId, err := atoi32(entryWords[1]); err != nil {
-			return newSectionConversionError("invalid address id in record", 1+index, entryWords[1], err)
+			return newSectionConversionError(ErrorInvalidField, "invalid address id in record", 1+index, entryWords[1], err)
 		} else {
 			newEntry.AddressId = &addressId
 		}
 		if anonymized, err := stringIntToBool(entryWords[2]); err != nil {
-			return newSectionConversionError("invalid anonymized in record", 1+index, entryWords[2], err)
+			return newSectionConversionError(ErrorInvalidField, "invalid anonymized in record", 1+index, entryWords[2], err)
 		} else {
 			newEntry.Anonymized = &anonymized
 		}
 		newEntry.Domain = &entryWords[3]
 		newEntry.IpAddress = &entryWords[4]
 		if ttl, err := atoi32(entryWords[5]); err != nil {
-			return newSectionConversionError("invalid TTL in record", 1+index, entryWords[5], err)
+			return newSectionConversionError(ErrorInvalidField, "invalid TTL in record", 1+index, entryWords[5], err)
 		} else {
 			newEntry.Ttl = &ttl
 		}
@@ -540,31 +622,31 @@ func parseSectionDnsTableCname(sectionLines []string, trace *Trace) error {
 		entryWords := words(line)
 		switch len(entryWords) {
 		case 0:
-			return newSectionError("missing packet id in record", index)
+			return newSectionError(ErrorMissingField, "missing packet id in record", index)
 		case 1:
-			return newSectionError("missing address id in record", index)
+			return newSectionError(ErrorMissingField, "missing address id in record", index)
 		case 2:
-			return newSectionError("missing domain anonymized in record", index)
+			return newSectionError(ErrorMissingField, "missing domain anonymized in record", index)
 		case 3:
-			return newSectionError("missing domain in record", index)
+			return newSectionError(ErrorMissingField, "missing domain in record", index)
 		case 4:
-			return newSectionError("missing CNAME anonymized (or CNAME) in record", index)
+			return newSectionError(ErrorMissingField, "missing CNAME anonymized (or CNAME) in record", index)
 		case 5:
-			return newSectionError("missing CNAME (or TTL id) in record", index)
+			return newSectionError(ErrorMissingField, "missing CNAME (or TTL id) in record", index)
 		}
 		newEntry := DnsCnameRecord{}
 		if packetId, err := atoi32(entryWords[0]); err != nil {
-			return newSectionConversionError("invalid packet id in record", index, entryWords[0], err)
+			return newSectionConversionError(ErrorInvalidField, "invalid packet id in record", index, entryWords[0], err)
 		} else {
 			newEntry.PacketId = &packetId
 		}
 		if addressId, err := atoi32(entryWords[1]); err != nil {
-			return newSectionConversionError("invalid address id in record", index, entryWords[1], err)
+			return newSectionConversionError(ErrorInvalidField, "invalid address id in record", index, entryWords[1], err)
 		} else {
 			newEntry.AddressId = &addressId
 		}
 		if domainAnonymized, err := stringIntToBool(entryWords[2]); err != nil {
-			return newSectionConversionError("invalid domain anonymized in record", index, entryWords[2], err)
+			return newSectionConversionError(ErrorInvalidField, "invalid domain anonymized in record", index, entryWords[2], err)
 		} else {
 			newEntry.DomainAnonymized = &domainAnonymized
 		}
@@ -573,7 +655,7 @@ func parseSectionDnsTableCname(sectionLines []string, trace *Trace) error {
 			newEntry.CnameAnonymized = newEntry.DomainAnonymized
 		} else if len(entryWords) >= 7 {
 			if cnameAnonymized, err := stringIntToBool(entryWords[4]); err != nil {
-				return newSectionConversionError("invalid CNAME anonymized in record", index, entryWords[4], err)
+				return newSectionConversionError(ErrorInvalidField, "invalid CNAME anonymized in record", index, entryWords[4], err)
 			} else {
 				newEntry.CnameAnonymized = &cnameAnonymized
 			}
@@ -582,7 +664,7 @@ func parseSectionDnsTableCname(sectionLines []string, trace *Trace) error {
 		}
 		newEntry.Cname = &entryWords[len(entryWords)-2]
 		if ttl, err := atoi32(entryWords[len(entryWords)-1]); err != nil {
-			return newSectionConversionError("invalid TTL in record", index, entryWords[len(entryWords)-1], err)
+			return newSectionConversionError(ErrorInvalidField, "invalid TTL in record", index, entryWords[len(entryWords)-1], err)
 		} else {
 			newEntry.Ttl = &ttl
 		}
@@ -600,21 +682,21 @@ func parseSectionDnsTableCname(sectionLines []string, trace *Trace) error {
 // [MAC address with lower 24 bits hashed] [hashed IP address]
 func parseSectionAddressTable(sectionLines []string, trace *Trace) error {
 	if len(sectionLines) < 1 {
-		return newSectionError("missing first line", 0)
+		return newSectionError(ErrorMissingLine, "missing first line", 0)
 	}
 	firstLineWords := words(sectionLines[0])
 	if len(firstLineWords) < 1 {
-		return newSectionError("missing first id", 0)
+		return newSectionError(ErrorMissingField, "missing first id", 0)
 	} else if len(firstLineWords) < 2 {
-		return newSectionError("missing table size", 0)
+		return newSectionError(ErrorMissingField, "missing table size", 0)
 	}
 	if firstId, err := atoi32(firstLineWords[0]); err != nil {
-		return newSectionConversionError("invalid first id", 0, firstLineWords[0], err)
+		return newSectionConversionError(ErrorInvalidField, "invalid first id", 0, firstLineWords[0], err)
 	} else {
 		trace.AddressTableFirstId = &firstId
 	}
 	if size, err := atoi32(firstLineWords[1]); err != nil {
-		return newSectionConversionError("invalid table size", 0, firstLineWords[1], err)
+		return newSectionConversionError(ErrorInvalidField, "invalid table size", 0, firstLineWords[1], err)
 	} else {
 		trace.AddressTableSize = &size
 	}
@@ -623,9 +705,9 @@ func parseSectionAddressTable(sectionLines []string, trace *Trace) error {
 	for index, line := range sectionLines[1:] {
 		entryWords := words(line)
 		if len(entryWords) < 1 {
-			return newSectionError("missing MAC address in entry", 1+index)
+			return newSectionError(ErrorMissingField, "missing MAC address in entry", 1+index)
 		} else if len(entryWords) < 2 {
-			return newSectionError("missing IP address in entry", 1+index)
+			return newSectionError(ErrorMissingField, "missing IP address in entry", 1+index)
 		}
 		trace.AddressTableEntry[index] = &AddressTableEntry{
 			MacAddress: &entryWords[0],
@@ -644,6 +726,8 @@ func parseSectionAddressTable(sectionLines []string, trace *Trace) error {
 func parseSectionDropStatistics(sectionLines []string, trace *Trace) error {
 	// Compensate for a bug where some traces don't leave space for
 	// a dropped packets section and skip to an HTTP URLs section.
+	// splitHttpUrlsSection moves those lines into their own section
+	// before we get here, but stop at them anyway in case it didn't.
 	numLines := len(sectionLines)
 	for index, line := range sectionLines {
 		if line != "" && line[len(line)-1] == ' ' {
@@ -655,18 +739,18 @@ func parseSectionDropStatistics(sectionLines []string, trace *Trace) error {
 	for index, line := range sectionLines[:numLines] {
 		entryWords := words(line)
 		if len(entryWords) < 1 {
-			return newSectionError("missing size in entry", index)
+			return newSectionError(ErrorMissingField, "missing size in entry", index)
 		} else if len(entryWords) < 2 {
-			return newSectionError("missing drop count in entry", index)
+			return newSectionError(ErrorMissingField, "missing drop count in entry", index)
 		}
 		newEntry := DroppedPacketsEntry{}
 		if size, err := atou32(entryWords[0]); err != nil {
-			return newSectionConversionError("invalid size in entry", index, entryWords[0], err)
+			return newSectionConversionError(ErrorInvalidField, "invalid size in entry", index, entryWords[0], err)
 		} else {
 			newEntry.Size = &size
 		}
 		if count, err := atou32(entryWords[1]); err != nil {
-			return newSectionConversionError("invalid count in entry", index, entryWords[1], err)
+			return newSectionConversionError(ErrorInvalidField, "invalid count in entry", index, entryWords[1], err)
 		} else {
 			newEntry.Count = &count
 		}
@@ -675,53 +759,255 @@ func parseSectionDropStatistics(sectionLines []string, trace *Trace) error {
 	return nil
 }
 
-// Parse the sections of a trace file. Some sections are mandatory, while others
-// are optional.
-func makeTraceFromSections(sections [][]string, lineNumbers []int) (*Trace, error) {
-	type sectionParser func([]string, *Trace) error
+// Parse the HTTP URLs section, which only a few builds of bismark-passive
+// wrote. Every line ends with a space. The format is:
+//
+// [dropped URLs]
+// [flow id] [anonymized?] [(hashed) URL]
+// [flow id] [anonymized?] [(hashed) URL]
+// ...
+// [flow id] [anonymized?] [(hashed) URL]
+func parseSectionHttpUrls(sectionLines []string, trace *Trace) error {
+	if len(sectionLines) < 1 {
+		// Traces end with a blank line, which sometimes looks like an
+		// empty section.
+		return nil
+	}
+	firstLineWords := words(strings.TrimRight(sectionLines[0], " "))
+	if len(firstLineWords[0]) == 0 {
+		return newSectionError(ErrorMissingField, "missing dropped URLs count", 0)
+	}
+	if dropped, err := atoi32(firstLineWords[0]); err != nil {
+		return newSectionConversionError(ErrorInvalidField, "invalid dropped URLs count", 0, firstLineWords[0], err)
+	} else {
+		trace.HttpUrlsDropped = &dropped
+	}
 
-	trace := new(Trace)
+	trace.HttpUrl = make([]*HttpUrlEntry, len(sectionLines[1:]))
+	for index, line := range sectionLines[1:] {
+		entryWords := words(strings.TrimRight(line, " "))
+		switch len(entryWords) {
+		case 1:
+			return newSectionError(ErrorMissingField, "missing anonymized in URL entry", 1+index)
+		case 2:
+			return newSectionError(ErrorMissingField, "missing URL in URL entry", 1+index)
+		}
+		newEntry := HttpUrlEntry{}
+		if flowId, err := atoi32(entryWords[0]); err != nil {
+			return newSectionConversionError(ErrorInvalidField, "invalid flow id in URL entry", 1+index, entryWords[0], err)
+		} else {
+			newEntry.FlowId = &flowId
+		}
+		if anonymized, err := stringIntToBool(entryWords[1]); err != nil {
+			return newSectionConversionError(ErrorInvalidField, "invalid anonymized in URL entry", 1+index, entryWords[1], err)
+		} else {
+			newEntry.Anonymized = &anonymized
+		}
+		newEntry.Url = &entryWords[2]
+		trace.HttpUrl[index] = &newEntry
+	}
+	return nil
+}
 
-	mandatorySectionsMap := map[Section]sectionParser{
-		SectionIntro:         parseSectionIntro,
-		SectionWhitelist:     parseSectionWhitelist,
-		SectionAnonymization: parseSectionAnonymization,
-		SectionPacketSeries:  parseSectionPacketSeries,
-		SectionFlowTable:     parseSectionFlowTable,
-		SectionDnsTableA:     parseSectionDnsTableA,
-		SectionDnsTableCname: parseSectionDnsTableCname,
-		SectionAddressTable:  parseSectionAddressTable,
-	}
-	for section, parse := range mandatorySectionsMap {
-		if len(sections) <= int(section) {
-			return nil, newTraceParseError(section, 0, newSectionError("missing", 0))
+// Some traces don't leave space for a dropped packets section and skip
+// directly to an HTTP URLs section, so the HTTP URLs end up in the drop
+// statistics section. Every line of the HTTP URLs section ends with a space,
+// unlike the drop statistics section, so we can split them apart.
+func splitHttpUrlsSection(sections [][]string, lineNumbers []int) ([][]string, []int) {
+	if len(sections) <= int(SectionDropStatistics) {
+		return sections, lineNumbers
+	}
+	if len(sections) > int(SectionHttpUrls) && len(sections[int(SectionHttpUrls)]) > 0 {
+		return sections, lineNumbers
+	}
+	dropStatisticsLines := sections[int(SectionDropStatistics)]
+	for index, line := range dropStatisticsLines {
+		if line != "" && line[len(line)-1] == ' ' {
+			sections = append(sections[:int(SectionDropStatistics)], dropStatisticsLines[:index], dropStatisticsLines[index:])
+			lineNumbers = append(lineNumbers[:int(SectionHttpUrls)], lineNumbers[int(SectionDropStatistics)]+index)
+			break
 		}
-		if err := parse(sections[int(section)], trace); err != nil {
-			if e, ok := err.(*sectionError); ok {
-				return nil, newTraceParseError(section, lineNumbers[int(section)]+e.LineNumber, err)
-			} else {
-				return nil, newTraceParseError(section, -1, err)
+	}
+	return sections, lineNumbers
+}
+
+type sectionParser func([]string, *Trace) error
+
+var mandatorySectionParsers = map[Section]sectionParser{
+	SectionIntro:         parseSectionIntro,
+	SectionWhitelist:     parseSectionWhitelist,
+	SectionAnonymization: parseSectionAnonymization,
+	SectionPacketSeries:  parseSectionPacketSeries,
+	SectionFlowTable:     parseSectionFlowTable,
+	SectionDnsTableA:     parseSectionDnsTableA,
+	SectionDnsTableCname: parseSectionDnsTableCname,
+	SectionAddressTable:  parseSectionAddressTable,
+}
+
+var optionalSectionParsers = map[Section]sectionParser{
+	SectionDropStatistics: parseSectionDropStatistics,
+	SectionHttpUrls:       parseSectionHttpUrls,
+}
+
+// The number of lines at the beginning of each section that come before the
+// section's entries. When parsing leniently we can skip damaged entries, but
+// we have to discard the whole section if its header is damaged. The intro
+// and anonymization sections aren't listed because they identify the trace, so
+// we can't salvage anything if they're damaged.
+var sectionHeaderLines = map[Section]int{
+	SectionWhitelist:      0,
+	SectionPacketSeries:   1,
+	SectionFlowTable:      1,
+	SectionDnsTableA:      1,
+	SectionDnsTableCname:  0,
+	SectionAddressTable:   1,
+	SectionDropStatistics: 0,
+	SectionHttpUrls:       1,
+}
+
+func parseSection(section Section, sectionLines []string, firstLineNumber int, parse sectionParser, trace *Trace) error {
+	if err := parse(sectionLines, trace); err != nil {
+		if e, ok := err.(*sectionError); ok {
+			return newTraceParseError(section, firstLineNumber+e.LineNumber, err)
+		} else {
+			return newTraceParseError(section, -1, err)
+		}
+	}
+	return nil
+}
+
+// Parse a section, skipping entries that fail to parse until the rest of the
+// section parses. Returns nil if the section wasn't damaged.
+//
+// Address table entries are identified by their position in the table, so we
+// replace skipped address table entries with empty entries instead of removing
+// them, which preserves the positions of the remaining entries.
+//
+// Packet series entries are also identified by their position, since DNS
+// records refer to packets by it, and each entry's offset is relative to the
+// previous entry's timestamp. If we can parse a damaged entry's offset we
+// replace the entry with a placeholder that has only a timestamp, which
+// downstream pipelines skip when they need a packet's size or flow. Otherwise we can't know the timestamps of the
+// later entries, so we skip them too.
+func salvageSection(section Section, sectionLines []string, parse sectionParser, trace *Trace) *SectionDamage {
+	headerLines := sectionHeaderLines[section]
+	lines := make([]string, len(sectionLines))
+	copy(lines, sectionLines)
+	originalLineNumbers := make([]int, len(sectionLines))
+	for index := range originalLineNumbers {
+		originalLineNumbers[index] = index
+	}
+	var skippedLineNumbers []int
+	// Indices into lines of the packet series entries we replaced.
+	var placeholderLineNumbers []int
+	for {
+		// Parse into a scratch trace so a failed attempt doesn't leave
+		// partial results in the real one.
+		err := parse(lines, new(Trace))
+		if err == nil {
+			parse(lines, trace)
+			if section == SectionAddressTable {
+				for _, lineNumber := range skippedLineNumbers {
+					index := lineNumber - headerLines
+					entries := append(trace.AddressTableEntry, nil)
+					copy(entries[index+1:], entries[index:])
+					entries[index] = &AddressTableEntry{}
+					trace.AddressTableEntry = entries
+				}
+			}
+			for _, lineNumber := range placeholderLineNumbers {
+				entry := trace.PacketSeries[lineNumber-headerLines]
+				entry.Size = nil
+				entry.FlowId = nil
+			}
+			break
+		}
+		e, ok := err.(*sectionError)
+		if !ok || e.LineNumber < headerLines || e.LineNumber >= len(lines) {
+			return &SectionDamage{
+				Section:        proto.Int32(int32(section)),
+				SkippedEntries: proto.Int32(int32(len(skippedLineNumbers))),
+				Discarded:      proto.Bool(true),
+			}
+		}
+		if section == SectionPacketSeries {
+			entryWords := words(lines[e.LineNumber])
+			if len(entryWords) > 0 {
+				if _, err := atoi32(entryWords[0]); err == nil {
+					skippedLineNumbers = append(skippedLineNumbers, originalLineNumbers[e.LineNumber])
+					placeholderLineNumbers = append(placeholderLineNumbers, e.LineNumber)
+					lines[e.LineNumber] = fmt.Sprintf("%s 0 -1", entryWords[0])
+					continue
+				}
 			}
+			skippedLineNumbers = append(skippedLineNumbers, originalLineNumbers[e.LineNumber:]...)
+			lines = lines[:e.LineNumber]
+			originalLineNumbers = originalLineNumbers[:e.LineNumber]
+			continue
 		}
+		skippedLineNumbers = append(skippedLineNumbers, originalLineNumbers[e.LineNumber])
+		lines = append(lines[:e.LineNumber], lines[e.LineNumber+1:]...)
+		originalLineNumbers = append(originalLineNumbers[:e.LineNumber], originalLineNumbers[e.LineNumber+1:]...)
+	}
+	if len(skippedLineNumbers) == 0 {
+		return nil
 	}
+	return &SectionDamage{
+		Section:        proto.Int32(int32(section)),
+		SkippedEntries: proto.Int32(int32(len(skippedLineNumbers))),
+	}
+}
 
-	optionalSectionsMap := map[Section]sectionParser{
-		SectionDropStatistics: parseSectionDropStatistics,
+func addSectionDamage(trace *Trace, damage *SectionDamage) {
+	for _, existingDamage := range trace.SectionDamage {
+		if existingDamage.GetSection() == damage.GetSection() {
+			*existingDamage.SkippedEntries += damage.GetSkippedEntries()
+			return
+		}
 	}
-	for section, parse := range optionalSectionsMap {
-		if int(section) >= len(sections) {
-			continue
+	trace.SectionDamage = append(trace.SectionDamage, damage)
+}
+
+// DNS records refer to packets by their position in the packet series, so
+// once we skip or discard packet series entries some DNS records might refer
+// to packets that no longer exist. Skip those records too, since downstream pipelines
+// assume every packet id is valid.
+func skipDanglingDnsRecords(trace *Trace) {
+	packetExists := func(packetId *int32) bool {
+		return packetId != nil && *packetId >= 0 && int(*packetId) < len(trace.PacketSeries)
+	}
+
+	var aRecords []*DnsARecord
+	for _, record := range trace.ARecord {
+		if packetExists(record.PacketId) {
+			aRecords = append(aRecords, record)
 		}
-		if err := parse(sections[int(section)], trace); err != nil {
-			if e, ok := err.(*sectionError); ok {
-				return nil, newTraceParseError(section, lineNumbers[int(section)]+e.LineNumber, err)
-			} else {
-				return nil, newTraceParseError(section, -1, err)
-			}
+	}
+	if skipped := len(trace.ARecord) - len(aRecords); skipped > 0 {
+		addSectionDamage(trace, &SectionDamage{
+			Section:        proto.Int32(int32(SectionDnsTableA)),
+			SkippedEntries: proto.Int32(int32(skipped)),
+		})
+		trace.ARecord = aRecords
+	}
+
+	var cnameRecords []*DnsCnameRecord
+	for _, record := range trace.CnameRecord {
+		if packetExists(record.PacketId) {
+			cnameRecords = append(cnameRecords, record)
 		}
 	}
+	if skipped := len(trace.CnameRecord) - len(cnameRecords); skipped > 0 {
+		addSectionDamage(trace, &SectionDamage{
+			Section:        proto.Int32(int32(SectionDnsTableCname)),
+			SkippedEntries: proto.Int32(int32(skipped)),
+		})
+		trace.CnameRecord = cnameRecords
+	}
+}
 
-	// Fill in nil repeated fields, otherise proto serialization fails.
+// Fill in nil repeated fields, otherise proto serialization fails.
+func fillRepeatedFields(trace *Trace) {
 	if trace.PacketSeries == nil {
 		trace.PacketSeries = make([]*PacketSeriesEntry, 0)
 	}
@@ -740,6 +1026,92 @@ func makeTraceFromSections(sections [][]string, lineNumbers []int) (*Trace, erro
 	if trace.DroppedPacketsEntry == nil {
 		trace.DroppedPacketsEntry = make([]*DroppedPacketsEntry, 0)
 	}
+	if trace.HttpUrl == nil {
+		trace.HttpUrl = make([]*HttpUrlEntry, 0)
+	}
+}
+
+// Parse the sections of a trace file. Some sections are mandatory, while others
+// are optional. Any sections after the ones we know about must be empty.
+func makeTraceFromSections(sections [][]string, lineNumbers []int) (*Trace, error) {
+	trace := new(Trace)
+
+	for section, parse := range mandatorySectionParsers {
+		if len(sections) <= int(section) {
+			return nil, newTraceParseError(section, 0, newSectionError(ErrorMissingSection, "missing", 0))
+		}
+		if err := parseSection(section, sections[int(section)], lineNumbers[int(section)], parse, trace); err != nil {
+			return nil, err
+		}
+	}
+
+	for section, parse := range optionalSectionParsers {
+		if int(section) >= len(sections) {
+			continue
+		}
+		if err := parseSection(section, sections[int(section)], lineNumbers[int(section)], parse, trace); err != nil {
+			return nil, err
+		}
+	}
+
+	for index := int(SectionHttpUrls) + 1; index < len(sections); index++ {
+		if len(sections[index]) > 0 {
+			return nil, newTraceParseError(Section(index), lineNumbers[index], newSectionError(ErrorExtraSection, "unknown section", 0))
+		}
+	}
+
+	fillRepeatedFields(trace)
+	return trace, nil
+}
+
+// Like makeTraceFromSections, but salvage as much as we can from damaged
+// sections instead of rejecting the whole trace. We skip entries that fail to
+// parse and discard sections that are missing or have damaged headers,
+// recording what we threw away in trace.SectionDamage. We still reject traces
+// with damaged intro or anonymization sections, since we need those sections
+// to identify the trace.
+func makeTraceFromSectionsLeniently(sections [][]string, lineNumbers []int) (*Trace, error) {
+	trace := new(Trace)
+
+	for _, section := range []Section{SectionIntro, SectionAnonymization} {
+		if len(sections) <= int(section) {
+			return nil, newTraceParseError(section, 0, newSectionError(ErrorMissingSection, "missing", 0))
+		}
+		if err := parseSection(section, sections[int(section)], lineNumbers[int(section)], mandatorySectionParsers[section], trace); err != nil {
+			return nil, err
+		}
+	}
+
+	for section := SectionIntro; section <= SectionHttpUrls; section++ {
+		if _, ok := sectionHeaderLines[section]; !ok {
+			continue
+		}
+		parse, mandatory := mandatorySectionParsers[section]
+		if !mandatory {
+			parse = optionalSectionParsers[section]
+		}
+		if int(section) >= len(sections) {
+			if mandatory {
+				addSectionDamage(trace, &SectionDamage{
+					Section:        proto.Int32(int32(section)),
+					SkippedEntries: proto.Int32(0),
+					Discarded:      proto.Bool(true),
+				})
+			}
+			continue
+		}
+		if damage := salvageSection(section, sections[int(section)], parse, trace); damage != nil {
+			addSectionDamage(trace, damage)
+		}
+	}
+
+	for _, damage := range trace.SectionDamage {
+		if damage.GetSection() == int32(SectionPacketSeries) {
+			skipDanglingDnsRecords(trace)
+		}
+	}
+
+	fillRepeatedFields(trace)
 	return trace, nil
 }
 
@@ -747,10 +1119,22 @@ func makeTraceFromSections(sections [][]string, lineNumbers []int) (*Trace, erro
 // This can parse all versions of the file format.
 func parseTrace(contents []byte) (*Trace, error) {
 	lines := bytes.Split(contents, []byte{'\n'})
-	sections, lineNumbers := linesToSections(lines)
+	sections, lineNumbers := splitHttpUrlsSection(linesToSections(lines))
 	trace, err := makeTraceFromSections(sections, lineNumbers)
 	if err != nil {
-		return nil, err
+		return nil, annotateTraceParseError(err, sections)
+	}
+	return trace, nil
+}
+
+// Like parseTrace, but salvage what we can from damaged traces. See
+// makeTraceFromSectionsLeniently for details.
+func parseTraceLeniently(contents []byte) (*Trace, error) {
+	lines := bytes.Split(contents, []byte{'\n'})
+	sections, lineNumbers := splitHttpUrlsSection(linesToSections(lines))
+	trace, err := makeTraceFromSectionsLeniently(sections, lineNumbers)
+	if err != nil {
+		return nil, annotateTraceParseError(err, sections)
 	}
 	return trace, nil
 }
@@ -40,6 +40,9 @@ type Trace struct {
 	AddressTableSize             *int32                 `protobuf:"varint,24,opt,name=address_table_size" json:"address_table_size,omitempty"`
 	AddressTableEntry            []*AddressTableEntry   `protobuf:"bytes,25,rep,name=address_table_entry" json:"address_table_entry,omitempty"`
 	DroppedPacketsEntry          []*DroppedPacketsEntry `protobuf:"bytes,26,rep,name=dropped_packets_entry" json:"dropped_packets_entry,omitempty"`
+	SectionDamage                []*SectionDamage       `protobuf:"bytes,27,rep,name=section_damage" json:"section_damage,omitempty"`
+	HttpUrlsDropped              *int32                 `protobuf:"varint,28,opt,name=http_urls_dropped" json:"http_urls_dropped,omitempty"`
+	HttpUrl                      []*HttpUrlEntry        `protobuf:"bytes,29,rep,name=http_url" json:"http_url,omitempty"`
 	XXX_unrecognized             []byte                 `json:"-"`
 }
 
@@ -180,6 +183,13 @@ func (this *Trace) GetAddressTableSize() int32 {
 	return 0
 }
 
+func (this *Trace) GetHttpUrlsDropped() int32 {
+	if this != nil && this.HttpUrlsDropped != nil {
+		return *this.HttpUrlsDropped
+	}
+	return 0
+}
+
 type PacketSeriesEntry struct {
 	TimestampMicroseconds *int64 `protobuf:"varint,1,opt,name=timestamp_microseconds" json:"timestamp_microseconds,omitempty"`
 	Size                  *int32 `protobuf:"varint,2,opt,name=size" json:"size,omitempty"`
@@ -452,5 +462,69 @@ func (this *DroppedPacketsEntry) GetCount() uint32 {
 	return 0
 }
 
+type HttpUrlEntry struct {
+	FlowId           *int32  `protobuf:"varint,1,opt,name=flow_id" json:"flow_id,omitempty"`
+	Anonymized       *bool   `protobuf:"varint,2,opt,name=anonymized" json:"anonymized,omitempty"`
+	Url              *string `protobuf:"bytes,3,opt,name=url" json:"url,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (this *HttpUrlEntry) Reset()         { *this = HttpUrlEntry{} }
+func (this *HttpUrlEntry) String() string { return proto.CompactTextString(this) }
+func (*HttpUrlEntry) ProtoMessage()       {}
+
+func (this *HttpUrlEntry) GetFlowId() int32 {
+	if this != nil && this.FlowId != nil {
+		return *this.FlowId
+	}
+	return 0
+}
+
+func (this *HttpUrlEntry) GetAnonymized() bool {
+	if this != nil && this.Anonymized != nil {
+		return *this.Anonymized
+	}
+	return false
+}
+
+func (this *HttpUrlEntry) GetUrl() string {
+	if this != nil && this.Url != nil {
+		return *this.Url
+	}
+	return ""
+}
+
+type SectionDamage struct {
+	Section          *int32 `protobuf:"varint,1,opt,name=section" json:"section,omitempty"`
+	SkippedEntries   *int32 `protobuf:"varint,2,opt,name=skipped_entries" json:"skipped_entries,omitempty"`
+	Discarded        *bool  `protobuf:"varint,3,opt,name=discarded" json:"discarded,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (this *SectionDamage) Reset()         { *this = SectionDamage{} }
+func (this *SectionDamage) String() string { return proto.CompactTextString(this) }
+func (*SectionDamage) ProtoMessage()       {}
+
+func (this *SectionDamage) GetSection() int32 {
+	if this != nil && this.Section != nil {
+		return *this.Section
+	}
+	return 0
+}
+
+func (this *SectionDamage) GetSkippedEntries() int32 {
+	if this != nil && this.SkippedEntries != nil {
+		return *this.SkippedEntries
+	}
+	return 0
+}
+
+func (this *SectionDamage) GetDiscarded() bool {
+	if this != nil && this.Discarded != nil {
+		return *this.Discarded
+	}
+	return false
+}
+
 func init() {
 }
@@ -3,6 +3,7 @@ package passive
 import (
 	"code.google.com/p/goprotobuf/proto"
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -713,6 +714,74 @@ func TestParseSectionDropStatistics_Invalid(t *testing.T) {
 	checkForSectionError(t, parseSectionDropStatistics, []string{"10 11", ""}, 2)
 }
 
+func TestParseSectionHttpUrls_Valid(t *testing.T) {
+	lines := []string{
+		"3 ",
+		"45040 0 971ca2633ac88795417ae7fe2cbe0b1c4e4e81e9 ",
+		"42037 1 8f4b37654010a76ce51a5b106e8a509ff9640a8d ",
+	}
+	trace := Trace{}
+	err := parseSectionHttpUrls(lines, &trace)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	expectedTrace := Trace{
+		HttpUrlsDropped: proto.Int32(3),
+		HttpUrl: []*HttpUrlEntry{
+			&HttpUrlEntry{
+				FlowId:     proto.Int32(45040),
+				Anonymized: proto.Bool(false),
+				Url:        proto.String("971ca2633ac88795417ae7fe2cbe0b1c4e4e81e9"),
+			},
+			&HttpUrlEntry{
+				FlowId:     proto.Int32(42037),
+				Anonymized: proto.Bool(true),
+				Url:        proto.String("8f4b37654010a76ce51a5b106e8a509ff9640a8d"),
+			},
+		},
+	}
+	checkProtosEqual(t, &expectedTrace, &trace)
+}
+
+func TestParseSectionHttpUrls_Invalid(t *testing.T) {
+	checkForSectionError(t, parseSectionHttpUrls, []string{" "}, 1)
+	checkForSectionError(t, parseSectionHttpUrls, []string{"x "}, 1)
+	checkForSectionError(t, parseSectionHttpUrls, []string{"0 ", "10 "}, 2)
+	checkForSectionError(t, parseSectionHttpUrls, []string{"0 ", "10 0 "}, 2)
+	checkForSectionError(t, parseSectionHttpUrls, []string{"0 ", "10 2 abcd "}, 2)
+}
+
+func TestSplitHttpUrlsSection(t *testing.T) {
+	sections := [][]string{{"intro"}, {}, {"anonymization"}, {"packets"}, {"flows"}, {"a"}, {}, {"addresses"}, {"46 1", "54 5045", "0 ", "45040 0 971ca2633ac88795417ae7fe2cbe0b1c4e4e81e9 "}}
+	lineNumbers := []int{0, 2, 3, 5, 7, 9, 11, 12, 14}
+	sections, lineNumbers = splitHttpUrlsSection(sections, lineNumbers)
+	if len(sections) != 10 || len(lineNumbers) != 10 {
+		t.Fatalf("Expected 10 sections. Got %d sections and %d line numbers", len(sections), len(lineNumbers))
+	}
+	if len(sections[SectionDropStatistics]) != 2 || sections[SectionDropStatistics][1] != "54 5045" {
+		t.Fatalf("Unexpected drop statistics section: %q", sections[SectionDropStatistics])
+	}
+	if len(sections[SectionHttpUrls]) != 2 || sections[SectionHttpUrls][0] != "0 " {
+		t.Fatalf("Unexpected HTTP URLs section: %q", sections[SectionHttpUrls])
+	}
+	if lineNumbers[SectionHttpUrls] != 16 {
+		t.Fatalf("Expected HTTP URLs section to start on line 16. Got %d", lineNumbers[SectionHttpUrls])
+	}
+
+	// Traces ending with a blank line have an extra empty section.
+	sections = [][]string{{"intro"}, {}, {"anonymization"}, {"packets"}, {"flows"}, {"a"}, {}, {"addresses"}, {"0 ", "1 1 abcd "}, {}}
+	sections, lineNumbers = splitHttpUrlsSection(sections, []int{0, 2, 3, 5, 7, 9, 11, 12, 14, 17})
+	if len(sections) != 10 || len(sections[SectionDropStatistics]) != 0 || len(sections[SectionHttpUrls]) != 2 || lineNumbers[SectionHttpUrls] != 14 {
+		t.Fatalf("Unexpected sections: %q %v", sections, lineNumbers)
+	}
+
+	sections = [][]string{{"intro"}, {}, {"anonymization"}, {"packets"}, {"flows"}, {"a"}, {}, {"addresses"}, {"46 1", "54 5045"}}
+	sections, lineNumbers = splitHttpUrlsSection(sections, lineNumbers[:9])
+	if len(sections) != 9 || len(lineNumbers) != 9 {
+		t.Fatalf("Traces without HTTP URLs shouldn't change")
+	}
+}
+
 func TestParseTrace_Valid(t *testing.T) {
 	fileContents :=
 		`5
@@ -1000,3 +1069,223 @@ c43dc79106a8 1336ec0318683863
 `
 	checkForParseError(t, invalidAddressTableIndex, 31)
 }
+
+func parseDamagedTraceLeniently(t *testing.T, old, new string) *Trace {
+	formatted, err := FormatTrace(makeTraceForFormatting(), 5)
+	if err != nil {
+		t.Fatalf("Failed to format trace: %s", err)
+	}
+	damaged := strings.Replace(string(formatted), old, new, 1)
+	if damaged == string(formatted) {
+		t.Fatalf("Failed to damage trace: %q not found", old)
+	}
+	if _, err := parseTrace([]byte(damaged)); err == nil {
+		t.Fatalf("Damaged trace should fail to parse strictly")
+	}
+	trace, err := parseTraceLeniently([]byte(damaged))
+	if err != nil {
+		t.Fatalf("Failed to parse damaged trace leniently: %s", err)
+	}
+	return trace
+}
+
+func makeExpectedLenientTrace() *Trace {
+	expectedTrace := makeTraceForFormatting()
+	expectedTrace.FileFormatVersion = proto.Int32(5)
+	return expectedTrace
+}
+
+func TestParseTraceLeniently_Valid(t *testing.T) {
+	formatted, err := FormatTrace(makeTraceForFormatting(), 5)
+	if err != nil {
+		t.Fatalf("Failed to format trace: %s", err)
+	}
+	trace, err := parseTraceLeniently(formatted)
+	if err != nil {
+		t.Fatalf("Failed to parse trace: %s", err)
+	}
+	checkProtosEqual(t, makeExpectedLenientTrace(), trace)
+}
+
+func TestParseTraceLeniently_SkipsDamagedEntry(t *testing.T) {
+	trace := parseDamagedTraceLeniently(t, "1 0 0 www.l.google.com", "1 0 InvalidAnonymized www.l.google.com")
+
+	expectedTrace := makeExpectedLenientTrace()
+	expectedTrace.ARecord = []*DnsARecord{}
+	expectedTrace.SectionDamage = []*SectionDamage{
+		&SectionDamage{
+			Section:        proto.Int32(int32(SectionDnsTableA)),
+			SkippedEntries: proto.Int32(1),
+		},
+	}
+	checkProtosEqual(t, expectedTrace, trace)
+}
+
+func TestParseTraceLeniently_DiscardsDamagedHeader(t *testing.T) {
+	trace := parseDamagedTraceLeniently(t, "1346479359 34 4 5\n", "1346479359 34 InvalidExpired 5\n")
+
+	expectedTrace := makeExpectedLenientTrace()
+	expectedTrace.FlowTableBaseline = nil
+	expectedTrace.FlowTableSize = nil
+	expectedTrace.FlowTableExpired = nil
+	expectedTrace.FlowTableDropped = nil
+	expectedTrace.FlowTableEntry = []*FlowTableEntry{}
+	expectedTrace.SectionDamage = []*SectionDamage{
+		&SectionDamage{
+			Section:        proto.Int32(int32(SectionFlowTable)),
+			SkippedEntries: proto.Int32(0),
+			Discarded:      proto.Bool(true),
+		},
+	}
+	checkProtosEqual(t, expectedTrace, trace)
+}
+
+func TestParseTraceLeniently_SkipsDanglingDnsRecords(t *testing.T) {
+	// Without the offset we can't know the timestamps of later packets, so we
+	// skip the damaged packet and everything after it.
+	trace := parseDamagedTraceLeniently(t, "498 174 -1\n", "InvalidOffset 174 -1\n")
+
+	expectedTrace := makeExpectedLenientTrace()
+	expectedTrace.PacketSeries = expectedTrace.PacketSeries[:1]
+	expectedTrace.ARecord = []*DnsARecord{}
+	expectedTrace.CnameRecord = []*DnsCnameRecord{}
+	expectedTrace.SectionDamage = []*SectionDamage{
+		&SectionDamage{
+			Section:        proto.Int32(int32(SectionPacketSeries)),
+			SkippedEntries: proto.Int32(1),
+		},
+		&SectionDamage{
+			Section:        proto.Int32(int32(SectionDnsTableA)),
+			SkippedEntries: proto.Int32(1),
+		},
+		&SectionDamage{
+			Section:        proto.Int32(int32(SectionDnsTableCname)),
+			SkippedEntries: proto.Int32(1),
+		},
+	}
+	checkProtosEqual(t, expectedTrace, trace)
+}
+
+func TestParseTraceLeniently_PreservesAddressIds(t *testing.T) {
+	trace := parseDamagedTraceLeniently(t, "3 256\n64a769ccb29d ebd6aae385287e9f\n", "3 256\n64a769ccb29d\nc43dc79106a8 1336ec0318683863\n")
+
+	expectedTrace := makeExpectedLenientTrace()
+	expectedTrace.AddressTableEntry = []*AddressTableEntry{
+		&AddressTableEntry{},
+		&AddressTableEntry{
+			MacAddress: proto.String("c43dc79106a8"),
+			IpAddress:  proto.String("1336ec0318683863"),
+		},
+	}
+	expectedTrace.SectionDamage = []*SectionDamage{
+		&SectionDamage{
+			Section:        proto.Int32(int32(SectionAddressTable)),
+			SkippedEntries: proto.Int32(1),
+		},
+	}
+	checkProtosEqual(t, expectedTrace, trace)
+}
+
+func TestParseTraceLeniently_MissingSections(t *testing.T) {
+	formatted, err := FormatTrace(makeTraceForFormatting(), 5)
+	if err != nil {
+		t.Fatalf("Failed to format trace: %s", err)
+	}
+	truncated := formatted[:strings.Index(string(formatted), "3 256\n")]
+	trace, err := parseTraceLeniently(truncated)
+	if err != nil {
+		t.Fatalf("Failed to parse truncated trace leniently: %s", err)
+	}
+
+	expectedTrace := makeExpectedLenientTrace()
+	expectedTrace.AddressTableFirstId = nil
+	expectedTrace.AddressTableSize = nil
+	expectedTrace.AddressTableEntry = []*AddressTableEntry{}
+	expectedTrace.DroppedPacketsEntry = []*DroppedPacketsEntry{}
+	expectedTrace.SectionDamage = []*SectionDamage{
+		&SectionDamage{
+			Section:        proto.Int32(int32(SectionAddressTable)),
+			SkippedEntries: proto.Int32(0),
+			Discarded:      proto.Bool(true),
+		},
+	}
+	checkProtosEqual(t, expectedTrace, trace)
+}
+
+func TestParseTraceLeniently_DamagedIntro(t *testing.T) {
+	formatted, err := FormatTrace(makeTraceForFormatting(), 5)
+	if err != nil {
+		t.Fatalf("Failed to format trace: %s", err)
+	}
+	damaged := strings.Replace(string(formatted), "NODEID 1346479358582428", "NODEID InvalidStart", 1)
+	if _, err := parseTraceLeniently([]byte(damaged)); err == nil {
+		t.Fatalf("Traces with damaged intros should fail to parse")
+	}
+}
+
+func TestParseTrace_ErrorCodes(t *testing.T) {
+	validContents := string(makeValidTraceContents("NODE", 0))
+	cases := []struct {
+		contents          string
+		section           Section
+		code              ParseErrorCode
+		fileFormatVersion int32
+		buildId           string
+	}{
+		{strings.Replace(validContents, "5\n", "InvalidVersion\n", 1), SectionIntro, ErrorInvalidField, -1, ""},
+		{strings.Replace(validContents, "NODE 10 0 20\n", "NODE 10 0\n", 1), SectionIntro, ErrorMissingField, 5, "UNKNOWN"},
+		{strings.Replace(validContents, "UNANONYMIZED\n\n0 0\n", "UNANONYMIZED\n\n0 x\n", 1), SectionPacketSeries, ErrorInvalidField, 5, "UNKNOWN"},
+		{"5\nBUILD\nNODE 10 0 20\n\n\nUNANONYMIZED\n\n0 0\n\n0 0 0 0\n\n0 0\n\n", SectionAddressTable, ErrorMissingSection, 5, "BUILD"},
+		{strings.Replace(validContents, "5\n", "0\n", 1), SectionIntro, ErrorUnsupportedVersion, 0, "UNKNOWN"},
+		{strings.Replace(validContents, "NODE 10 0 20\n", "", 1), SectionIntro, ErrorMissingLine, 5, "UNKNOWN"},
+		{validContents + "\nEXTRA\n", Section(SectionHttpUrls + 1), ErrorExtraSection, 5, "UNKNOWN"},
+	}
+	for _, c := range cases {
+		_, err := parseTrace([]byte(c.contents))
+		e, ok := err.(*TraceParseError)
+		if !ok {
+			t.Errorf("Expected a TraceParseError parsing %q. Got %v", c.contents, err)
+			continue
+		}
+		if e.Section != c.section || e.Code != c.code || e.FileFormatVersion != c.fileFormatVersion || e.BuildId != c.buildId {
+			t.Errorf("Expected %s error in section %s of version %d build %q. Got %s error in section %s of version %d build %q: %v",
+				c.code, c.section, c.fileFormatVersion, c.buildId, e.Code, e.Section, e.FileFormatVersion, e.BuildId, e)
+		}
+	}
+}
+
+func TestParseTraceLeniently_ReplacesDamagedPacket(t *testing.T) {
+	original := makeTraceForFormatting()
+	original.PacketSeries = append(original.PacketSeries, &PacketSeriesEntry{
+		TimestampMicroseconds: proto.Int64(1346479359147319),
+		Size:                  proto.Int32(60),
+		FlowId:                proto.Int32(31646),
+	})
+	original.ARecord[0].PacketId = proto.Int32(2)
+	original.CnameRecord[0].PacketId = proto.Int32(2)
+	formatted, err := FormatTrace(original, 5)
+	if err != nil {
+		t.Fatalf("Failed to format trace: %s", err)
+	}
+	damaged := strings.Replace(string(formatted), "498 174 -1\n", "498 InvalidSize -1\n", 1)
+	if damaged == string(formatted) {
+		t.Fatalf("Failed to damage trace")
+	}
+	trace, err := parseTraceLeniently([]byte(damaged))
+	if err != nil {
+		t.Fatalf("Failed to parse damaged trace leniently: %s", err)
+	}
+
+	expectedTrace := proto.Clone(original).(*Trace)
+	expectedTrace.FileFormatVersion = proto.Int32(5)
+	expectedTrace.PacketSeries[1] = &PacketSeriesEntry{
+		TimestampMicroseconds: proto.Int64(1346479359147219),
+	}
+	expectedTrace.SectionDamage = []*SectionDamage{
+		&SectionDamage{
+			Section:        proto.Int32(int32(SectionPacketSeries)),
+			SkippedEntries: proto.Int32(1),
+		},
+	}
+	checkProtosEqual(t, expectedTrace, trace)
+}
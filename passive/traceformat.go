@@ -0,0 +1,228 @@
+package passive
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+)
+
+// The oldest and newest trace file format versions we know how to write. See
+// the comment on file_format_version in trace.proto for a summary of how the
+// versions differ.
+const (
+	MinFileFormatVersion = 1
+	MaxFileFormatVersion = 5
+)
+
+func boolToStringInt(value bool) string {
+	if value {
+		return "1"
+	}
+	return "0"
+}
+
+// Format the introductory section. See parseSectionIntro for the format. The
+// PCAP statistics line is only written if all three statistics are present.
+func formatSectionIntro(trace *Trace, fileFormatVersion int32) ([]string, error) {
+	if trace.NodeId == nil {
+		return nil, fmt.Errorf("missing node id")
+	}
+	if trace.ProcessStartTimeMicroseconds == nil {
+		return nil, fmt.Errorf("missing process start time")
+	}
+	if trace.SequenceNumber == nil {
+		return nil, fmt.Errorf("missing sequence number")
+	}
+	if trace.TraceCreationTimestamp == nil {
+		return nil, fmt.Errorf("missing trace creation timestamp")
+	}
+	buildId := "UNKNOWN"
+	if trace.BuildId != nil && *trace.BuildId != "" {
+		buildId = *trace.BuildId
+	}
+	lines := []string{
+		fmt.Sprintf("%d", fileFormatVersion),
+		buildId,
+		fmt.Sprintf("%s %d %d %d", *trace.NodeId, *trace.ProcessStartTimeMicroseconds, *trace.SequenceNumber, *trace.TraceCreationTimestamp),
+	}
+	if trace.PcapReceived != nil && trace.PcapDropped != nil && trace.InterfaceDropped != nil {
+		lines = append(lines, fmt.Sprintf("%d %d %d", *trace.PcapReceived, *trace.PcapDropped, *trace.InterfaceDropped))
+	}
+	return lines, nil
+}
+
+// Format the whitelist section. See parseSectionWhitelist for the format.
+func formatSectionWhitelist(trace *Trace, fileFormatVersion int32) ([]string, error) {
+	return trace.Whitelist, nil
+}
+
+// Format the anonymization section. See parseSectionAnonymization for the
+// format.
+func formatSectionAnonymization(trace *Trace, fileFormatVersion int32) ([]string, error) {
+	if trace.AnonymizationSignature == nil {
+		return []string{"UNANONYMIZED"}, nil
+	}
+	return []string{*trace.AnonymizationSignature}, nil
+}
+
+// Format the packet series section. See parseSectionPacketSeries for the
+// format. The parser discards the base timestamp when there are no packets, so
+// we write 0 in that case.
+func formatSectionPacketSeries(trace *Trace, fileFormatVersion int32) ([]string, error) {
+	var baseTimestampMicroseconds int64
+	if len(trace.PacketSeries) > 0 {
+		baseTimestampMicroseconds = trace.PacketSeries[0].GetTimestampMicroseconds()
+	}
+	lines := []string{fmt.Sprintf("%d %d", baseTimestampMicroseconds, trace.GetPacketSeriesDropped())}
+	previousTimestampMicroseconds := baseTimestampMicroseconds
+	for index, entry := range trace.PacketSeries {
+		offset := entry.GetTimestampMicroseconds() - previousTimestampMicroseconds
+		if offset < math.MinInt32 || offset > math.MaxInt32 {
+			return nil, fmt.Errorf("offset of packet %d doesn't fit in 32 bits: %d", index, offset)
+		}
+		lines = append(lines, fmt.Sprintf("%d %d %d", offset, entry.GetSize(), entry.GetFlowId()))
+		previousTimestampMicroseconds = entry.GetTimestampMicroseconds()
+	}
+	return lines, nil
+}
+
+// Format the flow table section. See parseSectionFlowTable for the format.
+func formatSectionFlowTable(trace *Trace, fileFormatVersion int32) ([]string, error) {
+	lines := []string{fmt.Sprintf("%d %d %d %d", trace.GetFlowTableBaseline(), trace.GetFlowTableSize(), trace.GetFlowTableExpired(), trace.GetFlowTableDropped())}
+	for _, entry := range trace.FlowTableEntry {
+		lines = append(lines, fmt.Sprintf("%d %s %s %s %s %d %d %d",
+			entry.GetFlowId(),
+			boolToStringInt(entry.GetSourceIpAnonymized()),
+			entry.GetSourceIp(),
+			boolToStringInt(entry.GetDestinationIpAnonymized()),
+			entry.GetDestinationIp(),
+			entry.GetTransportProtocol(),
+			entry.GetSourcePort(),
+			entry.GetDestinationPort()))
+	}
+	return lines, nil
+}
+
+// Format the DNS A table section. See parseSectionDnsTableA for the format.
+func formatSectionDnsTableA(trace *Trace, fileFormatVersion int32) ([]string, error) {
+	lines := []string{fmt.Sprintf("%d %d", trace.GetARecordsDropped(), trace.GetCnameRecordsDropped())}
+	for _, entry := range trace.ARecord {
+		lines = append(lines, fmt.Sprintf("%d %d %s %s %s %d",
+			entry.GetPacketId(),
+			entry.GetAddressId(),
+			boolToStringInt(entry.GetAnonymized()),
+			entry.GetDomain(),
+			entry.GetIpAddress(),
+			entry.GetTtl()))
+	}
+	return lines, nil
+}
+
+// Format the DNS CNAME table section. See parseSectionDnsTableCname for the
+// format. Versions before 3 can't anonymize CNAMEs separately from domains, so
+// we refuse to write records that would lose that distinction.
+func formatSectionDnsTableCname(trace *Trace, fileFormatVersion int32) ([]string, error) {
+	lines := []string{}
+	for index, entry := range trace.CnameRecord {
+		if fileFormatVersion < 3 {
+			if entry.GetCnameAnonymized() != entry.GetDomainAnonymized() {
+				return nil, fmt.Errorf("CNAME record %d anonymizes its domain and CNAME differently, which version %d can't represent", index, fileFormatVersion)
+			}
+			lines = append(lines, fmt.Sprintf("%d %d %s %s %s %d",
+				entry.GetPacketId(),
+				entry.GetAddressId(),
+				boolToStringInt(entry.GetDomainAnonymized()),
+				entry.GetDomain(),
+				entry.GetCname(),
+				entry.GetTtl()))
+		} else {
+			lines = append(lines, fmt.Sprintf("%d %d %s %s %s %s %d",
+				entry.GetPacketId(),
+				entry.GetAddressId(),
+				boolToStringInt(entry.GetDomainAnonymized()),
+				entry.GetDomain(),
+				boolToStringInt(entry.GetCnameAnonymized()),
+				entry.GetCname(),
+				entry.GetTtl()))
+		}
+	}
+	return lines, nil
+}
+
+// Format the address table section. See parseSectionAddressTable for the
+// format.
+func formatSectionAddressTable(trace *Trace, fileFormatVersion int32) ([]string, error) {
+	lines := []string{fmt.Sprintf("%d %d", trace.GetAddressTableFirstId(), trace.GetAddressTableSize())}
+	for _, entry := range trace.AddressTableEntry {
+		lines = append(lines, fmt.Sprintf("%s %s", entry.GetMacAddress(), entry.GetIpAddress()))
+	}
+	return lines, nil
+}
+
+// Format the drop statistics section. See parseSectionDropStatistics for the
+// format.
+func formatSectionDropStatistics(trace *Trace, fileFormatVersion int32) ([]string, error) {
+	lines := []string{}
+	for _, entry := range trace.DroppedPacketsEntry {
+		lines = append(lines, fmt.Sprintf("%d %d", entry.GetSize(), entry.GetCount()))
+	}
+	return lines, nil
+}
+
+// Format the HTTP URLs section. See parseSectionHttpUrls for the format. We
+// always separate it from the drop statistics section with a blank line.
+func formatSectionHttpUrls(trace *Trace, fileFormatVersion int32) ([]string, error) {
+	lines := []string{fmt.Sprintf("%d ", trace.GetHttpUrlsDropped())}
+	for _, entry := range trace.HttpUrl {
+		lines = append(lines, fmt.Sprintf("%d %s %s ", entry.GetFlowId(), boolToStringInt(entry.GetAnonymized()), entry.GetUrl()))
+	}
+	return lines, nil
+}
+
+// Write a Trace in the bismark-passive text format for the given file format
+// version. Parsing the result with parseTrace yields the original Trace, except
+// that the file format version is replaced and unset optional fields are
+// written as zero.
+//
+// Version 1 traces don't have a drop statistics section, so those statistics
+// are omitted, along with any HTTP URLs. We always write the drop statistics
+// the way version 4 does, since the point of writing old versions is to feed
+// old tools, not to reproduce old bugs.
+func FormatTrace(trace *Trace, fileFormatVersion int32) ([]byte, error) {
+	type sectionFormatter func(*Trace, int32) ([]string, error)
+
+	if fileFormatVersion < MinFileFormatVersion || fileFormatVersion > MaxFileFormatVersion {
+		return nil, fmt.Errorf("Unsupported file format version %d", fileFormatVersion)
+	}
+
+	sectionFormatters := []sectionFormatter{
+		SectionIntro:         formatSectionIntro,
+		SectionWhitelist:     formatSectionWhitelist,
+		SectionAnonymization: formatSectionAnonymization,
+		SectionPacketSeries:  formatSectionPacketSeries,
+		SectionFlowTable:     formatSectionFlowTable,
+		SectionDnsTableA:     formatSectionDnsTableA,
+		SectionDnsTableCname: formatSectionDnsTableCname,
+		SectionAddressTable:  formatSectionAddressTable,
+	}
+	if fileFormatVersion >= 2 {
+		sectionFormatters = append(sectionFormatters, formatSectionDropStatistics)
+		if trace.HttpUrlsDropped != nil || len(trace.HttpUrl) > 0 {
+			sectionFormatters = append(sectionFormatters, formatSectionHttpUrls)
+		}
+	}
+
+	var buffer bytes.Buffer
+	for section, format := range sectionFormatters {
+		lines, err := format(trace, fileFormatVersion)
+		if err != nil {
+			return nil, fmt.Errorf("Section %s %s", Section(section), err)
+		}
+		for _, line := range lines {
+			buffer.WriteString(line)
+			buffer.WriteByte('\n')
+		}
+		buffer.WriteByte('\n')
+	}
+	return buffer.Bytes(), nil
+}
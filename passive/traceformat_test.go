@@ -0,0 +1,248 @@
+package passive
+
+import (
+	"strings"
+	"testing"
+
+	"code.google.com/p/goprotobuf/proto"
+)
+
+func makeTraceForFormatting() *Trace {
+	return &Trace{
+		BuildId:                      proto.String("BUILDID"),
+		NodeId:                       proto.String("NODEID"),
+		ProcessStartTimeMicroseconds: proto.Int64(1346479358582428),
+		SequenceNumber:               proto.Int32(7),
+		TraceCreationTimestamp:       proto.Int64(1346479388),
+		PcapReceived:                 proto.Uint32(138),
+		PcapDropped:                  proto.Uint32(1),
+		InterfaceDropped:             proto.Uint32(2),
+		Whitelist:                    []string{"google.com", "facebook.com"},
+		AnonymizationSignature:       proto.String("signature"),
+		PacketSeriesDropped:          proto.Uint32(3),
+		PacketSeries: []*PacketSeriesEntry{
+			&PacketSeriesEntry{
+				TimestampMicroseconds: proto.Int64(1346479359146721),
+				Size:                  proto.Int32(74),
+				FlowId:                proto.Int32(31646),
+			},
+			&PacketSeriesEntry{
+				TimestampMicroseconds: proto.Int64(1346479359147219),
+				Size:                  proto.Int32(174),
+				FlowId:                proto.Int32(-1),
+			},
+		},
+		FlowTableBaseline: proto.Int64(1346479359),
+		FlowTableSize:     proto.Uint32(34),
+		FlowTableExpired:  proto.Int32(4),
+		FlowTableDropped:  proto.Int32(5),
+		FlowTableEntry: []*FlowTableEntry{
+			&FlowTableEntry{
+				FlowId:                  proto.Int32(829),
+				SourceIpAnonymized:      proto.Bool(true),
+				SourceIp:                proto.String("9ccddd49ad2336c5"),
+				DestinationIpAnonymized: proto.Bool(false),
+				DestinationIp:           proto.String("1.2.3.4"),
+				TransportProtocol:       proto.Int32(6),
+				SourcePort:              proto.Int32(5228),
+				DestinationPort:         proto.Int32(46716),
+			},
+		},
+		ARecordsDropped:     proto.Int32(6),
+		CnameRecordsDropped: proto.Int32(7),
+		ARecord: []*DnsARecord{
+			&DnsARecord{
+				PacketId:   proto.Int32(1),
+				AddressId:  proto.Int32(0),
+				Anonymized: proto.Bool(false),
+				Domain:     proto.String("www.l.google.com"),
+				IpAddress:  proto.String("950a8fca863ac696"),
+				Ttl:        proto.Int32(298),
+			},
+		},
+		CnameRecord: []*DnsCnameRecord{
+			&DnsCnameRecord{
+				PacketId:         proto.Int32(1),
+				AddressId:        proto.Int32(0),
+				DomainAnonymized: proto.Bool(true),
+				Domain:           proto.String("2a8e2a4fe3b4e6f1"),
+				CnameAnonymized:  proto.Bool(true),
+				Cname:            proto.String("www.l.google.com"),
+				Ttl:              proto.Int32(43198),
+			},
+		},
+		AddressTableFirstId: proto.Int32(3),
+		AddressTableSize:    proto.Int32(256),
+		AddressTableEntry: []*AddressTableEntry{
+			&AddressTableEntry{
+				MacAddress: proto.String("64a769ccb29d"),
+				IpAddress:  proto.String("ebd6aae385287e9f"),
+			},
+		},
+		DroppedPacketsEntry: []*DroppedPacketsEntry{
+			&DroppedPacketsEntry{
+				Size:  proto.Uint32(46),
+				Count: proto.Uint32(1),
+			},
+		},
+	}
+}
+
+func TestFormatTrace_MatchesOriginal(t *testing.T) {
+	fileContents :=
+		`5
+UNKNOWN
+OWC43DC78EE081 1346479358582428 0 1346479388
+138 0 0
+
+google.com
+facebook.com
+
+88698fe15783cd75107714ef91761673c41a7d1f
+
+1346479359146721 0
+0 74 31646
+498 74 25349
+50825 174 34629
+
+1346479359 34 0 0
+829 1 9ccddd49ad2336c5 1 ebd6aae385287e9f 6 5228 46716
+
+0 0
+2 0 0 www.l.google.com 950a8fca863ac696 298
+
+2 0 0 www.google.com 0 www.l.google.com 43198
+
+0 256
+64a769ccb29d ebd6aae385287e9f
+c43dc79106a8 1336ec0318683863
+
+46 1
+54 5045
+
+`
+	trace, err := parseTrace([]byte(fileContents))
+	if err != nil {
+		t.Fatalf("Failed to parse trace: %s", err)
+	}
+	formatted, err := FormatTrace(trace, 5)
+	if err != nil {
+		t.Fatalf("Failed to format trace: %s", err)
+	}
+	if string(formatted) != fileContents {
+		t.Fatalf("Formatted trace doesn't match original:\nExpected: %q\nActual:   %q", fileContents, formatted)
+	}
+}
+
+func TestFormatTrace_RoundTrip(t *testing.T) {
+	for version := int32(MinFileFormatVersion); version <= MaxFileFormatVersion; version++ {
+		trace := makeTraceForFormatting()
+		formatted, err := FormatTrace(trace, version)
+		if err != nil {
+			t.Fatalf("Failed to format version %d trace: %s", version, err)
+		}
+		parsedTrace, err := parseTrace(formatted)
+		if err != nil {
+			t.Fatalf("Failed to parse version %d trace: %s", version, err)
+		}
+		trace.FileFormatVersion = proto.Int32(version)
+		if version < 2 {
+			trace.DroppedPacketsEntry = nil
+		}
+		checkProtosEqual(t, trace, parsedTrace)
+	}
+}
+
+func TestFormatTrace_Empty(t *testing.T) {
+	trace := &Trace{
+		NodeId:                       proto.String("NODEID"),
+		ProcessStartTimeMicroseconds: proto.Int64(123),
+		SequenceNumber:               proto.Int32(321),
+		TraceCreationTimestamp:       proto.Int64(789),
+	}
+	formatted, err := FormatTrace(trace, 4)
+	if err != nil {
+		t.Fatalf("Failed to format trace: %s", err)
+	}
+	expected := "4\nUNKNOWN\nNODEID 123 321 789\n\n\nUNANONYMIZED\n\n0 0\n\n0 0 0 0\n\n0 0\n\n\n0 0\n\n\n"
+	if string(formatted) != expected {
+		t.Fatalf("Unexpected formatted trace:\nExpected: %q\nActual:   %q", expected, formatted)
+	}
+	if _, err := parseTrace(formatted); err != nil {
+		t.Fatalf("Failed to parse formatted trace: %s", err)
+	}
+}
+
+func TestFormatTrace_Invalid(t *testing.T) {
+	if _, err := FormatTrace(makeTraceForFormatting(), 0); err == nil {
+		t.Fatalf("Version 0 should be unsupported")
+	}
+	if _, err := FormatTrace(makeTraceForFormatting(), MaxFileFormatVersion+1); err == nil {
+		t.Fatalf("Version %d should be unsupported", MaxFileFormatVersion+1)
+	}
+
+	missingNodeId := makeTraceForFormatting()
+	missingNodeId.NodeId = nil
+	if _, err := FormatTrace(missingNodeId, 5); err == nil {
+		t.Fatalf("Trace without a node id should fail to format")
+	}
+
+	mismatchedCname := makeTraceForFormatting()
+	mismatchedCname.CnameRecord[0].CnameAnonymized = proto.Bool(false)
+	if _, err := FormatTrace(mismatchedCname, 2); err == nil {
+		t.Fatalf("Version 2 can't represent separately anonymized CNAMEs")
+	}
+	if _, err := FormatTrace(mismatchedCname, 3); err != nil {
+		t.Fatalf("Version 3 should represent separately anonymized CNAMEs: %s", err)
+	}
+
+	largeOffset := makeTraceForFormatting()
+	*largeOffset.PacketSeries[1].TimestampMicroseconds += 1 << 32
+	if _, err := FormatTrace(largeOffset, 5); err == nil {
+		t.Fatalf("Packet offsets larger than 32 bits should fail to format")
+	}
+}
+
+func TestFormatTrace_HttpUrls(t *testing.T) {
+	trace := makeTraceForFormatting()
+	trace.FileFormatVersion = proto.Int32(5)
+	trace.HttpUrlsDropped = proto.Int32(2)
+	trace.HttpUrl = []*HttpUrlEntry{
+		&HttpUrlEntry{
+			FlowId:     proto.Int32(829),
+			Anonymized: proto.Bool(false),
+			Url:        proto.String("971ca2633ac88795417ae7fe2cbe0b1c4e4e81e9"),
+		},
+	}
+	formatted, err := FormatTrace(trace, 5)
+	if err != nil {
+		t.Fatalf("Failed to format trace: %s", err)
+	}
+	if !strings.HasSuffix(string(formatted), "46 1\n\n2 \n829 0 971ca2633ac88795417ae7fe2cbe0b1c4e4e81e9 \n\n") {
+		t.Fatalf("Unexpected HTTP URLs section: %q", formatted)
+	}
+	parsedTrace, err := parseTrace(formatted)
+	if err != nil {
+		t.Fatalf("Failed to parse trace: %s", err)
+	}
+	checkProtosEqual(t, trace, parsedTrace)
+
+	// Some traces skip straight from the drop statistics to the HTTP URLs
+	// without a blank line.
+	withoutBlankLine := strings.Replace(string(formatted), "46 1\n\n2 \n", "46 1\n2 \n", 1)
+	parsedTrace, err = parseTrace([]byte(withoutBlankLine))
+	if err != nil {
+		t.Fatalf("Failed to parse trace without blank line: %s", err)
+	}
+	checkProtosEqual(t, trace, parsedTrace)
+
+	damaged := strings.Replace(withoutBlankLine, "829 0 971ca", "829 x 971ca", 1)
+	_, err = parseTrace([]byte(damaged))
+	if e, ok := err.(*TraceParseError); !ok || e.Section != SectionHttpUrls || e.LineNumber+1 != strings.Count(withoutBlankLine, "\n")-1 {
+		t.Fatalf("Expected error in the last line of the HTTP URLs section. Got %v", err)
+	}
+
+	if formatted, err := FormatTrace(trace, 1); err != nil || strings.Contains(string(formatted), "829 0 971ca") {
+		t.Fatalf("Version 1 traces shouldn't have HTTP URLs: %q %v", formatted, err)
+	}
+}
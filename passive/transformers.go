@@ -235,3 +235,140 @@ func printRecords(inputChan, outputChan chan *store.Record) {
 	}
 	log.Printf("DONE PRINTING")
 }
+
+// Remove records from a store. Stores don't support deleting individual
+// records, so remover copies the records we keep to keptStore, with
+// DatabaseIndex 0, and the records we remove to removedStore, with
+// DatabaseIndex 1. Then we copy the records we kept back and empty keptStore.
+// We refuse to start if keptStore still has records from a run that stopped
+// partway.
+func RemoveRecordsPipeline(recordsStore, keptStore store.ReadingDeleter, remover transformer.Transformer, removedStore store.Writer) []transformer.PipelineStage {
+	return []transformer.PipelineStage{
+		transformer.PipelineStage{
+			Name:        "RemoveRecords",
+			Reader:      &emptyScratchReader{Reader: recordsStore, scratch: keptStore},
+			Transformer: remover,
+			Writer:      store.NewMuxingWriter(store.NewTruncatingWriter(keptStore), removedStore),
+		},
+		transformer.PipelineStage{
+			Name:   "RestoreKeptRecords",
+			Reader: keptStore,
+			Writer: store.NewTruncatingWriter(recordsStore),
+		},
+		clearStoreStage(keptStore),
+	}
+}
+
+// Empty a scratch store once we're done with it.
+func clearStoreStage(scratchStore store.Deleter) transformer.PipelineStage {
+	emptyStore := store.SliceStore{}
+	return transformer.PipelineStage{
+		Name:   "ClearScratch",
+		Reader: &emptyStore,
+		Writer: store.NewTruncatingWriter(scratchStore),
+	}
+}
+
+// Refuses to read if scratch has records when we begin reading. We remove
+// records by copying the ones we keep to a scratch store, truncating the
+// original and copying them back, and empty the scratch store afterwards, so
+// records left there mean an earlier run stopped partway. They may be the only
+// copy of the kept records, so we leave them for an operator to restore.
+type emptyScratchReader struct {
+	store.Reader
+	scratch store.Reader
+}
+
+func (reader *emptyScratchReader) BeginReading() error {
+	empty, err := readerIsEmpty(reader.scratch)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return fmt.Errorf("Scratch store isn't empty; an earlier run stopped while removing records and its scratch store may hold the only copy of the records it kept")
+	}
+	return reader.Reader.BeginReading()
+}
+
+// Whether a reader has no records.
+func readerIsEmpty(reader store.Reader) (bool, error) {
+	if err := reader.BeginReading(); err != nil {
+		return false, err
+	}
+	record, err := reader.ReadRecord()
+	if err != nil {
+		reader.EndReading()
+		return false, err
+	}
+	if err := reader.EndReading(); err != nil {
+		return false, err
+	}
+	return record == nil, nil
+}
+
+// Reads nothing if condition is empty when we begin reading. We use it to
+// skip rewriting large stores when there's nothing to remove from them.
+type unlessEmptyReader struct {
+	store.Reader
+	condition store.Reader
+	skip      bool
+}
+
+func (reader *unlessEmptyReader) BeginReading() error {
+	empty, err := readerIsEmpty(reader.condition)
+	if err != nil {
+		return err
+	}
+	reader.skip = empty
+	if reader.skip {
+		return nil
+	}
+	return reader.Reader.BeginReading()
+}
+
+func (reader *unlessEmptyReader) ReadRecord() (*store.Record, error) {
+	if reader.skip {
+		return nil, nil
+	}
+	return reader.Reader.ReadRecord()
+}
+
+func (reader *unlessEmptyReader) EndReading() error {
+	if reader.skip {
+		return nil
+	}
+	return reader.Reader.EndReading()
+}
+
+// Writes nothing if condition is empty when we begin writing.
+type unlessEmptyWriter struct {
+	store.Writer
+	condition store.Reader
+	skip      bool
+}
+
+func (writer *unlessEmptyWriter) BeginWriting() error {
+	empty, err := readerIsEmpty(writer.condition)
+	if err != nil {
+		return err
+	}
+	writer.skip = empty
+	if writer.skip {
+		return nil
+	}
+	return writer.Writer.BeginWriting()
+}
+
+func (writer *unlessEmptyWriter) WriteRecord(record *store.Record) error {
+	if writer.skip {
+		return nil
+	}
+	return writer.Writer.WriteRecord(record)
+}
+
+func (writer *unlessEmptyWriter) EndWriting() error {
+	if writer.skip {
+		return nil
+	}
+	return writer.Writer.EndWriting()
+}
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"testing"
 
 	"github.com/sburnett/lexicographic-tuples"
 	"github.com/sburnett/transformer"
@@ -222,3 +223,27 @@ func ExampleSessions() {
 	// node,context2,0
 	// node2,context,0
 }
+
+func TestEmptyScratchReader(t *testing.T) {
+	records := store.SliceStore{}
+	records.BeginWriting()
+	records.WriteRecord(&store.Record{Key: []byte("key")})
+	records.EndWriting()
+	scratch := store.SliceStore{}
+
+	reader := emptyScratchReader{Reader: &records, scratch: &scratch}
+	if err := reader.BeginReading(); err != nil {
+		t.Fatalf("Reading with an empty scratch store should succeed: %v", err)
+	}
+	if record, err := reader.ReadRecord(); err != nil || record == nil {
+		t.Errorf("Expected a record, got %v (%v)", record, err)
+	}
+	reader.EndReading()
+
+	scratch.BeginWriting()
+	scratch.WriteRecord(&store.Record{Key: []byte("kept")})
+	scratch.EndWriting()
+	if err := reader.BeginReading(); err == nil {
+		t.Errorf("Reading with records left in the scratch store should fail")
+	}
+}
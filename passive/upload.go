@@ -0,0 +1,295 @@
+package passive
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sburnett/lexicographic-tuples"
+	"github.com/sburnett/transformer"
+	"github.com/sburnett/transformer/store"
+)
+
+var uploadsReceived, uploadsRejected, uploadBytesReceived *expvar.Int
+
+func init() {
+	uploadsReceived = expvar.NewInt("UploadsReceived")
+	uploadsRejected = expvar.NewInt("UploadsRejected")
+	uploadBytesReceived = expvar.NewInt("UploadBytesReceived")
+}
+
+// Receive trace tarballs from routers over HTTP and index them as they
+// arrive. Routers POST tarballs to /upload/<filename>, authenticating with
+// HTTP basic authentication using their node ID and the key for that node in
+// nodeKeys. We write each tarball to
+// tarballsPath/<node id>/<YYYY-MM-DD>/<filename>, which is the same layout
+// IndexTarballsPipeline expects, and then index it with IndexTarballsPipeline.
+// If dbRoot isn't empty, we hold its LevelDbRootLock while we index each
+// upload, so we take turns with the other commands that use levelDbManager's
+// LevelDB root, like the scheduled runs.
+//
+// This pipeline never finishes; it keeps waiting for more uploads.
+func UploadPipeline(listenAddress, tarballsPath string, nodeKeys map[string]string, maxUploadBytes int64, lenient bool, dbRoot string, levelDbManager store.Manager, reportWriter io.Writer) transformer.Pipeline {
+	receiver := newUploadReceiver(tarballsPath, nodeKeys, maxUploadBytes)
+	return []transformer.PipelineStage{
+		transformer.PipelineStage{
+			Name:   "IndexUploads",
+			Reader: &uploadReader{listenAddress: listenAddress, receiver: receiver},
+			Writer: &uploadIndexingStore{
+				tarballsPath:   tarballsPath,
+				lenient:        lenient,
+				dbRoot:         dbRoot,
+				levelDbManager: levelDbManager,
+				reportWriter:   reportWriter,
+			},
+		},
+	}
+}
+
+// Parse a file mapping node IDs to upload keys. Each line contains a node ID
+// and its key separated by whitespace. Blank lines and lines starting with #
+// are ignored.
+func ParseNodeKeys(reader io.Reader) (map[string]string, error) {
+	nodeKeys := make(map[string]string)
+	scanner := bufio.NewScanner(reader)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Line %d: expected a node ID and a key", lineNumber)
+		}
+		if !validUploadName(fields[0]) {
+			return nil, fmt.Errorf("Line %d: invalid node ID %q", lineNumber, fields[0])
+		}
+		nodeKeys[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nodeKeys, nil
+}
+
+// Node IDs and filenames become part of paths and glob patterns, so only
+// allow names that can't escape their directory or match other files.
+func validUploadName(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+	return !strings.ContainsAny(name, "/\\*?[]")
+}
+
+type uploadReceiver struct {
+	tarballsPath   string
+	nodeKeys       map[string]string
+	maxUploadBytes int64
+	now            func() time.Time
+	// Paths of uploaded tarballs that we haven't indexed yet.
+	uploads chan string
+}
+
+func newUploadReceiver(tarballsPath string, nodeKeys map[string]string, maxUploadBytes int64) *uploadReceiver {
+	return &uploadReceiver{
+		tarballsPath:   tarballsPath,
+		nodeKeys:       nodeKeys,
+		maxUploadBytes: maxUploadBytes,
+		now:            time.Now,
+		uploads:        make(chan string, 100),
+	}
+}
+
+func (receiver *uploadReceiver) reject(writer http.ResponseWriter, message string, code int) {
+	uploadsRejected.Add(1)
+	http.Error(writer, message, code)
+}
+
+func (receiver *uploadReceiver) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		receiver.reject(writer, "Uploads must use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	nodeId, key, ok := basicAuth(request)
+	expectedKey, found := receiver.nodeKeys[nodeId]
+	if !ok || !found || subtle.ConstantTimeCompare([]byte(key), []byte(expectedKey)) != 1 {
+		writer.Header().Set("WWW-Authenticate", `Basic realm="bismark-passive"`)
+		receiver.reject(writer, "Invalid node ID or key", http.StatusUnauthorized)
+		return
+	}
+	filename := strings.TrimPrefix(request.URL.Path, "/upload/")
+	if filename == request.URL.Path || !validUploadName(filename) || archiveFormat(filename) == "" {
+		receiver.reject(writer, "Invalid tarball name", http.StatusBadRequest)
+		return
+	}
+
+	directory := filepath.Join(receiver.tarballsPath, nodeId, receiver.now().UTC().Format("2006-01-02"))
+	tarPath := filepath.Join(directory, filename)
+	size, err := receiver.writeTarball(directory, tarPath, &uploadLimitReader{reader: request.Body, remaining: receiver.maxUploadBytes})
+	if err == errUploadTooLarge {
+		// Routers retry failed uploads, so tell them not to bother.
+		log.Printf("Rejected %s from %s: larger than %d bytes", filename, nodeId, receiver.maxUploadBytes)
+		receiver.reject(writer, "Tarball too large", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		log.Printf("Error receiving %s from %s: %s", filename, nodeId, err)
+		receiver.reject(writer, "Error receiving tarball", http.StatusInternalServerError)
+		return
+	}
+	uploadsReceived.Add(1)
+	uploadBytesReceived.Add(size)
+	receiver.uploads <- tarPath
+	writer.WriteHeader(http.StatusCreated)
+}
+
+// The node ID and key from a request's basic authentication header.
+func basicAuth(request *http.Request) (nodeId, key string, ok bool) {
+	const prefix = "Basic "
+	authorization := request.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, prefix) {
+		return "", "", false
+	}
+	credentials, err := base64.StdEncoding.DecodeString(authorization[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	separator := strings.Index(string(credentials), ":")
+	if separator < 0 {
+		return "", "", false
+	}
+	return string(credentials[:separator]), string(credentials[separator+1:]), true
+}
+
+var errUploadTooLarge = errors.New("Upload too large")
+
+// Reads at most remaining bytes, and fails with errUploadTooLarge if there
+// are more.
+type uploadLimitReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (reader *uploadLimitReader) Read(buffer []byte) (int, error) {
+	if reader.remaining < 0 {
+		return 0, errUploadTooLarge
+	}
+	// Read one byte more than we allow, so we notice when there are more.
+	if int64(len(buffer)) > reader.remaining+1 {
+		buffer = buffer[:reader.remaining+1]
+	}
+	n, err := reader.reader.Read(buffer)
+	if int64(n) > reader.remaining {
+		n = int(reader.remaining)
+		reader.remaining = -1
+		return n, errUploadTooLarge
+	}
+	reader.remaining -= int64(n)
+	return n, err
+}
+
+// Write the tarball to a temporary file and then move it into place, so we
+// never index partial uploads.
+func (receiver *uploadReceiver) writeTarball(directory, tarPath string, contents io.Reader) (int64, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return 0, err
+	}
+	handle, err := ioutil.TempFile(directory, ".upload-")
+	if err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(handle, contents)
+	if closeErr := handle.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(handle.Name(), tarPath)
+	}
+	if err != nil {
+		os.Remove(handle.Name())
+		return 0, err
+	}
+	return size, nil
+}
+
+// Serves the upload receiver when we start reading, and reads the path of
+// every tarball it receives.
+type uploadReader struct {
+	listenAddress string
+	receiver      *uploadReceiver
+	listener      net.Listener
+}
+
+func (reader *uploadReader) BeginReading() error {
+	listener, err := net.Listen("tcp", reader.listenAddress)
+	if err != nil {
+		return err
+	}
+	reader.listener = listener
+	go func() {
+		log.Printf("Serving uploads on %s", listener.Addr())
+		if err := http.Serve(listener, reader.receiver); err != nil {
+			log.Printf("Stopped serving uploads: %s", err)
+		}
+	}()
+	return nil
+}
+
+func (reader *uploadReader) ReadRecord() (*store.Record, error) {
+	tarPath := <-reader.receiver.uploads
+	return &store.Record{
+		Key: lex.EncodeOrDie(tarPath),
+	}, nil
+}
+
+func (reader *uploadReader) EndReading() error {
+	return reader.listener.Close()
+}
+
+// Index each uploaded tarball as we receive it.
+type uploadIndexingStore struct {
+	tarballsPath   string
+	lenient        bool
+	dbRoot         string
+	levelDbManager store.Manager
+	reportWriter   io.Writer
+}
+
+func (store *uploadIndexingStore) BeginWriting() error {
+	return nil
+}
+
+func (store *uploadIndexingStore) WriteRecord(record *store.Record) error {
+	var tarPath string
+	lex.DecodeOrDie(record.Key, &tarPath)
+	tarballPattern, err := filepath.Rel(store.tarballsPath, tarPath)
+	if err != nil {
+		return err
+	}
+	if store.dbRoot != "" {
+		lock, err := LockLevelDbRoot(store.dbRoot)
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+	}
+	transformer.RunPipeline(IndexTarballsPipeline(store.tarballsPath, []string{tarballPattern}, store.lenient, store.levelDbManager, store.reportWriter))
+	return nil
+}
+
+func (store *uploadIndexingStore) EndWriting() error {
+	return nil
+}
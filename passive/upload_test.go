@@ -0,0 +1,108 @@
+package passive
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseNodeKeys(t *testing.T) {
+	nodeKeys, err := ParseNodeKeys(strings.NewReader("# Comment\nNODE1 secret1\n\n  NODE2\tsecret2  \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodeKeys) != 2 || nodeKeys["NODE1"] != "secret1" || nodeKeys["NODE2"] != "secret2" {
+		t.Fatalf("Unexpected node keys: %v", nodeKeys)
+	}
+
+	for _, invalid := range []string{"NODE1\n", "NODE1 secret extra\n", "../NODE secret\n", "NODE* secret\n"} {
+		if _, err := ParseNodeKeys(strings.NewReader(invalid)); err == nil {
+			t.Errorf("Expected an error parsing %q", invalid)
+		}
+	}
+}
+
+func postUpload(t *testing.T, server *httptest.Server, path, nodeId, key string, contents []byte) int {
+	request, err := http.NewRequest("POST", server.URL+path, bytes.NewReader(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.SetBasicAuth(nodeId, key)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	return response.StatusCode
+}
+
+func TestUploadReceiver(t *testing.T) {
+	tarballsPath, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tarballsPath)
+
+	receiver := newUploadReceiver(tarballsPath, map[string]string{"NODE": "secret"}, 1024)
+	receiver.now = func() time.Time { return time.Date(2013, 1, 2, 3, 4, 5, 0, time.UTC) }
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	contents := []byte("tarball contents")
+	if code := postUpload(t, server, "/upload/NODE_1.tar.gz", "NODE", "secret", contents); code != http.StatusCreated {
+		t.Fatalf("Expected status %d. Got %d", http.StatusCreated, code)
+	}
+	expectedPath := filepath.Join(tarballsPath, "NODE", "2013-01-02", "NODE_1.tar.gz")
+	select {
+	case tarPath := <-receiver.uploads:
+		if tarPath != expectedPath {
+			t.Fatalf("Expected upload at %s. Got %s", expectedPath, tarPath)
+		}
+	default:
+		t.Fatal("Upload wasn't queued for indexing")
+	}
+	written, err := ioutil.ReadFile(expectedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, contents) {
+		t.Fatalf("Expected %q. Got %q", contents, written)
+	}
+
+	rejected := []struct {
+		path, nodeId, key string
+		contents          []byte
+		code              int
+	}{
+		{"/upload/NODE_2.tar.gz", "NODE", "wrong", contents, http.StatusUnauthorized},
+		{"/upload/NODE_2.tar.gz", "OTHER", "secret", contents, http.StatusUnauthorized},
+		{"/upload/NODE_2.rar", "NODE", "secret", contents, http.StatusBadRequest},
+		{"/upload/../NODE_2.tar.gz", "NODE", "secret", contents, http.StatusBadRequest},
+		{"/other/NODE_2.tar.gz", "NODE", "secret", contents, http.StatusBadRequest},
+		{"/upload/NODE_2.tar.gz", "NODE", "secret", make([]byte, 2048), http.StatusRequestEntityTooLarge},
+	}
+	for _, upload := range rejected {
+		if code := postUpload(t, server, upload.path, upload.nodeId, upload.key, upload.contents); code != upload.code {
+			t.Errorf("Expected status %d uploading %s as %s. Got %d", upload.code, upload.path, upload.nodeId, code)
+		}
+	}
+	if len(receiver.uploads) > 0 {
+		t.Fatal("Rejected uploads were queued for indexing")
+	}
+	if _, err := os.Stat(filepath.Join(tarballsPath, "NODE", "2013-01-02", "NODE_2.tar.gz")); !os.IsNotExist(err) {
+		t.Fatal("Oversized upload was written")
+	}
+	leftovers, err := filepath.Glob(filepath.Join(tarballsPath, "NODE", "2013-01-02", ".upload-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leftovers) > 0 {
+		t.Fatalf("Temporary files weren't removed: %v", leftovers)
+	}
+}